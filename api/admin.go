@@ -0,0 +1,148 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/service"
+)
+
+func (s *Server) issueKey(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if !s.decode(w, r, &request) {
+		return
+	}
+
+	key, apiKey, err := s.keys.IssueKey(r.Context(), request.Name, request.Scopes)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	// The key is never shown again
+	writeJSON(w, http.StatusCreated, struct {
+		service.APIKey
+		Key string `json:"key"`
+	}{apiKey, key})
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.keys.ListKeys(r.Context())
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func (s *Server) revokeKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.invalid(w, r, "Invalid id parameter")
+		return
+	}
+
+	if err := s.keys.RevokeKey(r.Context(), id); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createTenant(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if !s.decode(w, r, &request) {
+		return
+	}
+
+	tenant, err := s.tenants.CreateTenant(r.Context(), request.Name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tenant)
+}
+
+func (s *Server) listTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.tenants.ListTenants(r.Context())
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tenants": tenants})
+}
+
+func (s *Server) listAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := service.AuditFilter{
+		Limit:      service.DefaultAuditLimit,
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		EntityType: query.Get("entityType"),
+		EntityID:   query.Get("entity"),
+	}
+
+	if !s.parseBounds(w, r, &filter.From, &filter.Till) || !s.parsePage(w, r, &filter.Limit, &filter.Before) {
+		return
+	}
+
+	entries, err := s.audit.ListAudit(r.Context(), filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	// next pages to the older entries, it is absent on the last page
+	response := map[string]interface{}{"entries": entries}
+	if len(entries) > 0 && len(entries) == filter.Limit {
+		response["next"] = entries[len(entries)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// parseBounds parses the from and till parameters, Unix timestamps like those of
+// the reading queries, it replies with a 422 and returns false when one is invalid
+func (s *Server) parseBounds(w http.ResponseWriter, r *http.Request, from, till **time.Time) bool {
+	query := r.URL.Query()
+	for param, bound := range map[string]**time.Time{"from": from, "till": till} {
+		if value := query.Get(param); value != "" {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				s.invalid(w, r, "Invalid '"+param+"' parameter")
+				return false
+			}
+			t := time.Unix(seconds, 0)
+			*bound = &t
+		}
+	}
+	return true
+}
+
+// parsePage parses the limit and before parameters of the lists returned newest
+// first, it replies with a 422 and returns false when one is invalid
+func (s *Server) parsePage(w http.ResponseWriter, r *http.Request, limit *int, before *int64) bool {
+	query := r.URL.Query()
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			s.invalid(w, r, "Invalid 'limit' parameter")
+			return false
+		}
+		*limit = parsed
+	}
+	if value := query.Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			s.invalid(w, r, "Invalid 'before' parameter")
+			return false
+		}
+		*before = parsed
+	}
+	return true
+}
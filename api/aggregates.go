@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/service"
+)
+
+const (
+	// wsWriteWait bounds the time a message takes to be written
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may stay silent, pings are sent more often
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 9 / 10
+	// wsMaxMessage bounds the size of a client message
+	wsMaxMessage = 4096
+)
+
+var upgrader = websocket.Upgrader{
+	// Callers authenticate with credentials rather than cookies, so a page of any
+	// origin may connect
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// aggregateRequest is a message of the client: subscribe to an aggregate under
+// an id of its choice, or unsubscribe from it
+type aggregateRequest struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Metric    string          `json:"metric"`
+	Aggregate string          `json:"aggregate"`
+	Window    string          `json:"window"`
+	Group     string          `json:"group"`
+	Sensor    string          `json:"sensor"`
+	Region    *service.Region `json:"region"`
+}
+
+// aggregateReply acknowledges a request, or reports why it failed with the
+// status and detail of the matching problem
+type aggregateReply struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// aggregateUpdate is an update of a subscribed aggregate
+type aggregateUpdate struct {
+	Type string `json:"type"`
+	service.AggregateUpdate
+}
+
+// streamAggregates serves rolling aggregates of the live readings over a WebSocket
+func (s *Server) streamAggregates(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeProblem(w, r, http.StatusUpgradeRequired, "this endpoint is a WebSocket")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	session, err := s.stream.OpenAggregates(ctx)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	// The upgrader replies to a failed handshake itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The reads end once the writer does, rather than block on its replies
+	replies := make(chan aggregateReply)
+	go func() {
+		defer cancel()
+		s.writeAggregates(ctx, conn, session, replies)
+	}()
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var reply aggregateReply
+		var request aggregateRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			reply = aggregateReply{Type: "error", Status: http.StatusUnprocessableEntity, Detail: "invalid message: " + err.Error()}
+		} else {
+			reply = s.handleAggregateRequest(ctx, session, request)
+		}
+
+		select {
+		case replies <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleAggregateRequest(ctx context.Context, session service.AggregateSession, request aggregateRequest) aggregateReply {
+	var err error
+	switch request.Type {
+	case "subscribe":
+		query := service.AggregateQuery{
+			Metric:    request.Metric,
+			Aggregate: request.Aggregate,
+			Group:     request.Group,
+			Sensor:    request.Sensor,
+			Region:    request.Region,
+		}
+		if request.Window != "" {
+			if query.Window, err = time.ParseDuration(request.Window); err != nil {
+				return aggregateReply{Type: "error", ID: request.ID, Status: http.StatusUnprocessableEntity, Detail: "invalid window " + request.Window}
+			}
+		}
+		err = session.Subscribe(ctx, request.ID, query)
+
+	case "unsubscribe":
+		err = session.Unsubscribe(request.ID)
+
+	default:
+		return aggregateReply{Type: "error", ID: request.ID, Status: http.StatusUnprocessableEntity, Detail: "type must be subscribe or unsubscribe"}
+	}
+
+	if err != nil {
+		status, detail := problemOf(err)
+		if status >= http.StatusInternalServerError {
+			logging.FromContext(ctx).Error("aggregate request failed", "type", request.Type, "err", err)
+		}
+		return aggregateReply{Type: "error", ID: request.ID, Status: status, Detail: detail}
+	}
+	return aggregateReply{Type: request.Type + "d", ID: request.ID}
+}
+
+// writeAggregates is the only writer of conn, it sends the replies and updates
+// and pings the client. It closes conn when the session ends or a write fails,
+// which ends the reads
+func (s *Server) writeAggregates(ctx context.Context, conn *websocket.Conn, session service.AggregateSession, replies <-chan aggregateReply) {
+	defer conn.Close()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	write := func(v interface{}) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(v) == nil
+	}
+
+	for {
+		select {
+		case reply := <-replies:
+			if !write(reply) {
+				return
+			}
+
+		case update, ok := <-session.Updates():
+			if !ok {
+				// A client that fell behind is told to reconnect
+				code, reason := websocket.CloseGoingAway, ""
+				if errors.Is(session.Err(), service.ErrSlowClient) {
+					code, reason = websocket.CloseTryAgainLater, "too slow, reconnect"
+				} else if session.Err() != nil {
+					code = websocket.CloseInternalServerErr
+				}
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+				return
+			}
+			if !write(aggregateUpdate{Type: "update", AggregateUpdate: update}) {
+				return
+			}
+
+		case <-ping.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)) != nil {
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
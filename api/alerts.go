@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/service"
+)
+
+// pathID parses the id of the rule or webhook of the path, it replies with a 422
+// and returns false when it is invalid
+func (s *Server) pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		s.invalid(w, r, "Invalid id parameter")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) createAlertRule(w http.ResponseWriter, r *http.Request) {
+	var rule service.AlertRule
+	if !s.decode(w, r, &rule) {
+		return
+	}
+
+	created, err := s.alerts.CreateRule(r.Context(), rule)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/alerts/rules/"+strconv.Itoa(created.ID))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) listAlertRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.alerts.ListRules(r.Context())
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rules": rules})
+}
+
+func (s *Server) getAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+
+	rule, err := s.alerts.GetRule(r.Context(), id)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) replaceAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+	var rule service.AlertRule
+	if !s.decode(w, r, &rule) {
+		return
+	}
+
+	replaced, err := s.alerts.ReplaceRule(r.Context(), id, rule)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, replaced)
+}
+
+func (s *Server) deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.alerts.DeleteRule(r.Context(), id); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listOpenAlerts lists the alerts that are pending or firing
+func (s *Server) listOpenAlerts(w http.ResponseWriter, r *http.Request) {
+	s.listAlerts(w, r, service.AlertFilter{Open: true, State: r.URL.Query().Get("state")})
+}
+
+// listAlertHistory lists every alert, resolved ones included, by page
+func (s *Server) listAlertHistory(w http.ResponseWriter, r *http.Request) {
+	filter := service.AlertFilter{State: r.URL.Query().Get("state")}
+	if !s.parseBounds(w, r, &filter.From, &filter.Till) {
+		return
+	}
+	s.listAlerts(w, r, filter)
+}
+
+func (s *Server) listAlerts(w http.ResponseWriter, r *http.Request, filter service.AlertFilter) {
+	query := r.URL.Query()
+	filter.Limit = service.DefaultAlertLimit
+	filter.Severity = query.Get("severity")
+	if value := query.Get("rule"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			s.invalid(w, r, "Invalid 'rule' parameter")
+			return
+		}
+		filter.RuleID = id
+	}
+	if !s.parsePage(w, r, &filter.Limit, &filter.Before) {
+		return
+	}
+
+	alerts, err := s.alerts.ListAlerts(r.Context(), filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	// next pages to the older alerts, it is absent on the last page
+	response := map[string]interface{}{"alerts": alerts}
+	if len(alerts) > 0 && len(alerts) == filter.Limit {
+		response["next"] = alerts[len(alerts)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/service"
+)
+
+func (s *Server) listAnomalies(w http.ResponseWriter, r *http.Request) {
+	codeName := mux.Vars(r)["codeName"]
+	filter := service.AnomalyFilter{Limit: service.DefaultAnomalyLimit, Metric: r.URL.Query().Get("metric")}
+	if !s.parseBounds(w, r, &filter.From, &filter.Till) || !s.parsePage(w, r, &filter.Limit, &filter.Before) {
+		return
+	}
+
+	anomalies, err := s.anomalies.ListAnomalies(r.Context(), codeName, filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	// next pages to the older anomalies, it is absent on the last page
+	response := map[string]interface{}{"sensor": codeName, "anomalies": anomalies}
+	if len(anomalies) > 0 && len(anomalies) == filter.Limit {
+		response["next"] = anomalies[len(anomalies)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getAnomalySettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := s.anomalies.GetSettings(r.Context(), mux.Vars(r)["groupName"])
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) updateAnomalySettings(w http.ResponseWriter, r *http.Request) {
+	var settings service.AnomalySettings
+	if !s.decode(w, r, &settings) {
+		return
+	}
+
+	updated, err := s.anomalies.UpdateSettings(r.Context(), mux.Vars(r)["groupName"], settings)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/tenant"
+)
+
+// authenticate puts the principal of the request in its context, replying 401
+// to a request without valid credentials. Every request is anonymous with full
+// access when authentication is disabled
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if s.authenticator == nil {
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(ctx, auth.Anonymous)))
+			return
+		}
+
+		principal, err := s.authenticator.Authenticate(ctx, r)
+		switch {
+		case err == nil:
+		case errors.Is(err, auth.ErrNoCredentials):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sensors"`)
+			writeProblem(w, r, http.StatusUnauthorized, "an API key or a bearer token is required")
+			return
+		case errors.Is(err, auth.ErrInvalidCredentials):
+			logging.FromContext(ctx).Info("authentication failed", "err", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sensors", error="invalid_token"`)
+			writeProblem(w, r, http.StatusUnauthorized, "invalid or revoked credentials")
+			return
+		default:
+			logging.FromContext(ctx).Error("authentication unavailable", "err", err)
+			w.Header().Set("Retry-After", "5")
+			writeProblem(w, r, http.StatusServiceUnavailable, "credentials cannot be checked")
+			return
+		}
+
+		logger := logging.FromContext(ctx).With("principal", principal.Subject, "auth_method", principal.Method)
+		ctx = logging.WithLogger(auth.WithPrincipal(ctx, principal), logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withTenant makes the request act on the tenant of its path, the service checks
+// its principal may
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tenant.WithName(r.Context(), mux.Vars(r)["tenant"])
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sensors/internal/service"
+)
+
+func (s *Server) getSensorsHealth(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := service.HealthFilter{Group: query.Get("group"), Status: query.Get("status")}
+	if value := query.Get("window"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			s.invalid(w, r, "Invalid 'window' parameter")
+			return
+		}
+		filter.Window = window
+	}
+
+	report, err := s.sensorHealth.Report(r.Context(), filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/service"
+)
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// writeProblem replies with a problem of status
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: logging.RequestID(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// fail replies with the problem matching the kind of err. Domain errors carry a
+// detail meant for the client, any other error is logged and hidden behind a 500
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, err error) {
+	logger := logging.FromContext(r.Context())
+
+	status, detail := problemOf(err)
+	switch status {
+	case http.StatusServiceUnavailable:
+		logger.Error("dependency unavailable", "err", err)
+		w.Header().Set("Retry-After", "5")
+	case http.StatusInternalServerError:
+		logger.Error("request failed", "err", err)
+	}
+	writeProblem(w, r, status, detail)
+}
+
+// problemOf returns the status matching the kind of err and the detail the client
+// may see, none for an internal error
+func problemOf(err error) (int, string) {
+	var domainErr *service.Error
+	if !errors.As(err, &domainErr) {
+		return http.StatusInternalServerError, ""
+	}
+
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		return http.StatusNotFound, domainErr.Detail
+	case errors.Is(err, service.ErrForbidden):
+		return http.StatusForbidden, domainErr.Detail
+	case errors.Is(err, service.ErrConflict):
+		return http.StatusConflict, domainErr.Detail
+	case errors.Is(err, service.ErrInvalidArgument):
+		return http.StatusUnprocessableEntity, domainErr.Detail
+	case errors.Is(err, service.ErrUnavailable):
+		return http.StatusServiceUnavailable, domainErr.Detail
+	default:
+		return http.StatusInternalServerError, ""
+	}
+}
+
+// invalid replies with a 422 for a request parameter that could not be parsed
+func (s *Server) invalid(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblem(w, r, http.StatusUnprocessableEntity, detail)
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/ratelimit"
+)
+
+// limited takes a token of class from the bucket of the client before serving
+// the request, replying 429 when there is none. Requests are let through when
+// Redis fails, the quotas protect Postgres and are not worth an outage
+func (s *Server) limited(class ratelimit.Class, next http.HandlerFunc) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.take(w, r, class, s.client(r)) {
+			next(w, r)
+		}
+	})
+}
+
+// limitedByAddress takes a token of the address class from the bucket of the
+// remote address before serving the request. It runs before authenticate, so
+// requests with bad credentials count too
+func (s *Server) limitedByAddress(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.take(w, r, ratelimit.ClassAddress, s.address(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// take takes a token of class from the bucket of client and reports whether the
+// request may be served, it replies 429 otherwise. The headers describe the
+// quota of the last class taken from
+func (s *Server) take(w http.ResponseWriter, r *http.Request, class ratelimit.Class, client string) bool {
+	result, err := s.limiter.Allow(r.Context(), class, client)
+	if err != nil {
+		metrics.ObserveRateLimit(string(class), metrics.RateLimitError)
+		logging.FromContext(r.Context()).Warn("rate limit check failed, letting the request through", "class", class, "err", err)
+		return true
+	}
+	if result.Quota.Limit == 0 {
+		return true
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Policy", result.Quota.Policy())
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Quota.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ratelimit.Seconds(result.Reset)))
+
+	if !result.Allowed {
+		metrics.ObserveRateLimit(string(class), metrics.RateLimitLimited)
+		retryAfter := ratelimit.Seconds(result.RetryAfter)
+		h.Set("Retry-After", strconv.Itoa(retryAfter))
+		writeProblem(w, r, http.StatusTooManyRequests,
+			fmt.Sprintf("quota of %d %s requests per %s exceeded, retry in %ds", result.Quota.Limit, class, result.Quota.Period, retryAfter))
+		return false
+	}
+	metrics.ObserveRateLimit(string(class), metrics.RateLimitAllowed)
+	return true
+}
+
+// client identifies who a quota applies to: the authenticated principal, or the
+// remote address when authentication is disabled
+func (s *Server) client(r *http.Request) string {
+	if principal := auth.FromContext(r.Context()); principal != nil && principal.ID != "" {
+		return principal.ID
+	}
+	return s.address(r)
+}
+
+// address identifies the remote address of r. When r comes from a trusted proxy
+// it is the last address of the Forwarded, else X-Forwarded-For, header that is
+// not a trusted proxy: the addresses before it were set by the client and can be
+// forged
+func (s *Server) address(r *http.Request) string {
+	host := hostOf(r.RemoteAddr)
+	if !s.trusted(host) {
+		return "ip:" + host
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		host = hops[i]
+		if !s.trusted(host) {
+			break
+		}
+	}
+	return "ip:" + host
+}
+
+// trusted reports whether host is the address of a trusted proxy
+func (s *Server) trusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for parameters of Forwarded headers (RFC 7239), from
+// the client to the last proxy
+func forwardedFor(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, hostOf(strings.Trim(value, `"`)))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses of X-Forwarded-For headers, from the
+// client to the last proxy
+func xForwardedFor(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hostOf(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// hostOf strips the port and IPv6 brackets of addr
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// ParseTrustedProxies reads a comma separated list of addresses and CIDR ranges
+// such as "10.0.0.0/8,192.168.1.10"
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy range %q: %w", field, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q: %w", field, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
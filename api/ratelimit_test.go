@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddress(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:5000", want: "ip:203.0.113.7"},
+		{name: "direct ipv6", remoteAddr: "[2001:db8::1]:5000", want: "ip:2001:db8::1"},
+		{name: "untrusted forwarded ignored", remoteAddr: "203.0.113.7:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1", "Forwarded": "for=198.51.100.1"}, want: "ip:203.0.113.7"},
+		{name: "trusted without header", remoteAddr: "10.1.2.3:5000", want: "ip:10.1.2.3"},
+		{name: "x-forwarded-for", remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "ip:198.51.100.1"},
+		{name: "forged x-forwarded-for", remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, want: "ip:198.51.100.1"},
+		{name: "proxy chain", remoteAddr: "192.168.1.10:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, want: "ip:198.51.100.1"},
+		{name: "forwarded", remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`}, want: "ip:2001:db8:cafe::17"},
+		{name: "forwarded takes precedence", remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": "For=198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, want: "ip:198.51.100.1"},
+		{name: "only proxies", remoteAddr: "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.1, 10.0.0.2"}, want: "ip:10.0.0.1"},
+		{name: "ipv6 proxy", remoteAddr: "[fd00::1]:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "ip:198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/region/temperature/min", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			if got := s.address(r); got != tt.want {
+				t.Errorf("address() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", s: ""},
+		{name: "ranges and addresses", s: "10.0.0.0/8, 192.168.1.10,::1", want: []string{"10.0.0.0/8", "192.168.1.10/32", "::1/128"}},
+		{name: "masked", s: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{name: "mapped ipv4", s: "::ffff:10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{name: "invalid address", s: "proxy.local", wantErr: true},
+		{name: "invalid range", s: "10.0.0.0/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := ParseTrustedProxies(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTrustedProxies(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			}
+			if len(prefixes) != len(tt.want) {
+				t.Fatalf("ParseTrustedProxies(%q) = %v, want %v", tt.s, prefixes, tt.want)
+			}
+			for i, prefix := range prefixes {
+				if prefix.String() != tt.want[i] {
+					t.Errorf("prefix %d = %s, want %s", i, prefix, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/service"
+)
+
+// decode reads the JSON body of r into v, replying 422 and returning false when
+// it is not valid
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		s.invalid(w, r, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if !s.decode(w, r, &request) {
+		return
+	}
+
+	group, err := s.microserviceServer.CreateGroup(r.Context(), request.Name)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, group)
+}
+
+func (s *Server) createSensor(w http.ResponseWriter, r *http.Request) {
+	groupName := mux.Vars(r)["groupName"]
+
+	var sensor service.Sensor
+	if !s.decode(w, r, &sensor) {
+		return
+	}
+
+	created, err := s.microserviceServer.CreateSensor(r.Context(), groupName, sensor)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/sensor/"+created.CodeName)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) updateSensor(w http.ResponseWriter, r *http.Request) {
+	codeName := mux.Vars(r)["codeName"]
+
+	var patch service.SensorPatch
+	if !s.decode(w, r, &patch) {
+		return
+	}
+
+	updated, err := s.microserviceServer.UpdateSensor(r.Context(), codeName, patch)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func (s *Server) deleteSensor(w http.ResponseWriter, r *http.Request) {
+	codeName := mux.Vars(r)["codeName"]
+
+	if err := s.microserviceServer.DeleteSensor(r.Context(), codeName); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
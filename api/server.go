@@ -4,34 +4,264 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sensors/internal/app"
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/ratelimit"
+	"github.com/sensors/internal/service"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
+// DefaultAddr is the address the API listens on unless WithAddr is used
+const DefaultAddr = ":8080"
+
 type Server struct {
 	microserviceServer app.MicroserviceServer
+	addr               string
+	health             *health.Checker
+	metrics            bool
+	authenticator      *auth.Authenticator
+	keys               service.KeyService
+	tenants            service.TenantService
+	audit              service.AuditService
+	stream             service.StreamService
+	alerts             service.AlertService
+	webhooks           service.WebhookService
+	anomalies          service.AnomalyService
+	sensorHealth       service.SensorHealthService
+	limiter            *ratelimit.Limiter
+	trustedProxies     []netip.Prefix
+	httpServer         *http.Server
+}
+
+// Option customizes a Server
+type Option func(*Server)
+
+// WithAddr sets the address the server listens on
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithHealth serves the liveness and readiness reports of checker at /healthz and /readyz
+func WithHealth(checker *health.Checker) Option {
+	return func(s *Server) {
+		s.health = checker
+	}
+}
+
+// WithMetrics counts and times every request and serves the Prometheus metrics
+// of the process at /metrics
+func WithMetrics() Option {
+	return func(s *Server) {
+		s.metrics = true
+	}
+}
+
+// WithAuth requires every API request to carry credentials authenticator
+// accepts, without it every request has full access
+func WithAuth(authenticator *auth.Authenticator) Option {
+	return func(s *Server) {
+		s.authenticator = authenticator
+	}
+}
+
+// WithKeys serves the API key management endpoints under /admin/keys
+func WithKeys(keys service.KeyService) Option {
+	return func(s *Server) {
+		s.keys = keys
+	}
+}
+
+// WithTenants serves the tenant management endpoints under /admin/tenants
+func WithTenants(tenants service.TenantService) Option {
+	return func(s *Server) {
+		s.tenants = tenants
+	}
+}
+
+// WithAudit serves the audit log under /admin/audit
+func WithAudit(audit service.AuditService) Option {
+	return func(s *Server) {
+		s.audit = audit
+	}
+}
+
+// WithStream serves the live readings at /stream/readings and their rolling
+// aggregates at /stream/aggregates
+func WithStream(stream service.StreamService) Option {
+	return func(s *Server) {
+		s.stream = stream
+	}
+}
+
+// WithAlerts serves the alert rules under /alerts/rules and their alerts under /alerts
+func WithAlerts(alerts service.AlertService) Option {
+	return func(s *Server) {
+		s.alerts = alerts
+	}
+}
+
+// WithWebhooks serves the webhook management endpoints under /admin/webhooks
+func WithWebhooks(webhooks service.WebhookService) Option {
+	return func(s *Server) {
+		s.webhooks = webhooks
+	}
+}
+
+// WithAnomalies serves the anomalies of the sensors at /sensor/{codeName}/anomalies
+// and the anomaly settings of the groups at /group/{groupName}/anomalies/settings
+func WithAnomalies(anomalies service.AnomalyService) Option {
+	return func(s *Server) {
+		s.anomalies = anomalies
+	}
+}
+
+// WithSensorHealth serves the health report of the sensors at /sensors/health
+func WithSensorHealth(sensorHealth service.SensorHealthService) Option {
+	return func(s *Server) {
+		s.sensorHealth = sensorHealth
+	}
 }
 
-func NewServer(ctx context.Context, microserviceServer app.MicroserviceServer) *Server {
-	return &Server{
+// WithRateLimit keeps every client within the quotas of limiter
+func WithRateLimit(limiter *ratelimit.Limiter) Option {
+	return func(s *Server) {
+		s.limiter = limiter
+	}
+}
+
+// WithTrustedProxies identifies the clients behind the proxies in prefixes by
+// the Forwarded and X-Forwarded-For headers, rather than by the remote address
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(s *Server) {
+		s.trustedProxies = prefixes
+	}
+}
+
+func NewServer(ctx context.Context, microserviceServer app.MicroserviceServer, opts ...Option) *Server {
+	s := &Server{
 		microserviceServer: microserviceServer,
+		addr:               DefaultAddr,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.httpServer = &http.Server{
+		Addr:    s.addr,
+		Handler: s.routes(),
 	}
+	return s
 }
 
+// Start serves the API until Shutdown is called, it then returns nil
 func (s *Server) Start() error {
+	err := s.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *Server) routes() http.Handler {
 	router := mux.NewRouter()
-	router.HandleFunc("/group/{groupName}/transparency/average", s.getGroupTransparencyAverage)
-	router.HandleFunc("/group/{groupName}/temperature/average", s.getGroupTemperatureAverage)
-	router.HandleFunc("/group/{groupName}/species", s.getGroupSpecies)
-	router.HandleFunc("/group/{groupName}/species/top/{n}", s.getTopNGroupSpecies)
-	router.HandleFunc("/region/temperature/min", s.getRegionMinTemperature)
-	router.HandleFunc("/region/temperature/max", s.getRegionMaxTemperature)
-	router.HandleFunc("/sensor/{codeName}/temperature/average", s.getCodenameTemperatureAverage)
-	http.Handle("/", router)
-	return http.ListenAndServe(":8080", router)
+	// Spans are named after the route and continue the trace of the traceparent header
+	router.Use(otelmux.Middleware("sensors-api"))
+	// The operational endpoints stay public, they are matched before the API
+	if s.health != nil {
+		router.HandleFunc("/healthz", s.health.HandleLiveness).Methods(http.MethodGet)
+		router.HandleFunc("/readyz", s.health.HandleReadiness).Methods(http.MethodGet)
+	}
+	if s.metrics {
+		router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+		router.Use(metrics.Middleware)
+	}
+
+	api := router.NewRoute().Subrouter()
+	api.Use(s.limitedByAddress)
+	api.Use(s.authenticate)
+	if s.tenants != nil {
+		api.Handle("/admin/tenants", s.limited(ratelimit.ClassAdmin, s.createTenant)).Methods(http.MethodPost)
+		api.Handle("/admin/tenants", s.limited(ratelimit.ClassAdmin, s.listTenants)).Methods(http.MethodGet)
+	}
+	// Requests act on the tenant of their principal, or on the one of the path
+	tenantAPI := api.PathPrefix("/tenants/{tenant}").Subrouter()
+	tenantAPI.Use(withTenant)
+	s.apiRoutes(tenantAPI)
+	s.apiRoutes(api)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, "no such route")
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	})
+	// Wraps the router rather than using router.Use so unmatched requests are logged too
+	return logging.Middleware(router)
+}
+
+// apiRoutes registers the endpoints acting on the groups of a tenant
+func (s *Server) apiRoutes(api *mux.Router) {
+	api.Handle("/groups", s.limited(ratelimit.ClassWrite, s.createGroup)).Methods(http.MethodPost)
+	api.Handle("/group/{groupName}/transparency/average", s.limited(ratelimit.ClassRead, s.getGroupTransparencyAverage))
+	api.Handle("/group/{groupName}/temperature/average", s.limited(ratelimit.ClassRead, s.getGroupTemperatureAverage))
+	api.Handle("/group/{groupName}/species", s.limited(ratelimit.ClassRead, s.getGroupSpecies))
+	api.Handle("/group/{groupName}/species/top/{n}", s.limited(ratelimit.ClassRead, s.getTopNGroupSpecies))
+	api.Handle("/group/{groupName}/sensors", s.limited(ratelimit.ClassWrite, s.createSensor)).Methods(http.MethodPost)
+	api.Handle("/region/temperature/min", s.limited(ratelimit.ClassRegion, s.getRegionMinTemperature))
+	api.Handle("/region/temperature/max", s.limited(ratelimit.ClassRegion, s.getRegionMaxTemperature))
+	api.Handle("/sensor/{codeName}/temperature/average", s.limited(ratelimit.ClassRead, s.getCodenameTemperatureAverage))
+	api.Handle("/sensor/{codeName}", s.limited(ratelimit.ClassWrite, s.updateSensor)).Methods(http.MethodPatch)
+	api.Handle("/sensor/{codeName}", s.limited(ratelimit.ClassWrite, s.deleteSensor)).Methods(http.MethodDelete)
+	if s.stream != nil {
+		api.Handle("/stream/readings", s.limited(ratelimit.ClassRead, s.streamReadings)).Methods(http.MethodGet)
+		api.Handle("/stream/aggregates", s.limited(ratelimit.ClassRead, s.streamAggregates)).Methods(http.MethodGet)
+	}
+	if s.alerts != nil {
+		api.Handle("/alerts/rules", s.limited(ratelimit.ClassWrite, s.createAlertRule)).Methods(http.MethodPost)
+		api.Handle("/alerts/rules", s.limited(ratelimit.ClassRead, s.listAlertRules)).Methods(http.MethodGet)
+		api.Handle("/alerts/rules/{id}", s.limited(ratelimit.ClassRead, s.getAlertRule)).Methods(http.MethodGet)
+		api.Handle("/alerts/rules/{id}", s.limited(ratelimit.ClassWrite, s.replaceAlertRule)).Methods(http.MethodPut)
+		api.Handle("/alerts/rules/{id}", s.limited(ratelimit.ClassWrite, s.deleteAlertRule)).Methods(http.MethodDelete)
+		api.Handle("/alerts", s.limited(ratelimit.ClassRead, s.listOpenAlerts)).Methods(http.MethodGet)
+		api.Handle("/alerts/history", s.limited(ratelimit.ClassRead, s.listAlertHistory)).Methods(http.MethodGet)
+	}
+	if s.anomalies != nil {
+		api.Handle("/sensor/{codeName}/anomalies", s.limited(ratelimit.ClassRead, s.listAnomalies)).Methods(http.MethodGet)
+		api.Handle("/group/{groupName}/anomalies/settings", s.limited(ratelimit.ClassRead, s.getAnomalySettings)).Methods(http.MethodGet)
+		api.Handle("/group/{groupName}/anomalies/settings", s.limited(ratelimit.ClassWrite, s.updateAnomalySettings)).Methods(http.MethodPut)
+	}
+	if s.sensorHealth != nil {
+		api.Handle("/sensors/health", s.limited(ratelimit.ClassRead, s.getSensorsHealth)).Methods(http.MethodGet)
+	}
+	if s.keys != nil {
+		api.Handle("/admin/keys", s.limited(ratelimit.ClassAdmin, s.issueKey)).Methods(http.MethodPost)
+		api.Handle("/admin/keys", s.limited(ratelimit.ClassAdmin, s.listKeys)).Methods(http.MethodGet)
+		api.Handle("/admin/keys/{id}", s.limited(ratelimit.ClassAdmin, s.revokeKey)).Methods(http.MethodDelete)
+	}
+	if s.audit != nil {
+		api.Handle("/admin/audit", s.limited(ratelimit.ClassAdmin, s.listAudit)).Methods(http.MethodGet)
+	}
+	if s.webhooks != nil {
+		api.Handle("/admin/webhooks", s.limited(ratelimit.ClassAdmin, s.createWebhook)).Methods(http.MethodPost)
+		api.Handle("/admin/webhooks", s.limited(ratelimit.ClassAdmin, s.listWebhooks)).Methods(http.MethodGet)
+		api.Handle("/admin/webhooks/{id}", s.limited(ratelimit.ClassAdmin, s.deleteWebhook)).Methods(http.MethodDelete)
+		api.Handle("/admin/webhooks/{id}/deliveries", s.limited(ratelimit.ClassAdmin, s.listDeliveries)).Methods(http.MethodGet)
+		api.Handle("/admin/webhooks/{id}/dead-letters", s.limited(ratelimit.ClassAdmin, s.listDeadLetters)).Methods(http.MethodGet)
+		api.Handle("/admin/webhooks/{id}/dead-letters/{letter}/replay", s.limited(ratelimit.ClassAdmin, s.replayDeadLetter)).Methods(http.MethodPost)
+	}
 }
 
 func (s *Server) getGroupTransparencyAverage(w http.ResponseWriter, r *http.Request) {
@@ -40,12 +270,12 @@ func (s *Server) getGroupTransparencyAverage(w http.ResponseWriter, r *http.Requ
 
 	averageTransparency, err := s.microserviceServer.GetGroupTransparencyAverage(r.Context(), groupName)
 	if err != nil {
-		http.Error(w, "Error calculating transparency average", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "averageTransparency": averageTransparency})
+	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "averageTransparency": averageTransparency.Value, "coverage": averageTransparency.Coverage})
 }
 
 func (s *Server) getGroupTemperatureAverage(w http.ResponseWriter, r *http.Request) {
@@ -54,12 +284,12 @@ func (s *Server) getGroupTemperatureAverage(w http.ResponseWriter, r *http.Reque
 
 	averageTemperature, err := s.microserviceServer.GetGroupTemperatureAverage(r.Context(), groupName)
 	if err != nil {
-		http.Error(w, "Error calculating temperature average", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "averageTemperature": averageTemperature})
+	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "averageTemperature": averageTemperature.Value, "coverage": averageTemperature.Coverage})
 }
 
 func (s *Server) getGroupSpecies(w http.ResponseWriter, r *http.Request) {
@@ -68,12 +298,12 @@ func (s *Server) getGroupSpecies(w http.ResponseWriter, r *http.Request) {
 
 	speciesList, err := s.microserviceServer.GetGroupSpecies(r.Context(), groupName)
 	if err != nil {
-		http.Error(w, "Error fetching species list", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "speciesList": speciesList})
+	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "speciesList": speciesList.Species, "coverage": speciesList.Coverage})
 }
 
 func (s *Server) getTopNGroupSpecies(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +312,7 @@ func (s *Server) getTopNGroupSpecies(w http.ResponseWriter, r *http.Request) {
 	groupName := vars["groupName"]
 	n, err := strconv.Atoi(vars["n"])
 	if err != nil {
-		http.Error(w, "Error fetching top n species list, invalid n value", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid n parameter")
 		return
 	}
 
@@ -94,13 +324,13 @@ func (s *Server) getTopNGroupSpecies(w http.ResponseWriter, r *http.Request) {
 
 	from, err := strconv.Atoi(fromStr)
 	if err != nil && fromStr != "" {
-		http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid 'from' parameter")
 		return
 	}
 
 	till, err := strconv.Atoi(tillStr)
 	if err != nil && tillStr != "" {
-		http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid 'till' parameter")
 		return
 	}
 
@@ -118,13 +348,13 @@ func (s *Server) getTopNGroupSpecies(w http.ResponseWriter, r *http.Request) {
 
 	speciesList, err := s.microserviceServer.GetTopNGroupSpecies(r.Context(), groupName, n, fromTime, tillTime)
 	if err != nil {
-		http.Error(w, "Error fetching top n species list", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "speciesList": speciesList})
+	json.NewEncoder(w).Encode(map[string]interface{}{"group": groupName, "speciesList": speciesList.Species, "coverage": speciesList.Coverage})
 }
 
 func (s *Server) getRegionMinTemperature(w http.ResponseWriter, r *http.Request) {
@@ -132,48 +362,48 @@ func (s *Server) getRegionMinTemperature(w http.ResponseWriter, r *http.Request)
 
 	xMin, err := strconv.ParseFloat(params.Get("xMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid xMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid xMin parameter")
 		return
 	}
 
 	xMax, err := strconv.ParseFloat(params.Get("xMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid xMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid xMax parameter")
 		return
 	}
 
 	yMin, err := strconv.ParseFloat(params.Get("yMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid yMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid yMin parameter")
 		return
 	}
 
 	yMax, err := strconv.ParseFloat(params.Get("yMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid yMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid yMax parameter")
 		return
 	}
 
 	zMin, err := strconv.ParseFloat(params.Get("zMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid zMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid zMin parameter")
 		return
 	}
 
 	zMax, err := strconv.ParseFloat(params.Get("zMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid zMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid zMax parameter")
 		return
 	}
 
 	minTemperature, err := s.microserviceServer.GetRegionMinTemperature(r.Context(), xMin, xMax, yMin, yMax, zMin, zMax)
 	if err != nil {
-		http.Error(w, "Error fetching region min temperature", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"Min Temperature": minTemperature})
+	json.NewEncoder(w).Encode(map[string]interface{}{"Min Temperature": minTemperature.Value, "coverage": minTemperature.Coverage})
 }
 
 func (s *Server) getRegionMaxTemperature(w http.ResponseWriter, r *http.Request) {
@@ -182,48 +412,48 @@ func (s *Server) getRegionMaxTemperature(w http.ResponseWriter, r *http.Request)
 	// Parse query parameters
 	xMin, err := strconv.ParseFloat(params.Get("xMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid xMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid xMin parameter")
 		return
 	}
 
 	xMax, err := strconv.ParseFloat(params.Get("xMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid xMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid xMax parameter")
 		return
 	}
 
 	yMin, err := strconv.ParseFloat(params.Get("yMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid yMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid yMin parameter")
 		return
 	}
 
 	yMax, err := strconv.ParseFloat(params.Get("yMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid yMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid yMax parameter")
 		return
 	}
 
 	zMin, err := strconv.ParseFloat(params.Get("zMin"), 64)
 	if err != nil {
-		http.Error(w, "Invalid zMin parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid zMin parameter")
 		return
 	}
 
 	zMax, err := strconv.ParseFloat(params.Get("zMax"), 64)
 	if err != nil {
-		http.Error(w, "Invalid zMax parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid zMax parameter")
 		return
 	}
 
 	maxTemperature, err := s.microserviceServer.GetRegionMaxTemperature(r.Context(), xMin, xMax, yMin, yMax, zMin, zMax)
 	if err != nil {
-		http.Error(w, "Error fetching region max temperature", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"Max Temperature": maxTemperature})
+	json.NewEncoder(w).Encode(map[string]interface{}{"Max Temperature": maxTemperature.Value, "coverage": maxTemperature.Coverage})
 }
 
 func (s *Server) getCodenameTemperatureAverage(w http.ResponseWriter, r *http.Request) {
@@ -236,26 +466,31 @@ func (s *Server) getCodenameTemperatureAverage(w http.ResponseWriter, r *http.Re
 
 	from, err := strconv.Atoi(fromStr)
 	if err != nil && fromStr != "" {
-		http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid 'from' parameter")
 		return
 	}
 
 	till, err := strconv.Atoi(tillStr)
 	if err != nil && tillStr != "" {
-		http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+		s.invalid(w, r, "Invalid 'till' parameter")
 		return
 	}
 
 	fromTime := time.Unix(int64(from), 0)
 
-	tillTime := time.Unix(int64(till), 0)
+	// An open ended range runs until now
+	var tillTime *time.Time
+	if tillStr != "" {
+		t := time.Unix(int64(till), 0)
+		tillTime = &t
+	}
 
 	averageTemperature, err := s.microserviceServer.GetCodeNameTemperatureAverage(r.Context(), codeName, fromTime, tillTime)
 	if err != nil {
-		http.Error(w, "Error calculating temperature average", http.StatusBadRequest)
+		s.fail(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"codeName": codeName, "averageTemperature": averageTemperature})
+	json.NewEncoder(w).Encode(map[string]interface{}{"codeName": codeName, "averageTemperature": averageTemperature.Value, "coverage": averageTemperature.Coverage})
 }
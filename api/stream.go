@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sensors/internal/logging"
+)
+
+const (
+	// heartbeatInterval keeps proxies from closing a stream without readings
+	heartbeatInterval = 15 * time.Second
+	// retryMillis is how long clients wait before reconnecting a closed stream
+	retryMillis = 3000
+)
+
+// streamReadings pushes the readings as Server-Sent Events, each event carrying
+// the reading ID so that EventSource resumes from it with Last-Event-ID
+func (s *Server) streamReadings(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// lastEventId is for the clients that cannot set headers
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			s.invalid(w, r, "Invalid Last-Event-ID")
+			return
+		}
+	}
+
+	readings, err := s.stream.StreamReadings(r.Context(), query.Get("group"), query.Get("sensor"), lastID)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	logger := logging.FromContext(r.Context())
+	controller := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the events
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	if err := controller.Flush(); err != nil {
+		logger.Error("stream flush", "err", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case reading, ok := <-readings.Readings():
+			if !ok {
+				if err := readings.Err(); err != nil {
+					logger.Warn("reading stream ended", "err", err)
+				}
+				return
+			}
+			// A reading that cannot be encoded, such as a NaN temperature, is
+			// skipped. Ending the stream would have the client resume right
+			// before it again
+			data, err := json.Marshal(reading)
+			if err != nil {
+				logger.Warn("encode reading", "id", reading.ID, "err", err)
+				continue
+			}
+			// A reading committed late comes after larger ids, the client
+			// resumes after the largest
+			if reading.ID > lastID {
+				lastID = reading.ID
+				fmt.Fprintf(w, "id: %d\n", reading.ID)
+			}
+			fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data)
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
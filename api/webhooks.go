@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sensors/internal/service"
+)
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if !s.decode(w, r, &request) {
+		return
+	}
+
+	secret, webhook, err := s.webhooks.CreateWebhook(r.Context(), request.URL, request.Events)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	// The secret is never shown again
+	w.Header().Set("Location", "/admin/webhooks/"+strconv.Itoa(webhook.ID))
+	writeJSON(w, http.StatusCreated, struct {
+		service.Webhook
+		Secret string `json:"secret"`
+	}{webhook, secret})
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.webhooks.ListWebhooks(r.Context())
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": webhooks})
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.webhooks.DeleteWebhook(r.Context(), id); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+	filter := service.DeliveryFilter{Limit: service.DefaultDeliveryLimit, State: r.URL.Query().Get("state")}
+	if !s.parsePage(w, r, &filter.Limit, &filter.Before) {
+		return
+	}
+
+	deliveries, err := s.webhooks.ListDeliveries(r.Context(), id, filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	// next pages to the older deliveries, it is absent on the last page
+	response := map[string]interface{}{"deliveries": deliveries}
+	if len(deliveries) > 0 && len(deliveries) == filter.Limit {
+		response["next"] = deliveries[len(deliveries)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+	filter := service.DeliveryFilter{Limit: service.DefaultDeliveryLimit}
+	if !s.parsePage(w, r, &filter.Limit, &filter.Before) {
+		return
+	}
+
+	letters, err := s.webhooks.ListDeadLetters(r.Context(), id, filter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	response := map[string]interface{}{"deadLetters": letters}
+	if len(letters) > 0 && len(letters) == filter.Limit {
+		response["next"] = letters[len(letters)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathID(w, r)
+	if !ok {
+		return
+	}
+	letter, err := strconv.ParseInt(mux.Vars(r)["letter"], 10, 64)
+	if err != nil || letter <= 0 {
+		s.invalid(w, r, "Invalid letter parameter")
+		return
+	}
+
+	delivery, err := s.webhooks.ReplayDeadLetter(r.Context(), id, letter)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
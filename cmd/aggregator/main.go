@@ -0,0 +1,62 @@
+// Command aggregator periodically stores aggregated group statistics
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sensors/internal/aggregator"
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/supervisor"
+)
+
+func main() {
+	var (
+		logConfig        config.Log
+		dbConfig         config.Database
+		healthConfig     config.Health
+		freshness        config.Freshness
+		aggregatorConfig config.Aggregator
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	healthConfig.RegisterFlags(flag.CommandLine)
+	freshness.RegisterFlags(flag.CommandLine)
+	aggregatorConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	workers := supervisor.New(supervisor.DefaultBackoff())
+	workers.Go(ctx, "aggregator", aggregator.New(db, aggregatorConfig.Interval).Run)
+
+	if healthConfig.Addr != "" {
+		checker := health.New(db, health.WithWorkers(workers), freshness.Aggregator())
+		go func() {
+			if err := checker.Serve(ctx, healthConfig.Addr, map[string]http.Handler{"/metrics": metrics.Handler()}); err != nil {
+				slog.Error("health endpoint", "err", err)
+			}
+		}()
+	}
+
+	workers.Wait()
+}
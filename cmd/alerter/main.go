@@ -0,0 +1,77 @@
+// Command alerter evaluates the alert rules, detects the anomalies of the live
+// readings, watches the health of the sensors and delivers the events to the
+// webhooks, a single one must run against a database
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sensors/internal/alert"
+	"github.com/sensors/internal/anomaly"
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/stream"
+	"github.com/sensors/internal/supervisor"
+	"github.com/sensors/internal/watchdog"
+	"github.com/sensors/internal/webhook"
+)
+
+func main() {
+	var (
+		logConfig       config.Log
+		dbConfig        config.Database
+		healthConfig    config.Health
+		alertsConfig    config.Alerts
+		webhooksConfig  config.Webhooks
+		anomaliesConfig config.Anomalies
+		watchdogConfig  config.Watchdog
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	healthConfig.RegisterFlags(flag.CommandLine)
+	alertsConfig.RegisterFlags(flag.CommandLine)
+	webhooksConfig.RegisterFlags(flag.CommandLine)
+	anomaliesConfig.RegisterFlags(flag.CommandLine)
+	watchdogConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	hub := stream.NewHub(db, dbConfig.URL)
+	workers := supervisor.New(supervisor.DefaultBackoff())
+	workers.Go(ctx, "stream", hub.Run)
+	workers.Go(ctx, "alerts", alert.New(db, hub, alertsConfig.Interval).Run)
+	workers.Go(ctx, "anomalies", anomaly.New(db, hub, anomaliesConfig.Interval, anomaliesConfig.Threshold).Run)
+	workers.Go(ctx, "watchdog", watchdog.New(db, watchdogConfig.Interval).Run)
+	workers.Go(ctx, "webhooks", webhook.New(db, webhooksConfig.Interval, webhooksConfig.Timeout, webhooksConfig.Backoff()).Run)
+
+	if healthConfig.Addr != "" {
+		checker := health.New(db, health.WithWorkers(workers))
+		go func() {
+			if err := checker.Serve(ctx, healthConfig.Addr, map[string]http.Handler{"/metrics": metrics.Handler()}); err != nil {
+				slog.Error("health endpoint", "err", err)
+			}
+		}()
+	}
+
+	workers.Wait()
+}
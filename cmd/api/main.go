@@ -0,0 +1,112 @@
+// Command api serves the HTTP API, its only worker streams the readings to its
+// own subscribers so it can be scaled out behind a load balancer
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sensors/api"
+	"github.com/sensors/internal/app"
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/service"
+	"github.com/sensors/internal/stream"
+	"github.com/sensors/internal/supervisor"
+)
+
+func main() {
+	var (
+		logConfig       config.Log
+		dbConfig        config.Database
+		redisConfig     config.Redis
+		apiConfig       config.API
+		freshness       config.Freshness
+		tracingConfig   config.Tracing
+		authConfig      config.Auth
+		rateLimitConfig config.RateLimit
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	redisConfig.RegisterFlags(flag.CommandLine)
+	apiConfig.RegisterFlags(flag.CommandLine)
+	freshness.RegisterFlags(flag.CommandLine)
+	tracingConfig.RegisterFlags(flag.CommandLine)
+	authConfig.RegisterFlags(flag.CommandLine)
+	rateLimitConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracingConfig.Setup(ctx, "sensors-api")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Flushes the spans of the last requests, after the server stopped
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("tracing shutdown", "err", err)
+		}
+	}()
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	redisClient := redisConfig.Open()
+	defer redisClient.Close()
+
+	// Every replica listens for the readings it streams to its own subscribers
+	workers := supervisor.New(supervisor.DefaultBackoff())
+	hub := stream.NewHub(db, dbConfig.URL)
+	workers.Go(ctx, "stream", hub.Run)
+
+	sensor := service.NewSensorService(repository.NewDAO(db), redisClient)
+	// The API also reports whether the simulator and aggregator, wherever they
+	// run, keep the data it serves fresh
+	checker := health.New(db, health.WithRedis(redisClient), health.WithWorkers(workers), freshness.Generator(), freshness.Aggregator())
+	authOptions, err := authConfig.Options(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rateLimitOptions, err := rateLimitConfig.Options(redisClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := append([]api.Option{api.WithAddr(apiConfig.Addr), api.WithHealth(checker), api.WithMetrics(), api.WithAudit(service.NewAuditService(db)),
+		api.WithStream(service.NewStreamService(repository.NewDAO(db), hub)), api.WithAlerts(service.NewAlertService(db)),
+		api.WithWebhooks(service.NewWebhookService(db)), api.WithAnomalies(service.NewAnomalyService(db)),
+		api.WithSensorHealth(service.NewSensorHealthService(db))}, authOptions...)
+	options = append(options, rateLimitOptions...)
+	server := api.NewServer(ctx, *app.NewMicroservice(sensor), options...)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("api shutdown", "err", err)
+		}
+	}()
+
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
+	workers.Wait()
+}
@@ -0,0 +1,114 @@
+// Command apikey issues, lists and revokes API keys, it bootstraps the first
+// admin key the /admin/keys endpoints can then be used with
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/repository"
+)
+
+func main() {
+	var (
+		logConfig config.Log
+		dbConfig  config.Database
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	name := flag.String("name", "", "name of the key to issue")
+	tenantName := flag.String("tenant", "", "tenant of the key to issue, created if missing, or of the keys to list or revoke; a key without tenant is a platform key acting on every tenant")
+	scopes := flag.String("scopes", auth.ScopeAdmin, "comma separated scopes of the key to issue: admin, read:<group> or write:<group>")
+	list := flag.Bool("list", false, "list the keys instead of issuing one")
+	revoke := flag.Int("revoke", 0, "id of a key to revoke instead of issuing one")
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := repository.CreateTables(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Issuing a key for a new tenant creates the tenant, listing and revoking do not
+	var tenantID *int
+	if *tenantName != "" {
+		var id int
+		if *list || *revoke != 0 {
+			tenant, err := repository.NewDAO(db).NewTenantQuery().FetchTenant(ctx, *tenantName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			id = tenant.ID
+		} else if id, err = repository.EnsureTenant(db, *tenantName); err != nil {
+			log.Fatal(err)
+		}
+		tenantID = &id
+	}
+
+	// Keys managed from the command line are recorded in the audit log under the
+	// name of the operating system user running it
+	actor := repository.Actor{Subject: "cli", Method: "cli"}
+	if current, err := user.Current(); err == nil {
+		actor.Subject = "cli:" + current.Username
+	}
+
+	switch {
+	case *list:
+		keys, err := repository.ListAPIKeys(ctx, db, tenantID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTENANT\tNAME\tPREFIX\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			tenant := key.Tenant
+			if tenant == "" {
+				tenant = "-"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, tenant, key.Name, key.Prefix, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+
+	case *revoke != 0:
+		if err := repository.RevokeAPIKey(ctx, db, actor, tenantID, *revoke); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("revoked key " + strconv.Itoa(*revoke))
+
+	default:
+		if *name == "" {
+			log.Fatal("-name is required to issue a key")
+		}
+		key, stored, err := auth.IssueKey(ctx, db, actor, tenantID, *name, strings.Split(*scopes, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "issued key %d %q with scopes %s, it is not shown again\n", stored.ID, stored.Name, strings.Join(stored.Scopes, ","))
+		fmt.Println(key)
+	}
+}
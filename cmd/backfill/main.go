@@ -0,0 +1,190 @@
+// Command backfill synthesizes historical readings for a sensor topology and bulk
+// loads them into PostgreSQL
+package main
+
+import (
+	"container/heap"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/generator"
+	"github.com/sensors/internal/repository"
+)
+
+func main() {
+	var (
+		logConfig    config.Log
+		dbConfig     config.Database
+		writerConfig config.Writer
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	writerConfig.RegisterFlags(flag.CommandLine)
+	topologyPath := flag.String("topology", "", "path to a JSON topology file, defaults to the alpha, beta and gamma groups")
+	generatorConfigPath := flag.String("generator-config", "", "path to a JSON file selecting the data generator models")
+	seed := flag.Int64("seed", 0, "seed for the data generator, the same seed and range produce the same readings")
+	fromStr := flag.String("from", "", "RFC 3339 start of the backfill, defaults to -months before -till")
+	tillStr := flag.String("till", "", "RFC 3339 end of the backfill, defaults to now")
+	months := flag.Int("months", 3, "number of months to backfill when -from is not set")
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	topology := generator.DefaultTopology()
+	if *topologyPath != "" {
+		var err error
+		topology, err = generator.LoadTopology(*topologyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	generatorConfig := generator.DefaultConfig()
+	if *generatorConfigPath != "" {
+		var err error
+		generatorConfig, err = generator.LoadConfig(*generatorConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	till := time.Now().UTC()
+	if *tillStr != "" {
+		var err error
+		till, err = time.Parse(time.RFC3339, *tillStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	from := till.AddDate(0, -*months, 0)
+	if *fromStr != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339, *fromStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !from.Before(till) {
+		log.Fatalf("-from %s must be before -till %s", from, till)
+	}
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := repository.CreateTables(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Historic data must not disturb the live transparency state kept in Redis
+	rng := generator.NewRand(*seed)
+	gen, err := generator.New(generatorConfig, rng, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sensors, _, err := generator.Provision(db, gen, topology)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	groupNames, err := generator.LoadGroupNames(context.Background(), db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	injector, err := generator.NewFaultInjector(gen, rng, generatorConfig.Faults, groupNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A backfill with holes is useless, stop at the first batch that cannot be loaded
+	writerCfg := writerConfig.Config()
+	writerCfg.OnDrop = func(err error, dropped []repository.SensorData) error {
+		return fmt.Errorf("could not load %d readings: %w", len(dropped), err)
+	}
+	ctx := context.Background()
+	writer := repository.NewBatchWriter(ctx, db, writerCfg)
+
+	started := time.Now()
+	total := 0
+
+	// Readings are generated in chronological order across all sensors, so the
+	// stateful models evolve the same way they do when running live
+	schedule := make(readingSchedule, 0, len(sensors))
+	for _, sensor := range sensors {
+		if sensor.DataRate <= 0 {
+			slog.Warn("skipping sensor without a data rate", "sensor", sensor.Codename)
+			continue
+		}
+		schedule = append(schedule, &nextReading{sensor: sensor, at: from})
+	}
+	heap.Init(&schedule)
+
+	for schedule.Len() > 0 {
+		next := schedule[0]
+		if next.at.After(till) {
+			break
+		}
+
+		for _, data := range injector.Generate(next.sensor, next.at) {
+			if err := writer.Write(ctx, data); err != nil {
+				writer.Close()
+				log.Fatal(err)
+			}
+			total++
+			if total%100000 == 0 {
+				slog.Info("backfill progress", "readings", total, "at", next.at.Format(time.RFC3339))
+			}
+		}
+
+		next.at = next.at.Add(time.Duration(next.sensor.DataRate) * time.Second)
+		heap.Fix(&schedule, 0)
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	slog.Info("backfill done", "readings", total, "sensors", len(schedule),
+		"from", from.Format(time.RFC3339), "till", till.Format(time.RFC3339), "took", time.Since(started).Round(time.Millisecond))
+}
+
+type nextReading struct {
+	sensor repository.Sensor
+	at     time.Time
+}
+
+// readingSchedule is a min-heap of the next reading of every sensor
+type readingSchedule []*nextReading
+
+func (s readingSchedule) Len() int { return len(s) }
+
+func (s readingSchedule) Less(i, j int) bool {
+	if s[i].at.Equal(s[j].at) {
+		return s[i].sensor.ID < s[j].sensor.ID
+	}
+	return s[i].at.Before(s[j].at)
+}
+
+func (s readingSchedule) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s *readingSchedule) Push(x interface{}) { *s = append(*s, x.(*nextReading)) }
+
+func (s *readingSchedule) Pop() interface{} {
+	old := *s
+	item := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return item
+}
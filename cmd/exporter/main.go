@@ -0,0 +1,53 @@
+// Command exporter publishes the latest readings of every sensor as Prometheus
+// gauges, read from sensor_data on every scrape
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/exporter"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/metrics"
+)
+
+func main() {
+	var (
+		logConfig      config.Log
+		dbConfig       config.Database
+		exporterConfig config.Exporter
+		freshness      config.Freshness
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	exporterConfig.RegisterFlags(flag.CommandLine)
+	freshness.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	metrics.Registry.MustRegister(exporter.New(db, exporterConfig.Window, exporterConfig.Timeout))
+
+	// Stale readings would be exported as if they were current, readiness flags them
+	checker := health.New(db, freshness.Generator())
+	if err := checker.Serve(ctx, exporterConfig.Addr, map[string]http.Handler{"/metrics": metrics.Handler()}); err != nil {
+		log.Fatal(err)
+	}
+}
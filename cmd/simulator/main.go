@@ -0,0 +1,85 @@
+// Command simulator provisions the sensor topology and writes generated readings
+// for every sensor at its data rate
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sensors/internal/config"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/simulator"
+	"github.com/sensors/internal/supervisor"
+)
+
+func main() {
+	var (
+		logConfig       config.Log
+		dbConfig        config.Database
+		redisConfig     config.Redis
+		healthConfig    config.Health
+		freshness       config.Freshness
+		simulatorConfig config.Simulator
+	)
+	logConfig.RegisterFlags(flag.CommandLine)
+	dbConfig.RegisterFlags(flag.CommandLine)
+	redisConfig.RegisterFlags(flag.CommandLine)
+	healthConfig.RegisterFlags(flag.CommandLine)
+	freshness.RegisterFlags(flag.CommandLine)
+	simulatorConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := logConfig.Setup(); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := simulatorConfig.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := dbConfig.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	redisClient := redisConfig.Open()
+	defer redisClient.Close()
+
+	sim, err := simulator.New(ctx, db, redisClient, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The simulator provisions the topology on its first run and is restarted
+	// with a backoff whenever it fails
+	workers := supervisor.New(supervisor.DefaultBackoff())
+	workers.Go(ctx, "simulator", sim.Run)
+
+	if healthConfig.Addr != "" {
+		checker := health.New(db, health.WithRedis(redisClient), health.WithWorkers(workers), freshness.Generator())
+		go func() {
+			if err := checker.Serve(ctx, healthConfig.Addr, map[string]http.Handler{"/metrics": metrics.Handler()}); err != nil {
+				slog.Error("health endpoint", "err", err)
+			}
+		}()
+	}
+
+	workers.Wait()
+
+	// Flush what is still buffered
+	if err := sim.Close(); err != nil {
+		slog.Error("simulator close", "err", err)
+	}
+}
@@ -0,0 +1,68 @@
+package aggregator
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/retry"
+)
+
+// Aggregator periodically stores the average temperature and transparency of
+// every group in aggregated_statistics
+type Aggregator struct {
+	db       *sql.DB
+	interval time.Duration
+}
+
+func New(db *sql.DB, interval time.Duration) *Aggregator {
+	return &Aggregator{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// Run creates the tables if needed and aggregates once per interval until ctx is
+// done, transient database errors are retried and any other error is returned
+func (a *Aggregator) Run(ctx context.Context) error {
+	err := retry.Do(ctx, retry.DefaultBackoff(), repository.IsTransient, func() error {
+		return repository.CreateTables(a.db)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		err := retry.Do(ctx, retry.DefaultBackoff(), repository.IsTransient, func() error {
+			started := time.Now()
+			err := repository.AggregateStatistics(ctx, a.db)
+			metrics.ObserveAggregation(time.Since(started), err)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if err := repository.Heartbeat(ctx, a.db, repository.HeartbeatAggregator); err != nil && ctx.Err() == nil {
+			slog.Warn("aggregator heartbeat", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package alert evaluates the alert rules against the live readings and keeps
+// the state of their alerts in Postgres
+package alert
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/stream"
+)
+
+// Operators comparing the aggregate of a rule to its threshold
+const (
+	Above        = ">"
+	AboveOrEqual = ">="
+	Below        = "<"
+	BelowOrEqual = "<="
+)
+
+// Holds reports whether value compares to threshold with operator
+func Holds(operator string, value, threshold float64) bool {
+	switch operator {
+	case Above:
+		return value > threshold
+	case AboveOrEqual:
+		return value >= threshold
+	case Below:
+		return value < threshold
+	case BelowOrEqual:
+		return value <= threshold
+	default:
+		return false
+	}
+}
+
+// Evaluator follows the readings of every enabled rule and moves its alert
+// through the pending, firing and resolved states. A single evaluator runs
+// against a database, the transitions of several would interleave, so it holds
+// an advisory lock while evaluating
+type Evaluator struct {
+	db       *sql.DB
+	hub      *stream.Hub
+	interval time.Duration
+	watchers map[int]*watcher
+}
+
+// watcher evaluates a rule until it is stopped
+type watcher struct {
+	rule   repository.AlertRule
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New creates an evaluator reading the rules of db and following their readings
+// on hub, each rule being evaluated once per interval
+func New(db *sql.DB, hub *stream.Hub, interval time.Duration) *Evaluator {
+	return &Evaluator{db: db, hub: hub, interval: interval, watchers: make(map[int]*watcher)}
+}
+
+// Run evaluates the enabled rules until ctx is done, the rules are reloaded
+// once per interval so their changes apply within it. It waits for the evaluator
+// of another process to stop first, and fails when its lock is lost
+func (e *Evaluator) Run(ctx context.Context) error {
+	lease, err := e.lead(ctx)
+	if err != nil || lease == nil {
+		return err
+	}
+	defer lease.Release()
+	defer e.stopAll()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := lease.Check(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("alert evaluator lock lost: %w", err)
+		}
+		e.sync(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead takes the lock of the alert evaluation, trying again once per interval
+// while another evaluator holds it. It returns a nil lease when ctx is done first
+func (e *Evaluator) lead(ctx context.Context) (*repository.Lease, error) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for waiting := false; ; waiting = true {
+		lease, err := repository.TryLease(ctx, e.db, repository.AlertEvaluatorLock)
+		if ctx.Err() != nil {
+			if lease != nil {
+				lease.Release()
+			}
+			return nil, nil
+		}
+		if err != nil || lease != nil {
+			return lease, err
+		}
+		if !waiting {
+			slog.Info("another alert evaluator runs against the database, waiting for it to stop")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync starts watching the rules that were enabled or changed and stops watching
+// those that were disabled or deleted. The watchers are left as they are when the
+// rules cannot be read
+func (e *Evaluator) sync(ctx context.Context) {
+	rules, err := repository.ListAlertRules(ctx, e.db, nil)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("alert rules", "err", err)
+		}
+		return
+	}
+
+	enabled := make(map[int]repository.AlertRule, len(rules))
+	for _, rule := range rules {
+		if rule.Enabled {
+			enabled[rule.ID] = rule
+		}
+	}
+
+	for id, w := range e.watchers {
+		rule, ok := enabled[id]
+		// A sensor moving to another group changes the scope of its alerts
+		if !ok || !rule.UpdatedAt.Equal(w.rule.UpdatedAt) || rule.SensorGroup != w.rule.SensorGroup {
+			w.stop()
+			delete(e.watchers, id)
+		}
+	}
+	for id, rule := range enabled {
+		if _, ok := e.watchers[id]; !ok {
+			e.watchers[id] = e.watch(ctx, rule)
+		}
+	}
+}
+
+func (e *Evaluator) stopAll() {
+	for id, w := range e.watchers {
+		w.stop()
+		delete(e.watchers, id)
+	}
+}
+
+func (w *watcher) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// watch evaluates rule until the returned watcher is stopped, starting over
+// after an interval when its readings or its alert cannot be read or written
+func (e *Evaluator) watch(ctx context.Context, rule repository.AlertRule) *watcher {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watcher{rule: rule, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(w.done)
+		for {
+			err := e.evaluate(ctx, rule)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn("alert rule evaluation", "rule", rule.ID, "tenant", rule.TenantID, "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(e.interval):
+			}
+		}
+	}()
+
+	return w
+}
+
+// evaluate seeds the window of rule from the stored readings, then adds the live
+// ones and checks its condition once per interval. It returns when ctx is done,
+// when the subscription ends or when a transition cannot be stored
+func (e *Evaluator) evaluate(ctx context.Context, rule repository.AlertRule) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	filter := stream.Filter{TenantID: rule.TenantID, Group: rule.Group, CodeName: rule.CodeName}
+	// Subscribed before the window is seeded so no reading falls in between, the
+	// readings the seed accounts for are skipped
+	subscription := e.hub.Subscribe(ctx, filter, 0)
+
+	window := stream.NewWindow(rule.Window)
+	buckets, seededThrough, err := e.hub.Buckets(ctx, filter, rule.Metric, time.Now().Add(-rule.Window), window.Width())
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		window.Merge(bucket)
+	}
+
+	// The alert of the rule survives restarts, a pending one keeps its start
+	open, err := repository.OpenAlertOf(ctx, e.db, rule.ID)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case reading, ok := <-subscription.Readings():
+			if !ok {
+				return subscription.Err()
+			}
+			if reading.ID > seededThrough {
+				window.AddReading(reading, rule.Metric)
+			}
+
+		case now := <-ticker.C:
+			value, _ := window.Evaluate(now, rule.Aggregate)
+			if open, err = e.transition(ctx, rule, open, value, now); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// step is a change of the state of an alert
+type step int
+
+const (
+	stepNone step = iota
+	stepPending
+	stepFire
+	stepResolve
+)
+
+// next returns the step moving open, the alert of rule that is not resolved or
+// nil, to the state value calls for at now: pending or firing right away from
+// nil, firing once pending for rule.For. A window without reading, or whose
+// aggregate is not a finite number, leaves the alert as it is, as the absence
+// of data tells nothing about the condition
+func next(rule repository.AlertRule, open *repository.Alert, value *float64, now time.Time) step {
+	if value == nil || math.IsNaN(*value) || math.IsInf(*value, 0) {
+		return stepNone
+	}
+	holds := Holds(rule.Operator, *value, rule.Threshold)
+
+	switch {
+	case open == nil && holds && rule.For == 0:
+		return stepFire
+	case open == nil && holds:
+		return stepPending
+	case open != nil && open.State == repository.AlertPending && holds && now.Sub(open.StartedAt) >= rule.For:
+		return stepFire
+	case open != nil && !holds:
+		return stepResolve
+	default:
+		return stepNone
+	}
+}
+
+// transition stores the step of open that value calls for, see next, and
+// returns the alert left open
+func (e *Evaluator) transition(ctx context.Context, rule repository.AlertRule, open *repository.Alert, value *float64, now time.Time) (*repository.Alert, error) {
+	var (
+		alert repository.Alert
+		err   error
+	)
+	switch step := next(rule, open, value, now); {
+	case step == stepPending && open == nil:
+		alert, err = repository.OpenAlert(ctx, e.db, rule, repository.AlertPending, round(*value))
+	case step == stepFire && open == nil:
+		alert, err = repository.OpenAlert(ctx, e.db, rule, repository.AlertFiring, round(*value))
+	case step == stepFire:
+		alert, err = repository.FireAlert(ctx, e.db, open.ID, round(*value))
+	case step == stepResolve:
+		alert, err = repository.ResolveAlert(ctx, e.db, open.ID)
+	default:
+		return open, nil
+	}
+	// The alert was resolved meanwhile, by a change of its rule
+	if errors.Is(err, repository.ErrAlertNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return open, err
+	}
+
+	metrics.ObserveAlert(alert.Severity, alert.State)
+	attrs := []any{"rule", rule.Name, "tenant", rule.TenantID, "severity", alert.Severity, "state", alert.State}
+	if value != nil {
+		attrs = append(attrs, "value", round(*value))
+	}
+	slog.Info("alert", attrs...)
+	if alert.State == repository.AlertResolved {
+		return nil, nil
+	}
+	return &alert, nil
+}
+
+// round keeps the 2 decimals the statistics are served with
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,74 @@
+package alert
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+func TestHolds(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    float64
+		want     bool
+	}{
+		{operator: Above, value: 31, want: true},
+		{operator: Above, value: 30},
+		{operator: AboveOrEqual, value: 30, want: true},
+		{operator: AboveOrEqual, value: 29.99},
+		{operator: Below, value: 29, want: true},
+		{operator: Below, value: 30},
+		{operator: BelowOrEqual, value: 30, want: true},
+		{operator: BelowOrEqual, value: 30.01},
+		{operator: "==", value: 30},
+		{operator: "", value: 30},
+	}
+
+	for _, tt := range tests {
+		if got := Holds(tt.operator, tt.value, 30); got != tt.want {
+			t.Errorf("Holds(%q, %v, 30) = %v, want %v", tt.operator, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	rule := repository.AlertRule{Operator: Above, Threshold: 30, For: 2 * time.Minute}
+	immediate := repository.AlertRule{Operator: Above, Threshold: 30}
+	pending := &repository.Alert{State: repository.AlertPending, StartedAt: now.Add(-time.Minute)}
+	pendingLong := &repository.Alert{State: repository.AlertPending, StartedAt: now.Add(-2 * time.Minute)}
+	firing := &repository.Alert{State: repository.AlertFiring, StartedAt: now.Add(-time.Hour)}
+	value := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		rule  repository.AlertRule
+		open  *repository.Alert
+		value *float64
+		want  step
+	}{
+		{name: "ok stays ok", rule: rule, value: value(20), want: stepNone},
+		{name: "holds opens pending", rule: rule, value: value(31), want: stepPending},
+		{name: "holds fires without for", rule: immediate, value: value(31), want: stepFire},
+		{name: "pending waits for for", rule: rule, open: pending, value: value(31), want: stepNone},
+		{name: "pending fires after for", rule: rule, open: pendingLong, value: value(31), want: stepFire},
+		{name: "pending resolves", rule: rule, open: pending, value: value(30), want: stepResolve},
+		{name: "firing stays firing", rule: rule, open: firing, value: value(31), want: stepNone},
+		{name: "firing resolves", rule: rule, open: firing, value: value(29), want: stepResolve},
+		{name: "no data keeps firing", rule: rule, open: firing, want: stepNone},
+		{name: "no data keeps pending", rule: rule, open: pendingLong, want: stepNone},
+		{name: "no data opens nothing", rule: rule, want: stepNone},
+		{name: "nan keeps firing", rule: rule, open: firing, value: value(math.NaN()), want: stepNone},
+		{name: "infinity opens nothing", rule: rule, value: value(math.Inf(1)), want: stepNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := next(tt.rule, tt.open, tt.value, now); got != tt.want {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package anomaly
+
+import (
+	"math"
+	"time"
+)
+
+// Methods measuring how far a value deviates from a baseline
+const (
+	// MethodRolling compares to the mean and deviation of the latest values
+	MethodRolling = "rolling"
+	// MethodEWMA compares to exponentially weighted moving averages, which
+	// follow slow drifts
+	MethodEWMA = "ewma"
+	// MethodSeasonal compares to the values usually read at that hour of the day
+	MethodSeasonal = "seasonal"
+)
+
+const (
+	// rollingSize is the number of latest values the rolling statistics cover
+	rollingSize = 120
+	// warmUp is the number of values a baseline learns before it flags any
+	warmUp = 30
+	// ewmaAlpha weighs the newest value in the moving averages
+	ewmaAlpha = 0.05
+	// seasonSlots splits the day of the seasonal profile in hours
+	seasonSlots = 24
+	// slotWarmUp is the number of values a slot of the seasonal profile learns
+	// before it flags any, slotAlpha weighs the newest of them
+	slotWarmUp = 10
+	slotAlpha  = 0.1
+	// minDeviation keeps the sensors reading a constant value from flagging
+	// rounding noise
+	minDeviation = 0.05
+)
+
+// Baseline learns the usual values of a metric of a sensor. It is stored as JSON
+// so it survives restarts
+type Baseline struct {
+	// Recent holds the latest values, Next being where the next one goes
+	Recent []float64 `json:"recent"`
+	Next   int       `json:"next"`
+	Count  int       `json:"count"`
+	EWMA   moments   `json:"ewma"`
+	// Slots is the seasonal profile, a slot per hour of the day in UTC
+	Slots []moments `json:"slots"`
+}
+
+// moments is an exponentially weighted mean and variance
+type moments struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Count    int     `json:"count"`
+}
+
+func (m *moments) add(value, alpha float64) {
+	if m.Count == 0 {
+		m.Mean = value
+	}
+	diff := value - m.Mean
+	increment := alpha * diff
+	m.Mean += increment
+	m.Variance = (1 - alpha) * (m.Variance + diff*increment)
+	m.Count++
+}
+
+// Deviation is how far a value is from the one Method expected, Score being the
+// difference in standard deviations, negative below
+type Deviation struct {
+	Method   string
+	Expected float64
+	Score    float64
+}
+
+// NewBaseline creates a baseline that has learnt nothing
+func NewBaseline() *Baseline {
+	return &Baseline{Recent: make([]float64, 0, rollingSize), Slots: make([]moments, seasonSlots)}
+}
+
+// Check returns the largest deviation of value read at t when at least two of
+// the methods that learnt enough measure it beyond threshold, nil otherwise or
+// when value is not a finite number. A single method strays on ordinary noise
+// more often than two agreeing ones do
+func (b *Baseline) Check(value float64, t time.Time, threshold float64) *Deviation {
+	if b.Count < warmUp || !finite(value) {
+		return nil
+	}
+
+	mean, deviation := b.rolling()
+	deviations := []Deviation{
+		{Method: MethodRolling, Expected: mean, Score: score(value, mean, deviation)},
+		{Method: MethodEWMA, Expected: b.EWMA.Mean, Score: score(value, b.EWMA.Mean, math.Sqrt(b.EWMA.Variance))},
+	}
+	if slot := b.Slots[slotOf(t)]; slot.Count >= slotWarmUp {
+		deviations = append(deviations, Deviation{Method: MethodSeasonal, Expected: slot.Mean, Score: score(value, slot.Mean, math.Sqrt(slot.Variance))})
+	}
+
+	var (
+		worst  *Deviation
+		beyond int
+	)
+	for i, candidate := range deviations {
+		if math.Abs(candidate.Score) < threshold {
+			continue
+		}
+		beyond++
+		if worst == nil || math.Abs(candidate.Score) > math.Abs(worst.Score) {
+			worst = &deviations[i]
+		}
+	}
+	if beyond < 2 {
+		return nil
+	}
+	return worst
+}
+
+// Learn adds value read at t to b. Once warmed up, values further than threshold
+// deviations from the rolling mean are learnt as if they were at that distance,
+// so a spike does not widen the baseline it is flagged from. Values that are not
+// finite numbers are not learnt
+func (b *Baseline) Learn(value float64, t time.Time, threshold float64) {
+	if !finite(value) {
+		return
+	}
+	if b.Count >= warmUp {
+		mean, deviation := b.rolling()
+		deviation = math.Max(deviation, minDeviation)
+		value = math.Max(mean-threshold*deviation, math.Min(mean+threshold*deviation, value))
+	}
+
+	if len(b.Recent) < rollingSize {
+		b.Recent = append(b.Recent, value)
+	} else {
+		b.Recent[b.Next] = value
+	}
+	b.Next = (b.Next + 1) % rollingSize
+	b.Count++
+
+	b.EWMA.add(value, ewmaAlpha)
+	b.Slots[slotOf(t)].add(value, slotAlpha)
+}
+
+// rolling returns the mean and standard deviation of the recent values
+func (b *Baseline) rolling() (mean, deviation float64) {
+	for _, value := range b.Recent {
+		mean += value
+	}
+	mean /= float64(len(b.Recent))
+
+	var squares float64
+	for _, value := range b.Recent {
+		squares += (value - mean) * (value - mean)
+	}
+	if len(b.Recent) > 1 {
+		deviation = math.Sqrt(squares / float64(len(b.Recent)-1))
+	}
+	return mean, deviation
+}
+
+func score(value, mean, deviation float64) float64 {
+	return (value - mean) / math.Max(deviation, minDeviation)
+}
+
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+func slotOf(t time.Time) int {
+	return t.UTC().Hour() * seasonSlots / 24
+}
+
+// valid reports whether b was decoded from a state of the current layout
+func (b *Baseline) valid() bool {
+	return len(b.Slots) == seasonSlots && len(b.Recent) <= rollingSize && b.Next >= 0 && b.Next < rollingSize
+}
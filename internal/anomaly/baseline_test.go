@@ -0,0 +1,152 @@
+package anomaly
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// warmed returns a baseline whose rolling values alternate around 20 by 0.5, with
+// ewma as its moving averages and slot as the seasonal slot of hour
+func warmed(ewma moments, hour int, slot moments) *Baseline {
+	b := NewBaseline()
+	for i := 0; i < warmUp; i++ {
+		b.Recent = append(b.Recent, 20+0.5*float64(1-2*(i%2)))
+	}
+	b.Next, b.Count = warmUp, warmUp
+	b.EWMA = ewma
+	b.Slots[hour] = slot
+	return b
+}
+
+func TestCheck(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	usual := moments{Mean: 20, Variance: 0.25, Count: warmUp}
+	drifted := moments{Mean: 25, Variance: 0.25, Count: warmUp}
+	learnt := moments{Mean: 20, Variance: 0.25, Count: slotWarmUp}
+	learning := moments{Mean: 20, Variance: 0.25, Count: slotWarmUp - 1}
+	cold := warmed(usual, 10, learnt)
+	cold.Count = warmUp - 1
+
+	tests := []struct {
+		name     string
+		baseline *Baseline
+		value    float64
+		method   string
+		expected float64
+	}{
+		{name: "usual value", baseline: warmed(usual, 10, learnt), value: 20.4},
+		{name: "warming up", baseline: cold, value: 100},
+		{name: "not finite", baseline: warmed(usual, 10, learnt), value: math.NaN()},
+		{name: "infinite", baseline: warmed(usual, 10, learnt), value: math.Inf(1)},
+		{name: "rolling and ewma agree", baseline: warmed(usual, 3, learnt), value: 25, method: MethodEWMA, expected: 20},
+		{name: "below", baseline: warmed(usual, 3, learnt), value: 15, method: MethodEWMA, expected: 20},
+		{name: "rolling alone", baseline: warmed(drifted, 3, learnt), value: 25},
+		{name: "rolling and seasonal agree", baseline: warmed(drifted, 10, learnt), value: 25, method: MethodSeasonal, expected: 20},
+		{name: "seasonal slot warming up", baseline: warmed(drifted, 10, learning), value: 25},
+		{name: "seasonal slot of another hour", baseline: warmed(drifted, 11, learnt), value: 25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.baseline.Check(tt.value, at, 4)
+			switch {
+			case tt.method == "" && got != nil:
+				t.Fatalf("Check(%v) = %+v, want nil", tt.value, *got)
+			case tt.method == "":
+			case got == nil:
+				t.Fatalf("Check(%v) = nil, want %s", tt.value, tt.method)
+			case got.Method != tt.method || got.Expected != tt.expected:
+				t.Fatalf("Check(%v) = %+v, want %s expecting %v", tt.value, *got, tt.method, tt.expected)
+			case math.Signbit(got.Score) != (tt.value < tt.expected):
+				t.Fatalf("Check(%v) scored %v on the wrong side of %v", tt.value, got.Score, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLearn(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	constant := func(count int) *Baseline {
+		b := NewBaseline()
+		for i := 0; i < count; i++ {
+			b.Learn(20, at, 4)
+		}
+		return b
+	}
+	_, deviation := warmed(moments{}, 0, moments{}).rolling()
+
+	tests := []struct {
+		name     string
+		baseline *Baseline
+		value    float64
+		want     float64
+	}{
+		{name: "usual value", baseline: warmed(moments{}, 0, moments{}), value: 21, want: 21},
+		{name: "spike clamped", baseline: warmed(moments{}, 0, moments{}), value: 100, want: 20 + 4*deviation},
+		{name: "drop clamped", baseline: warmed(moments{}, 0, moments{}), value: -100, want: 20 - 4*deviation},
+		{name: "spike clamped to the minimum deviation", baseline: constant(warmUp), value: 100, want: 20 + 4*minDeviation},
+		{name: "spike learnt while warming up", baseline: constant(warmUp - 1), value: 100, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := tt.baseline.Count
+			tt.baseline.Learn(tt.value, at, 4)
+			if tt.baseline.Count != count+1 {
+				t.Fatalf("Count = %d, want %d", tt.baseline.Count, count+1)
+			}
+			if got := tt.baseline.Recent[count]; math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("learnt %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLearnNotFinite(t *testing.T) {
+	b := NewBaseline()
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		b.Learn(value, time.Now(), 4)
+	}
+	if b.Count != 0 || len(b.Recent) != 0 || b.EWMA.Count != 0 {
+		t.Fatalf("learnt values that are not finite: %+v", b)
+	}
+}
+
+func TestLearnWraps(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	b := NewBaseline()
+	for i := 0; i < rollingSize+5; i++ {
+		b.Learn(20, at, 4)
+	}
+
+	if len(b.Recent) != rollingSize || b.Next != 5 || b.Count != rollingSize+5 {
+		t.Fatalf("len(Recent) = %d, Next = %d, Count = %d", len(b.Recent), b.Next, b.Count)
+	}
+	if !b.valid() {
+		t.Fatal("baseline not valid after wrapping")
+	}
+	if got := b.Slots[10].Count; got != rollingSize+5 {
+		t.Fatalf("slot 10 learnt %d values, want %d", got, rollingSize+5)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	d := &Detector{
+		baselines: map[baselineKey]*Baseline{
+			{1, "temperature"}:  NewBaseline(),
+			{1, "transparency"}: NewBaseline(),
+			{2, "temperature"}:  NewBaseline(),
+		},
+		dirty: map[baselineKey]bool{{2, "temperature"}: true},
+	}
+
+	d.prune(map[int]bool{1: true, 3: true})
+
+	if len(d.baselines) != 2 || d.baselines[baselineKey{2, "temperature"}] != nil {
+		t.Fatalf("baselines = %v, want those of sensor 1", d.baselines)
+	}
+	if len(d.dirty) != 0 {
+		t.Fatalf("dirty = %v, want none", d.dirty)
+	}
+}
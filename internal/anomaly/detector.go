@@ -0,0 +1,269 @@
+// Package anomaly learns the usual readings of every sensor and flags those that
+// deviate from them, storing them as anomalies in Postgres
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/stream"
+)
+
+// Metrics the baselines are learnt for
+var Metrics = []string{"temperature", "transparency"}
+
+// saveTimeout bounds the save of the baselines when the detector stops
+const saveTimeout = 5 * time.Second
+
+// Detector follows the readings of every tenant and flags those deviating from
+// the baseline of their sensor by the threshold of their group. A single detector
+// must run against a database, the baselines of several would overwrite each other
+type Detector struct {
+	db        *sql.DB
+	hub       *stream.Hub
+	interval  time.Duration
+	threshold float64
+	baselines map[baselineKey]*Baseline
+	dirty     map[baselineKey]bool
+	settings  map[groupKey]repository.AnomalySettings
+	// lastID is the last reading learnt, a new subscription resumes after it
+	lastID int64
+}
+
+// baselineKey is keyed by sensor ID, a sensor re-created under the same code
+// name starts from a new baseline
+type baselineKey struct {
+	sensorID int
+	metric   string
+}
+
+type groupKey struct {
+	tenantID int
+	group    string
+}
+
+// New creates a detector following the readings on hub, threshold being the
+// deviation readings are flagged from in the groups that do not set one. The
+// baselines are saved and the group settings reloaded once per interval
+func New(db *sql.DB, hub *stream.Hub, interval time.Duration, threshold float64) *Detector {
+	return &Detector{db: db, hub: hub, interval: interval, threshold: threshold, dirty: make(map[baselineKey]bool)}
+}
+
+// Run detects anomalies until ctx is done, starting over after an interval when
+// the readings, baselines or settings cannot be read or written
+func (d *Detector) Run(ctx context.Context) error {
+	for {
+		err := d.detect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("anomaly detection", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// detect loads the baselines unless they are, then learns from the live readings
+// until ctx is done or the subscription ends. The baselines are saved on the way out
+func (d *Detector) detect(ctx context.Context) error {
+	if d.baselines == nil {
+		if err := d.load(ctx); err != nil {
+			return err
+		}
+	}
+	if err := d.reload(ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subscription := d.hub.Subscribe(ctx, stream.Filter{AllTenants: true}, d.lastID)
+	defer func() {
+		saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), saveTimeout)
+		defer cancel()
+		if err := d.save(saveCtx); err != nil {
+			slog.Warn("anomaly baselines", "err", err)
+		}
+	}()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case reading, ok := <-subscription.Readings():
+			if !ok {
+				return subscription.Err()
+			}
+			if err := d.observe(ctx, reading); err != nil {
+				return err
+			}
+			// A reading committed late comes after larger ids
+			d.lastID = max(d.lastID, reading.ID)
+
+		case <-ticker.C:
+			if err := d.save(ctx); err != nil {
+				return err
+			}
+			if err := d.reload(ctx); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// observe checks every metric of reading against the baseline of its sensor,
+// stores the anomalies found, then learns the reading. Nothing is learnt unless
+// every anomaly was stored, a reading delivered again is not learnt twice
+func (d *Detector) observe(ctx context.Context, reading repository.Reading) error {
+	settings, ok := d.settings[groupKey{reading.TenantID, reading.Group}]
+	if !ok {
+		settings.Enabled = true
+	}
+	threshold := d.threshold
+	if settings.Threshold != nil {
+		threshold = *settings.Threshold
+	}
+
+	values := make([]float64, len(Metrics))
+	baselines := make([]*Baseline, len(Metrics))
+	for i, metric := range Metrics {
+		value := reading.Temperature
+		if metric == "transparency" {
+			value = float64(reading.Transparency)
+		}
+
+		key := baselineKey{reading.SensorID, metric}
+		baseline, ok := d.baselines[key]
+		if !ok {
+			baseline = NewBaseline()
+			d.baselines[key] = baseline
+		}
+		values[i], baselines[i] = value, baseline
+
+		// A group with detection disabled keeps learning, so enabling it flags
+		// right away
+		if deviation := baseline.Check(value, reading.CreatedAt, threshold); settings.Enabled && deviation != nil {
+			anomaly := repository.Anomaly{
+				TenantID:  reading.TenantID,
+				Group:     reading.Group,
+				CodeName:  reading.CodeName,
+				ReadingID: reading.ID,
+				Metric:    metric,
+				Method:    deviation.Method,
+				Value:     value,
+				Expected:  round(deviation.Expected),
+				Score:     round(deviation.Score),
+				Threshold: threshold,
+				ReadAt:    reading.CreatedAt,
+			}
+			if err := repository.RecordAnomaly(ctx, d.db, &anomaly); err != nil {
+				return err
+			}
+			metrics.ObserveAnomaly(metric)
+			slog.Debug("anomaly", "tenant", reading.TenantID, "sensor", reading.CodeName, "metric", metric, "method", deviation.Method,
+				"value", value, "expected", anomaly.Expected, "score", anomaly.Score)
+		}
+	}
+
+	for i, metric := range Metrics {
+		baselines[i].Learn(values[i], reading.CreatedAt, threshold)
+		d.dirty[baselineKey{reading.SensorID, metric}] = true
+	}
+	return nil
+}
+
+// load reads the stored baselines, those that cannot be decoded start over
+func (d *Detector) load(ctx context.Context) error {
+	stored, err := repository.LoadBaselines(ctx, d.db)
+	if err != nil {
+		return err
+	}
+
+	d.baselines = make(map[baselineKey]*Baseline, len(stored))
+	for _, s := range stored {
+		var baseline Baseline
+		if err := json.Unmarshal(s.State, &baseline); err != nil || !baseline.valid() {
+			slog.Warn("anomaly baseline dropped", "tenant", s.TenantID, "sensor", s.CodeName, "metric", s.Metric)
+			continue
+		}
+		d.baselines[baselineKey{s.SensorID, s.Metric}] = &baseline
+	}
+	return nil
+}
+
+// save stores the baselines that learnt since they were last saved
+func (d *Detector) save(ctx context.Context) error {
+	if len(d.dirty) == 0 {
+		return nil
+	}
+
+	baselines := make([]repository.Baseline, 0, len(d.dirty))
+	for key := range d.dirty {
+		state, err := json.Marshal(d.baselines[key])
+		if err != nil {
+			return err
+		}
+		baselines = append(baselines, repository.Baseline{SensorID: key.sensorID, Metric: key.metric, State: state})
+	}
+	if err := repository.SaveBaselines(ctx, d.db, baselines); err != nil {
+		return err
+	}
+
+	d.dirty = make(map[baselineKey]bool)
+	return nil
+}
+
+// reload reads the settings of the groups and drops the baselines of the
+// sensors deleted meanwhile
+func (d *Detector) reload(ctx context.Context) error {
+	stored, err := repository.ListAnomalySettings(ctx, d.db)
+	if err != nil {
+		return err
+	}
+	sensors, err := repository.ListSensors(ctx, d.db)
+	if err != nil {
+		return err
+	}
+
+	d.settings = make(map[groupKey]repository.AnomalySettings, len(stored))
+	for _, settings := range stored {
+		d.settings[groupKey{settings.TenantID, settings.Group}] = settings
+	}
+
+	ids := make(map[int]bool, len(sensors))
+	for _, sensor := range sensors {
+		ids[sensor.ID] = true
+	}
+	d.prune(ids)
+	return nil
+}
+
+// prune drops the baselines of the sensors missing from ids
+func (d *Detector) prune(ids map[int]bool) {
+	for key := range d.baselines {
+		if !ids[key.sensorID] {
+			delete(d.baselines, key)
+			delete(d.dirty, key)
+		}
+	}
+}
+
+// round keeps the 2 decimals the statistics are served with
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -3,46 +3,97 @@ package app
 import (
 	"context"
 	"time"
+
+	"github.com/sensors/internal/service"
+	"github.com/sensors/internal/tracing"
 )
 
-func (m *MicroserviceServer) GetGroupTransparencyAverage(ctx context.Context, groupName string) (averageTransparency float64, err error) {
+var tracer = tracing.Tracer("app")
+
+func (m *MicroserviceServer) GetGroupTransparencyAverage(ctx context.Context, groupName string) (averageTransparency service.Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetGroupTransparencyAverage")
+	defer func() { tracing.End(span, err) }()
 
 	averageTransparency, err = m.SensorService.GetGroupTransparencyAverage(ctx, groupName)
 	return
 }
 
-func (m *MicroserviceServer) GetGroupTemperatureAverage(ctx context.Context, groupName string) (averageTemperature float64, err error) {
+func (m *MicroserviceServer) GetGroupTemperatureAverage(ctx context.Context, groupName string) (averageTemperature service.Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetGroupTemperatureAverage")
+	defer func() { tracing.End(span, err) }()
 
 	averageTemperature, err = m.SensorService.GetGroupTemperatureAverage(ctx, groupName)
 	return
 }
 
-func (m *MicroserviceServer) GetGroupSpecies(ctx context.Context, groupName string) (speciesList map[string]int, err error) {
+func (m *MicroserviceServer) GetGroupSpecies(ctx context.Context, groupName string) (speciesList service.SpeciesCounts, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetGroupSpecies")
+	defer func() { tracing.End(span, err) }()
 
 	speciesList, err = m.SensorService.GetGroupSpecies(ctx, groupName)
 	return
 }
 
-func (m *MicroserviceServer) GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList map[string]int, err error) {
+func (m *MicroserviceServer) GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList service.SpeciesCounts, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetTopNGroupSpecies")
+	defer func() { tracing.End(span, err) }()
 
 	speciesList, err = m.SensorService.GetTopNGroupSpecies(ctx, groupName, n, from, till)
 	return
 }
 
-func (m *MicroserviceServer) GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature float64, err error) {
+func (m *MicroserviceServer) GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature service.Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetRegionMinTemperature")
+	defer func() { tracing.End(span, err) }()
 
 	minTemperature, err = m.SensorService.GetRegionMinTemperature(ctx, xMin, xMax, yMin, yMax, zMin, zMax)
 	return
 }
 
-func (m *MicroserviceServer) GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature float64, err error) {
+func (m *MicroserviceServer) GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature service.Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetRegionMaxTemperature")
+	defer func() { tracing.End(span, err) }()
 
 	maxTemperature, err = m.SensorService.GetRegionMaxTemperature(ctx, xMin, xMax, yMin, yMax, zMin, zMax)
 	return
 }
 
-func (m *MicroserviceServer) GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from, till time.Time) (averageTemperature float64, err error) {
+func (m *MicroserviceServer) GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from time.Time, till *time.Time) (averageTemperature service.Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.GetCodeNameTemperatureAverage")
+	defer func() { tracing.End(span, err) }()
 
 	averageTemperature, err = m.SensorService.GetCodeNameTemperatureAverage(ctx, codeName, from, till)
 	return
 }
+
+func (m *MicroserviceServer) CreateGroup(ctx context.Context, name string) (group service.Group, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.CreateGroup")
+	defer func() { tracing.End(span, err) }()
+
+	group, err = m.SensorService.CreateGroup(ctx, name)
+	return
+}
+
+func (m *MicroserviceServer) CreateSensor(ctx context.Context, groupName string, sensor service.Sensor) (created service.Sensor, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.CreateSensor")
+	defer func() { tracing.End(span, err) }()
+
+	created, err = m.SensorService.CreateSensor(ctx, groupName, sensor)
+	return
+}
+
+func (m *MicroserviceServer) UpdateSensor(ctx context.Context, codeName string, patch service.SensorPatch) (updated service.Sensor, err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.UpdateSensor")
+	defer func() { tracing.End(span, err) }()
+
+	updated, err = m.SensorService.UpdateSensor(ctx, codeName, patch)
+	return
+}
+
+func (m *MicroserviceServer) DeleteSensor(ctx context.Context, codeName string) (err error) {
+	ctx, span := tracer.Start(ctx, "MicroserviceServer.DeleteSensor")
+	defer func() { tracing.End(span, err) }()
+
+	err = m.SensorService.DeleteSensor(ctx, codeName)
+	return
+}
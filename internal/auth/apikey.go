@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/sensors/internal/repository"
+)
+
+// keyPrefix starts every API key so it can be told apart from a JWT
+const keyPrefix = "sens_"
+
+// IsAPIKey reports whether token looks like an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, keyPrefix)
+}
+
+// HashKey returns the hash a key is stored by. Keys are random 256 bit strings,
+// so a plain SHA-256 is as good as a slow password hash for them
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueKey creates a key of tenantID, nil for a platform key, called name with
+// scopes on behalf of actor. The key is only ever returned here, the database only
+// keeps its hash and a prefix to recognize it by
+func IssueKey(ctx context.Context, db *sql.DB, actor repository.Actor, tenantID *int, name string, scopes []string) (string, repository.APIKey, error) {
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return "", repository.APIKey{}, fmt.Errorf("invalid scope %q, want admin, read:<group> or write:<group>", scope)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", repository.APIKey{}, err
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	prefix := key[:len(keyPrefix)+6]
+
+	stored, err := repository.CreateAPIKey(ctx, db, actor, tenantID, name, prefix, HashKey(key), scopes)
+	if err != nil {
+		return "", repository.APIKey{}, err
+	}
+	return key, stored, nil
+}
@@ -0,0 +1,122 @@
+// Package auth authenticates API callers and tells which sensor groups they may
+// read or write
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+// Action is what a caller does to a sensor group
+type Action string
+
+const (
+	Read  Action = "read"
+	Write Action = "write"
+)
+
+// AllGroups stands for every sensor group, in scopes and in authorization checks
+// spanning groups such as region queries
+const AllGroups = "*"
+
+// ScopeAdmin grants every action on every group and the key management
+const ScopeAdmin = "admin"
+
+// Authentication methods
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	MethodNone   = "none"
+)
+
+// Principal is an authenticated caller. Scopes are "admin" or "<action>:<group>",
+// the group being a name or * for every group of the tenant of the principal. A
+// principal without tenant is a platform principal, its scopes apply to every tenant
+type Principal struct {
+	// ID tells principals apart across requests, empty for Anonymous and System
+	ID      string   `json:"-"`
+	Subject string   `json:"subject"`
+	Method  string   `json:"method"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Scopes  []string `json:"scopes"`
+}
+
+// Anonymous is the principal of every request when authentication is disabled
+var Anonymous = &Principal{Subject: "anonymous", Method: MethodNone, Scopes: []string{ScopeAdmin}}
+
+// System is the principal of the work the service does on its own behalf
+var System = &Principal{Subject: "system", Method: MethodNone, Scopes: []string{ScopeAdmin}}
+
+// CanAccessTenant reports whether p may act on the groups of tenant
+func (p *Principal) CanAccessTenant(tenant string) bool {
+	return p.Tenant == "" || p.Tenant == tenant
+}
+
+// IsAdmin reports whether p may manage keys
+func (p *Principal) IsAdmin() bool {
+	for _, scope := range p.Scopes {
+		if scope == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether p may apply action to group, AllGroups requiring a wildcard scope
+func (p *Principal) Can(action Action, group string) bool {
+	for _, scope := range p.Scopes {
+		if scope == ScopeAdmin {
+			return true
+		}
+		scopeAction, scopeGroup, ok := strings.Cut(scope, ":")
+		if !ok || Action(scopeAction) != action {
+			continue
+		}
+		if scopeGroup == AllGroups || (group != AllGroups && scopeGroup == group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups returns the groups p may apply action to, all being true when it may
+// apply it to every group
+func (p *Principal) Groups(action Action) (groups []string, all bool) {
+	groups = []string{}
+	for _, scope := range p.Scopes {
+		if scope == ScopeAdmin {
+			return nil, true
+		}
+		scopeAction, scopeGroup, ok := strings.Cut(scope, ":")
+		if !ok || Action(scopeAction) != action {
+			continue
+		}
+		if scopeGroup == AllGroups {
+			return nil, true
+		}
+		groups = append(groups, scopeGroup)
+	}
+	return groups, false
+}
+
+// ValidScope reports whether scope is admin or <read|write>:<group>
+func ValidScope(scope string) bool {
+	if scope == ScopeAdmin {
+		return true
+	}
+	action, group, ok := strings.Cut(scope, ":")
+	return ok && (Action(action) == Read || Action(action) == Write) && group != ""
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of ctx, nil when the caller is unknown
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
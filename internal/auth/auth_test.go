@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	// The hex SHA-256 of the key, as the keys issued so far are stored by it
+	if got, want := HashKey("sens_test"), "5c7c4c1d12d50bd3cffb77658f0ea72629d61658533a35359a9ece6361f49acd"; got != want {
+		t.Errorf("HashKey() = %q, want %q", got, want)
+	}
+	if HashKey("sens_test") == HashKey("sens_tesT") {
+		t.Error("two keys share a hash")
+	}
+}
+
+func TestIsAPIKey(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{token: "sens_abcdef", want: true},
+		{token: "eyJhbGciOiJSUzI1NiJ9.e30.sig"},
+		{token: "SENS_abcdef"},
+		{token: ""},
+	}
+	for _, tt := range tests {
+		if got := IsAPIKey(tt.token); got != tt.want {
+			t.Errorf("IsAPIKey(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{scope: "admin", want: true},
+		{scope: "read:reef", want: true},
+		{scope: "write:*", want: true},
+		{scope: "read:"},
+		{scope: "delete:reef"},
+		{scope: "read"},
+		{scope: "openid"},
+	}
+	for _, tt := range tests {
+		if got := ValidScope(tt.scope); got != tt.want {
+			t.Errorf("ValidScope(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		action Action
+		group  string
+		want   bool
+	}{
+		{name: "read own group", scopes: []string{"read:reef"}, action: Read, group: "reef", want: true},
+		{name: "read other group", scopes: []string{"read:reef"}, action: Read, group: "lagoon"},
+		{name: "write with read", scopes: []string{"read:reef"}, action: Write, group: "reef"},
+		{name: "read with write", scopes: []string{"write:reef"}, action: Read, group: "reef"},
+		{name: "write own group", scopes: []string{"read:reef", "write:reef"}, action: Write, group: "reef", want: true},
+		{name: "wildcard", scopes: []string{"read:*"}, action: Read, group: "lagoon", want: true},
+		{name: "every group with wildcard", scopes: []string{"read:*"}, action: Read, group: AllGroups, want: true},
+		{name: "every group with one", scopes: []string{"read:reef"}, action: Read, group: AllGroups},
+		{name: "write wildcard does not read", scopes: []string{"write:*"}, action: Read, group: "reef"},
+		{name: "admin", scopes: []string{ScopeAdmin}, action: Write, group: AllGroups, want: true},
+		{name: "no scope", action: Read, group: "reef"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Principal{Scopes: tt.scopes}
+			if got := p.Can(tt.action, tt.group); got != tt.want {
+				t.Errorf("Can(%s, %q) = %v, want %v", tt.action, tt.group, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		action  Action
+		want    []string
+		wantAll bool
+	}{
+		{name: "some", scopes: []string{"read:reef", "write:lagoon", "read:bay"}, action: Read, want: []string{"reef", "bay"}},
+		{name: "none", scopes: []string{"write:lagoon"}, action: Read, want: []string{}},
+		{name: "wildcard", scopes: []string{"read:reef", "read:*"}, action: Read, wantAll: true},
+		{name: "admin", scopes: []string{ScopeAdmin}, action: Write, wantAll: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, all := (&Principal{Scopes: tt.scopes}).Groups(tt.action)
+			if all != tt.wantAll || (!all && !reflect.DeepEqual(groups, tt.want)) {
+				t.Errorf("Groups(%s) = %v, %v, want %v, %v", tt.action, groups, all, tt.want, tt.wantAll)
+			}
+		})
+	}
+}
+
+func TestCanAccessTenant(t *testing.T) {
+	acme := &Principal{Tenant: "acme"}
+	platform := &Principal{}
+	if !acme.CanAccessTenant("acme") || acme.CanAccessTenant("globex") {
+		t.Error("a tenant principal must only access its tenant")
+	}
+	if !platform.CanAccessTenant("globex") {
+		t.Error("a platform principal must access every tenant")
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sensors/internal/repository"
+)
+
+// Authentication errors
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// AccessTokenParam is the query parameter carrying a bearer token when the
+// client cannot set headers
+const AccessTokenParam = "access_token"
+
+// Authenticator tells who sent a request, from an API key in the X-API-Key header
+// or a bearer token, which is either an API key or a JWT, given in the
+// Authorization header or the access_token query parameter
+type Authenticator struct {
+	db  *sql.DB
+	jwt *JWTVerifier
+}
+
+// NewAuthenticator checks API keys against db and JWTs with verifier, JWTs are
+// refused when verifier is nil
+func NewAuthenticator(db *sql.DB, verifier *JWTVerifier) *Authenticator {
+	return &Authenticator{db: db, jwt: verifier}
+}
+
+// Authenticate returns the principal of r, ErrNoCredentials when it has none and
+// an error wrapping ErrInvalidCredentials when they are wrong. Other errors come
+// from the database
+func (a *Authenticator) Authenticate(ctx context.Context, r *http.Request) (*Principal, error) {
+	token := r.Header.Get("X-API-Key")
+	if token == "" {
+		scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(credentials)
+		}
+	}
+	// Browsers cannot set headers on EventSource and WebSocket requests
+	if token == "" {
+		token = r.URL.Query().Get(AccessTokenParam)
+	}
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	if IsAPIKey(token) {
+		key, err := repository.APIKeyByHash(ctx, a.db, HashKey(token))
+		if errors.Is(err, repository.ErrAPIKeyNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{ID: "key:" + strconv.Itoa(key.ID), Subject: key.Name, Method: MethodAPIKey, Tenant: key.Tenant, Scopes: key.Scopes}, nil
+	}
+
+	if a.jwt == nil {
+		return nil, ErrInvalidCredentials
+	}
+	principal, err := a.jwt.Verify(token)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidCredentials, err)
+	}
+	return principal, nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sensors/internal/repository"
+)
+
+func TestAuthenticateWithoutDatabase(t *testing.T) {
+	a := NewAuthenticator(nil, nil)
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		query   string
+		wantErr error
+	}{
+		{name: "no credentials", wantErr: ErrNoCredentials},
+		{name: "other scheme", header: "Authorization", value: "Basic dXNlcjpwYXNz", wantErr: ErrNoCredentials},
+		{name: "jwt without verifier", header: "Authorization", value: "Bearer eyJhbGciOiJSUzI1NiJ9.e30.sig", wantErr: ErrInvalidCredentials},
+		{name: "jwt in the query without verifier", query: "?access_token=eyJhbGciOiJSUzI1NiJ9.e30.sig", wantErr: ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/group/reef/species"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if _, err := a.Authenticate(context.Background(), r); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestAuthenticateAPIKey issues and revokes a key in the database at
+// TEST_DATABASE_URL, it is skipped when unset
+func TestAuthenticateAPIKey(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := repository.NewDBFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := repository.CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	actor := repository.Actor{Subject: "test", Method: MethodNone}
+	key, stored, err := IssueKey(ctx, db, actor, nil, "test", []string{"read:reef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator(db, nil)
+
+	for _, header := range []string{"X-API-Key", "Authorization"} {
+		r := httptest.NewRequest("GET", "/api/v1/group/reef/species", nil)
+		value := key
+		if header == "Authorization" {
+			value = "Bearer " + key
+		}
+		r.Header.Set(header, value)
+		principal, err := a.Authenticate(ctx, r)
+		if err != nil || principal.Subject != "test" || !principal.Can(Read, "reef") || principal.Can(Write, "reef") {
+			t.Errorf("key in %s = %+v, %v, want a principal reading reef", header, principal, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/group/reef/species", nil)
+	r.Header.Set("X-API-Key", key+"x")
+	if _, err := a.Authenticate(ctx, r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown key error = %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	if err := repository.RevokeAPIKey(ctx, db, actor, nil, stored.ID); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/api/v1/group/reef/species", nil)
+	r.Header.Set("X-API-Key", key)
+	if _, err := a.Authenticate(ctx, r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("revoked key error = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
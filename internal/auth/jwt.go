@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sensors/internal/repository"
+)
+
+// JWKS holds the public keys JWTs are verified with, by key ID
+type JWKS struct {
+	keys map[string]crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads the RSA and EC public keys of the JSON Web Key Set at path
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	jwks := &JWKS{keys: make(map[string]crypto.PublicKey)}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q of %s: %w", key.Kid, path, err)
+		}
+		jwks.keys[key.Kid] = publicKey
+	}
+	if len(jwks.keys) == 0 {
+		return nil, fmt.Errorf("no signing key in %s", path)
+	}
+
+	return jwks, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWTVerifier checks bearer tokens signed by one of the keys of a JWKS
+type JWTVerifier struct {
+	jwks     *JWKS
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifier creates a verifier, issuer and audience are only checked when set
+func NewJWTVerifier(jwks *JWKS, issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{jwks: jwks, issuer: issuer, audience: audience}
+}
+
+// claims are the registered claims plus the tenant and the scopes, given either
+// as an OAuth 2 space separated "scope" or as a "scopes" array
+type claims struct {
+	jwt.RegisteredClaims
+	Tenant string   `json:"tenant"`
+	Scope  string   `json:"scope"`
+	Scopes []string `json:"scopes"`
+}
+
+// Verify checks the signature, expiry, issuer and audience of token and returns
+// the principal it describes
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := v.jwks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	scopes := append(strings.Fields(c.Scope), c.Scopes...)
+	valid := scopes[:0]
+	for _, scope := range scopes {
+		// Tokens may carry scopes meant for other services
+		if ValidScope(scope) {
+			valid = append(valid, scope)
+		}
+	}
+
+	// Platform principals are API keys only, a token without tenant claim acts
+	// on the default tenant
+	tenant := c.Tenant
+	if tenant == "" {
+		tenant = repository.DefaultTenant
+	}
+
+	return &Principal{ID: "jwt:" + tenant + ":" + c.Subject, Subject: c.Subject, Method: MethodJWT, Tenant: tenant, Scopes: valid}, nil
+}
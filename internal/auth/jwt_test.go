@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// sign returns a token of claims signed with key under kid
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := &JWKS{keys: map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey}}
+	verifier := NewJWTVerifier(jwks, "https://issuer.example", "sensors")
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{"sub": "alice", "iss": "https://issuer.example", "aud": "sensors", "exp": exp, "tenant": "acme", "scope": "read:reef"}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *Principal
+		wantErr bool
+	}{
+		{name: "rsa", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(nil)),
+			want: &Principal{ID: "jwt:acme:alice", Subject: "alice", Method: MethodJWT, Tenant: "acme", Scopes: []string{"read:reef"}}},
+		{name: "ec", token: sign(t, jwt.SigningMethodES256, ecKey, "ec", valid(nil)),
+			want: &Principal{ID: "jwt:acme:alice", Subject: "alice", Method: MethodJWT, Tenant: "acme", Scopes: []string{"read:reef"}}},
+		{name: "scopes array and foreign scopes", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"scope": "openid read:reef", "scopes": []string{"write:reef", "profile"}})),
+			want: &Principal{ID: "jwt:acme:alice", Subject: "alice", Method: MethodJWT, Tenant: "acme", Scopes: []string{"read:reef", "write:reef"}}},
+		{name: "default tenant", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"tenant": nil})),
+			want: &Principal{ID: "jwt:default:alice", Subject: "alice", Method: MethodJWT, Tenant: "default", Scopes: []string{"read:reef"}}},
+		{name: "expired", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), wantErr: true},
+		{name: "without expiry", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"exp": nil})), wantErr: true},
+		{name: "not yet valid", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()})), wantErr: true},
+		{name: "hmac", token: sign(t, jwt.SigningMethodHS256, []byte("secret"), "rsa", valid(nil)), wantErr: true},
+		{name: "none", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "rsa", valid(nil)), wantErr: true},
+		{name: "unknown kid", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rotated", valid(nil)), wantErr: true},
+		{name: "without kid", token: sign(t, jwt.SigningMethodRS256, rsaKey, "", valid(nil)), wantErr: true},
+		{name: "other key", token: sign(t, jwt.SigningMethodRS256, otherKey, "rsa", valid(nil)), wantErr: true},
+		{name: "key of another type", token: sign(t, jwt.SigningMethodES256, ecKey, "rsa", valid(nil)), wantErr: true},
+		{name: "wrong issuer", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"iss": "https://evil.example"})), wantErr: true},
+		{name: "wrong audience", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"aud": "billing"})), wantErr: true},
+		{name: "without subject", token: sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid(jwt.MapClaims{"sub": nil})), wantErr: true},
+		{name: "garbage", token: "not.a.token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifier.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Verify() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+
+	write := func(keys ...map[string]string) string {
+		data, err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rsaJWK := map[string]string{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))}
+	ecJWK := map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)}
+	encJWK := map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))}
+
+	jwks, err := LoadJWKS(write(rsaJWK, ecJWK, encJWK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.keys) != 2 || !rsaKey.PublicKey.Equal(jwks.keys["rsa"]) || !ecKey.PublicKey.Equal(jwks.keys["ec"]) {
+		t.Errorf("keys = %v, want the rsa and ec signing keys", jwks.keys)
+	}
+
+	tests := []struct {
+		name string
+		keys []map[string]string
+	}{
+		{name: "no signing key", keys: []map[string]string{encJWK}},
+		{name: "unsupported curve", keys: []map[string]string{{"kty": "EC", "kid": "ec", "crv": "P-192", "x": "AA", "y": "AA"}}},
+		{name: "unsupported type", keys: []map[string]string{{"kty": "oct", "kid": "hmac"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadJWKS(write(tt.keys...)); err == nil {
+				t.Error("LoadJWKS() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+// Package config holds the command line flags shared by the commands
+package config
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/api"
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/generator"
+	"github.com/sensors/internal/health"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/ratelimit"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/retry"
+	"github.com/sensors/internal/service"
+	"github.com/sensors/internal/simulator"
+	"github.com/sensors/internal/tracing"
+	"github.com/sensors/internal/webhook"
+)
+
+// Log holds the logging flags
+type Log struct {
+	Level  string
+	Format string
+}
+
+func (c *Log) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Level, "log-level", "info", "minimum level logged: debug, info, warn or error")
+	fs.StringVar(&c.Format, "log-format", logging.FormatText, "log format: text or json")
+}
+
+// Setup makes the logger the flags describe the default one, the standard log
+// package included
+func (c *Log) Setup() error {
+	logger, err := logging.New(os.Stderr, c.Level, c.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Tracing holds the OpenTelemetry flags
+type Tracing struct {
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+}
+
+func (c *Tracing) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Exporter, "trace-exporter", tracing.ExporterNone, "where spans are sent: none, stdout or otlp")
+	fs.StringVar(&c.Endpoint, "otlp-endpoint", "localhost:4318", "host:port of the OTLP/HTTP collector")
+	fs.BoolVar(&c.Insecure, "otlp-insecure", true, "talk plain HTTP to the OTLP collector")
+	fs.Float64Var(&c.SampleRatio, "trace-sample-ratio", 1, "share of the traces started by this process that are recorded")
+}
+
+// Setup installs the tracer provider of the service called name, the returned
+// function flushes the spans on shutdown
+func (c *Tracing) Setup(ctx context.Context, name string) (func(context.Context) error, error) {
+	return tracing.Setup(ctx, name, tracing.Config{
+		Exporter:    c.Exporter,
+		Endpoint:    c.Endpoint,
+		Insecure:    c.Insecure,
+		SampleRatio: c.SampleRatio,
+	})
+}
+
+// Database holds the PostgreSQL flags
+type Database struct {
+	URL string
+}
+
+func (c *Database) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.URL, "db", repository.DefaultDatabaseURL(), "PostgreSQL connection URL")
+}
+
+func (c *Database) Open() (*sql.DB, error) {
+	return repository.NewDBFromURL(c.URL)
+}
+
+// Redis holds the Redis flags
+type Redis struct {
+	Addr string
+}
+
+func (c *Redis) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "redis", repository.DefaultRedisAddr, "Redis address")
+}
+
+func (c *Redis) Open() *redis.Client {
+	return repository.NewClientFromAddr(c.Addr)
+}
+
+// API holds the HTTP server flags
+type API struct {
+	Addr string
+}
+
+func (c *API) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", api.DefaultAddr, "address the HTTP API listens on")
+}
+
+// Auth holds the authentication flags of the API
+type Auth struct {
+	Enabled  bool
+	JWKSFile string
+	Issuer   string
+	Audience string
+}
+
+func (c *Auth) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Enabled, "auth", true, "require an API key or a JWT on every API request")
+	fs.StringVar(&c.JWKSFile, "jwks-file", "", "path to the JSON Web Key Set JWTs are verified with, JWTs are refused when empty")
+	fs.StringVar(&c.Issuer, "jwt-issuer", "", "issuer JWTs must carry, not checked when empty")
+	fs.StringVar(&c.Audience, "jwt-audience", "", "audience JWTs must carry, not checked when empty")
+}
+
+// Options returns the API options authenticating requests against db and serving
+// the key management, none when authentication is disabled
+func (c *Auth) Options(db *sql.DB) ([]api.Option, error) {
+	if !c.Enabled {
+		slog.Warn("authentication disabled, every request has full access")
+		return nil, nil
+	}
+
+	var verifier *auth.JWTVerifier
+	if c.JWKSFile != "" {
+		jwks, err := auth.LoadJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		verifier = auth.NewJWTVerifier(jwks, c.Issuer, c.Audience)
+	}
+
+	return []api.Option{
+		api.WithAuth(auth.NewAuthenticator(db, verifier)),
+		api.WithKeys(service.NewKeyService(db)),
+		api.WithTenants(service.NewTenantService(db)),
+	}, nil
+}
+
+// RateLimit holds the request quota flags of the API
+type RateLimit struct {
+	Quotas         string
+	TrustedProxies string
+}
+
+func (c *RateLimit) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Quotas, "rate-limits", ratelimit.DefaultQuotas,
+		"request quotas per client and route class (read, region, write, admin) and per IP address (ip) as <class>=<limit>/<s|m|h>[:<burst>], comma separated, disabled when empty")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "",
+		"addresses and CIDR ranges of the reverse proxies whose Forwarded and X-Forwarded-For headers identify the client, comma separated, none when empty")
+}
+
+// Options returns the API options enforcing the quotas in Redis, none when they
+// are disabled
+func (c *RateLimit) Options(redisClient *redis.Client) ([]api.Option, error) {
+	quotas, err := ratelimit.ParseQuotas(c.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+	proxies, err := api.ParseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return []api.Option{api.WithRateLimit(ratelimit.New(redisClient, quotas)), api.WithTrustedProxies(proxies)}, nil
+}
+
+// Health holds the flags of the health endpoint of the commands without an API
+type Health struct {
+	Addr string
+}
+
+func (c *Health) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "health-addr", "", "address serving /healthz, /readyz and /metrics, disabled when empty")
+}
+
+// Freshness holds how long the components may go without succeeding before
+// the readiness report flags them as stale
+type Freshness struct {
+	GeneratorMaxAge  time.Duration
+	AggregatorMaxAge time.Duration
+}
+
+func (c *Freshness) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.GeneratorMaxAge, "generator-max-age", 5*time.Minute, "time since the last reading was written after which the generator is stale")
+	fs.DurationVar(&c.AggregatorMaxAge, "aggregator-max-age", 5*time.Minute, "time since the last aggregation after which the aggregator is stale")
+}
+
+// Generator reports the generator freshness
+func (c *Freshness) Generator() health.Option {
+	return health.WithFreshness(repository.HeartbeatGenerator, c.GeneratorMaxAge)
+}
+
+// Aggregator reports the aggregator freshness
+func (c *Freshness) Aggregator() health.Option {
+	return health.WithFreshness(repository.HeartbeatAggregator, c.AggregatorMaxAge)
+}
+
+// Exporter holds the flags of the sensor readings exporter
+type Exporter struct {
+	Addr    string
+	Window  time.Duration
+	Timeout time.Duration
+}
+
+func (c *Exporter) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", ":9101", "address serving /metrics, /healthz and /readyz")
+	fs.DurationVar(&c.Window, "species-window", time.Hour, "species seen longer than this before the last reading of a sensor are no longer exported")
+	fs.DurationVar(&c.Timeout, "scrape-timeout", 10*time.Second, "time allowed to read the latest readings on every scrape")
+}
+
+// Aggregator holds the aggregation flags
+type Aggregator struct {
+	Interval time.Duration
+}
+
+func (c *Aggregator) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "aggregation-interval", time.Minute, "time between two aggregations of the group statistics")
+}
+
+// Alerts holds the alert evaluation flags
+type Alerts struct {
+	Interval time.Duration
+}
+
+func (c *Alerts) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "alert-interval", 10*time.Second, "time between two evaluations of an alert rule, rule changes apply within it")
+}
+
+// Anomalies holds the anomaly detection flags
+type Anomalies struct {
+	Interval  time.Duration
+	Threshold float64
+}
+
+func (c *Anomalies) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "anomaly-interval", time.Minute, "time between two saves of the anomaly baselines, group setting changes apply within it")
+	fs.Float64Var(&c.Threshold, "anomaly-threshold", 3, "deviation from the baseline, in standard deviations, readings are flagged from in the groups that do not set one")
+}
+
+// Watchdog holds the sensor health flags
+type Watchdog struct {
+	Interval time.Duration
+}
+
+func (c *Watchdog) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "watchdog-interval", time.Minute, "time between two checks of the health of every sensor")
+}
+
+// Webhooks holds the webhook delivery flags
+type Webhooks struct {
+	Interval    time.Duration
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+func (c *Webhooks) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "webhook-interval", 2*time.Second, "time between two looks for due webhook deliveries")
+	fs.DurationVar(&c.Timeout, "webhook-timeout", 10*time.Second, "longest wait for a webhook receiver to reply")
+	fs.IntVar(&c.MaxAttempts, "webhook-attempts", webhook.DefaultBackoff().MaxAttempts, "attempts of a webhook delivery before it is moved to the dead letters")
+}
+
+// Backoff returns the waits between the attempts of a delivery the flags describe
+func (c *Webhooks) Backoff() retry.Backoff {
+	backoff := webhook.DefaultBackoff()
+	backoff.MaxAttempts = c.MaxAttempts
+	return backoff
+}
+
+// Writer holds the batch writer flags
+type Writer struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxBuffered   int
+}
+
+func (c *Writer) RegisterFlags(fs *flag.FlagSet) {
+	defaults := repository.DefaultWriterConfig()
+	fs.IntVar(&c.BatchSize, "write-batch-size", defaults.BatchSize, "number of readings loaded per COPY")
+	fs.DurationVar(&c.FlushInterval, "write-flush-interval", defaults.FlushInterval, "longest time a reading waits before being written")
+	fs.IntVar(&c.MaxBuffered, "write-buffer", defaults.MaxBuffered, "readings buffered in memory before generation blocks")
+}
+
+// Config returns the writer settings the flags describe
+func (c *Writer) Config() repository.WriterConfig {
+	cfg := repository.DefaultWriterConfig()
+	cfg.BatchSize = c.BatchSize
+	cfg.FlushInterval = c.FlushInterval
+	cfg.MaxBuffered = c.MaxBuffered
+	return cfg
+}
+
+// Simulator holds the data generation flags
+type Simulator struct {
+	GeneratorConfig    string
+	Topology           string
+	Seed               int64
+	SimulationStart    string
+	SimulationDuration time.Duration
+	Writer             Writer
+}
+
+func (c *Simulator) RegisterFlags(fs *flag.FlagSet) {
+	c.Writer.RegisterFlags(fs)
+	fs.StringVar(&c.GeneratorConfig, "generator-config", "", "path to a JSON file selecting the data generator models")
+	fs.StringVar(&c.Topology, "topology", "", "path to a JSON topology file, defaults to the alpha, beta and gamma groups")
+	fs.Int64Var(&c.Seed, "seed", 0, "seed for the data generator, a non zero seed runs a reproducible simulation on a simulated clock")
+	fs.StringVar(&c.SimulationStart, "simulation-start", "2024-01-01T00:00:00Z", "RFC 3339 start time of the simulated clock")
+	fs.DurationVar(&c.SimulationDuration, "simulation-duration", 24*time.Hour, "simulated time a seeded run covers before it stops")
+}
+
+// Load reads the files the flags point to
+func (c *Simulator) Load() (simulator.Config, error) {
+	cfg := simulator.Config{
+		Generator: generator.DefaultConfig(),
+		Topology:  generator.DefaultTopology(),
+		Seed:      c.Seed,
+		Writer:    c.Writer.Config(),
+	}
+
+	var err error
+	if c.GeneratorConfig != "" {
+		if cfg.Generator, err = generator.LoadConfig(c.GeneratorConfig); err != nil {
+			return cfg, err
+		}
+	}
+	if c.Topology != "" {
+		if cfg.Topology, err = generator.LoadTopology(c.Topology); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.SimulationStart, err = time.Parse(time.RFC3339, c.SimulationStart); err != nil {
+		return cfg, err
+	}
+	if c.SimulationDuration <= 0 {
+		return cfg, fmt.Errorf("simulation duration must be positive, got %s", c.SimulationDuration)
+	}
+	cfg.SimulationEnd = cfg.SimulationStart.Add(c.SimulationDuration)
+
+	return cfg, nil
+}
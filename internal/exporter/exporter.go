@@ -0,0 +1,113 @@
+// Package exporter publishes the latest sensor readings as Prometheus gauges
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sensors/internal/repository"
+)
+
+const namespace = "sensors"
+
+var (
+	temperatureDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "temperature_celsius"),
+		"Temperature of the last reading of a sensor.",
+		[]string{"tenant", "group", "sensor"}, nil,
+	)
+	transparencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "transparency_percent"),
+		"Transparency of the last reading of a sensor.",
+		[]string{"tenant", "group", "sensor"}, nil,
+	)
+	lastReadingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "last_reading_timestamp_seconds"),
+		"Time of the last reading of a sensor.",
+		[]string{"tenant", "group", "sensor"}, nil,
+	)
+	sensorSpeciesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "species_count"),
+		"Last count of a species seen by a sensor.",
+		[]string{"tenant", "group", "sensor", "species"}, nil,
+	)
+	groupSpeciesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "group", "species_count"),
+		"Sum over the sensors of a group of the last count of a species.",
+		[]string{"tenant", "group", "species"}, nil,
+	)
+	upDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "up"),
+		"Whether the last readings could be read from the database.",
+		nil, nil,
+	)
+)
+
+// Exporter is a prometheus.Collector reading the last rows of sensor_data on
+// every scrape, so the gauges are never older than the database
+type Exporter struct {
+	db      *sql.DB
+	window  time.Duration
+	timeout time.Duration
+}
+
+// New creates an exporter, species seen more than window before the last reading
+// of a sensor are no longer reported for it
+func New(db *sql.DB, window, timeout time.Duration) *Exporter {
+	return &Exporter{db: db, window: window, timeout: timeout}
+}
+
+// Describe implements prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- temperatureDesc
+	ch <- transparencyDesc
+	ch <- lastReadingDesc
+	ch <- sensorSpeciesDesc
+	ch <- groupSpeciesDesc
+	ch <- upDesc
+}
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	if err := e.collect(ctx, ch); err != nil {
+		slog.Error("exporter scrape", "err", err)
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1)
+}
+
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	readings, err := repository.LatestReadings(ctx, e.db)
+	if err != nil {
+		return err
+	}
+	counts, err := repository.LatestSpeciesCounts(ctx, e.db, e.window)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range readings {
+		ch <- prometheus.MustNewConstMetric(temperatureDesc, prometheus.GaugeValue, r.Temperature, r.Tenant, r.Group, r.Sensor)
+		ch <- prometheus.MustNewConstMetric(transparencyDesc, prometheus.GaugeValue, float64(r.Transparency), r.Tenant, r.Group, r.Sensor)
+		ch <- prometheus.MustNewConstMetric(lastReadingDesc, prometheus.GaugeValue, float64(r.CreatedAt.Unix()), r.Tenant, r.Group, r.Sensor)
+	}
+
+	type groupSpecies struct{ tenant, group, species string }
+	totals := make(map[groupSpecies]int)
+	for _, c := range counts {
+		ch <- prometheus.MustNewConstMetric(sensorSpeciesDesc, prometheus.GaugeValue, float64(c.Count), c.Tenant, c.Group, c.Sensor, c.Species)
+		totals[groupSpecies{c.Tenant, c.Group, c.Species}] += c.Count
+	}
+	for key, total := range totals {
+		ch <- prometheus.MustNewConstMetric(groupSpeciesDesc, prometheus.GaugeValue, float64(total), key.tenant, key.group, key.species)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package generator
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells the generator what time it is and lets it wait for the next reading
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d to elapse or ctx to be done, whichever comes first
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// SystemClock reports the wall clock time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SimulatedClock only moves when advanced, so generated timestamps do not depend
+// on how fast the generator runs. Sleeping advances it instantly
+type SimulatedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *SimulatedClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Advance(d)
+	return nil
+}
+
+// NewRand returns the RNG shared by all the models, a zero seed picks a random one
+func NewRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
@@ -0,0 +1,367 @@
+package generator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// FaultKind names a kind of sensor fault
+type FaultKind string
+
+const (
+	// FaultStuck repeats the last reading taken before the fault started
+	FaultStuck FaultKind = "stuck"
+	// FaultSpike adds +/-Magnitude to the metric
+	FaultSpike FaultKind = "spike"
+	// FaultDrift adds an offset growing by Magnitude per hour since the fault started
+	FaultDrift FaultKind = "drift"
+	// FaultDropout drops the reading
+	FaultDropout FaultKind = "dropout"
+	// FaultDuplicate emits the reading twice with the same timestamp
+	FaultDuplicate FaultKind = "duplicate"
+	// FaultOutOfOrder moves the timestamp up to Magnitude seconds into the past
+	FaultOutOfOrder FaultKind = "out_of_order"
+	// FaultCorrupt replaces the metric with an impossible value. Values stay
+	// finite, NaN and infinities cannot be encoded as JSON
+	FaultCorrupt FaultKind = "corrupt"
+)
+
+// Metrics a fault can target
+const (
+	MetricTemperature  = "temperature"
+	MetricTransparency = "transparency"
+	MetricSpecies      = "species"
+)
+
+// Duration is a time.Duration written as a string such as "90s" or "1h30m" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Fault describes a fault injected into the readings of some sensors
+type Fault struct {
+	Kind FaultKind `json:"kind"`
+	// Sensors and Groups select the affected sensors by codename and group name,
+	// leaving both empty affects every sensor
+	Sensors []string `json:"sensors"`
+	Groups  []string `json:"groups"`
+	// Tenant restricts the fault to the sensors of a tenant, codenames and group
+	// names being unique per tenant only. Empty selects them in every tenant
+	Tenant string `json:"tenant"`
+	// Metric is the value altered by spike, drift and corrupt faults, temperature by default
+	Metric string `json:"metric"`
+	// Start and End bound when the fault is active, zero values leave the window open
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Every repeats the fault, keeping it active for For at the start of every period
+	Every Duration `json:"every"`
+	For   Duration `json:"for"`
+	// Probability is the chance an active fault alters a reading, between 0 and 1
+	// and 1 when unset
+	Probability float64 `json:"probability"`
+	// Magnitude sizes spike, drift and out of order faults, it may not be negative
+	Magnitude float64 `json:"magnitude"`
+}
+
+// Validate reports configuration mistakes
+func (f Fault) Validate() error {
+	switch f.Kind {
+	case FaultStuck, FaultSpike, FaultDrift, FaultDropout, FaultDuplicate, FaultOutOfOrder, FaultCorrupt:
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+
+	switch f.Metric {
+	case "", MetricTemperature, MetricTransparency, MetricSpecies:
+	default:
+		return fmt.Errorf("unknown fault metric %q", f.Metric)
+	}
+
+	if f.Every < 0 || f.For < 0 || (f.Every > 0 && f.For <= 0) {
+		return fmt.Errorf("fault %s needs a positive for when every is set", f.Kind)
+	}
+
+	if !f.Start.IsZero() && !f.End.IsZero() && !f.Start.Before(f.End) {
+		return fmt.Errorf("fault %s starts after it ends", f.Kind)
+	}
+
+	if !(f.Probability >= 0 && f.Probability <= 1) {
+		return fmt.Errorf("fault %s needs a probability between 0 and 1", f.Kind)
+	}
+
+	if !(f.Magnitude >= 0) || math.IsInf(f.Magnitude, 1) {
+		return fmt.Errorf("fault %s needs a finite magnitude of at least 0", f.Kind)
+	}
+
+	return nil
+}
+
+// activeSince returns when the current activation of the fault started and
+// whether the fault is active at all at the given time
+func (f Fault) activeSince(at time.Time) (time.Time, bool) {
+	if !f.Start.IsZero() && at.Before(f.Start) {
+		return time.Time{}, false
+	}
+	if !f.End.IsZero() && !at.Before(f.End) {
+		return time.Time{}, false
+	}
+	if f.Every == 0 {
+		return f.Start, true
+	}
+
+	// A repeating fault without a start counts its periods from the Unix epoch
+	origin := f.Start
+	if origin.IsZero() {
+		origin = time.Unix(0, 0)
+	}
+	every := time.Duration(f.Every)
+	since := at.Sub(origin)
+	periodStart := origin.Add(since - since%every)
+	if at.Sub(periodStart) >= time.Duration(f.For) {
+		return time.Time{}, false
+	}
+	return periodStart, true
+}
+
+func (f Fault) metric() string {
+	if f.Metric == "" {
+		return MetricTemperature
+	}
+	return f.Metric
+}
+
+// FaultInjector wraps a generator and alters its readings according to a list
+// of faults, so consumers can be validated against misbehaving sensors
+type FaultInjector struct {
+	mu         sync.Mutex
+	gen        *Generator
+	rng        *rand.Rand
+	faults     []Fault
+	groupNames map[int]GroupName
+	// state holds, per fault and sensor id, the reading a stuck sensor keeps
+	// repeating or the start of an open ended drift
+	state map[faultKey]repository.SensorData
+	// last holds the last reading of every sensor that was not altered, by id
+	last map[int]repository.SensorData
+}
+
+type faultKey struct {
+	fault    int
+	sensorID int
+}
+
+// GroupName names a sensor group and its tenant, as faults select them
+type GroupName struct {
+	Tenant string
+	Group  string
+}
+
+// LoadGroupNames returns the names of every stored group by id
+func LoadGroupNames(ctx context.Context, db *sql.DB) (map[int]GroupName, error) {
+	tenants, err := repository.ListTenants(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	tenantNames := make(map[int]string, len(tenants))
+	for _, tenant := range tenants {
+		tenantNames[tenant.ID] = tenant.Name
+	}
+
+	groups, err := repository.ListSensorGroups(db)
+	if err != nil {
+		return nil, err
+	}
+	groupNames := make(map[int]GroupName, len(groups))
+	for _, group := range groups {
+		groupNames[group.ID] = GroupName{Tenant: tenantNames[group.TenantID], Group: group.Name}
+	}
+	return groupNames, nil
+}
+
+// NewFaultInjector checks the faults and wraps gen, groupNames maps group ids to the
+// names used to select sensors in Fault.Groups and Fault.Tenant
+func NewFaultInjector(gen *Generator, rng *rand.Rand, faults []Fault, groupNames map[int]GroupName) (*FaultInjector, error) {
+	for _, fault := range faults {
+		if err := fault.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FaultInjector{
+		gen:        gen,
+		rng:        rng,
+		faults:     faults,
+		groupNames: groupNames,
+		state:      make(map[faultKey]repository.SensorData),
+		last:       make(map[int]repository.SensorData),
+	}, nil
+}
+
+// HasGroup reports whether the names of the group with the given id are known
+func (i *FaultInjector) HasGroup(id int) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, ok := i.groupNames[id]
+	return ok
+}
+
+// SetGroupNames replaces the names of the groups, so the groups created since the
+// injector was built are selected too
+func (i *FaultInjector) SetGroupNames(groupNames map[int]GroupName) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.groupNames = groupNames
+}
+
+// Generate produces the readings of sensor at the given time, that is zero
+// readings for a dropout, two for a duplicate and one otherwise
+func (i *FaultInjector) Generate(sensor repository.Sensor, at time.Time) []repository.SensorData {
+	data := i.gen.Generate(sensor, at)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	altered := false
+	duplicate := false
+
+	for index, fault := range i.faults {
+		stateKey := faultKey{index, sensor.ID}
+
+		since, active := fault.activeSince(at)
+		if !active || !i.affects(fault, sensor) {
+			delete(i.state, stateKey)
+			continue
+		}
+		if fault.Probability > 0 && i.rng.Float64() >= fault.Probability {
+			continue
+		}
+
+		altered = true
+
+		switch fault.Kind {
+		case FaultStuck:
+			snapshot, ok := i.state[stateKey]
+			if !ok {
+				snapshot, ok = i.last[sensor.ID]
+				if !ok {
+					snapshot = data
+				}
+				i.state[stateKey] = snapshot
+			}
+			data.Temperature = snapshot.Temperature
+			data.Transparency = snapshot.Transparency
+			data.FishSpeciesName = snapshot.FishSpeciesName
+			data.FishSpeciesCount = snapshot.FishSpeciesCount
+
+		case FaultSpike:
+			offset := fault.Magnitude
+			if i.rng.Intn(2) == 0 {
+				offset = -offset
+			}
+			i.offset(&data, fault.metric(), offset)
+
+		case FaultDrift:
+			// An open ended fault drifts from the first reading it alters
+			if since.IsZero() {
+				snapshot, ok := i.state[stateKey]
+				if !ok {
+					snapshot = repository.SensorData{CreatedAt: at}
+					i.state[stateKey] = snapshot
+				}
+				since = snapshot.CreatedAt
+			}
+			i.offset(&data, fault.metric(), fault.Magnitude*at.Sub(since).Hours())
+
+		case FaultDropout:
+			return nil
+
+		case FaultDuplicate:
+			duplicate = true
+
+		case FaultOutOfOrder:
+			data.CreatedAt = data.CreatedAt.Add(-time.Duration(i.rng.Float64() * fault.Magnitude * float64(time.Second)))
+
+		case FaultCorrupt:
+			i.corrupt(&data, fault.metric())
+		}
+	}
+
+	if !altered {
+		i.last[sensor.ID] = data
+	}
+
+	if duplicate {
+		return []repository.SensorData{data, data}
+	}
+	return []repository.SensorData{data}
+}
+
+// affects reports whether fault selects sensor
+func (i *FaultInjector) affects(fault Fault, sensor repository.Sensor) bool {
+	names := i.groupNames[sensor.GroupID]
+	if fault.Tenant != "" && fault.Tenant != names.Tenant {
+		return false
+	}
+	if len(fault.Sensors) == 0 && len(fault.Groups) == 0 {
+		return true
+	}
+	for _, codename := range fault.Sensors {
+		if codename == sensor.Codename {
+			return true
+		}
+	}
+	for _, group := range fault.Groups {
+		if group == names.Group {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *FaultInjector) offset(data *repository.SensorData, metric string, offset float64) {
+	switch metric {
+	case MetricTemperature:
+		data.Temperature += offset
+	case MetricTransparency:
+		data.Transparency += int(math.Round(offset))
+	case MetricSpecies:
+		data.FishSpeciesCount += int(math.Round(offset))
+	}
+}
+
+func (i *FaultInjector) corrupt(data *repository.SensorData, metric string) {
+	switch metric {
+	case MetricTemperature:
+		corrupted := []float64{-9999, -273.15, 9999}
+		data.Temperature = corrupted[i.rng.Intn(len(corrupted))]
+	case MetricTransparency:
+		corrupted := []int{-1, 255, math.MaxInt32}
+		data.Transparency = corrupted[i.rng.Intn(len(corrupted))]
+	case MetricSpecies:
+		data.FishSpeciesName = ""
+		data.FishSpeciesCount = -1
+	}
+}
@@ -0,0 +1,221 @@
+package generator
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// constantModel reads 20 plus the minute of the hour, a transparency of 50 and 3 tuna
+type constantModel struct{}
+
+func (constantModel) Temperature(sensor repository.Sensor, at time.Time) float64 {
+	return 20 + float64(at.Minute())
+}
+
+func (constantModel) Transparency(sensor repository.Sensor, at time.Time) int {
+	return 50
+}
+
+func (constantModel) Species(sensor repository.Sensor, temperature float64, at time.Time) (string, int) {
+	return "Tuna", 3
+}
+
+func newInjector(t *testing.T, faults ...Fault) *FaultInjector {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	gen := NewWithModels(rng, constantModel{}, constantModel{}, constantModel{})
+	injector, err := NewFaultInjector(gen, rng, faults, map[int]GroupName{
+		1: {Tenant: "acme", Group: "reef"},
+		2: {Tenant: "other", Group: "reef"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return injector
+}
+
+func TestFaultValidate(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		fault Fault
+		valid bool
+	}{
+		{name: "spike", fault: Fault{Kind: FaultSpike, Metric: MetricTransparency, Probability: 0.01, Magnitude: 40}, valid: true},
+		{name: "certain", fault: Fault{Kind: FaultDropout, Probability: 1}, valid: true},
+		{name: "window", fault: Fault{Kind: FaultStuck, Start: start, End: start.Add(time.Hour)}, valid: true},
+		{name: "repeating", fault: Fault{Kind: FaultDrift, Every: Duration(time.Hour), For: Duration(time.Minute), Magnitude: 2}, valid: true},
+		{name: "unknown kind", fault: Fault{Kind: "melt"}},
+		{name: "unknown metric", fault: Fault{Kind: FaultSpike, Metric: "salinity"}},
+		{name: "every without for", fault: Fault{Kind: FaultDropout, Every: Duration(time.Hour)}},
+		{name: "negative for", fault: Fault{Kind: FaultDropout, For: Duration(-time.Minute)}},
+		{name: "ends before it starts", fault: Fault{Kind: FaultDropout, Start: start, End: start.Add(-time.Hour)}},
+		{name: "ends when it starts", fault: Fault{Kind: FaultDropout, Start: start, End: start}},
+		{name: "negative probability", fault: Fault{Kind: FaultDropout, Probability: -0.1}},
+		{name: "probability above 1", fault: Fault{Kind: FaultDropout, Probability: 1.5}},
+		{name: "probability not a number", fault: Fault{Kind: FaultDropout, Probability: math.NaN()}},
+		{name: "negative magnitude", fault: Fault{Kind: FaultSpike, Magnitude: -1}},
+		{name: "magnitude not a number", fault: Fault{Kind: FaultSpike, Magnitude: math.NaN()}},
+		{name: "infinite magnitude", fault: Fault{Kind: FaultSpike, Magnitude: math.Inf(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fault.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("Validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestActiveSince(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	epoch := time.Unix(0, 0)
+	hourly := Fault{Every: Duration(time.Hour), For: Duration(10 * time.Minute)}
+
+	tests := []struct {
+		name   string
+		fault  Fault
+		at     time.Time
+		since  time.Time
+		active bool
+	}{
+		{name: "always", at: start, active: true},
+		{name: "before start", fault: Fault{Start: start}, at: start.Add(-time.Second)},
+		{name: "at start", fault: Fault{Start: start}, at: start, since: start, active: true},
+		{name: "before end", fault: Fault{End: start}, at: start.Add(-time.Second), active: true},
+		{name: "at end", fault: Fault{End: start}, at: start},
+		{name: "inside window", fault: Fault{Start: start, End: start.Add(time.Hour)}, at: start.Add(30 * time.Minute), since: start, active: true},
+		{name: "first period", fault: Fault{Start: start, Every: hourly.Every, For: hourly.For}, at: start.Add(5 * time.Minute), since: start, active: true},
+		{name: "between periods", fault: Fault{Start: start, Every: hourly.Every, For: hourly.For}, at: start.Add(10 * time.Minute)},
+		{name: "later period", fault: Fault{Start: start, Every: hourly.Every, For: hourly.For}, at: start.Add(2*time.Hour + 9*time.Minute), since: start.Add(2 * time.Hour), active: true},
+		{name: "periods from the epoch", fault: hourly, at: start.Add(3 * time.Minute), since: start, active: true},
+		{name: "epoch period over", fault: hourly, at: start.Add(30 * time.Minute)},
+		{name: "epoch period in the first hour", fault: hourly, at: epoch.Add(time.Minute), since: epoch, active: true},
+		{name: "period cut by end", fault: Fault{Start: start, End: start.Add(time.Hour + 5*time.Minute), Every: hourly.Every, For: hourly.For}, at: start.Add(time.Hour + 5*time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, active := tt.fault.activeSince(tt.at)
+			if active != tt.active || !since.Equal(tt.since) {
+				t.Fatalf("activeSince(%v) = %v, %v, want %v, %v", tt.at, since, active, tt.since, tt.active)
+			}
+		})
+	}
+}
+
+func TestFaultKinds(t *testing.T) {
+	sensor := repository.Sensor{ID: 1, GroupID: 1, Codename: "reef1"}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("stuck", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultStuck, Start: start.Add(time.Minute)})
+		before := injector.Generate(sensor, start)
+		for minute := 1; minute <= 3; minute++ {
+			data := injector.Generate(sensor, start.Add(time.Duration(minute)*time.Minute))
+			if len(data) != 1 || data[0].Temperature != before[0].Temperature {
+				t.Fatalf("minute %d: %+v, want stuck at %v", minute, data, before[0].Temperature)
+			}
+		}
+	})
+
+	t.Run("spike", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultSpike, Magnitude: 5})
+		for minute := 0; minute < 10; minute++ {
+			data := injector.Generate(sensor, start.Add(time.Duration(minute)*time.Minute))
+			if offset := math.Abs(data[0].Temperature - (20 + float64(minute))); offset != 5 {
+				t.Fatalf("minute %d: offset %v, want 5", minute, offset)
+			}
+		}
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDrift, Metric: MetricTransparency, Start: start, Magnitude: 10})
+		data := injector.Generate(sensor, start.Add(90*time.Minute))
+		if data[0].Transparency != 65 {
+			t.Fatalf("transparency %d after 90 minutes, want 65", data[0].Transparency)
+		}
+	})
+
+	t.Run("open ended drift", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDrift, Metric: MetricTransparency, Magnitude: 10})
+		first := injector.Generate(sensor, start)
+		later := injector.Generate(sensor, start.Add(2*time.Hour))
+		if first[0].Transparency != 50 || later[0].Transparency != 70 {
+			t.Fatalf("transparency %d then %d, want 50 then 70", first[0].Transparency, later[0].Transparency)
+		}
+	})
+
+	t.Run("dropout", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDropout})
+		if data := injector.Generate(sensor, start); len(data) != 0 {
+			t.Fatalf("got %d readings, want none", len(data))
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDuplicate})
+		data := injector.Generate(sensor, start)
+		if len(data) != 2 || data[0] != data[1] {
+			t.Fatalf("got %+v, want the same reading twice", data)
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultOutOfOrder, Magnitude: 30})
+		for minute := 0; minute < 10; minute++ {
+			at := start.Add(time.Duration(minute) * time.Minute)
+			data := injector.Generate(sensor, at)
+			if data[0].CreatedAt.After(at) || !data[0].CreatedAt.After(at.Add(-30*time.Second)) {
+				t.Fatalf("read at %v, want within 30s before %v", data[0].CreatedAt, at)
+			}
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultCorrupt}, Fault{Kind: FaultCorrupt, Metric: MetricSpecies})
+		data := injector.Generate(sensor, start)
+		switch data[0].Temperature {
+		case -9999, -273.15, 9999:
+		default:
+			t.Fatalf("temperature %v, want an impossible one", data[0].Temperature)
+		}
+		if data[0].FishSpeciesName != "" || data[0].FishSpeciesCount != -1 {
+			t.Fatalf("species %q %d, want corrupted", data[0].FishSpeciesName, data[0].FishSpeciesCount)
+		}
+	})
+
+	t.Run("probability", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDropout, Probability: 0.5})
+		dropped := 0
+		for i := 0; i < 1000; i++ {
+			if len(injector.Generate(sensor, start.Add(time.Duration(i)*time.Second))) == 0 {
+				dropped++
+			}
+		}
+		if dropped < 400 || dropped > 600 {
+			t.Fatalf("dropped %d of 1000 readings, want about half", dropped)
+		}
+	})
+
+	t.Run("selection", func(t *testing.T) {
+		injector := newInjector(t, Fault{Kind: FaultDropout, Tenant: "acme", Groups: []string{"reef"}})
+		other := repository.Sensor{ID: 2, GroupID: 2, Codename: "reef1"}
+		if data := injector.Generate(sensor, start); len(data) != 0 {
+			t.Fatal("the sensor of the tenant was not affected")
+		}
+		if data := injector.Generate(other, start); len(data) != 1 {
+			t.Fatal("the sensor of another tenant was affected")
+		}
+	})
+}
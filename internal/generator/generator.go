@@ -0,0 +1,199 @@
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/internal/repository"
+)
+
+// TemperatureModel produces the water temperature seen by a sensor at a given time
+type TemperatureModel interface {
+	Temperature(sensor repository.Sensor, at time.Time) float64
+}
+
+// TransparencyModel produces the water transparency (0..100) seen by a sensor at a given time
+type TransparencyModel interface {
+	Transparency(sensor repository.Sensor, at time.Time) int
+}
+
+// SpeciesModel produces the fish species and count detected by a sensor at a given time
+type SpeciesModel interface {
+	Species(sensor repository.Sensor, temperature float64, at time.Time) (name string, count int)
+}
+
+// Model names accepted in Config
+const (
+	TemperatureLinear   = "linear"
+	TemperatureSeasonal = "seasonal"
+
+	TransparencyUniform    = "uniform"
+	TransparencyCorrelated = "correlated"
+
+	SpeciesUniform = "uniform"
+	SpeciesHabitat = "habitat"
+)
+
+// Config selects and tunes the model used for every metric
+type Config struct {
+	Temperature        string             `json:"temperature"`
+	Transparency       string             `json:"transparency"`
+	Species            string             `json:"species"`
+	Schooling          bool               `json:"schooling"`
+	SeasonalConfig     SeasonalConfig     `json:"seasonalConfig"`
+	TransparencyConfig TransparencyConfig `json:"transparencyConfig"`
+	SchoolingConfig    SchoolingConfig    `json:"schoolingConfig"`
+	Habitats           []Habitat          `json:"habitats"`
+	Faults             []Fault            `json:"faults"`
+}
+
+// DefaultConfig returns the realistic models with their default settings
+func DefaultConfig() Config {
+	return Config{
+		Temperature:        TemperatureSeasonal,
+		Transparency:       TransparencyCorrelated,
+		Species:            SpeciesHabitat,
+		Schooling:          true,
+		SeasonalConfig:     DefaultSeasonalConfig(),
+		TransparencyConfig: DefaultTransparencyConfig(),
+		SchoolingConfig:    DefaultSchoolingConfig(),
+		Habitats:           DefaultHabitats(),
+	}
+}
+
+// LoadConfig reads a JSON config file, fields missing from the file keep their default value
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid generator config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid generator config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Validate reports configuration mistakes the models would fail on
+func (c Config) Validate() error {
+	// Both species models pick one of the habitats for every reading
+	if len(c.Habitats) == 0 {
+		return errors.New("habitats must list at least one species")
+	}
+	for _, habitat := range c.Habitats {
+		if habitat.Name == "" {
+			return errors.New("habitats must name their species")
+		}
+		if habitat.Abundance < 0 || habitat.MaxCount < 0 {
+			return fmt.Errorf("habitat %s needs a non negative abundance and max count", habitat.Name)
+		}
+	}
+	return nil
+}
+
+// Generator produces sensor readings from one model per metric. All the models
+// draw from the same RNG, so a seeded generator produces the same readings for
+// the same sequence of calls
+type Generator struct {
+	mu           sync.Mutex
+	rng          *rand.Rand
+	temperature  TemperatureModel
+	transparency TransparencyModel
+	species      SpeciesModel
+}
+
+// New builds the models selected by cfg on top of rng. redisClient is optional and
+// only used by the correlated transparency model to persist its state, leave it nil
+// for reproducible runs
+func New(cfg Config, rng *rand.Rand, redisClient *redis.Client) (*Generator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Generator{rng: rng}
+
+	switch cfg.Temperature {
+	case TemperatureLinear:
+		g.temperature = NewLinearTemperature(rng)
+	case TemperatureSeasonal:
+		g.temperature = NewSeasonalTemperature(cfg.SeasonalConfig, rng)
+	default:
+		return nil, fmt.Errorf("unknown temperature model %q", cfg.Temperature)
+	}
+
+	switch cfg.Transparency {
+	case TransparencyUniform:
+		g.transparency = NewUniformTransparency(rng)
+	case TransparencyCorrelated:
+		g.transparency = NewTransparencyField(cfg.TransparencyConfig, rng, redisClient)
+	default:
+		return nil, fmt.Errorf("unknown transparency model %q", cfg.Transparency)
+	}
+
+	switch cfg.Species {
+	case SpeciesUniform:
+		g.species = NewUniformSpecies(habitatNames(cfg.Habitats), rng)
+	case SpeciesHabitat:
+		g.species = NewHabitatSpecies(cfg.Habitats, rng)
+	default:
+		return nil, fmt.Errorf("unknown species model %q", cfg.Species)
+	}
+
+	if cfg.Schooling {
+		g.species = NewSchooling(cfg.SchoolingConfig, rng, g.species)
+	}
+
+	return g, nil
+}
+
+// NewWithModels builds a generator from already constructed models sharing rng
+func NewWithModels(rng *rand.Rand, temperature TemperatureModel, transparency TransparencyModel, species SpeciesModel) *Generator {
+	return &Generator{
+		rng:          rng,
+		temperature:  temperature,
+		transparency: transparency,
+		species:      species,
+	}
+}
+
+// Generate produces the reading of sensor at the given time
+func (g *Generator) Generate(sensor repository.Sensor, at time.Time) repository.SensorData {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	temperature := g.temperature.Temperature(sensor, at)
+	fishSpeciesName, fishSpeciesCount := g.species.Species(sensor, temperature, at)
+
+	return repository.SensorData{
+		SensorID:         sensor.ID,
+		Temperature:      temperature,
+		Transparency:     g.transparency.Transparency(sensor, at),
+		FishSpeciesName:  fishSpeciesName,
+		FishSpeciesCount: fishSpeciesCount,
+		CreatedAt:        at,
+	}
+}
+
+// Position returns random coordinates for a new sensor inside a size*size*size cube
+func (g *Generator) Position(size float64) (x, y, z float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.rng.Float64() * size, g.rng.Float64() * size, g.rng.Float64() * size
+}
+
+// Rand returns the RNG shared by the models, it must only be used from the
+// goroutine calling Generate
+func (g *Generator) Rand() *rand.Rand {
+	return g.rng
+}
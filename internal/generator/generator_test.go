@@ -0,0 +1,42 @@
+package generator
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRejectsInvalidHabitats(t *testing.T) {
+	tests := []struct {
+		name     string
+		species  string
+		habitats []Habitat
+	}{
+		{name: "no habitats for the uniform model", species: SpeciesUniform},
+		{name: "no habitats for the habitat model", species: SpeciesHabitat, habitats: []Habitat{}},
+		{name: "unnamed species", species: SpeciesHabitat, habitats: []Habitat{{Abundance: 1, MaxCount: 3}}},
+		{name: "negative max count", species: SpeciesUniform, habitats: []Habitat{{Name: "Tuna", MaxCount: -1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Species = tt.species
+			cfg.Habitats = tt.habitats
+			if _, err := New(cfg, rand.New(rand.NewSource(1)), nil); err == nil {
+				t.Fatal("New accepted the habitats")
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsEmptyHabitats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "generator.json")
+	if err := os.WriteFile(path, []byte(`{"species": "uniform", "habitats": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("LoadConfig accepted a config without habitats")
+	}
+}
@@ -0,0 +1,63 @@
+package generator
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/sensors/internal/repository"
+)
+
+// defaultSize is the edge of the placement cube used when a group does not set one
+const defaultSize = 10
+
+// Provision creates the groups and sensors of topology that do not exist yet and
+// returns every sensor of the topology, created holds the ids of the new ones
+func Provision(db *sql.DB, gen *Generator, topology Topology) (sensors []repository.Sensor, created map[int]bool, err error) {
+	created = make(map[int]bool)
+
+	for _, group := range topology.Groups {
+		tenant := group.Tenant
+		if tenant == "" {
+			tenant = repository.DefaultTenant
+		}
+		tenantID, err := repository.EnsureTenant(db, tenant)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		groupID, _, err := repository.EnsureSensorGroup(db, tenantID, group.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		size := group.Size
+		if size <= 0 {
+			size = defaultSize
+		}
+
+		for sensorIndex := 0; sensorIndex < group.Sensors; sensorIndex++ {
+			x, y, z := gen.Position(size)
+			sensor := repository.Sensor{
+				GroupID:  groupID,
+				Codename: fmt.Sprintf("%s%d", group.Name, sensorIndex+1),
+				Index:    sensorIndex + 1,
+				X:        x,
+				Y:        y,
+				Z:        z,
+				DataRate: group.DataRate,
+			}
+
+			isNew, err := repository.EnsureSensor(db, &sensor)
+			if err != nil {
+				return nil, nil, err
+			}
+			if isNew {
+				created[sensor.ID] = true
+			}
+
+			sensors = append(sensors, sensor)
+		}
+	}
+
+	return sensors, created, nil
+}
@@ -0,0 +1,193 @@
+package generator
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// Habitat describes where a fish species is likely to be found
+type Habitat struct {
+	Name string `json:"name"`
+	// MinDepth and MaxDepth bound the depths the species prefers
+	MinDepth float64 `json:"minDepth"`
+	MaxDepth float64 `json:"maxDepth"`
+	// PreferredTemperature is the temperature the species is most often found in
+	PreferredTemperature float64 `json:"preferredTemperature"`
+	// TemperatureTolerance is how far from PreferredTemperature the species still goes
+	TemperatureTolerance float64 `json:"temperatureTolerance"`
+	// Abundance is the relative frequency of the species in ideal conditions
+	Abundance float64 `json:"abundance"`
+	// MaxCount is the largest number of fish detected at once in ideal conditions
+	MaxCount int `json:"maxCount"`
+}
+
+// DefaultHabitats returns the species the generator has always produced
+func DefaultHabitats() []Habitat {
+	return []Habitat{
+		{Name: "Atlantic Cod", MinDepth: 3, MaxDepth: 10, PreferredTemperature: 8, TemperatureTolerance: 3, Abundance: 1, MaxCount: 15},
+		{Name: "Sailfish", MinDepth: 0, MaxDepth: 3, PreferredTemperature: 26, TemperatureTolerance: 3, Abundance: 0.5, MaxCount: 3},
+		{Name: "Tuna", MinDepth: 0, MaxDepth: 6, PreferredTemperature: 20, TemperatureTolerance: 5, Abundance: 0.8, MaxCount: 20},
+		{Name: "Salmon", MinDepth: 0, MaxDepth: 5, PreferredTemperature: 12, TemperatureTolerance: 4, Abundance: 1, MaxCount: 12},
+		{Name: "Trout", MinDepth: 0, MaxDepth: 3, PreferredTemperature: 14, TemperatureTolerance: 3, Abundance: 0.7, MaxCount: 6},
+		{Name: "Barracuda", MinDepth: 0, MaxDepth: 4, PreferredTemperature: 24, TemperatureTolerance: 4, Abundance: 0.6, MaxCount: 8},
+	}
+}
+
+func habitatNames(habitats []Habitat) []string {
+	names := make([]string, 0, len(habitats))
+	for _, habitat := range habitats {
+		names = append(names, habitat.Name)
+	}
+	return names
+}
+
+// UniformSpecies is the original model, any species with a count below 20
+type UniformSpecies struct {
+	names []string
+	rng   *rand.Rand
+}
+
+func NewUniformSpecies(names []string, rng *rand.Rand) *UniformSpecies {
+	return &UniformSpecies{names: names, rng: rng}
+}
+
+func (m *UniformSpecies) Species(sensor repository.Sensor, temperature float64, at time.Time) (name string, count int) {
+	return m.names[m.rng.Intn(len(m.names))], m.rng.Intn(20)
+}
+
+// HabitatSpecies picks species according to how well the sensor depth and the
+// water temperature match their habitat
+type HabitatSpecies struct {
+	habitats []Habitat
+	rng      *rand.Rand
+}
+
+func NewHabitatSpecies(habitats []Habitat, rng *rand.Rand) *HabitatSpecies {
+	return &HabitatSpecies{habitats: habitats, rng: rng}
+}
+
+func (m *HabitatSpecies) Species(sensor repository.Sensor, temperature float64, at time.Time) (name string, count int) {
+	suitability := make([]float64, len(m.habitats))
+	var total float64
+	for i, habitat := range m.habitats {
+		suitability[i] = habitat.suitability(sensor.Z, temperature)
+		total += habitat.Abundance * suitability[i]
+	}
+
+	// Nothing lives here, report whatever swims by in tiny numbers
+	if total == 0 {
+		habitat := m.habitats[m.rng.Intn(len(m.habitats))]
+		return habitat.Name, m.rng.Intn(2)
+	}
+
+	pick := m.rng.Float64() * total
+	for i, habitat := range m.habitats {
+		pick -= habitat.Abundance * suitability[i]
+		if pick <= 0 {
+			return habitat.Name, m.rng.Intn(int(math.Ceil(float64(habitat.MaxCount)*suitability[i])) + 1)
+		}
+	}
+
+	last := len(m.habitats) - 1
+	return m.habitats[last].Name, m.rng.Intn(m.habitats[last].MaxCount + 1)
+}
+
+// suitability returns 1 for ideal conditions, decaying towards 0 outside the habitat
+func (h Habitat) suitability(depth, temperature float64) float64 {
+	depthFit := 1.0
+	if depth < h.MinDepth {
+		depthFit = math.Exp(h.MinDepth - depth)
+	} else if depth > h.MaxDepth {
+		depthFit = math.Exp(-(depth - h.MaxDepth))
+	}
+
+	temperatureFit := 1.0
+	if h.TemperatureTolerance > 0 {
+		delta := temperature - h.PreferredTemperature
+		temperatureFit = math.Exp(-delta * delta / (2 * h.TemperatureTolerance * h.TemperatureTolerance))
+	}
+
+	return depthFit * temperatureFit
+}
+
+// SchoolingConfig tunes the schooling behaviour
+type SchoolingConfig struct {
+	// Species lists the species that move in schools
+	Species []string `json:"species"`
+	// StayProbability is the chance a school is still in front of the sensor on the next reading
+	StayProbability float64 `json:"stayProbability"`
+	// SizeFactor multiplies the count of a single detection into the size of a school
+	SizeFactor float64 `json:"sizeFactor"`
+	// Drift is the relative standard deviation of the school size between readings
+	Drift float64 `json:"drift"`
+}
+
+// DefaultSchoolingConfig returns the settings used by the generator
+func DefaultSchoolingConfig() SchoolingConfig {
+	return SchoolingConfig{
+		Species:         []string{"Atlantic Cod", "Tuna", "Salmon"},
+		StayProbability: 0.85,
+		SizeFactor:      4,
+		Drift:           0.1,
+	}
+}
+
+type school struct {
+	name  string
+	count int
+}
+
+// Schooling wraps a species model so schooling species linger in front of a
+// sensor for several readings in large, slowly changing numbers
+type Schooling struct {
+	mu   sync.Mutex
+	cfg  SchoolingConfig
+	rng  *rand.Rand
+	next SpeciesModel
+	// schools are keyed by sensor id, codenames are only unique per tenant
+	schools map[int]*school
+	species map[string]bool
+}
+
+func NewSchooling(cfg SchoolingConfig, rng *rand.Rand, next SpeciesModel) *Schooling {
+	species := make(map[string]bool, len(cfg.Species))
+	for _, name := range cfg.Species {
+		species[name] = true
+	}
+
+	return &Schooling{
+		cfg:     cfg,
+		rng:     rng,
+		next:    next,
+		schools: make(map[int]*school),
+		species: species,
+	}
+}
+
+func (m *Schooling) Species(sensor repository.Sensor, temperature float64, at time.Time) (name string, count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, ok := m.schools[sensor.ID]; ok {
+		if m.rng.Float64() < m.cfg.StayProbability {
+			current.count += int(math.Round(m.rng.NormFloat64() * m.cfg.Drift * float64(current.count)))
+			if current.count < 1 {
+				current.count = 1
+			}
+			return current.name, current.count
+		}
+		delete(m.schools, sensor.ID)
+	}
+
+	name, count = m.next.Species(sensor, temperature, at)
+	if m.species[name] && count > 0 {
+		count = int(math.Ceil(float64(count) * m.cfg.SizeFactor))
+		m.schools[sensor.ID] = &school{name: name, count: count}
+	}
+
+	return name, count
+}
@@ -0,0 +1,86 @@
+package generator
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// LinearTemperature is the original model, temperature grows linearly with depth plus noise
+type LinearTemperature struct {
+	rng *rand.Rand
+}
+
+func NewLinearTemperature(rng *rand.Rand) *LinearTemperature {
+	return &LinearTemperature{rng: rng}
+}
+
+func (m *LinearTemperature) Temperature(sensor repository.Sensor, at time.Time) float64 {
+	return 10 + sensor.Z*2 + m.rng.Float64()*5
+}
+
+// SeasonalConfig tunes the seasonal temperature model
+type SeasonalConfig struct {
+	// SurfaceMean is the yearly mean temperature at the surface
+	SurfaceMean float64 `json:"surfaceMean"`
+	// DeepTemperature is the temperature the water converges to far below the thermocline
+	DeepTemperature float64 `json:"deepTemperature"`
+	// SeasonalAmplitude is half the difference between summer and winter surface temperature
+	SeasonalAmplitude float64 `json:"seasonalAmplitude"`
+	// WarmestDay is the day of the year with the warmest surface water
+	WarmestDay int `json:"warmestDay"`
+	// DiurnalAmplitude is half the difference between day and night surface temperature
+	DiurnalAmplitude float64 `json:"diurnalAmplitude"`
+	// WarmestHour is the hour of the day with the warmest surface water
+	WarmestHour float64 `json:"warmestHour"`
+	// ThermoclineDepth is the depth at which surface effects decay to 1/e
+	ThermoclineDepth float64 `json:"thermoclineDepth"`
+	// Noise is the standard deviation of the measurement noise
+	Noise float64 `json:"noise"`
+}
+
+// DefaultSeasonalConfig returns settings resembling a temperate sea
+func DefaultSeasonalConfig() SeasonalConfig {
+	return SeasonalConfig{
+		SurfaceMean:       16,
+		DeepTemperature:   6,
+		SeasonalAmplitude: 6,
+		WarmestDay:        220,
+		DiurnalAmplitude:  1.5,
+		WarmestHour:       15,
+		ThermoclineDepth:  4,
+		Noise:             0.2,
+	}
+}
+
+// SeasonalTemperature models yearly and daily cycles at the surface that fade with
+// depth, the water cooling towards DeepTemperature below the thermocline
+type SeasonalTemperature struct {
+	cfg SeasonalConfig
+	rng *rand.Rand
+}
+
+func NewSeasonalTemperature(cfg SeasonalConfig, rng *rand.Rand) *SeasonalTemperature {
+	return &SeasonalTemperature{cfg: cfg, rng: rng}
+}
+
+func (m *SeasonalTemperature) Temperature(sensor repository.Sensor, at time.Time) float64 {
+	at = at.UTC()
+
+	day := float64(at.YearDay())
+	seasonal := m.cfg.SeasonalAmplitude * math.Cos(2*math.Pi*(day-float64(m.cfg.WarmestDay))/365.25)
+
+	hour := float64(at.Hour()) + float64(at.Minute())/60
+	diurnal := m.cfg.DiurnalAmplitude * math.Cos(2*math.Pi*(hour-m.cfg.WarmestHour)/24)
+
+	surface := m.cfg.SurfaceMean + seasonal + diurnal
+
+	decay := 0.0
+	if m.cfg.ThermoclineDepth > 0 {
+		decay = math.Exp(-math.Max(sensor.Z, 0) / m.cfg.ThermoclineDepth)
+	}
+
+	return m.cfg.DeepTemperature + (surface-m.cfg.DeepTemperature)*decay + m.rng.NormFloat64()*m.cfg.Noise
+}
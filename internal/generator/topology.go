@@ -0,0 +1,57 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// GroupTopology describes the sensors of one group
+type GroupTopology struct {
+	Name string `json:"name"`
+	// Tenant owns the group, the default tenant when empty
+	Tenant string `json:"tenant,omitempty"`
+	// Sensors is the number of sensors in the group, named <name>1..<name>N
+	Sensors int `json:"sensors"`
+	// DataRate is the number of seconds between two readings of a sensor
+	DataRate int `json:"dataRate"`
+	// Size is the edge of the cube the sensors are randomly placed in
+	Size float64 `json:"size"`
+}
+
+// Topology describes the sensor network to generate data for
+type Topology struct {
+	Groups []GroupTopology `json:"groups"`
+}
+
+// DefaultTopology returns the three groups of three sensors the service starts with
+func DefaultTopology() Topology {
+	return Topology{
+		Groups: []GroupTopology{
+			{Name: "alpha", Sensors: 3, DataRate: 60, Size: 10},
+			{Name: "beta", Sensors: 3, DataRate: 60, Size: 10},
+			{Name: "gamma", Sensors: 3, DataRate: 60, Size: 10},
+		},
+	}
+}
+
+// LoadTopology reads a JSON topology file
+func LoadTopology(path string) (Topology, error) {
+	var topology Topology
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return topology, err
+	}
+	if err := json.Unmarshal(data, &topology); err != nil {
+		return topology, fmt.Errorf("invalid topology %s: %w", path, err)
+	}
+
+	for _, group := range topology.Groups {
+		if group.Name == "" || group.Sensors <= 0 || group.DataRate <= 0 {
+			return topology, fmt.Errorf("invalid topology %s: group %q needs a name, sensors and a data rate", path, group.Name)
+		}
+	}
+
+	return topology, nil
+}
@@ -0,0 +1,237 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/internal/repository"
+)
+
+// UniformTransparency is the original model, a fresh random value on every reading
+type UniformTransparency struct {
+	rng *rand.Rand
+}
+
+func NewUniformTransparency(rng *rand.Rand) *UniformTransparency {
+	return &UniformTransparency{rng: rng}
+}
+
+func (m *UniformTransparency) Transparency(sensor repository.Sensor, at time.Time) int {
+	return m.rng.Intn(100)
+}
+
+// TransparencyConfig tunes the spatially correlated transparency model
+type TransparencyConfig struct {
+	// Mean is the long-run transparency every sensor drifts back to
+	Mean float64 `json:"mean"`
+	// Reversion is the fraction of the gap to Mean closed on every step (0..1)
+	Reversion float64 `json:"reversion"`
+	// Volatility is the standard deviation of the random change per step
+	Volatility float64 `json:"volatility"`
+	// CorrelationLength is the distance at which a sensor's influence on another drops to 1/e
+	CorrelationLength float64 `json:"correlationLength"`
+	// NeighbourRadius is the distance under which two sensors count as neighbours
+	NeighbourRadius float64 `json:"neighbourRadius"`
+	// MaxNeighbourDelta is the largest allowed transparency difference between neighbours
+	MaxNeighbourDelta float64 `json:"maxNeighbourDelta"`
+}
+
+// DefaultTransparencyConfig returns the settings used by the correlated model
+func DefaultTransparencyConfig() TransparencyConfig {
+	return TransparencyConfig{
+		Mean:              50,
+		Reversion:         0.05,
+		Volatility:        3,
+		CorrelationLength: 2,
+		NeighbourRadius:   3,
+		MaxNeighbourDelta: 10,
+	}
+}
+
+type transparencyState struct {
+	id      int
+	x, y, z float64
+	value   float64
+}
+
+// TransparencyField keeps the current transparency of every sensor and evolves it
+// as a mean-reverting random walk that is pulled towards nearby sensors, so values
+// change smoothly over time and neighbours never differ by more than MaxNeighbourDelta
+type TransparencyField struct {
+	mu          sync.Mutex
+	cfg         TransparencyConfig
+	rng         *rand.Rand
+	redisClient *redis.Client
+	// sensors keeps insertion order so the floating point sums, and therefore
+	// seeded runs, are reproducible
+	sensors []*transparencyState
+	index   map[int]*transparencyState
+}
+
+// NewTransparencyField creates an empty field, redisClient is optional and is used
+// to persist the last value of each sensor across restarts
+func NewTransparencyField(cfg TransparencyConfig, rng *rand.Rand, redisClient *redis.Client) *TransparencyField {
+	return &TransparencyField{
+		cfg:         cfg,
+		rng:         rng,
+		redisClient: redisClient,
+		index:       make(map[int]*transparencyState),
+	}
+}
+
+// Transparency advances the sensor by one step and returns its new transparency
+func (f *TransparencyField) Transparency(sensor repository.Sensor, at time.Time) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.index[sensor.ID]
+	if !ok {
+		state = &transparencyState{id: sensor.ID, x: sensor.X, y: sensor.Y, z: sensor.Z}
+		initial := f.initialValue(state)
+		f.sensors = append(f.sensors, state)
+		f.index[sensor.ID] = state
+		f.place(state, initial)
+	}
+	state.x, state.y, state.z = sensor.X, sensor.Y, sensor.Z
+
+	// Temporal evolution: revert towards the mean and add a small random step
+	value := state.value + f.cfg.Reversion*(f.cfg.Mean-state.value) + f.rng.NormFloat64()*f.cfg.Volatility
+
+	// Spatial coupling: blend with the distance weighted values of the other sensors
+	var weighted, totalWeight float64
+	for _, other := range f.sensors {
+		if other == state {
+			continue
+		}
+		weight := f.weight(state, other)
+		weighted += weight * other.value
+		totalWeight += weight
+	}
+	if totalWeight > 0 {
+		value = (value + weighted) / (1 + totalWeight)
+	}
+
+	f.place(state, value)
+
+	return int(state.value)
+}
+
+// Value returns the current transparency of the sensor with the given id and
+// whether it is known
+func (f *TransparencyField) Value(id int) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.index[id]
+	if !ok {
+		return 0, false
+	}
+	return int(state.value), true
+}
+
+// initialValue seeds a sensor from Redis, its neighbours or the configured mean,
+// state is not in the field yet
+func (f *TransparencyField) initialValue(state *transparencyState) float64 {
+	if f.redisClient != nil {
+		if val, err := f.redisClient.Get(f.redisClient.Context(), transparencyKey(state.id)).Result(); err == nil {
+			if cached, err := strconv.ParseFloat(val, 64); err == nil {
+				return cached
+			}
+		}
+	}
+
+	var weighted, totalWeight float64
+	for _, other := range f.sensors {
+		weight := f.weight(state, other)
+		weighted += weight * other.value
+		totalWeight += weight
+	}
+	if totalWeight > 0 {
+		return weighted / totalWeight
+	}
+
+	return f.cfg.Mean + f.rng.NormFloat64()*f.cfg.Volatility
+}
+
+// weight returns how strongly other influences state, decaying exponentially with distance
+func (f *TransparencyField) weight(state, other *transparencyState) float64 {
+	if f.cfg.CorrelationLength <= 0 {
+		return 0
+	}
+	return math.Exp(-distance(state, other) / f.cfg.CorrelationLength)
+}
+
+// place sets the value of state to value, rounded and kept inside 0..100 and
+// within MaxNeighbourDelta of every neighbour
+func (f *TransparencyField) place(state *transparencyState, value float64) {
+	bound := math.Floor(f.cfg.MaxNeighbourDelta)
+	low, high := 0.0, 100.0
+
+	for _, neighbour := range f.sensors {
+		if neighbour == state || distance(state, neighbour) > f.cfg.NeighbourRadius {
+			continue
+		}
+		low = math.Max(low, neighbour.value-bound)
+		high = math.Min(high, neighbour.value+bound)
+	}
+
+	if low <= high {
+		state.value = math.Min(math.Max(math.Round(value), low), high)
+		f.store(state.id, state.value)
+		return
+	}
+
+	// Neighbours can disagree by more than twice the bound when they are not
+	// neighbours of each other, no value is then within the bound of both. The
+	// sensor settles in the middle and the field contracts until it is
+	state.value = math.Round((low + high) / 2)
+	f.store(state.id, state.value)
+	f.contract(bound)
+}
+
+// contract scales the values of the field towards their mean so that every pair
+// of neighbours is within bound again. Rounding widens a difference by 1 at most,
+// the scale leaves room for it
+func (f *TransparencyField) contract(bound float64) {
+	var mean, widest float64
+	for i, a := range f.sensors {
+		mean += a.value
+		for _, b := range f.sensors[i+1:] {
+			if distance(a, b) <= f.cfg.NeighbourRadius {
+				widest = math.Max(widest, math.Abs(a.value-b.value))
+			}
+		}
+	}
+	if widest <= bound {
+		return
+	}
+	mean /= float64(len(f.sensors))
+
+	scale := math.Max(bound-1, 0) / widest
+	for _, state := range f.sensors {
+		state.value = math.Round(mean + scale*(state.value-mean))
+		f.store(state.id, state.value)
+	}
+}
+
+func (f *TransparencyField) store(id int, value float64) {
+	if f.redisClient == nil {
+		return
+	}
+	f.redisClient.Set(f.redisClient.Context(), transparencyKey(id), value, 0)
+}
+
+// transparencyKey is keyed by sensor id, codenames are only unique per tenant
+func transparencyKey(id int) string {
+	return fmt.Sprintf("transparency:sensor:%d", id)
+}
+
+// distance returns the euclidean distance between two sensors
+func distance(a, b *transparencyState) float64 {
+	return math.Sqrt((a.x-b.x)*(a.x-b.x) + (a.y-b.y)*(a.y-b.y) + (a.z-b.z)*(a.z-b.z))
+}
@@ -0,0 +1,158 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// checkNeighbours fails t when two neighbours of field differ by more than its
+// bound or a value leaves 0..100
+func checkNeighbours(t *testing.T, field *TransparencyField, step int) {
+	t.Helper()
+	bound := math.Floor(field.cfg.MaxNeighbourDelta)
+	for i, a := range field.sensors {
+		if a.value < 0 || a.value > 100 {
+			t.Fatalf("step %d: sensor %d has transparency %v outside 0..100", step, a.id, a.value)
+		}
+		for _, b := range field.sensors[i+1:] {
+			if distance(a, b) > field.cfg.NeighbourRadius {
+				continue
+			}
+			if delta := math.Abs(a.value - b.value); delta > bound {
+				t.Fatalf("step %d: neighbours %d (%v) and %d (%v) differ by %v, more than %v",
+					step, a.id, a.value, b.id, b.value, delta, bound)
+			}
+		}
+	}
+}
+
+// line places count sensors spacing apart along x
+func line(count int, spacing float64) []repository.Sensor {
+	sensors := make([]repository.Sensor, count)
+	for i := range sensors {
+		sensors[i] = repository.Sensor{ID: i + 1, Codename: fmt.Sprintf("s%d", i), X: float64(i) * spacing}
+	}
+	return sensors
+}
+
+// grid places side*side sensors spacing apart in the x/y plane
+func grid(side int, spacing float64) []repository.Sensor {
+	var sensors []repository.Sensor
+	for i := 0; i < side; i++ {
+		for j := 0; j < side; j++ {
+			sensors = append(sensors, repository.Sensor{
+				ID:       len(sensors) + 1,
+				Codename: fmt.Sprintf("s%d-%d", i, j),
+				X:        float64(i) * spacing,
+				Y:        float64(j) * spacing,
+			})
+		}
+	}
+	return sensors
+}
+
+func TestTransparencyFieldKeepsNeighboursWithinBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensors []repository.Sensor
+		cfg     func(*TransparencyConfig)
+	}{
+		{name: "default line", sensors: line(10, 1)},
+		{name: "default grid", sensors: grid(5, 1.5)},
+		{name: "tight bound", sensors: grid(4, 1), cfg: func(c *TransparencyConfig) { c.MaxNeighbourDelta = 2 }},
+		{name: "zero bound", sensors: line(6, 1), cfg: func(c *TransparencyConfig) { c.MaxNeighbourDelta = 0 }},
+		{name: "fractional bound", sensors: grid(3, 2), cfg: func(c *TransparencyConfig) { c.MaxNeighbourDelta = 4.7 }},
+		{name: "volatile", sensors: line(8, 2), cfg: func(c *TransparencyConfig) {
+			c.Volatility = 40
+			c.Reversion = 0
+		}},
+		{name: "uncoupled", sensors: line(8, 2), cfg: func(c *TransparencyConfig) {
+			c.CorrelationLength = 0
+			c.Volatility = 25
+		}},
+		{name: "wide radius", sensors: grid(4, 1), cfg: func(c *TransparencyConfig) {
+			c.NeighbourRadius = 10
+			c.MaxNeighbourDelta = 5
+			c.Volatility = 20
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultTransparencyConfig()
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			field := NewTransparencyField(cfg, rand.New(rand.NewSource(42)), nil)
+			at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+			for step := 0; step < 500; step++ {
+				sensor := tt.sensors[step%len(tt.sensors)]
+				value := field.Transparency(sensor, at.Add(time.Duration(step)*time.Minute))
+				if value < 0 || value > 100 {
+					t.Fatalf("step %d: transparency %d outside 0..100", step, value)
+				}
+				checkNeighbours(t, field, step)
+			}
+		})
+	}
+}
+
+func TestTransparencyFieldSettlesBetweenDisagreeingNeighbours(t *testing.T) {
+	tests := []struct {
+		name        string
+		left, right float64
+		bound       float64
+	}{
+		{name: "extremes", left: 0, right: 100, bound: 10},
+		{name: "just beyond twice the bound", left: 40, right: 61, bound: 10},
+		{name: "zero bound", left: 20, right: 80, bound: 0},
+		{name: "bound of one", left: 10, right: 30, bound: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultTransparencyConfig()
+			cfg.NeighbourRadius = 3
+			cfg.MaxNeighbourDelta = tt.bound
+			field := NewTransparencyField(cfg, rand.New(rand.NewSource(7)), nil)
+
+			// left and right are 4 apart, not neighbours of each other, while
+			// middle is a neighbour of both
+			sensors := line(3, 2)
+			at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+			field.Transparency(sensors[0], at)
+			field.Transparency(sensors[2], at)
+			field.index[sensors[0].ID].value = tt.left
+			field.index[sensors[2].ID].value = tt.right
+
+			field.Transparency(sensors[1], at)
+			checkNeighbours(t, field, 0)
+		})
+	}
+}
+
+func TestTransparencyFieldIsReproducible(t *testing.T) {
+	run := func() []int {
+		field := NewTransparencyField(DefaultTransparencyConfig(), rand.New(rand.NewSource(3)), nil)
+		sensors := grid(3, 1)
+		at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+		var values []int
+		for step := 0; step < 90; step++ {
+			values = append(values, field.Transparency(sensors[step%len(sensors)], at.Add(time.Duration(step)*time.Minute)))
+		}
+		return values
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("step %d: seeded runs differ, %d then %d", i, first[i], second[i])
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package health reports whether a process is alive and ready to serve
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/supervisor"
+)
+
+// Overall statuses
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+)
+
+// Check statuses
+const (
+	CheckUp      = "up"
+	CheckDown    = "down"
+	CheckFresh   = "fresh"
+	CheckStale   = "stale"
+	CheckUnknown = "unknown"
+)
+
+// Check is the result of checking a dependency or the freshness of a component
+type Check struct {
+	Status        string     `json:"status"`
+	LatencyMs     *int64     `json:"latencyMs,omitempty"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	AgeSeconds    *float64   `json:"ageSeconds,omitempty"`
+	MaxAgeSeconds *float64   `json:"maxAgeSeconds,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// Report is the JSON body of /healthz and /readyz
+type Report struct {
+	Status  string              `json:"status"`
+	Checks  map[string]Check    `json:"checks,omitempty"`
+	Workers []supervisor.Status `json:"workers,omitempty"`
+}
+
+// Checker serves /healthz and /readyz
+type Checker struct {
+	db          *sql.DB
+	redisClient *redis.Client
+	workers     *supervisor.Supervisor
+	freshness   map[string]time.Duration
+	timeout     time.Duration
+}
+
+// Option customizes a Checker
+type Option func(*Checker)
+
+// WithRedis checks the Redis connectivity
+func WithRedis(redisClient *redis.Client) Option {
+	return func(c *Checker) {
+		c.redisClient = redisClient
+	}
+}
+
+// WithWorkers reports the supervised workers, /healthz fails when one failed for
+// good and /readyz is degraded while one is restarting
+func WithWorkers(workers *supervisor.Supervisor) Option {
+	return func(c *Checker) {
+		c.workers = workers
+	}
+}
+
+// WithFreshness reports how long ago the component called name last succeeded,
+// it is stale after maxAge
+func WithFreshness(name string, maxAge time.Duration) Option {
+	return func(c *Checker) {
+		c.freshness[name] = maxAge
+	}
+}
+
+// WithTimeout bounds every dependency check
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = timeout
+	}
+}
+
+// New creates a checker of the PostgreSQL database db
+func New(db *sql.DB, opts ...Option) *Checker {
+	c := &Checker{
+		db:        db,
+		freshness: make(map[string]time.Duration),
+		timeout:   2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Liveness reports whether the process works, that is whether none of its workers
+// failed for good. Dependencies, and the workers restarting because of them, are
+// left to Readiness as restarting the process would not bring them back
+func (c *Checker) Liveness(ctx context.Context) Report {
+	report := Report{Status: StatusOK}
+	if c.workers != nil {
+		report.Workers = c.workers.Statuses()
+		if !c.workers.Healthy() {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// Readiness checks PostgreSQL, Redis and the freshness of the components. It is
+// down when a dependency is unreachable and degraded when a component is stale
+// or a worker is restarting
+func (c *Checker) Readiness(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Check)}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	record := func(name string, check Check) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Checks[name] = check
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		record("postgres", ping(func() error { return c.db.PingContext(ctx) }))
+	}()
+
+	if c.redisClient != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record("redis", ping(func() error { return c.redisClient.Ping(ctx).Err() }))
+		}()
+	}
+
+	if len(c.freshness) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name, check := range c.checkFreshness(ctx) {
+				record(name, check)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if c.workers != nil {
+		report.Workers = c.workers.Statuses()
+		if c.workers.Restarting() {
+			report.Status = StatusDegraded
+		}
+	}
+	for _, check := range report.Checks {
+		switch check.Status {
+		case CheckDown:
+			report.Status = StatusDown
+		case CheckStale, CheckUnknown:
+			if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+		}
+	}
+
+	return report
+}
+
+func (c *Checker) checkFreshness(ctx context.Context) map[string]Check {
+	checks := make(map[string]Check, len(c.freshness))
+
+	heartbeats, err := repository.Heartbeats(ctx, c.db)
+	for name, maxAge := range c.freshness {
+		maxAgeSeconds := maxAge.Seconds()
+		check := Check{Status: CheckUnknown, MaxAgeSeconds: &maxAgeSeconds}
+
+		if err != nil {
+			check.Error = err.Error()
+		} else if beat, ok := heartbeats[name]; ok {
+			at, age := beat.At, beat.Age.Seconds()
+			check.LastSuccess, check.AgeSeconds = &at, &age
+			check.Status = CheckFresh
+			if beat.Age > maxAge {
+				check.Status = CheckStale
+			}
+		}
+
+		checks[name] = check
+	}
+
+	return checks
+}
+
+func ping(fn func() error) Check {
+	started := time.Now()
+	err := fn()
+	latency := time.Since(started).Milliseconds()
+
+	if err != nil {
+		return Check{Status: CheckDown, LatencyMs: &latency, Error: err.Error()}
+	}
+	return Check{Status: CheckUp, LatencyMs: &latency}
+}
+
+// HandleLiveness serves the liveness report, with a 503 when the process is down
+func (c *Checker) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Liveness(r.Context()))
+}
+
+// HandleReadiness serves the readiness report, with a 503 when a dependency is down
+func (c *Checker) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Readiness(r.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	code := http.StatusOK
+	if report.Status == StatusDown {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Serve serves /healthz and /readyz on addr until ctx is done, for the commands
+// without an HTTP API. extra maps further paths to their handlers, such as /metrics
+func (c *Checker) Serve(ctx context.Context, addr string, extra map[string]http.Handler) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.HandleLiveness)
+	mux.HandleFunc("/readyz", c.HandleReadiness)
+	for path, handler := range extra {
+		mux.Handle(path, handler)
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
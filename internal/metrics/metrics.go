@@ -0,0 +1,298 @@
+// Package metrics exposes the service metrics in the Prometheus format
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sensors"
+
+// Registry holds every metric of the process
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	httpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	cacheRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit, miss, error).",
+	}, []string{"cache", "result"})
+
+	rateLimitRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ratelimit_requests_total",
+		Help:      "Rate limited requests by route class and result (allowed, limited, error).",
+	}, []string{"class", "result"})
+
+	streamSubscribers = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_subscribers",
+		Help:      "Clients subscribed to the live readings.",
+	})
+
+	streamDisconnects = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_slow_disconnects_total",
+		Help:      "Subscribers disconnected for falling too far behind the live readings.",
+	})
+
+	alertTransitions = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alert_transitions_total",
+		Help:      "Alerts entering a state by severity and state (pending, firing, resolved).",
+	}, []string{"severity", "state"})
+
+	webhookDeliveries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by result (delivered, failed, dead).",
+	}, []string{"result"})
+
+	anomalies = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "anomalies_total",
+		Help:      "Readings flagged as anomalies by metric.",
+	}, []string{"metric"})
+
+	sensorStatuses = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sensor_status",
+		Help:      "Sensors by health status (ok, stale, irregular, silent).",
+	}, []string{"status"})
+
+	queryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Repository query latency by query.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+
+	queryErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "Repository queries that failed by query.",
+	}, []string{"query"})
+
+	readingsGenerated = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_generated_total",
+		Help:      "Readings produced by the generator, faults included.",
+	})
+
+	readingsWritten = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_written_total",
+		Help:      "Readings written to the database.",
+	})
+
+	readingsDropped = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_dropped_total",
+		Help:      "Readings dropped after their batch could not be written.",
+	})
+
+	writeDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_batch_duration_seconds",
+		Help:      "Time spent writing a batch of readings, retries included.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	aggregationDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "aggregation_duration_seconds",
+		Help:      "Time spent aggregating the group statistics.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	aggregationErrors = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "aggregation_errors_total",
+		Help:      "Aggregations that failed.",
+	})
+)
+
+// Handler serves the metrics of Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Middleware counts and times the requests of a gorilla router by route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take the connection over, which switches protocols
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Cache results
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+// ObserveCache records the result of a cache lookup
+func ObserveCache(cache, result string) {
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// Rate limit results
+const (
+	RateLimitAllowed = "allowed"
+	RateLimitLimited = "limited"
+	RateLimitError   = "error"
+)
+
+// ObserveRateLimit records the result of a rate limit check
+func ObserveRateLimit(class, result string) {
+	rateLimitRequests.WithLabelValues(class, result).Inc()
+}
+
+// ObserveSubscribers records a change of the number of live reading subscribers
+func ObserveSubscribers(delta int) {
+	streamSubscribers.Add(float64(delta))
+}
+
+// ObserveSlowDisconnect records a subscriber disconnected for being too slow
+func ObserveSlowDisconnect() {
+	streamDisconnects.Inc()
+}
+
+// ObserveAlert records an alert of severity entering state
+func ObserveAlert(severity, state string) {
+	alertTransitions.WithLabelValues(severity, state).Inc()
+}
+
+// Webhook delivery results
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryDead      = "dead"
+)
+
+// ObserveDelivery records the result of a webhook delivery attempt
+func ObserveDelivery(result string) {
+	webhookDeliveries.WithLabelValues(result).Inc()
+}
+
+// ObserveAnomaly records a reading flagged as an anomaly of metric
+func ObserveAnomaly(metric string) {
+	anomalies.WithLabelValues(metric).Inc()
+}
+
+// ObserveSensorStatuses records the number of sensors in each health status,
+// replacing the previous counts
+func ObserveSensorStatuses(counts map[string]int) {
+	sensorStatuses.Reset()
+	for status, count := range counts {
+		sensorStatuses.WithLabelValues(status).Set(float64(count))
+	}
+}
+
+// ObserveQuery records the latency and outcome of a repository query
+func ObserveQuery(query string, started time.Time, err error) {
+	queryDuration.WithLabelValues(query).Observe(time.Since(started).Seconds())
+	if err != nil {
+		queryErrors.WithLabelValues(query).Inc()
+	}
+}
+
+// ObserveGenerated records readings produced by the generator
+func ObserveGenerated(n int) {
+	readingsGenerated.Add(float64(n))
+}
+
+// ObserveWrite records a batch of readings written to the database
+func ObserveWrite(written int, took time.Duration) {
+	readingsWritten.Add(float64(written))
+	writeDuration.Observe(took.Seconds())
+}
+
+// ObserveDrop records readings dropped by the writer
+func ObserveDrop(dropped int) {
+	readingsDropped.Add(float64(dropped))
+}
+
+// ObserveAggregation records the duration and outcome of an aggregation
+func ObserveAggregation(took time.Duration, err error) {
+	aggregationDuration.Observe(took.Seconds())
+	if err != nil {
+		aggregationErrors.Inc()
+	}
+}
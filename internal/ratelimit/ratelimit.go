@@ -0,0 +1,188 @@
+// Package ratelimit keeps clients within their request quotas with token buckets
+// stored in Redis, so every API instance shares them
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Class groups the routes sharing a quota, by how much they cost the database
+type Class string
+
+const (
+	// ClassRead is the group and sensor statistics, served by indexed queries or the cache
+	ClassRead Class = "read"
+	// ClassRegion is the region queries, scanning the readings of every sensor
+	ClassRegion Class = "region"
+	// ClassWrite is the changes to the topology
+	ClassWrite Class = "write"
+	// ClassAdmin is the key and tenant management
+	ClassAdmin Class = "admin"
+	// ClassAddress is every request of an IP address, taken before its
+	// credentials are checked so floods of bad credentials are limited too
+	ClassAddress Class = "ip"
+)
+
+// DefaultQuotas are the quotas of the -rate-limits flag
+const DefaultQuotas = "read=600/m,region=60/m,write=120/m,admin=60/m,ip=1200/m"
+
+// Quota lets a client send Limit requests per Period, in bursts of up to Burst
+type Quota struct {
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+// rate returns the tokens refilled per millisecond
+func (q Quota) rate() float64 {
+	return float64(q.Limit) / float64(q.Period.Milliseconds())
+}
+
+// Policy describes q in the RateLimit-Policy header syntax
+func (q Quota) Policy() string {
+	return fmt.Sprintf("%d;w=%d;burst=%d", q.Limit, int(q.Period.Seconds()), q.Burst)
+}
+
+// ParseQuotas reads quotas such as "read=600/m,region=60/m:10", a class getting
+// limit requests per s, m or h, with bursts of the optional number after the
+// colon, else of limit
+func ParseQuotas(s string) (map[Class]Quota, error) {
+	quotas := make(map[Class]Quota)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		class, spec, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota %q, want <class>=<limit>/<s|m|h>[:<burst>]", field)
+		}
+		spec, burst, hasBurst := strings.Cut(spec, ":")
+		limit, unit, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota %q, want <class>=<limit>/<s|m|h>[:<burst>]", field)
+		}
+
+		var quota Quota
+		var err error
+		if quota.Limit, err = strconv.Atoi(limit); err != nil || quota.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit in quota %q", field)
+		}
+		switch unit {
+		case "s":
+			quota.Period = time.Second
+		case "m":
+			quota.Period = time.Minute
+		case "h":
+			quota.Period = time.Hour
+		default:
+			return nil, fmt.Errorf("invalid period in quota %q, want s, m or h", field)
+		}
+		quota.Burst = quota.Limit
+		if hasBurst {
+			if quota.Burst, err = strconv.Atoi(burst); err != nil || quota.Burst <= 0 {
+				return nil, fmt.Errorf("invalid burst in quota %q", field)
+			}
+		}
+
+		switch Class(class) {
+		case ClassRead, ClassRegion, ClassWrite, ClassAdmin, ClassAddress:
+			quotas[Class(class)] = quota
+		default:
+			return nil, fmt.Errorf("unknown class %q in quota %q, want read, region, write, admin or ip", class, field)
+		}
+	}
+	return quotas, nil
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed bool
+	// Quota is the quota applied, zero when the class is not limited
+	Quota Quota
+	// Remaining is the number of requests that can be sent right away
+	Remaining int
+	// RetryAfter is how long until the next request is allowed, zero when allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Limiter takes tokens from the bucket of a client and class
+type Limiter struct {
+	client *redis.Client
+	quotas map[Class]Quota
+}
+
+// New creates a limiter applying quotas, classes without quota are not limited
+func New(client *redis.Client, quotas map[Class]Quota) *Limiter {
+	return &Limiter{client: client, quotas: quotas}
+}
+
+// tokenBucket refills the bucket for the time elapsed since it was last used, by
+// the clock of Redis so API instances with skewed clocks agree, then takes a
+// token from it when there is one. The bucket expires once it would be full again
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+local reset = math.ceil((burst - tokens) / rate)
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], reset + 1000)
+return {allowed, math.floor(tokens), retry, reset}
+`)
+
+// Allow takes a token from the bucket of client for class, a class without quota
+// is always allowed. The request is allowed too when Redis fails, with the error
+func (l *Limiter) Allow(ctx context.Context, class Class, client string) (Result, error) {
+	quota, ok := l.quotas[class]
+	if !ok {
+		return Result{Allowed: true}, nil
+	}
+
+	key := "ratelimit:" + string(class) + ":" + client
+	values, err := tokenBucket.Run(ctx, l.client, []string{key}, strconv.FormatFloat(quota.rate(), 'g', -1, 64), quota.Burst).Int64Slice()
+	if err != nil {
+		return Result{Allowed: true}, err
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Quota:      quota,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		Reset:      time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// Seconds rounds d up to whole seconds, as the rate limit headers want them
+func Seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestParseQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[Class]Quota
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: map[Class]Quota{}},
+		{name: "default", s: DefaultQuotas, want: map[Class]Quota{
+			ClassRead:    {Limit: 600, Period: time.Minute, Burst: 600},
+			ClassRegion:  {Limit: 60, Period: time.Minute, Burst: 60},
+			ClassWrite:   {Limit: 120, Period: time.Minute, Burst: 120},
+			ClassAdmin:   {Limit: 60, Period: time.Minute, Burst: 60},
+			ClassAddress: {Limit: 1200, Period: time.Minute, Burst: 1200},
+		}},
+		{name: "burst and spaces", s: " read=10/s:20 , region=5/h ", want: map[Class]Quota{
+			ClassRead:   {Limit: 10, Period: time.Second, Burst: 20},
+			ClassRegion: {Limit: 5, Period: time.Hour, Burst: 5},
+		}},
+		{name: "missing equal", s: "read", wantErr: true},
+		{name: "missing period", s: "read=10", wantErr: true},
+		{name: "zero limit", s: "read=0/s", wantErr: true},
+		{name: "invalid limit", s: "read=ten/s", wantErr: true},
+		{name: "unknown period", s: "read=10/d", wantErr: true},
+		{name: "zero burst", s: "read=10/s:0", wantErr: true},
+		{name: "unknown class", s: "delete=10/s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas, err := ParseQuotas(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuotas(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(quotas, tt.want) {
+				t.Errorf("ParseQuotas(%q) = %v, want %v", tt.s, quotas, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaPolicy(t *testing.T) {
+	quota := Quota{Limit: 60, Period: time.Minute, Burst: 5}
+	if got, want := quota.Policy(), "60;w=60;burst=5"; got != want {
+		t.Errorf("Policy() = %q, want %q", got, want)
+	}
+}
+
+// TestTokenBucket runs the token bucket script against the Redis at
+// TEST_REDIS_ADDR, it is skipped when unset
+func TestTokenBucket(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	// 1 request per second, in bursts of 3
+	limiter := New(client, map[Class]Quota{ClassRead: {Limit: 1, Period: time.Second, Burst: 3}})
+	id := "test:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer client.Del(ctx, "ratelimit:read:"+id)
+
+	for i, remaining := range []int{2, 1, 0} {
+		result, err := limiter.Allow(ctx, ClassRead, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != remaining {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i, result, remaining)
+		}
+	}
+
+	result, err := limiter.Allow(ctx, ClassRead, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Fatalf("request over the burst = %+v, want refused with a retry within a second", result)
+	}
+	if result.Reset <= 2*time.Second || result.Reset > 3*time.Second {
+		t.Errorf("Reset = %v, want the time to refill 3 tokens", result.Reset)
+	}
+
+	time.Sleep(result.RetryAfter)
+	if result, err = limiter.Allow(ctx, ClassRead, id); err != nil || !result.Allowed {
+		t.Errorf("request after the refill = %+v, %v, want allowed", result, err)
+	}
+
+	if result, err = limiter.Allow(ctx, ClassWrite, id); err != nil || !result.Allowed || result.Quota.Limit != 0 {
+		t.Errorf("request of a class without quota = %+v, %v, want allowed without quota", result, err)
+	}
+}
@@ -0,0 +1,459 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Alert states. An alert is pending while the condition of its rule has not held
+// for the duration of the rule yet, firing once it has, and resolved when the
+// condition stops holding or the rule changes
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule raises an alert when Aggregate of Metric over the last Window of the
+// sensor called CodeName, else of the group called Group, else of every group of
+// the tenant compares to Threshold with Operator for at least For
+type AlertRule struct {
+	ID        int
+	TenantID  int
+	Name      string
+	Metric    string
+	Aggregate string
+	Window    time.Duration
+	Group     string
+	CodeName  string
+	// SensorGroup is the group the sensor of the rule is in now, empty for the
+	// rules of a group or of every group
+	SensorGroup string
+	Operator    string
+	Threshold   float64
+	For         time.Duration
+	Severity    string
+	Enabled     bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// ScopeGroup is the group the readings of r come from, empty for every group
+func (r AlertRule) ScopeGroup() string {
+	if r.CodeName != "" {
+		return r.SensorGroup
+	}
+	return r.Group
+}
+
+// ruleSnapshot is what the audit log keeps of an alert rule
+type ruleSnapshot struct {
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`
+	Aggregate string  `json:"aggregate"`
+	Window    string  `json:"window"`
+	Group     string  `json:"group,omitempty"`
+	Sensor    string  `json:"sensor,omitempty"`
+	Operator  string  `json:"operator"`
+	Threshold float64 `json:"threshold"`
+	For       string  `json:"for"`
+	Severity  string  `json:"severity"`
+	Enabled   bool    `json:"enabled"`
+}
+
+func (r AlertRule) snapshot() ruleSnapshot {
+	return ruleSnapshot{
+		Name:      r.Name,
+		Metric:    r.Metric,
+		Aggregate: r.Aggregate,
+		Window:    r.Window.String(),
+		Group:     r.Group,
+		Sensor:    r.CodeName,
+		Operator:  r.Operator,
+		Threshold: r.Threshold,
+		For:       r.For.String(),
+		Severity:  r.Severity,
+		Enabled:   r.Enabled,
+	}
+}
+
+// Alert is an occurrence of the condition of a rule. The rule name, severity and
+// scope are copied so the alert outlives its rule, RuleID being nil once the rule
+// is deleted. Group is the group the readings came from when the alert started.
+// SensorID is the sensor an alert without rule was raised for, nil once it is
+// deleted
+type Alert struct {
+	ID         int64
+	TenantID   int
+	RuleID     *int
+	RuleName   string
+	Severity   string
+	Group      string
+	CodeName   string
+	State      string
+	Value      *float64
+	StartedAt  time.Time
+	FiredAt    *time.Time
+	ResolvedAt *time.Time
+	SensorID   *int
+}
+
+const ruleColumns = `
+	SELECT r.id, r.tenant_id, r.name, r.metric, r.aggregate, r.window_seconds, r.group_name, r.codename,
+		COALESCE(sg.name, ''), r.operator, r.threshold, r.for_seconds, r.severity, r.enabled, r.created_at, r.updated_at
+	FROM alert_rules r
+	LEFT JOIN sensors s ON s.tenant_id = r.tenant_id AND s.codename = r.codename
+	LEFT JOIN sensor_groups sg ON sg.id = s.group_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRule(row scanner) (AlertRule, error) {
+	var (
+		rule                AlertRule
+		windowSecs, forSecs int
+	)
+	err := row.Scan(&rule.ID, &rule.TenantID, &rule.Name, &rule.Metric, &rule.Aggregate, &windowSecs, &rule.Group, &rule.CodeName,
+		&rule.SensorGroup, &rule.Operator, &rule.Threshold, &forSecs, &rule.Severity, &rule.Enabled, &rule.CreatedAt, &rule.UpdatedAt)
+	rule.Window = time.Duration(windowSecs) * time.Second
+	rule.For = time.Duration(forSecs) * time.Second
+	return rule, err
+}
+
+// CreateAlertRule stores rule, filling its ID and timestamps
+func CreateAlertRule(ctx context.Context, db *sql.DB, actor Actor, rule *AlertRule) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO alert_rules (tenant_id, name, metric, aggregate, window_seconds, group_name, codename,
+			operator, threshold, for_seconds, severity, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at, updated_at;
+	`, rule.TenantID, rule.Name, rule.Metric, rule.Aggregate, int(rule.Window.Seconds()), rule.Group, rule.CodeName,
+		rule.Operator, rule.Threshold, int(rule.For.Seconds()), rule.Severity, rule.Enabled).Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrAlertRuleExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &rule.TenantID, actor, ActionAlertRuleCreate, "alert_rule", strconv.Itoa(rule.ID), nil, rule.snapshot()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceAlertRule replaces the rule of rule.TenantID with rule.ID by rule. Its open
+// alert is resolved, the evaluation starts over with the new condition
+func ReplaceAlertRule(ctx context.Context, db *sql.DB, actor Actor, rule *AlertRule) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockAlertRule(ctx, tx, rule.TenantID, rule.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE alert_rules
+		SET name = $3, metric = $4, aggregate = $5, window_seconds = $6, group_name = $7, codename = $8,
+			operator = $9, threshold = $10, for_seconds = $11, severity = $12, enabled = $13, updated_at = NOW()
+		WHERE tenant_id = $1 AND id = $2
+		RETURNING created_at, updated_at;
+	`, rule.TenantID, rule.ID, rule.Name, rule.Metric, rule.Aggregate, int(rule.Window.Seconds()), rule.Group, rule.CodeName,
+		rule.Operator, rule.Threshold, int(rule.For.Seconds()), rule.Severity, rule.Enabled).Scan(&rule.CreatedAt, &rule.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrAlertRuleExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := resolveRuleAlert(ctx, tx, rule.ID); err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &rule.TenantID, actor, ActionAlertRuleUpdate, "alert_rule", strconv.Itoa(rule.ID), before.snapshot(), rule.snapshot()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteAlertRule deletes the rule of tenantID with id after resolving its open
+// alert, the alerts it raised are kept
+func DeleteAlertRule(ctx context.Context, db *sql.DB, actor Actor, tenantID, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockAlertRule(ctx, tx, tenantID, id)
+	if err != nil {
+		return err
+	}
+	if err := resolveRuleAlert(ctx, tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM alert_rules WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &tenantID, actor, ActionAlertRuleDelete, "alert_rule", strconv.Itoa(id), before.snapshot(), nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockAlertRule returns the rule of tenantID with id, locked until tx ends
+func lockAlertRule(ctx context.Context, tx *sql.Tx, tenantID, id int) (AlertRule, error) {
+	rule, err := scanRule(tx.QueryRowContext(ctx, ruleColumns+`
+		WHERE r.tenant_id = $1 AND r.id = $2
+		FOR UPDATE OF r;
+	`, tenantID, id))
+	if err == sql.ErrNoRows {
+		return rule, ErrAlertRuleNotFound
+	}
+	return rule, err
+}
+
+// resolveRuleAlert resolves the open alert of the rule with id, if any
+func resolveRuleAlert(ctx context.Context, tx *sql.Tx, id int) error {
+	alert, err := scanAlert(tx.QueryRowContext(ctx, `
+		UPDATE alerts SET state = 'resolved', resolved_at = NOW()
+		WHERE rule_id = $1 AND resolved_at IS NULL
+		RETURNING `+alertColumns+`;
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return enqueueAlert(ctx, tx, alert)
+}
+
+// FetchAlertRule returns the rule of tenantID with id
+func FetchAlertRule(ctx context.Context, db *sql.DB, tenantID, id int) (rule AlertRule, err error) {
+	ctx, end := start(ctx, "alert_rule")
+	defer end(&err)
+
+	rule, err = scanRule(db.QueryRowContext(ctx, ruleColumns+" WHERE r.tenant_id = $1 AND r.id = $2", tenantID, id))
+	if err == sql.ErrNoRows {
+		return rule, ErrAlertRuleNotFound
+	}
+	return rule, err
+}
+
+// ListAlertRules returns the rules of tenantID, of every tenant when it is nil,
+// ordered by id
+func ListAlertRules(ctx context.Context, db *sql.DB, tenantID *int) (rules []AlertRule, err error) {
+	ctx, end := start(ctx, "alert_rules")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, ruleColumns+" WHERE $1::int IS NULL OR r.tenant_id = $1 ORDER BY r.id", nullable(tenantID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+const alertColumns = `id, tenant_id, rule_id, rule_name, severity, group_name, codename, state, value, started_at, fired_at, resolved_at, sensor_id`
+
+func scanAlert(row scanner) (Alert, error) {
+	var (
+		alert            Alert
+		ruleID, sensorID sql.NullInt64
+		value            sql.NullFloat64
+		fired, resolved  sql.NullTime
+	)
+	err := row.Scan(&alert.ID, &alert.TenantID, &ruleID, &alert.RuleName, &alert.Severity, &alert.Group, &alert.CodeName,
+		&alert.State, &value, &alert.StartedAt, &fired, &resolved, &sensorID)
+	alert.RuleID, alert.SensorID = nullInt(ruleID), nullInt(sensorID)
+	if value.Valid {
+		alert.Value = &value.Float64
+	}
+	if fired.Valid {
+		alert.FiredAt = &fired.Time
+	}
+	if resolved.Valid {
+		alert.ResolvedAt = &resolved.Time
+	}
+	return alert, err
+}
+
+// OpenAlertOf returns the alert of the rule with id that is not resolved, nil
+// when there is none
+func OpenAlertOf(ctx context.Context, db *sql.DB, id int) (alert *Alert, err error) {
+	ctx, end := start(ctx, "open_alert")
+	defer end(&err)
+
+	found, err := scanAlert(db.QueryRowContext(ctx, "SELECT "+alertColumns+" FROM alerts WHERE rule_id = $1 AND resolved_at IS NULL", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// OpenAlert starts an alert of rule in state, pending or firing, value being the
+// one that met its condition
+func OpenAlert(ctx context.Context, db *sql.DB, rule AlertRule, state string, value float64) (alert Alert, err error) {
+	ctx, end := start(ctx, "open_alert")
+	defer end(&err)
+
+	return transitionAlert(ctx, db, `
+		INSERT INTO alerts (tenant_id, rule_id, rule_name, severity, group_name, codename, state, value, fired_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $7 = 'firing' THEN NOW() END)
+		RETURNING `+alertColumns+`;
+	`, rule.TenantID, rule.ID, rule.Name, rule.Severity, rule.ScopeGroup(), rule.CodeName, state, value)
+}
+
+// FireAlert fires the pending alert with id, value being the one that met the
+// condition of its rule. ErrAlertNotFound is returned when it is not pending anymore
+func FireAlert(ctx context.Context, db *sql.DB, id int64, value float64) (alert Alert, err error) {
+	ctx, end := start(ctx, "fire_alert")
+	defer end(&err)
+
+	return transitionAlert(ctx, db, `
+		UPDATE alerts SET state = 'firing', value = $2, fired_at = NOW()
+		WHERE id = $1 AND state = 'pending'
+		RETURNING `+alertColumns+`;
+	`, id, value)
+}
+
+// ResolveAlert resolves the open alert with id. ErrAlertNotFound is returned when
+// it is resolved already
+func ResolveAlert(ctx context.Context, db *sql.DB, id int64) (alert Alert, err error) {
+	ctx, end := start(ctx, "resolve_alert")
+	defer end(&err)
+
+	return transitionAlert(ctx, db, `
+		UPDATE alerts SET state = 'resolved', resolved_at = NOW()
+		WHERE id = $1 AND resolved_at IS NULL
+		RETURNING `+alertColumns+`;
+	`, id)
+}
+
+// transitionAlert runs query, which returns the alert entering a state, and
+// enqueues the event of the transition along with it. ErrAlertNotFound is returned
+// when query returns no alert
+func transitionAlert(ctx context.Context, db *sql.DB, query string, args ...interface{}) (alert Alert, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return alert, err
+	}
+	defer tx.Rollback()
+
+	alert, err = scanAlert(tx.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return alert, ErrAlertNotFound
+	}
+	if err != nil {
+		return alert, err
+	}
+	if err := enqueueAlert(ctx, tx, alert); err != nil {
+		return alert, err
+	}
+
+	return alert, tx.Commit()
+}
+
+// AlertFilter selects alerts, zero fields select everything
+type AlertFilter struct {
+	TenantID int
+	// Groups restricts the alerts to those read in one of the groups, nil
+	// selects the alerts of every group and of the rules spanning groups
+	Groups   []string
+	RuleID   int
+	State    string
+	Open     bool
+	Severity string
+	From     *time.Time
+	Till     *time.Time
+	// BeforeID pages through the alerts, newest first
+	BeforeID int64
+	Limit    int
+}
+
+// ListAlerts returns the alerts matching filter, newest first
+func ListAlerts(ctx context.Context, db *sql.DB, filter AlertFilter) (alerts []Alert, err error) {
+	ctx, end := start(ctx, "alerts")
+	defer end(&err)
+
+	query := "SELECT " + alertColumns + " FROM alerts WHERE tenant_id = $1"
+	args := []interface{}{filter.TenantID}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if filter.Groups != nil {
+		where("group_name = ANY($%d)", pq.Array(filter.Groups))
+	}
+	if filter.RuleID != 0 {
+		where("rule_id = $%d", filter.RuleID)
+	}
+	if filter.State != "" {
+		where("state = $%d", filter.State)
+	}
+	if filter.Open {
+		query += " AND resolved_at IS NULL"
+	}
+	if filter.Severity != "" {
+		where("severity = $%d", filter.Severity)
+	}
+	if filter.From != nil {
+		where("started_at >= $%d", *filter.From)
+	}
+	if filter.Till != nil {
+		where("started_at <= $%d", *filter.Till)
+	}
+	if filter.BeforeID > 0 {
+		where("id < $%d", filter.BeforeID)
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", filter.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
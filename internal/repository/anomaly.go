@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Anomaly is a reading whose Metric deviated from the baseline of its sensor,
+// Score being the deviation in standard deviations as measured by Method
+type Anomaly struct {
+	ID        int64
+	TenantID  int
+	Group     string
+	CodeName  string
+	ReadingID int64
+	Metric    string
+	Method    string
+	Value     float64
+	Expected  float64
+	Score     float64
+	Threshold float64
+	ReadAt    time.Time
+	CreatedAt time.Time
+}
+
+// AnomalySettings tunes the anomaly detection of a group. Threshold is the
+// deviation, in standard deviations, a reading is flagged from, nil for the
+// default of the detector
+type AnomalySettings struct {
+	TenantID  int
+	Group     string
+	Threshold *float64
+	Enabled   bool
+}
+
+// Baseline is the learnt state of the anomaly detection of a metric of a sensor,
+// TenantID and CodeName are only filled by LoadBaselines
+type Baseline struct {
+	SensorID int
+	TenantID int
+	CodeName string
+	Metric   string
+	State    json.RawMessage
+}
+
+// RecordAnomaly stores anomaly, filling its ID and CreatedAt
+func RecordAnomaly(ctx context.Context, db *sql.DB, anomaly *Anomaly) (err error) {
+	ctx, end := start(ctx, "record_anomaly")
+	defer end(&err)
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO anomalies (tenant_id, group_name, codename, reading_id, metric, method, value, expected, score, threshold, read_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at;
+	`, anomaly.TenantID, anomaly.Group, anomaly.CodeName, anomaly.ReadingID, anomaly.Metric, anomaly.Method, anomaly.Value,
+		anomaly.Expected, anomaly.Score, anomaly.Threshold, anomaly.ReadAt).Scan(&anomaly.ID, &anomaly.CreatedAt)
+}
+
+// AnomalyFilter selects the anomalies of a sensor, zero fields select everything
+type AnomalyFilter struct {
+	TenantID int
+	CodeName string
+	Metric   string
+	From     *time.Time
+	Till     *time.Time
+	// BeforeID pages through the anomalies, newest first
+	BeforeID int64
+	Limit    int
+}
+
+// ListAnomalies returns the anomalies matching filter, newest first
+func ListAnomalies(ctx context.Context, db *sql.DB, filter AnomalyFilter) (anomalies []Anomaly, err error) {
+	ctx, end := start(ctx, "anomalies")
+	defer end(&err)
+
+	query := `
+		SELECT id, tenant_id, group_name, codename, reading_id, metric, method, value, expected, score, threshold, read_at, created_at
+		FROM anomalies
+		WHERE tenant_id = $1 AND codename = $2`
+	args := []interface{}{filter.TenantID, filter.CodeName}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if filter.Metric != "" {
+		where("metric = $%d", filter.Metric)
+	}
+	if filter.From != nil {
+		where("read_at >= $%d", *filter.From)
+	}
+	if filter.Till != nil {
+		where("read_at <= $%d", *filter.Till)
+	}
+	if filter.BeforeID > 0 {
+		where("id < $%d", filter.BeforeID)
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", filter.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var anomaly Anomaly
+		if err := rows.Scan(&anomaly.ID, &anomaly.TenantID, &anomaly.Group, &anomaly.CodeName, &anomaly.ReadingID, &anomaly.Metric,
+			&anomaly.Method, &anomaly.Value, &anomaly.Expected, &anomaly.Score, &anomaly.Threshold, &anomaly.ReadAt, &anomaly.CreatedAt); err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return anomalies, rows.Err()
+}
+
+// FetchAnomalySettings returns the settings of the group of tenantID called groupName
+func FetchAnomalySettings(ctx context.Context, db *sql.DB, tenantID int, groupName string) (settings AnomalySettings, err error) {
+	ctx, end := start(ctx, "anomaly_settings")
+	defer end(&err)
+
+	settings = AnomalySettings{TenantID: tenantID, Group: groupName}
+	var threshold sql.NullFloat64
+	err = db.QueryRowContext(ctx, "SELECT anomaly_threshold, anomaly_enabled FROM sensor_groups WHERE tenant_id = $1 AND name = $2",
+		tenantID, groupName).Scan(&threshold, &settings.Enabled)
+	if err == sql.ErrNoRows {
+		return settings, ErrGroupNotFound
+	}
+	if threshold.Valid {
+		settings.Threshold = &threshold.Float64
+	}
+	return settings, err
+}
+
+// ListAnomalySettings returns the settings of the groups of every tenant that
+// differ from the defaults
+func ListAnomalySettings(ctx context.Context, db *sql.DB) (settings []AnomalySettings, err error) {
+	ctx, end := start(ctx, "anomaly_settings")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT tenant_id, name, anomaly_threshold, anomaly_enabled
+		FROM sensor_groups
+		WHERE anomaly_threshold IS NOT NULL OR NOT anomaly_enabled;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			group     AnomalySettings
+			threshold sql.NullFloat64
+		)
+		if err := rows.Scan(&group.TenantID, &group.Group, &threshold, &group.Enabled); err != nil {
+			return nil, err
+		}
+		if threshold.Valid {
+			group.Threshold = &threshold.Float64
+		}
+		settings = append(settings, group)
+	}
+
+	return settings, rows.Err()
+}
+
+// UpdateAnomalySettings replaces the settings of the group of settings.TenantID
+// called settings.Group
+func UpdateAnomalySettings(ctx context.Context, db *sql.DB, actor Actor, settings AnomalySettings) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		before    AnomalySettings
+		threshold sql.NullFloat64
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT anomaly_threshold, anomaly_enabled
+		FROM sensor_groups
+		WHERE tenant_id = $1 AND name = $2
+		FOR UPDATE;
+	`, settings.TenantID, settings.Group).Scan(&threshold, &before.Enabled)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if threshold.Valid {
+		before.Threshold = &threshold.Float64
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sensor_groups SET anomaly_threshold = $3, anomaly_enabled = $4 WHERE tenant_id = $1 AND name = $2",
+		settings.TenantID, settings.Group, nullable(settings.Threshold), settings.Enabled)
+	if err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &settings.TenantID, actor, ActionAnomalySettingsUpdate, "group", settings.Group,
+		before.snapshot(), settings.snapshot()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// anomalySettingsSnapshot is what the audit log keeps of the settings of a group
+type anomalySettingsSnapshot struct {
+	Threshold *float64 `json:"anomalyThreshold"`
+	Enabled   bool     `json:"anomalyDetection"`
+}
+
+func (s AnomalySettings) snapshot() anomalySettingsSnapshot {
+	return anomalySettingsSnapshot{Threshold: s.Threshold, Enabled: s.Enabled}
+}
+
+// LoadBaselines returns the stored baselines of the sensors of every tenant
+func LoadBaselines(ctx context.Context, db *sql.DB) (baselines []Baseline, err error) {
+	ctx, end := start(ctx, "load_baselines")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.sensor_id, s.tenant_id, s.codename, b.metric, b.state
+		FROM anomaly_baselines b
+		JOIN sensors s ON s.id = b.sensor_id;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			baseline Baseline
+			state    []byte
+		)
+		if err := rows.Scan(&baseline.SensorID, &baseline.TenantID, &baseline.CodeName, &baseline.Metric, &state); err != nil {
+			return nil, err
+		}
+		baseline.State = state
+		baselines = append(baselines, baseline)
+	}
+
+	return baselines, rows.Err()
+}
+
+// SaveBaselines stores baselines, replacing the previous state of each. The
+// baselines of sensors deleted meanwhile are dropped
+func SaveBaselines(ctx context.Context, db *sql.DB, baselines []Baseline) (err error) {
+	ctx, end := start(ctx, "save_baselines")
+	defer end(&err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO anomaly_baselines (sensor_id, metric, state)
+		SELECT id, $2, $3 FROM sensors WHERE id = $1
+		ON CONFLICT (sensor_id, metric) DO UPDATE SET state = EXCLUDED.state, updated_at = NOW();
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, baseline := range baselines {
+		if _, err := stmt.ExecContext(ctx, baseline.SensorID, baseline.Metric, string(baseline.State)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIKey is a stored API key, the key itself is only known by its SHA-256 hash.
+// A key without tenant is a platform key
+type APIKey struct {
+	ID        int
+	TenantID  *int
+	Tenant    string
+	Name      string
+	Prefix    string
+	Scopes    []string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+// keySnapshot is what the audit log keeps of an API key, never its hash
+type keySnapshot struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k APIKey) snapshot() keySnapshot {
+	return keySnapshot{ID: k.ID, Name: k.Name, Prefix: k.Prefix, Scopes: k.Scopes, RevokedAt: k.RevokedAt}
+}
+
+// CreateAPIKey stores a key of tenantID, nil for a platform key, by its hash,
+// prefix being the part shown to tell keys apart
+func CreateAPIKey(ctx context.Context, db *sql.DB, actor Actor, tenantID *int, name, prefix, hash string, scopes []string) (APIKey, error) {
+	key := APIKey{TenantID: tenantID, Name: name, Prefix: prefix, Scopes: scopes}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return key, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO api_keys (tenant_id, name, prefix, hash, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, COALESCE((SELECT name FROM tenants WHERE id = $1), '');
+	`, nullable(tenantID), name, prefix, hash, pq.Array(scopes)).Scan(&key.ID, &key.CreatedAt, &key.Tenant)
+	if err != nil {
+		return key, err
+	}
+
+	if err := audit(ctx, tx, tenantID, actor, ActionKeyIssue, "api_key", strconv.Itoa(key.ID), nil, key.snapshot()); err != nil {
+		return key, err
+	}
+
+	return key, tx.Commit()
+}
+
+// APIKeyByHash returns the key that is not revoked with hash
+func APIKeyByHash(ctx context.Context, db *sql.DB, hash string) (APIKey, error) {
+	var (
+		key      APIKey
+		tenantID sql.NullInt64
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT k.id, k.tenant_id, COALESCE(t.name, ''), k.name, k.prefix, k.scopes, k.created_at
+		FROM api_keys k
+		LEFT JOIN tenants t ON t.id = k.tenant_id
+		WHERE k.hash = $1 AND k.revoked_at IS NULL;
+	`, hash).Scan(&key.ID, &tenantID, &key.Tenant, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return key, ErrAPIKeyNotFound
+	}
+	key.TenantID = nullInt(tenantID)
+	return key, err
+}
+
+// ListAPIKeys returns the keys of tenantID, every key when it is nil, revoked
+// ones included, ordered by id
+func ListAPIKeys(ctx context.Context, db *sql.DB, tenantID *int) ([]APIKey, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT k.id, k.tenant_id, COALESCE(t.name, ''), k.name, k.prefix, k.scopes, k.created_at, k.revoked_at
+		FROM api_keys k
+		LEFT JOIN tenants t ON t.id = k.tenant_id
+		WHERE $1::int IS NULL OR k.tenant_id = $1
+		ORDER BY k.id;
+	`, nullable(tenantID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var (
+			key       APIKey
+			keyTenant sql.NullInt64
+			revokedAt sql.NullTime
+		)
+		if err := rows.Scan(&key.ID, &keyTenant, &key.Tenant, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		key.TenantID = nullInt(keyTenant)
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the key with id of tenantID, of any tenant when it is nil.
+// Revoking a revoked key is a no-op
+func RevokeAPIKey(ctx context.Context, db *sql.DB, actor Actor, tenantID *int, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		before    APIKey
+		keyTenant sql.NullInt64
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, tenant_id, name, prefix, scopes, revoked_at
+		FROM api_keys
+		WHERE id = $1 AND ($2::int IS NULL OR tenant_id = $2)
+		FOR UPDATE;
+	`, id, nullable(tenantID)).Scan(&before.ID, &keyTenant, &before.Name, &before.Prefix, pq.Array(&before.Scopes), &revokedAt)
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if revokedAt.Valid {
+		return nil
+	}
+
+	after := before
+	err = tx.QueryRowContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 RETURNING revoked_at", id).Scan(&revokedAt)
+	if err != nil {
+		return err
+	}
+	after.RevokedAt = &revokedAt.Time
+
+	// The entry belongs to the tenant of the key, even when a platform admin revokes it
+	if err := audit(ctx, tx, nullInt(keyTenant), actor, ActionKeyRevoke, "api_key", strconv.Itoa(id), before.snapshot(), after.snapshot()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func nullInt(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Audited actions
+const (
+	ActionGroupCreate           = "group.create"
+	ActionSensorCreate          = "sensor.create"
+	ActionSensorUpdate          = "sensor.update"
+	ActionSensorDelete          = "sensor.delete"
+	ActionKeyIssue              = "api_key.issue"
+	ActionKeyRevoke             = "api_key.revoke"
+	ActionTenantCreate          = "tenant.create"
+	ActionAlertRuleCreate       = "alert_rule.create"
+	ActionAlertRuleUpdate       = "alert_rule.update"
+	ActionAlertRuleDelete       = "alert_rule.delete"
+	ActionWebhookCreate         = "webhook.create"
+	ActionWebhookDelete         = "webhook.delete"
+	ActionWebhookReplay         = "webhook.replay"
+	ActionAnomalySettingsUpdate = "anomaly_settings.update"
+)
+
+// Actor is who a change is recorded for
+type Actor struct {
+	Subject     string
+	PrincipalID string
+	Method      string
+	RequestID   string
+}
+
+// AuditEntry records a change: who made it, to which entity, and the entity
+// before and after it, nil when it did not exist
+type AuditEntry struct {
+	ID         int64
+	TenantID   *int
+	Tenant     string
+	Actor      Actor
+	Action     string
+	EntityType string
+	EntityID   string
+	Before     json.RawMessage
+	After      json.RawMessage
+	CreatedAt  time.Time
+}
+
+// sensorSnapshot is what the audit log keeps of a sensor
+type sensorSnapshot struct {
+	CodeName string  `json:"codeName"`
+	Group    string  `json:"group"`
+	Index    int     `json:"index"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Z        float64 `json:"z"`
+	DataRate int     `json:"dataRate"`
+}
+
+// audit appends an entry to the audit log within tx, so the change and its record
+// are committed together. before and after are stored as JSON, nil as NULL
+func audit(ctx context.Context, tx *sql.Tx, tenantID *int, actor Actor, action, entityType, entityID string, before, after interface{}) error {
+	beforeJSON, err := snapshotJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := snapshotJSON(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_log (tenant_id, actor, principal_id, auth_method, request_id, action, entity_type, entity_id, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+	`, nullable(tenantID), actor.Subject, actor.PrincipalID, actor.Method, actor.RequestID, action, entityType, entityID, beforeJSON, afterJSON)
+	return err
+}
+
+func snapshotJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// AuditFilter selects audit entries, zero fields select everything
+type AuditFilter struct {
+	// TenantID restricts the entries to a tenant, nil selects every tenant and
+	// the platform entries
+	TenantID   *int
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   string
+	From       *time.Time
+	Till       *time.Time
+	// BeforeID pages through the entries, newest first
+	BeforeID int64
+	Limit    int
+}
+
+// ListAuditEntries returns the entries matching filter, newest first
+func ListAuditEntries(ctx context.Context, db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+	query := `
+		SELECT a.id, a.tenant_id, COALESCE(t.name, ''), a.actor, a.principal_id, a.auth_method, a.request_id,
+			a.action, a.entity_type, a.entity_id, a.before, a.after, a.created_at
+		FROM audit_log a
+		LEFT JOIN tenants t ON t.id = a.tenant_id
+		WHERE TRUE`
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if filter.TenantID != nil {
+		where("a.tenant_id = $%d", *filter.TenantID)
+	}
+	if filter.Actor != "" {
+		where("a.actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("a.action = $%d", filter.Action)
+	}
+	if filter.EntityType != "" {
+		where("a.entity_type = $%d", filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		where("a.entity_id = $%d", filter.EntityID)
+	}
+	if filter.From != nil {
+		where("a.created_at >= $%d", *filter.From)
+	}
+	if filter.Till != nil {
+		where("a.created_at <= $%d", *filter.Till)
+	}
+	if filter.BeforeID > 0 {
+		where("a.id < $%d", filter.BeforeID)
+	}
+	query += fmt.Sprintf(" ORDER BY a.id DESC LIMIT %d", filter.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var (
+			entry         AuditEntry
+			tenantID      sql.NullInt64
+			before, after []byte
+		)
+		if err := rows.Scan(&entry.ID, &tenantID, &entry.Tenant, &entry.Actor.Subject, &entry.Actor.PrincipalID, &entry.Actor.Method,
+			&entry.Actor.RequestID, &entry.Action, &entry.EntityType, &entry.EntityID, &before, &after, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.TenantID = nullInt(tenantID)
+		if before != nil {
+			entry.Before = before
+		}
+		if after != nil {
+			entry.After = after
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SensorCommand changes the groups and sensors of the topology of a tenant, every
+// change is recorded in the audit log on behalf of actor
+type SensorCommand interface {
+	CreateGroup(ctx context.Context, actor Actor, name string) (SensorGroup, error)
+	CreateSensor(ctx context.Context, actor Actor, groupName string, sensor *Sensor) error
+	UpdateSensor(ctx context.Context, actor Actor, codeName string, update SensorUpdate) (Sensor, error)
+	DeleteSensor(ctx context.Context, actor Actor, codeName string) error
+}
+
+// SensorUpdate holds the fields of a sensor to change, nil fields are left as is
+type SensorUpdate struct {
+	GroupName *string
+	X         *float64
+	Y         *float64
+	Z         *float64
+	DataRate  *int
+}
+
+type sensorCommand struct {
+	db       *sql.DB
+	tenantID int
+}
+
+// CreateGroup adds a group called name
+func (c *sensorCommand) CreateGroup(ctx context.Context, actor Actor, name string) (group SensorGroup, err error) {
+	ctx, end := start(ctx, "create_group")
+	defer end(&err)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return group, err
+	}
+	defer tx.Rollback()
+
+	group = SensorGroup{TenantID: c.tenantID, Name: name}
+	err = tx.QueryRowContext(ctx, "INSERT INTO sensor_groups (tenant_id, name) VALUES ($1, $2) RETURNING id", c.tenantID, name).Scan(&group.ID)
+	if isUniqueViolation(err) {
+		return group, ErrGroupExists
+	}
+	if err != nil {
+		return group, err
+	}
+
+	after := map[string]string{"name": name}
+	if err := audit(ctx, tx, &c.tenantID, actor, ActionGroupCreate, "group", name, nil, after); err != nil {
+		return group, err
+	}
+
+	return group, tx.Commit()
+}
+
+// CreateSensor adds sensor to the group called groupName, filling its ID and
+// GroupID. A zero Index takes the next index of the group and an empty Codename
+// follows the <group><index> convention of the topology
+func (c *sensorCommand) CreateSensor(ctx context.Context, actor Actor, groupName string, sensor *Sensor) (err error) {
+	ctx, end := start(ctx, "create_sensor")
+	defer end(&err)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the group serializes the creations picking its next index
+	err = tx.QueryRowContext(ctx, "SELECT id FROM sensor_groups WHERE tenant_id = $1 AND name = $2 FOR UPDATE", c.tenantID, groupName).Scan(&sensor.GroupID)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var nextIndex int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(index), 0) + 1 FROM sensors WHERE group_id = $1", sensor.GroupID).Scan(&nextIndex)
+	if err != nil {
+		return err
+	}
+
+	if sensor.Index == 0 {
+		sensor.Index = nextIndex
+	}
+	if sensor.Codename == "" {
+		sensor.Codename = fmt.Sprintf("%s%d", groupName, sensor.Index)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO sensors (tenant_id, group_id, codename, index, x, y, z, data_rate)
+		VALUES ($8, $1, $2, $3, $4, $5, $6, $7)
+		RETURNING id;
+	`, sensor.GroupID, sensor.Codename, sensor.Index, sensor.X, sensor.Y, sensor.Z, sensor.DataRate, c.tenantID).Scan(&sensor.ID)
+	if isUniqueViolation(err) {
+		return ErrSensorExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &c.tenantID, actor, ActionSensorCreate, "sensor", sensor.Codename, nil, snapshot(*sensor, groupName)); err != nil {
+		return err
+	}
+	if err := enqueueEvent(ctx, tx, c.tenantID, EventSensorCreated, sensorEvent{Sensor: snapshot(*sensor, groupName)}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateSensor applies update to the sensor called codeName and returns it updated
+func (c *sensorCommand) UpdateSensor(ctx context.Context, actor Actor, codeName string, update SensorUpdate) (sensor Sensor, err error) {
+	ctx, end := start(ctx, "update_sensor")
+	defer end(&err)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sensor, err
+	}
+	defer tx.Rollback()
+
+	before, beforeGroup, err := c.lockSensor(ctx, tx, codeName)
+	if err != nil {
+		return sensor, err
+	}
+
+	groupID, groupName := before.GroupID, beforeGroup
+	if update.GroupName != nil {
+		err = tx.QueryRowContext(ctx, "SELECT id FROM sensor_groups WHERE tenant_id = $1 AND name = $2", c.tenantID, *update.GroupName).Scan(&groupID)
+		if err == sql.ErrNoRows {
+			return sensor, ErrGroupNotFound
+		}
+		if err != nil {
+			return sensor, err
+		}
+		groupName = *update.GroupName
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE sensors SET
+			group_id = $2,
+			x = COALESCE($3, x),
+			y = COALESCE($4, y),
+			z = COALESCE($5, z),
+			data_rate = COALESCE($6, data_rate)
+		WHERE id = $1
+		RETURNING id, group_id, codename, index, x, y, z, data_rate;
+	`, before.ID, groupID, nullable(update.X), nullable(update.Y), nullable(update.Z), nullable(update.DataRate)).
+		Scan(&sensor.ID, &sensor.GroupID, &sensor.Codename, &sensor.Index, &sensor.X, &sensor.Y, &sensor.Z, &sensor.DataRate)
+	if err != nil {
+		return sensor, err
+	}
+
+	if err := audit(ctx, tx, &c.tenantID, actor, ActionSensorUpdate, "sensor", codeName, snapshot(before, beforeGroup), snapshot(sensor, groupName)); err != nil {
+		return sensor, err
+	}
+	previous := snapshot(before, beforeGroup)
+	if err := enqueueEvent(ctx, tx, c.tenantID, EventSensorUpdated, sensorEvent{Sensor: snapshot(sensor, groupName), Previous: &previous}); err != nil {
+		return sensor, err
+	}
+
+	return sensor, tx.Commit()
+}
+
+// DeleteSensor removes the sensor called codeName along with its readings
+func (c *sensorCommand) DeleteSensor(ctx context.Context, actor Actor, codeName string) (err error) {
+	ctx, end := start(ctx, "delete_sensor")
+	defer end(&err)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, groupName, err := c.lockSensor(ctx, tx, codeName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sensors WHERE id = $1", before.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sensor_data WHERE sensor_id = $1", before.ID); err != nil {
+		return err
+	}
+	// A sensor created later under the same code name starts without anomalies
+	if _, err := tx.ExecContext(ctx, "DELETE FROM anomalies WHERE tenant_id = $1 AND codename = $2", c.tenantID, codeName); err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &c.tenantID, actor, ActionSensorDelete, "sensor", codeName, snapshot(before, groupName), nil); err != nil {
+		return err
+	}
+	if err := enqueueEvent(ctx, tx, c.tenantID, EventSensorDeleted, sensorEvent{Sensor: snapshot(before, groupName)}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockSensor returns the sensor called codeName and the name of its group, locking
+// the sensor until tx ends
+func (c *sensorCommand) lockSensor(ctx context.Context, tx *sql.Tx, codeName string) (sensor Sensor, groupName string, err error) {
+	err = tx.QueryRowContext(ctx, `
+		SELECT s.id, s.group_id, s.codename, s.index, s.x, s.y, s.z, s.data_rate, g.name
+		FROM sensors s
+		JOIN sensor_groups g ON g.id = s.group_id
+		WHERE s.tenant_id = $1 AND s.codename = $2
+		FOR UPDATE OF s;
+	`, c.tenantID, codeName).
+		Scan(&sensor.ID, &sensor.GroupID, &sensor.Codename, &sensor.Index, &sensor.X, &sensor.Y, &sensor.Z, &sensor.DataRate, &groupName)
+	if err == sql.ErrNoRows {
+		return sensor, "", ErrSensorNotFound
+	}
+	return sensor, groupName, err
+}
+
+func snapshot(sensor Sensor, groupName string) sensorSnapshot {
+	return sensorSnapshot{
+		CodeName: sensor.Codename,
+		Group:    groupName,
+		Index:    sensor.Index,
+		X:        sensor.X,
+		Y:        sensor.Y,
+		Z:        sensor.Z,
+		DataRate: sensor.DataRate,
+	}
+}
+
+func nullable[T any](v *T) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
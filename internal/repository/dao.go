@@ -10,8 +10,9 @@ import (
 
 // SensorGroup represents the structure of a sensor group
 type SensorGroup struct {
-	ID   int
-	Name string
+	ID       int
+	TenantID int
+	Name     string
 }
 
 // Sensor represents the structure of a sensor
@@ -45,8 +46,12 @@ const (
 	dbname   = "sensors_db"
 )
 
+// DAO hands out the queries and commands of a tenant, which never see the rows
+// of another tenant
 type DAO interface {
-	NewSensorQuery() SensorQuery
+	NewSensorQuery(tenantID int) SensorQuery
+	NewSensorCommand(tenantID int) SensorCommand
+	NewTenantQuery() TenantQuery
 }
 
 type dao struct {
@@ -59,15 +64,37 @@ func NewDAO(db *sql.DB) DAO {
 	}
 }
 
-func (d *dao) NewSensorQuery() SensorQuery {
+func (d *dao) NewSensorQuery(tenantID int) SensorQuery {
 	return &sensorQuery{
+		db:       d.DB,
+		tenantID: tenantID,
+	}
+}
+
+func (d *dao) NewSensorCommand(tenantID int) SensorCommand {
+	return &sensorCommand{
+		db:       d.DB,
+		tenantID: tenantID,
+	}
+}
+
+func (d *dao) NewTenantQuery() TenantQuery {
+	return &tenantQuery{
 		db: d.DB,
 	}
 }
 
+// DefaultDatabaseURL returns the connection URL of the docker-compose database
+func DefaultDatabaseURL() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", user, password, host, port, dbname)
+}
+
 func NewDB() (*sql.DB, error) {
+	return NewDBFromURL(DefaultDatabaseURL())
+}
 
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", user, password, host, port, dbname)
+// NewDBFromURL opens the PostgreSQL database at connStr
+func NewDBFromURL(connStr string) (*sql.DB, error) {
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
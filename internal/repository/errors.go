@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/lib/pq"
+)
+
+// Errors of the queries about an entity that does not exist
+var (
+	ErrGroupNotFound      = errors.New("group not found")
+	ErrSensorNotFound     = errors.New("sensor not found")
+	ErrAPIKeyNotFound     = errors.New("api key not found")
+	ErrTenantNotFound     = errors.New("tenant not found")
+	ErrAlertRuleNotFound  = errors.New("alert rule not found")
+	ErrAlertNotFound      = errors.New("alert not found")
+	ErrWebhookNotFound    = errors.New("webhook not found")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// Errors of the creations of an entity whose name is in use
+var (
+	ErrSensorExists    = errors.New("sensor already exists")
+	ErrGroupExists     = errors.New("group already exists")
+	ErrTenantExists    = errors.New("tenant already exists")
+	ErrAlertRuleExists = errors.New("alert rule already exists")
+)
+
+// IsTransient reports whether err is likely to go away when the operation is
+// retried, such as a lost connection or a database restarting
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// connection exception, transaction rollback (serialization failure,
+		// deadlock), insufficient resources and operator intervention (shutdown)
+		case "08", "40", "53", "57":
+			return true
+		}
+	}
+
+	return false
+}
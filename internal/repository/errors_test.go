@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil},
+		{name: "canceled", err: context.Canceled},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded)},
+		{name: "no rows", err: sql.ErrNoRows},
+		{name: "not found", err: ErrSensorNotFound},
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "eof", err: fmt.Errorf("read: %w", io.EOF), want: true},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, want: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "connection reset", err: fmt.Errorf("write: %w", syscall.ECONNRESET), want: true},
+		{name: "broken pipe", err: syscall.EPIPE, want: true},
+		{name: "dns", err: &net.DNSError{Err: "no such host", Name: "postgres"}, want: true},
+		{name: "connection failure", err: &pq.Error{Code: "08006"}, want: true},
+		{name: "serialization failure", err: &pq.Error{Code: "40001"}, want: true},
+		{name: "deadlock", err: fmt.Errorf("insert: %w", &pq.Error{Code: "40P01"}), want: true},
+		{name: "too many connections", err: &pq.Error{Code: "53300"}, want: true},
+		{name: "admin shutdown", err: &pq.Error{Code: "57P01"}, want: true},
+		{name: "unique violation", err: &pq.Error{Code: "23505"}},
+		{name: "syntax error", err: &pq.Error{Code: "42601"}},
+		{name: "other", err: errors.New("boom")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// latestIntervals is the number of intervals between the latest readings of a
+// sensor its sampling is judged on
+const latestIntervals = 10
+
+// SensorActivity is when a sensor reported. Interval is the median number of
+// seconds between its latest readings, nil with less than 2 of them
+type SensorActivity struct {
+	SensorID  int
+	TenantID  int
+	Group     string
+	CodeName  string
+	DataRate  int
+	FirstSeen *time.Time
+	LastSeen  *time.Time
+	Interval  *float64
+}
+
+// Gap is a time a sensor did not report for longer than its data rate allows,
+// From and Till being the readings around it
+type Gap struct {
+	CodeName string
+	From     time.Time
+	Till     time.Time
+}
+
+// ActivityFilter selects sensors, zero fields select everything
+type ActivityFilter struct {
+	// TenantID restricts the sensors to those of a tenant, nil selects every tenant
+	TenantID *int
+	// Groups restricts the sensors to those of one of the groups, nil selects
+	// every group
+	Groups []string
+	Group  string
+}
+
+// where returns the conditions on the sensors s of filter and their arguments,
+// numbered after the offset first ones
+func (filter ActivityFilter) where(offset int) (string, []interface{}) {
+	var (
+		conditions string
+		args       []interface{}
+	)
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions += fmt.Sprintf(" AND "+condition, offset+len(args))
+	}
+	if filter.TenantID != nil {
+		add("s.tenant_id = $%d", *filter.TenantID)
+	}
+	if filter.Groups != nil {
+		add("g.name = ANY($%d)", pq.Array(filter.Groups))
+	}
+	if filter.Group != "" {
+		add("g.name = $%d", filter.Group)
+	}
+	return conditions, args
+}
+
+// ListSensorActivity returns the activity of the sensors matching filter,
+// ordered by tenant and code name
+func ListSensorActivity(ctx context.Context, db *sql.DB, filter ActivityFilter) (activities []SensorActivity, err error) {
+	ctx, end := start(ctx, "sensor_activity")
+	defer end(&err)
+
+	conditions, args := filter.where(1)
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.id, s.tenant_id, g.name, s.codename, s.data_rate,
+			(SELECT MIN(created_at) FROM sensor_data WHERE sensor_id = s.id),
+			latest.last_seen, latest.interval
+		FROM sensors s
+		JOIN sensor_groups g ON g.id = s.group_id
+		CROSS JOIN LATERAL (
+			SELECT MAX(created_at) AS last_seen,
+				percentile_cont(0.5) WITHIN GROUP (ORDER BY seconds) AS interval
+			FROM (
+				SELECT created_at, EXTRACT(EPOCH FROM created_at - LAG(created_at) OVER (ORDER BY created_at))::float8 AS seconds
+				FROM (SELECT created_at FROM sensor_data WHERE sensor_id = s.id ORDER BY created_at DESC LIMIT $1) l
+			) i
+		) latest
+		WHERE TRUE`+conditions+`
+		ORDER BY s.tenant_id, s.codename;
+	`, append([]interface{}{latestIntervals + 1}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			activity            SensorActivity
+			firstSeen, lastSeen sql.NullTime
+			interval            sql.NullFloat64
+		)
+		if err := rows.Scan(&activity.SensorID, &activity.TenantID, &activity.Group, &activity.CodeName, &activity.DataRate,
+			&firstSeen, &lastSeen, &interval); err != nil {
+			return nil, err
+		}
+		if firstSeen.Valid {
+			activity.FirstSeen = &firstSeen.Time
+		}
+		if lastSeen.Valid {
+			activity.LastSeen = &lastSeen.Time
+		}
+		if interval.Valid {
+			activity.Interval = &interval.Float64
+		}
+		activities = append(activities, activity)
+	}
+
+	return activities, rows.Err()
+}
+
+// ListGaps returns the gaps since the given time of the sensors matching filter,
+// those between readings further apart than factor times the data rate of their
+// sensor. A gap started before since is cut at it, one still open is not returned.
+// They are ordered by code name and time
+func ListGaps(ctx context.Context, db *sql.DB, filter ActivityFilter, since time.Time, factor float64) (gaps []Gap, err error) {
+	ctx, end := start(ctx, "sensor_gaps")
+	defer end(&err)
+
+	// The reading before the first one since is only looked up for that one
+	conditions, args := filter.where(2)
+	rows, err := db.QueryContext(ctx, `
+		WITH readings AS (
+			SELECT d.sensor_id, d.created_at,
+				LAG(d.created_at) OVER (PARTITION BY d.sensor_id ORDER BY d.created_at) AS previous
+			FROM sensor_data d
+			JOIN sensors s ON s.id = d.sensor_id
+			JOIN sensor_groups g ON g.id = s.group_id
+			WHERE d.created_at >= $1`+conditions+`
+		), spans AS (
+			SELECT r.sensor_id, r.created_at, COALESCE(r.previous,
+				(SELECT MAX(p.created_at) FROM sensor_data p WHERE p.sensor_id = r.sensor_id AND p.created_at < $1)) AS previous
+			FROM readings r
+		)
+		SELECT s.codename, GREATEST(sp.previous, $1), sp.created_at
+		FROM spans sp
+		JOIN sensors s ON s.id = sp.sensor_id
+		WHERE sp.created_at - sp.previous > make_interval(secs => s.data_rate * $2::float8)
+		ORDER BY s.codename, sp.created_at;
+	`, append([]interface{}{since, factor}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var gap Gap
+		if err := rows.Scan(&gap.CodeName, &gap.From, &gap.Till); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, gap)
+	}
+
+	return gaps, rows.Err()
+}
+
+// OpenSensorAlerts returns the alerts raised by the sensor watchdog that are not
+// resolved, those without rule
+func OpenSensorAlerts(ctx context.Context, db *sql.DB) (alerts []Alert, err error) {
+	ctx, end := start(ctx, "open_sensor_alerts")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, "SELECT "+alertColumns+" FROM alerts WHERE rule_id IS NULL AND resolved_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// RaiseSensorAlert fires an alert without rule called name for the sensor of
+// activity, value being the one that raised it
+func RaiseSensorAlert(ctx context.Context, db *sql.DB, activity SensorActivity, name, severity string, value float64) (alert Alert, err error) {
+	ctx, end := start(ctx, "raise_sensor_alert")
+	defer end(&err)
+
+	return transitionAlert(ctx, db, `
+		INSERT INTO alerts (tenant_id, sensor_id, rule_name, severity, group_name, codename, state, value, fired_at)
+		VALUES ($1, $2, $3, $4, $5, $6, 'firing', $7, NOW())
+		RETURNING `+alertColumns+`;
+	`, activity.TenantID, activity.SensorID, name, severity, activity.Group, activity.CodeName, value)
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AlertEvaluatorLock is the advisory lock held by the alert evaluator running
+// against a database
+const AlertEvaluatorLock = 0x616c6572
+
+// Lease is a session advisory lock, held on a connection of its own until it is
+// released or the connection is lost
+type Lease struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// TryLease takes the advisory lock key when it is free, it returns a nil lease
+// when another session holds it
+func TryLease(ctx context.Context, db *sql.DB, key int64) (lease *Lease, err error) {
+	ctx, end := start(ctx, "try_lease")
+	defer end(&err)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+	return &Lease{conn: conn, key: key}, nil
+}
+
+// Check fails when the connection holding the lock was lost, the lock going with it
+func (l *Lease) Check(ctx context.Context) error {
+	return l.conn.PingContext(ctx)
+}
+
+// Release unlocks the lock and returns its connection to the pool
+func (l *Lease) Release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	if closeErr := l.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -5,10 +5,18 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// DefaultRedisAddr is the address of the docker-compose Redis
+const DefaultRedisAddr = "localhost:6379"
+
 // NewClient creates a new Redis client and returns it
 func NewClient() *redis.Client {
+	return NewClientFromAddr(DefaultRedisAddr)
+}
+
+// NewClientFromAddr creates a new Redis client connected to addr
+func NewClientFromAddr(addr string) *redis.Client {
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
+		Addr:     addr,
 		Password: "",
 		DB:       0,
 	})
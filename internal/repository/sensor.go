@@ -1,76 +1,135 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"math"
 	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("repository")
+
+// Coverage describes the readings a result was computed from, a result computed
+// from no reading is nil rather than zero
+type Coverage struct {
+	Readings int        `json:"readings"`
+	First    *time.Time `json:"first,omitempty"`
+	Last     *time.Time `json:"last,omitempty"`
+}
+
 type SensorQuery interface {
-	FetchAverageTransparency(groupName string) (averageTransparency float64, err error)
-	FetchAverageTemperature(groupName string) (averageTransparency float64, err error)
-	FetchSpeciesList(groupName string) (speciesList map[string]int, err error)
-	FetchTopNSpeciesList(groupName string, n int, from, till *time.Time) (speciesList map[string]int, err error)
-	GetRegionMinTemperature(xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature float64, err error)
-	GetRegionMaxTemperature(xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature float64, err error)
-	FetchCodeNameAverageTemperature(codeName string, from, till time.Time) (averageTransparency float64, err error)
+	FetchAverageTransparency(ctx context.Context, groupName string) (averageTransparency *float64, coverage Coverage, err error)
+	FetchAverageTemperature(ctx context.Context, groupName string) (averageTemperature *float64, coverage Coverage, err error)
+	FetchSpeciesList(ctx context.Context, groupName string) (speciesList map[string]int, coverage Coverage, err error)
+	FetchTopNSpeciesList(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList map[string]int, coverage Coverage, err error)
+	GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature *float64, coverage Coverage, err error)
+	GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature *float64, coverage Coverage, err error)
+	FetchCodeNameAverageTemperature(ctx context.Context, codeName string, from time.Time, till *time.Time) (averageTemperature *float64, coverage Coverage, err error)
+	FetchSensor(ctx context.Context, codeName string) (sensor Sensor, groupName string, err error)
+	FetchGroup(ctx context.Context, groupName string) (group SensorGroup, err error)
 }
 
+// sensorQuery answers about the groups and sensors of one tenant, every query
+// is filtered by tenant_id
 type sensorQuery struct {
-	db *sql.DB
+	db       *sql.DB
+	tenantID int
 }
 
-func (s *sensorQuery) FetchAverageTransparency(groupName string) (averageTransparency float64, err error) {
-	rows, err := s.db.Query("SELECT ROUND(AVG(sd.transparency), 2) AS transparency FROM sensors s JOIN sensor_data sd ON s.id = sd.sensor_id JOIN sensor_groups sg ON sg.id = s.group_id WHERE sg.name = $1 GROUP BY s.group_id;", groupName)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
+func (s *sensorQuery) FetchAverageTransparency(ctx context.Context, groupName string) (averageTransparency *float64, coverage Coverage, err error) {
+	ctx, end := start(ctx, "group_average_transparency")
+	defer end(&err)
+
+	return s.groupAverage(ctx, "transparency", groupName)
+}
 
-	var totalTransparency float64
-	var rowCount int
+func (s *sensorQuery) FetchAverageTemperature(ctx context.Context, groupName string) (averageTemperature *float64, coverage Coverage, err error) {
+	ctx, end := start(ctx, "group_average_temperature")
+	defer end(&err)
 
-	for rows.Next() {
-		var transparency float64
-		if err := rows.Scan(&transparency); err != nil {
-			return 0, err
-		}
-		totalTransparency += transparency
-		rowCount++
+	return s.groupAverage(ctx, "temperature", groupName)
+}
+
+// finite is the condition keeping the readings whose column is a finite number,
+// NaN sorts above Infinity in Postgres. Only temperatures may be NaN
+func finite(column string) string {
+	if column != "temperature" {
+		return "TRUE"
 	}
+	return "sd.temperature > '-Infinity' AND sd.temperature < 'Infinity'"
+}
 
-	if rowCount == 0 {
-		return 0, fmt.Errorf("no transparency data found for the group")
+// groupAverage averages column over the readings of the sensors of a group, the
+// left joins keep a row for a group without readings so that it can be told
+// apart from a group that does not exist
+func (s *sensorQuery) groupAverage(ctx context.Context, column, groupName string) (*float64, Coverage, error) {
+	var (
+		average     sql.NullFloat64
+		count       int
+		first, last sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT AVG(sd.%s) FILTER (WHERE %s), COUNT(sd.id), MIN(sd.created_at), MAX(sd.created_at)
+		FROM sensor_groups sg
+		LEFT JOIN sensors s ON s.group_id = sg.id
+		LEFT JOIN sensor_data sd ON sd.sensor_id = s.id
+		WHERE sg.tenant_id = $1 AND sg.name = $2
+		GROUP BY sg.name;
+	`, column, finite(column)), s.tenantID, groupName).Scan(&average, &count, &first, &last)
+	if err == sql.ErrNoRows {
+		return nil, Coverage{}, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, Coverage{}, err
 	}
 
-	return totalTransparency / float64(rowCount), nil
+	return rounded(average), newCoverage(count, first, last), nil
 }
 
-func (s *sensorQuery) FetchAverageTemperature(groupName string) (averageTemperature float64, err error) {
-	rows, err := s.db.Query("SELECT AVG(sd.temperature) AS temperature FROM sensors s JOIN sensor_data sd ON s.id = sd.sensor_id JOIN sensor_groups sg ON sg.id = s.group_id WHERE sg.name = $1 GROUP BY s.group_id;", groupName)
+// groupCoverage checks the group exists and counts its readings between from and
+// till, either of which may be nil
+func (s *sensorQuery) groupCoverage(ctx context.Context, groupName string, from, till *time.Time) (Coverage, error) {
+	var (
+		count       int
+		first, last sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(sd.id), MIN(sd.created_at), MAX(sd.created_at)
+		FROM sensor_groups sg
+		LEFT JOIN sensors s ON s.group_id = sg.id
+		LEFT JOIN sensor_data sd ON sd.sensor_id = s.id
+			AND ($3::timestamptz IS NULL OR sd.created_at >= $3)
+			AND ($4::timestamptz IS NULL OR sd.created_at <= $4)
+		WHERE sg.tenant_id = $1 AND sg.name = $2
+		GROUP BY sg.name;
+	`, s.tenantID, groupName, nullTime(from), nullTime(till)).Scan(&count, &first, &last)
+	if err == sql.ErrNoRows {
+		return Coverage{}, ErrGroupNotFound
+	}
 	if err != nil {
-		return 0, err
+		return Coverage{}, err
 	}
-	defer rows.Close()
 
-	var totalTemperature float64
-	var rowCount int
+	return newCoverage(count, first, last), nil
+}
 
-	for rows.Next() {
-		var temperature float64
-		if err := rows.Scan(&temperature); err != nil {
-			return 0, err
-		}
-		totalTemperature += temperature
-		rowCount++
-	}
+// start opens the span of query, the returned function ends it and records its
+// latency once the query returned the error err points to
+func start(ctx context.Context, query string) (context.Context, func(err *error)) {
+	started := time.Now()
+	ctx, span := tracer.Start(ctx, "repository."+query, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
 
-	if rowCount == 0 {
-		return 0, fmt.Errorf("no transparency data found for the group")
+	return ctx, func(err *error) {
+		metrics.ObserveQuery(query, started, *err)
+		tracing.End(span, *err)
 	}
-
-	return roundToPrecision(totalTemperature/float64(rowCount), 2), nil
 }
 
 func roundToPrecision(value float64, precision int) float64 {
@@ -78,10 +137,45 @@ func roundToPrecision(value float64, precision int) float64 {
 	return math.Round(value*shift) / shift
 }
 
-func (s *sensorQuery) FetchSpeciesList(groupName string) (speciesList map[string]int, err error) {
-	rows, err := s.db.Query("SELECT fish_species_name, COUNT(*) as count FROM sensor_data sd JOIN sensors s ON sd.sensor_id = s.id JOIN sensor_groups sg ON s.group_id = sg.id	WHERE sg.name = $1 GROUP BY fish_species_name;", groupName)
+// rounded returns value rounded to 2 decimals, or nil when it is NULL
+func rounded(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	v := roundToPrecision(value.Float64, 2)
+	return &v
+}
+
+func newCoverage(count int, first, last sql.NullTime) Coverage {
+	coverage := Coverage{Readings: count}
+	if first.Valid {
+		coverage.First = &first.Time
+	}
+	if last.Valid {
+		coverage.Last = &last.Time
+	}
+	return coverage
+}
+
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+func (s *sensorQuery) FetchSpeciesList(ctx context.Context, groupName string) (speciesList map[string]int, coverage Coverage, err error) {
+	ctx, end := start(ctx, "group_species")
+	defer end(&err)
+
+	coverage, err = s.groupCoverage(ctx, groupName, nil, nil)
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT fish_species_name, COUNT(*) as count FROM sensor_data sd JOIN sensors s ON sd.sensor_id = s.id JOIN sensor_groups sg ON s.group_id = sg.id	WHERE sg.tenant_id = $1 AND sg.name = $2 GROUP BY fish_species_name;", s.tenantID, groupName)
 	if err != nil {
-		return nil, err
+		return nil, coverage, err
 	}
 	defer rows.Close()
 
@@ -93,54 +187,48 @@ func (s *sensorQuery) FetchSpeciesList(groupName string) (speciesList map[string
 	for rows.Next() {
 		err := rows.Scan(&fishSpeciesName, &count)
 		if err != nil {
-			return nil, err
+			return nil, coverage, err
 		}
 		speciesList[fishSpeciesName] = count
 	}
 
-	return
+	return speciesList, coverage, rows.Err()
 }
 
-func (s *sensorQuery) FetchTopNSpeciesList(groupName string, n int, from, till *time.Time) (speciesList map[string]int, err error) {
+func (s *sensorQuery) FetchTopNSpeciesList(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList map[string]int, coverage Coverage, err error) {
+	ctx, end := start(ctx, "group_top_species")
+	defer end(&err)
+
+	coverage, err = s.groupCoverage(ctx, groupName, from, till)
+	if err != nil {
+		return nil, coverage, err
+	}
 
 	query := `
 		SELECT fish_species_name AS species, COUNT(*) AS count
 		FROM sensor_data sd
 		JOIN sensors s ON sd.sensor_id = s.id
-		WHERE s.group_id = (SELECT id FROM sensor_groups WHERE name = $1)
+		WHERE s.group_id IN (SELECT id FROM sensor_groups WHERE tenant_id = $1 AND name = $2)
 		`
-	// Add time range conditions if parameters are provided
+	// Add time range conditions if parameters are provided, numbering the
+	// placeholders after the arguments actually bound
+	args := []interface{}{s.tenantID, groupName}
 	if from != nil {
-		query += " AND sd.created_at >= $2"
+		args = append(args, *from)
+		query += fmt.Sprintf(" AND sd.created_at >= $%d", len(args))
 	}
 
 	if till != nil {
-		query += " AND sd.created_at <= $3"
+		args = append(args, *till)
+		query += fmt.Sprintf(" AND sd.created_at <= $%d", len(args))
 	}
 
 	query += fmt.Sprintf(" GROUP BY fish_species_name ORDER BY count DESC LIMIT %d", n)
 
-	// query += `
-	// 		 GROUP BY fish_species_name
-	// 		ORDER BY count DESC
-	// 		LIMIT $4
-	// 	`
-
 	// Execute the SQL query
-	var rows *sql.Rows
-
-	// Check the number of parameters to bind
-	if from == nil && till == nil {
-		rows, err = s.db.Query(query, groupName)
-	} else if from != nil && till == nil {
-		rows, err = s.db.Query(query, groupName, *from)
-	} else if from == nil && till != nil {
-		rows, err = s.db.Query(query, groupName, *till)
-	} else {
-		rows, err = s.db.Query(query, groupName, *from, *till)
-	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, coverage, err
 	}
 
 	defer rows.Close()
@@ -153,52 +241,110 @@ func (s *sensorQuery) FetchTopNSpeciesList(groupName string, n int, from, till *
 	for rows.Next() {
 		err := rows.Scan(&fishSpeciesName, &count)
 		if err != nil {
-			return nil, err
+			return nil, coverage, err
 		}
 		speciesList[fishSpeciesName] = count
 	}
 
-	return
+	return speciesList, coverage, rows.Err()
 }
 
-func (s *sensorQuery) GetRegionMinTemperature(xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature float64, err error) {
-	err = s.db.QueryRow("SELECT COALESCE(MIN(temperature), 0.0) AS min_temperature	FROM sensor_data sd JOIN sensors s ON sd.sensor_id = s.id WHERE (x >= $1 AND x <= $2) AND (y >= $3 AND y <= $4) AND (z >= $5 AND z <= $6)", xMin, xMax, yMin, yMax, zMin, zMax).Scan(&minTemperature)
-	if err != nil {
-		return 0, err
-	}
-	return
+func (s *sensorQuery) GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature *float64, coverage Coverage, err error) {
+	ctx, end := start(ctx, "region_min_temperature")
+	defer end(&err)
+
+	return s.regionTemperature(ctx, "MIN", xMin, xMax, yMin, yMax, zMin, zMax)
 }
 
-func (s *sensorQuery) GetRegionMaxTemperature(xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature float64, err error) {
-	err = s.db.QueryRow("SELECT COALESCE(MAX(temperature), 0.0) AS min_temperature	FROM sensor_data sd JOIN sensors s ON sd.sensor_id = s.id WHERE (x >= $1 AND x <= $2) AND (y >= $3 AND y <= $4) AND (z >= $5 AND z <= $6)", xMin, xMax, yMin, yMax, zMin, zMax).Scan(&maxTemperature)
+func (s *sensorQuery) GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature *float64, coverage Coverage, err error) {
+	ctx, end := start(ctx, "region_max_temperature")
+	defer end(&err)
+
+	return s.regionTemperature(ctx, "MAX", xMin, xMax, yMin, yMax, zMin, zMax)
+}
+
+// regionTemperature applies aggregate to the temperatures read in a region, which
+// is NULL rather than zero when no sensor of the region reported
+func (s *sensorQuery) regionTemperature(ctx context.Context, aggregate string, xMin, xMax, yMin, yMax, zMin, zMax float64) (*float64, Coverage, error) {
+	var (
+		temperature sql.NullFloat64
+		count       int
+		first, last sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT %s(temperature) FILTER (WHERE %s), COUNT(sd.id), MIN(sd.created_at), MAX(sd.created_at)
+		FROM sensor_data sd
+		JOIN sensors s ON sd.sensor_id = s.id
+		WHERE s.tenant_id = $7 AND (x >= $1 AND x <= $2) AND (y >= $3 AND y <= $4) AND (z >= $5 AND z <= $6);
+	`, aggregate, finite("temperature")), xMin, xMax, yMin, yMax, zMin, zMax, s.tenantID).Scan(&temperature, &count, &first, &last)
 	if err != nil {
-		return 0, err
+		return nil, Coverage{}, err
+	}
+
+	var value *float64
+	if temperature.Valid {
+		value = &temperature.Float64
 	}
-	return
+	return value, newCoverage(count, first, last), nil
 }
 
-func (s *sensorQuery) FetchCodeNameAverageTemperature(codeName string, from, till time.Time) (averageTemperature float64, err error) {
-	rows, err := s.db.Query("SELECT COALESCE(AVG(temperature), 0.0) AS avg_temperature FROM sensor_data WHERE sensor_id = (SELECT id FROM sensors WHERE codename = $1) AND created_at BETWEEN $2 AND $3;", codeName, from, till)
+func (s *sensorQuery) FetchCodeNameAverageTemperature(ctx context.Context, codeName string, from time.Time, till *time.Time) (averageTemperature *float64, coverage Coverage, err error) {
+	ctx, end := start(ctx, "sensor_average_temperature")
+	defer end(&err)
+
+	var (
+		average     sql.NullFloat64
+		count       int
+		first, last sql.NullTime
+	)
+	// An open ended range has no upper bound
+	args := []interface{}{codeName, s.tenantID, from}
+	upTo := ""
+	if till != nil {
+		args = append(args, *till)
+		upTo = " AND sd.created_at <= $4"
+	}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT AVG(sd.temperature) FILTER (WHERE `+finite("temperature")+`), COUNT(sd.id), MIN(sd.created_at), MAX(sd.created_at)
+		FROM sensors s
+		LEFT JOIN sensor_data sd ON sd.sensor_id = s.id AND sd.created_at >= $3`+upTo+`
+		WHERE s.tenant_id = $2 AND s.codename = $1
+		GROUP BY s.codename;
+	`, args...).Scan(&average, &count, &first, &last)
+	if err == sql.ErrNoRows {
+		return nil, Coverage{}, ErrSensorNotFound
+	}
 	if err != nil {
-		return 0, err
+		return nil, Coverage{}, err
 	}
-	defer rows.Close()
 
-	var totalTemperature float64
-	var rowCount int
+	return rounded(average), newCoverage(count, first, last), nil
+}
 
-	for rows.Next() {
-		var temperature float64
-		if err := rows.Scan(&temperature); err != nil {
-			return 0, err
-		}
-		totalTemperature += temperature
-		rowCount++
+func (s *sensorQuery) FetchSensor(ctx context.Context, codeName string) (sensor Sensor, groupName string, err error) {
+	ctx, end := start(ctx, "sensor")
+	defer end(&err)
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT s.id, s.group_id, sg.name, s.codename, s.index, s.x, s.y, s.z, s.data_rate
+		FROM sensors s
+		JOIN sensor_groups sg ON sg.id = s.group_id
+		WHERE s.tenant_id = $2 AND s.codename = $1;
+	`, codeName, s.tenantID).Scan(&sensor.ID, &sensor.GroupID, &groupName, &sensor.Codename, &sensor.Index, &sensor.X, &sensor.Y, &sensor.Z, &sensor.DataRate)
+	if err == sql.ErrNoRows {
+		return sensor, "", ErrSensorNotFound
 	}
+	return sensor, groupName, err
+}
 
-	if rowCount == 0 {
-		return 0, fmt.Errorf("no transparency data found for the group")
-	}
+func (s *sensorQuery) FetchGroup(ctx context.Context, groupName string) (group SensorGroup, err error) {
+	ctx, end := start(ctx, "group")
+	defer end(&err)
 
-	return roundToPrecision(totalTemperature/float64(rowCount), 2), nil
+	err = s.db.QueryRowContext(ctx, "SELECT id, tenant_id, name FROM sensor_groups WHERE tenant_id = $1 AND name = $2", s.tenantID, groupName).
+		Scan(&group.ID, &group.TenantID, &group.Name)
+	if err == sql.ErrNoRows {
+		return group, ErrGroupNotFound
+	}
+	return group, err
 }
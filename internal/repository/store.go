@@ -0,0 +1,532 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// schemaLock is the advisory lock serialising CreateTables across processes
+const schemaLock = 0x73656e73
+
+// CreateTables creates the necessary tables if they do not exist. It holds an
+// advisory lock for the transaction, so processes starting together do not race
+// on the same DDL
+func CreateTables(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", schemaLock); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS tenants (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		INSERT INTO tenants (id, name) VALUES (1, 'default') ON CONFLICT DO NOTHING;
+		SELECT setval(pg_get_serial_sequence('tenants', 'id'), (SELECT MAX(id) FROM tenants));
+		CREATE TABLE IF NOT EXISTS sensor_groups (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sensors (
+			id SERIAL PRIMARY KEY,
+			group_id INT NOT NULL,
+			codename VARCHAR(255) NOT NULL,
+			index INT NOT NULL,
+			x FLOAT NOT NULL,
+			y FLOAT NOT NULL,
+			z FLOAT NOT NULL,
+			data_rate INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sensor_data (
+			id SERIAL PRIMARY KEY,
+			sensor_id INT NOT NULL,
+			temperature FLOAT NOT NULL,
+			transparency INT NOT NULL,
+			fish_species_name VARCHAR(255) NOT NULL,
+			fish_species_count INT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		-- Readings were stored without time zone, in the one of the process that
+		-- wrote them, which is taken to be the one of the database
+		DO $$
+		BEGIN
+			IF (SELECT data_type FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'sensor_data' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+				ALTER TABLE sensor_data ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+			END IF;
+		END $$;
+		-- Groups and sensors created before tenants belong to the default tenant.
+		-- Sensors repeat the tenant of their group so codenames are unique per tenant
+		ALTER TABLE sensor_groups ADD COLUMN IF NOT EXISTS tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+		ALTER TABLE sensors ADD COLUMN IF NOT EXISTS tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+		DROP INDEX IF EXISTS sensors_codename_idx;
+		CREATE UNIQUE INDEX IF NOT EXISTS sensors_tenant_codename_idx ON sensors (tenant_id, codename);
+		CREATE UNIQUE INDEX IF NOT EXISTS sensor_groups_tenant_name_idx ON sensor_groups (tenant_id, name);
+		-- The tenant of a sensor is the one of its group, Postgres checks it
+		CREATE UNIQUE INDEX IF NOT EXISTS sensor_groups_id_tenant_idx ON sensor_groups (id, tenant_id);
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'sensors_group_tenant_fkey') THEN
+				ALTER TABLE sensors ADD CONSTRAINT sensors_group_tenant_fkey
+					FOREIGN KEY (group_id, tenant_id) REFERENCES sensor_groups (id, tenant_id);
+			END IF;
+		END $$;
+		CREATE INDEX IF NOT EXISTS sensor_data_sensor_id_created_at_idx ON sensor_data (sensor_id, created_at);
+		-- Every insert statement, COPY included, notifies the largest id it wrote so
+		-- the API replicas streaming readings fetch the new rows
+		CREATE OR REPLACE FUNCTION notify_sensor_data() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('sensor_data', (SELECT MAX(id) FROM new_rows)::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS sensor_data_notify ON sensor_data;
+		CREATE TRIGGER sensor_data_notify AFTER INSERT ON sensor_data
+			REFERENCING NEW TABLE AS new_rows
+			FOR EACH STATEMENT EXECUTE PROCEDURE notify_sensor_data();
+		CREATE TABLE IF NOT EXISTS aggregated_statistics (
+			id SERIAL PRIMARY KEY,
+			group_id INT NOT NULL,
+			average_temperature DOUBLE PRECISION,
+			average_transparency INT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (group_id) REFERENCES sensor_groups(id)
+		);
+		CREATE TABLE IF NOT EXISTS heartbeats (
+			name VARCHAR(255) PRIMARY KEY,
+			beat_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			prefix VARCHAR(32) NOT NULL,
+			hash CHAR(64) NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			revoked_at TIMESTAMPTZ
+		);
+		-- A key without tenant is a platform key, it may act on every tenant
+		ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant_id INT REFERENCES tenants(id);
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id INT REFERENCES tenants(id),
+			actor VARCHAR(255) NOT NULL,
+			principal_id VARCHAR(255) NOT NULL,
+			auth_method VARCHAR(32) NOT NULL,
+			request_id VARCHAR(64) NOT NULL,
+			action VARCHAR(64) NOT NULL,
+			entity_type VARCHAR(64) NOT NULL,
+			entity_id VARCHAR(255) NOT NULL,
+			before JSONB,
+			after JSONB,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_tenant_id_idx ON audit_log (tenant_id, id);
+		CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity_type, entity_id);
+		-- The audit log is append-only, even for the service itself
+		CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+		CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+		CREATE TABLE IF NOT EXISTS alert_rules (
+			id SERIAL PRIMARY KEY,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			name VARCHAR(255) NOT NULL,
+			metric VARCHAR(32) NOT NULL,
+			aggregate VARCHAR(8) NOT NULL,
+			window_seconds INT NOT NULL,
+			group_name VARCHAR(255) NOT NULL,
+			codename VARCHAR(255) NOT NULL,
+			operator VARCHAR(2) NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			for_seconds INT NOT NULL,
+			severity VARCHAR(16) NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (tenant_id, name)
+		);
+		-- Alerts copy the name, severity and scope of their rule so the history
+		-- outlives it
+		CREATE TABLE IF NOT EXISTS alerts (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			rule_id INT REFERENCES alert_rules(id) ON DELETE SET NULL,
+			rule_name VARCHAR(255) NOT NULL,
+			severity VARCHAR(16) NOT NULL,
+			group_name VARCHAR(255) NOT NULL,
+			codename VARCHAR(255) NOT NULL,
+			state VARCHAR(16) NOT NULL,
+			value DOUBLE PRECISION,
+			started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			fired_at TIMESTAMPTZ,
+			resolved_at TIMESTAMPTZ
+		);
+		-- A rule has at most one open alert
+		CREATE UNIQUE INDEX IF NOT EXISTS alerts_open_rule_idx ON alerts (rule_id) WHERE resolved_at IS NULL;
+		CREATE INDEX IF NOT EXISTS alerts_tenant_id_idx ON alerts (tenant_id, id);
+		-- The sensor an alert without rule was raised for, a sensor re-created under
+		-- the same code name does not take over its alerts
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS sensor_id INT REFERENCES sensors(id) ON DELETE SET NULL;
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id SERIAL PRIMARY KEY,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			url TEXT NOT NULL,
+			secret VARCHAR(64) NOT NULL,
+			events TEXT[] NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		-- Deliveries are both the queue of the events to send and their log
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			event_id CHAR(32) NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload JSONB NOT NULL,
+			state VARCHAR(16) NOT NULL DEFAULT 'pending',
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_status INT,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			delivered_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE state = 'pending';
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+		CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id BIGSERIAL PRIMARY KEY,
+			delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+			webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			event_id CHAR(32) NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload JSONB NOT NULL,
+			attempts INT NOT NULL,
+			last_status INT,
+			last_error TEXT NOT NULL,
+			dead_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS webhook_dead_letters_webhook_id_idx ON webhook_dead_letters (webhook_id, id);
+		-- A NULL threshold leaves the group to the default of the anomaly detector
+		ALTER TABLE sensor_groups ADD COLUMN IF NOT EXISTS anomaly_threshold DOUBLE PRECISION;
+		ALTER TABLE sensor_groups ADD COLUMN IF NOT EXISTS anomaly_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+		CREATE TABLE IF NOT EXISTS anomaly_baselines (
+			sensor_id INT NOT NULL REFERENCES sensors(id) ON DELETE CASCADE,
+			metric VARCHAR(32) NOT NULL,
+			state JSONB NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (sensor_id, metric)
+		);
+		CREATE TABLE IF NOT EXISTS anomalies (
+			id BIGSERIAL PRIMARY KEY,
+			tenant_id INT NOT NULL REFERENCES tenants(id),
+			group_name VARCHAR(255) NOT NULL,
+			codename VARCHAR(255) NOT NULL,
+			reading_id BIGINT NOT NULL,
+			metric VARCHAR(32) NOT NULL,
+			method VARCHAR(16) NOT NULL,
+			value DOUBLE PRECISION NOT NULL,
+			expected DOUBLE PRECISION NOT NULL,
+			score DOUBLE PRECISION NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			read_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS anomalies_sensor_idx ON anomalies (tenant_id, codename, id);
+		-- The alerts without rule are raised by the sensor watchdog, a sensor has at
+		-- most one of them open
+		CREATE UNIQUE INDEX IF NOT EXISTS alerts_open_sensor_idx ON alerts (tenant_id, codename) WHERE rule_id IS NULL AND resolved_at IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Components reporting heartbeats
+const (
+	HeartbeatGenerator  = "generator"
+	HeartbeatAggregator = "aggregator"
+)
+
+// Heartbeat records that the component called name just completed its work
+func Heartbeat(ctx context.Context, db *sql.DB, name string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO heartbeats (name, beat_at) VALUES ($1, NOW())
+		ON CONFLICT (name) DO UPDATE SET beat_at = EXCLUDED.beat_at;
+	`, name)
+	return err
+}
+
+// HeartbeatAge is the last heartbeat of a component and how long ago it was,
+// measured by the database clock so the components' clocks do not matter
+type HeartbeatAge struct {
+	At  time.Time
+	Age time.Duration
+}
+
+// Heartbeats returns the last heartbeat of every component by name
+func Heartbeats(ctx context.Context, db *sql.DB) (map[string]HeartbeatAge, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, beat_at, EXTRACT(EPOCH FROM NOW() - beat_at) FROM heartbeats")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	heartbeats := make(map[string]HeartbeatAge)
+	for rows.Next() {
+		var (
+			name    string
+			beat    HeartbeatAge
+			seconds float64
+		)
+		if err := rows.Scan(&name, &beat.At, &seconds); err != nil {
+			return nil, err
+		}
+		beat.Age = time.Duration(seconds * float64(time.Second))
+		heartbeats[name] = beat
+	}
+
+	return heartbeats, rows.Err()
+}
+
+// EnsureSensorGroup returns the id of the group of tenantID called name, creating
+// the group if it does not exist yet
+func EnsureSensorGroup(db *sql.DB, tenantID int, name string) (id int, created bool, err error) {
+	err = db.QueryRow("SELECT id FROM sensor_groups WHERE tenant_id = $1 AND name = $2", tenantID, name).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	err = db.QueryRow("INSERT INTO sensor_groups (tenant_id, name) VALUES ($1, $2) RETURNING id", tenantID, name).Scan(&id)
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// ListSensorGroups returns every sensor group of every tenant
+func ListSensorGroups(db *sql.DB) ([]SensorGroup, error) {
+	rows, err := db.Query("SELECT id, tenant_id, name FROM sensor_groups ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []SensorGroup
+	for rows.Next() {
+		var group SensorGroup
+		if err := rows.Scan(&group.ID, &group.TenantID, &group.Name); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// EnsureSensor fills sensor with the stored sensor of the same codename in the
+// tenant of its group, creating it if it does not exist yet
+func EnsureSensor(db *sql.DB, sensor *Sensor) (created bool, err error) {
+	err = db.QueryRow(`
+		SELECT s.id, s.group_id, s.index, s.x, s.y, s.z, s.data_rate
+		FROM sensors s
+		JOIN sensor_groups sg ON sg.tenant_id = s.tenant_id
+		WHERE sg.id = $1 AND s.codename = $2;
+	`, sensor.GroupID, sensor.Codename).
+		Scan(&sensor.ID, &sensor.GroupID, &sensor.Index, &sensor.X, &sensor.Y, &sensor.Z, &sensor.DataRate)
+	if err == nil {
+		return false, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO sensors (tenant_id, group_id, codename, index, x, y, z, data_rate)
+		SELECT tenant_id, $1, $2, $3, $4, $5, $6, $7 FROM sensor_groups WHERE id = $1
+		RETURNING id;
+	`, sensor.GroupID, sensor.Codename, sensor.Index, sensor.X, sensor.Y, sensor.Z, sensor.DataRate).Scan(&sensor.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListSensors returns every sensor ordered by id
+func ListSensors(ctx context.Context, db *sql.DB) ([]Sensor, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, group_id, codename, index, x, y, z, data_rate FROM sensors ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sensors []Sensor
+	for rows.Next() {
+		var sensor Sensor
+		if err := rows.Scan(&sensor.ID, &sensor.GroupID, &sensor.Codename, &sensor.Index, &sensor.X, &sensor.Y, &sensor.Z, &sensor.DataRate); err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, sensor)
+	}
+
+	return sensors, rows.Err()
+}
+
+// HasReadings reports whether any reading is stored, false before the tables exist
+func HasReadings(ctx context.Context, db *sql.DB) (found bool, err error) {
+	err = db.QueryRowContext(ctx, "SELECT to_regclass('sensor_data') IS NOT NULL").Scan(&found)
+	if err != nil || !found {
+		return false, err
+	}
+	err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sensor_data)").Scan(&found)
+	return found, err
+}
+
+// AggregateStatistics stores the current average temperature and transparency of every group
+func AggregateStatistics(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO aggregated_statistics (group_id, average_temperature, average_transparency, created_at)
+		SELECT 
+			s.group_id,
+			AVG(sd.temperature) FILTER (WHERE `+finite("temperature")+`) AS average_temperature,
+			AVG(sd.transparency) AS average_transparency,
+			NOW() AS created_at
+		FROM sensors s
+		JOIN sensor_data sd ON s.id = sd.sensor_id
+		GROUP BY s.group_id;
+	`)
+	return err
+}
+
+// CopySensorData bulk loads readings with COPY in a single transaction
+func CopySensorData(db *sql.DB, data []SensorData) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("sensor_data", "sensor_id", "temperature", "transparency", "fish_species_name", "fish_species_count", "created_at"))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range data {
+		if _, err := stmt.Exec(d.SensorID, d.Temperature, d.Transparency, d.FishSpeciesName, d.FishSpeciesCount, d.CreatedAt); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// An Exec without arguments flushes the buffered rows
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LatestReading is the last reading of a sensor
+type LatestReading struct {
+	Tenant string
+	Group  string
+	Sensor string
+	SensorData
+}
+
+// LatestReadings returns the last reading of every sensor that reported one
+func LatestReadings(ctx context.Context, db *sql.DB) ([]LatestReading, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (sd.sensor_id)
+			t.name, sg.name, s.codename, sd.id, sd.sensor_id, sd.temperature, sd.transparency,
+			sd.fish_species_name, sd.fish_species_count, sd.created_at
+		FROM sensor_data sd
+		JOIN sensors s ON s.id = sd.sensor_id
+		JOIN sensor_groups sg ON sg.id = s.group_id
+		JOIN tenants t ON t.id = sg.tenant_id
+		ORDER BY sd.sensor_id, sd.created_at DESC, sd.id DESC;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []LatestReading
+	for rows.Next() {
+		var r LatestReading
+		if err := rows.Scan(&r.Tenant, &r.Group, &r.Sensor, &r.ID, &r.SensorID, &r.Temperature, &r.Transparency,
+			&r.FishSpeciesName, &r.FishSpeciesCount, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+
+	return readings, rows.Err()
+}
+
+// SpeciesCount is the last count of a species seen by a sensor
+type SpeciesCount struct {
+	Tenant  string
+	Group   string
+	Sensor  string
+	Species string
+	Count   int
+}
+
+// LatestSpeciesCounts returns the last count of every species seen by every sensor
+// within window of the sensor's last reading
+func LatestSpeciesCounts(ctx context.Context, db *sql.DB, window time.Duration) ([]SpeciesCount, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH latest AS (
+			SELECT sensor_id, MAX(created_at) AS created_at FROM sensor_data GROUP BY sensor_id
+		)
+		SELECT DISTINCT ON (sd.sensor_id, sd.fish_species_name)
+			t.name, sg.name, s.codename, sd.fish_species_name, sd.fish_species_count
+		FROM sensor_data sd
+		JOIN latest l ON l.sensor_id = sd.sensor_id
+		JOIN sensors s ON s.id = sd.sensor_id
+		JOIN sensor_groups sg ON sg.id = s.group_id
+		JOIN tenants t ON t.id = sg.tenant_id
+		WHERE sd.created_at >= l.created_at - make_interval(secs => $1)
+		ORDER BY sd.sensor_id, sd.fish_species_name, sd.created_at DESC, sd.id DESC;
+	`, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []SpeciesCount
+	for rows.Next() {
+		var c SpeciesCount
+		if err := rows.Scan(&c.Tenant, &c.Group, &c.Sensor, &c.Species, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReadingsChannel is the channel notified with the largest id of every insert
+// into sensor_data
+const ReadingsChannel = "sensor_data"
+
+// Reading is a row of sensor_data along with the sensor, group and tenant it
+// belongs to, X, Y and Z being the current position of the sensor
+type Reading struct {
+	ID               int64
+	SensorID         int
+	TenantID         int
+	Group            string
+	CodeName         string
+	X                float64
+	Y                float64
+	Z                float64
+	Temperature      float64
+	Transparency     int
+	FishSpeciesName  string
+	FishSpeciesCount int
+	CreatedAt        time.Time
+}
+
+// Region is a box of sensor positions, bounds included
+type Region struct {
+	XMin, XMax float64
+	YMin, YMax float64
+	ZMin, ZMax float64
+}
+
+// Contains reports whether the position x, y, z is in r
+func (r Region) Contains(x, y, z float64) bool {
+	return x >= r.XMin && x <= r.XMax && y >= r.YMin && y <= r.YMax && z >= r.ZMin && z <= r.ZMax
+}
+
+// ReadingFilter selects the readings written after AfterID, zero fields select
+// every tenant, group, sensor, position or id
+type ReadingFilter struct {
+	TenantID int
+	Group    string
+	CodeName string
+	Region   *Region
+	AfterID  int64
+	// IDs selects the readings with an id in one of the ranges
+	IDs   []IDRange
+	Limit int
+}
+
+// IDRange is a range of reading ids, bounds included
+type IDRange struct {
+	From, To int64
+}
+
+// where returns the conditions of f on the sensor_data sd, sensors s and
+// sensor_groups sg rows along with their arguments
+func (f ReadingFilter) where() (string, []interface{}) {
+	conditions := "sd.id > $1"
+	args := []interface{}{f.AfterID}
+	add := func(condition string, arg ...interface{}) {
+		placeholders := make([]interface{}, len(arg))
+		for i := range arg {
+			placeholders[i] = len(args) + i + 1
+		}
+		conditions += " AND " + fmt.Sprintf(condition, placeholders...)
+		args = append(args, arg...)
+	}
+	if f.TenantID != 0 {
+		add("s.tenant_id = $%d", f.TenantID)
+	}
+	if f.Group != "" {
+		add("sg.name = $%d", f.Group)
+	}
+	if f.CodeName != "" {
+		add("s.codename = $%d", f.CodeName)
+	}
+	if r := f.Region; r != nil {
+		add("s.x BETWEEN $%d AND $%d AND s.y BETWEEN $%d AND $%d AND s.z BETWEEN $%d AND $%d",
+			r.XMin, r.XMax, r.YMin, r.YMax, r.ZMin, r.ZMax)
+	}
+	if len(f.IDs) > 0 {
+		ranges := make([]string, len(f.IDs))
+		for i, r := range f.IDs {
+			ranges[i] = fmt.Sprintf("sd.id BETWEEN $%d AND $%d", len(args)+1, len(args)+2)
+			args = append(args, r.From, r.To)
+		}
+		conditions += " AND (" + strings.Join(ranges, " OR ") + ")"
+	}
+	return conditions, args
+}
+
+// ReadingsAfter returns up to filter.Limit readings matching filter in id order
+func ReadingsAfter(ctx context.Context, db *sql.DB, filter ReadingFilter) (readings []Reading, err error) {
+	ctx, end := start(ctx, "readings_after")
+	defer end(&err)
+
+	conditions, args := filter.where()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT sd.id, s.id, s.tenant_id, sg.name, s.codename, s.x, s.y, s.z, sd.temperature, sd.transparency,
+			sd.fish_species_name, sd.fish_species_count, sd.created_at
+		FROM sensor_data sd
+		JOIN sensors s ON s.id = sd.sensor_id
+		JOIN sensor_groups sg ON sg.id = s.group_id
+		WHERE %s
+		ORDER BY sd.id
+		LIMIT %d;
+	`, conditions, filter.Limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reading Reading
+		if err := rows.Scan(&reading.ID, &reading.SensorID, &reading.TenantID, &reading.Group, &reading.CodeName, &reading.X, &reading.Y, &reading.Z,
+			&reading.Temperature, &reading.Transparency, &reading.FishSpeciesName, &reading.FishSpeciesCount, &reading.CreatedAt); err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading)
+	}
+
+	return readings, rows.Err()
+}
+
+// LastReadingID returns the largest id of sensor_data, 0 when it is empty
+func LastReadingID(ctx context.Context, db *sql.DB) (id int64, err error) {
+	ctx, end := start(ctx, "last_reading_id")
+	defer end(&err)
+
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM sensor_data").Scan(&id)
+	return id, err
+}
+
+// ReadingBucket summarizes the values of a column read during the width long
+// interval starting at Index*width since the Unix epoch
+type ReadingBucket struct {
+	Index int64
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// ReadingBuckets summarizes column, temperature or transparency, over the
+// readings matching filter written since since, by width long buckets. lastID is
+// the largest id summarized, readings up to it are accounted for
+func ReadingBuckets(ctx context.Context, db *sql.DB, filter ReadingFilter, column string, since time.Time, width time.Duration) (buckets []ReadingBucket, lastID int64, err error) {
+	ctx, end := start(ctx, "reading_buckets")
+	defer end(&err)
+
+	if column != "temperature" && column != "transparency" {
+		return nil, 0, fmt.Errorf("no bucket of column %q", column)
+	}
+
+	conditions, args := filter.where()
+	args = append(args, since, width.Seconds())
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT FLOOR(EXTRACT(EPOCH FROM sd.created_at) / $%[3]d)::BIGINT AS bucket,
+			COUNT(*), SUM(sd.%[1]s), MIN(sd.%[1]s), MAX(sd.%[1]s), MAX(sd.id)
+		FROM sensor_data sd
+		JOIN sensors s ON s.id = sd.sensor_id
+		JOIN sensor_groups sg ON sg.id = s.group_id
+		WHERE %[2]s AND sd.created_at >= $%[4]d AND %[5]s
+		GROUP BY bucket
+		ORDER BY bucket;
+	`, column, conditions, len(args), len(args)-1, finite(column)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			bucket ReadingBucket
+			maxID  int64
+		)
+		if err := rows.Scan(&bucket.Index, &bucket.Count, &bucket.Sum, &bucket.Min, &bucket.Max, &maxID); err != nil {
+			return nil, 0, err
+		}
+		if maxID > lastID {
+			lastID = maxID
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, lastID, rows.Err()
+}
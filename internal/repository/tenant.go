@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultTenant owns the groups created before tenants existed and those of the
+// topology that do not name a tenant
+const DefaultTenant = "default"
+
+// Tenant is an organisation sharing the deployment, it never sees the groups,
+// sensors and readings of another tenant
+type Tenant struct {
+	ID        int
+	Name      string
+	CreatedAt time.Time
+}
+
+// TenantQuery looks tenants up
+type TenantQuery interface {
+	FetchTenant(ctx context.Context, name string) (Tenant, error)
+}
+
+type tenantQuery struct {
+	db *sql.DB
+}
+
+func (q *tenantQuery) FetchTenant(ctx context.Context, name string) (tenant Tenant, err error) {
+	ctx, end := start(ctx, "tenant")
+	defer end(&err)
+
+	err = q.db.QueryRowContext(ctx, "SELECT id, name, created_at FROM tenants WHERE name = $1", name).
+		Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt)
+	if err == sql.ErrNoRows {
+		return tenant, ErrTenantNotFound
+	}
+	return tenant, err
+}
+
+// CreateTenant adds a tenant called name, the audit entry is a platform one
+func CreateTenant(ctx context.Context, db *sql.DB, actor Actor, name string) (Tenant, error) {
+	tenant := Tenant{Name: name}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return tenant, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "INSERT INTO tenants (name) VALUES ($1) RETURNING id, created_at", name).
+		Scan(&tenant.ID, &tenant.CreatedAt)
+	if isUniqueViolation(err) {
+		return tenant, ErrTenantExists
+	}
+	if err != nil {
+		return tenant, err
+	}
+
+	after := map[string]string{"name": name}
+	if err := audit(ctx, tx, nil, actor, ActionTenantCreate, "tenant", name, nil, after); err != nil {
+		return tenant, err
+	}
+
+	return tenant, tx.Commit()
+}
+
+// EnsureTenant returns the id of the tenant called name, creating it if it does
+// not exist yet
+func EnsureTenant(db *sql.DB, name string) (id int, err error) {
+	err = db.QueryRow(`
+		INSERT INTO tenants (name) VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id;
+	`, name).Scan(&id)
+	return id, err
+}
+
+// ListTenants returns every tenant ordered by id
+func ListTenants(ctx context.Context, db *sql.DB) ([]Tenant, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, created_at FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+
+	return tenants, rows.Err()
+}
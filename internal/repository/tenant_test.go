@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// testDB opens the database at TEST_DATABASE_URL and creates the tables, the
+// test is skipped when it is unset
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := NewDBFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testTenant creates a tenant with a group reef holding a sensor reef1 that
+// read temperature, all named alike in every tenant
+func testTenant(t *testing.T, db *sql.DB, temperature float64) (Tenant, Sensor) {
+	t.Helper()
+	ctx := context.Background()
+	actor := Actor{Subject: "test", Method: "none"}
+
+	tenant, err := CreateTenant(ctx, db, actor, fmt.Sprintf("test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := NewDAO(db).NewSensorCommand(tenant.ID)
+	if _, err := command.CreateGroup(ctx, actor, "reef"); err != nil {
+		t.Fatal(err)
+	}
+	sensor := Sensor{Codename: "reef1", DataRate: 60}
+	if err := command.CreateSensor(ctx, actor, "reef", &sensor); err != nil {
+		t.Fatal(err)
+	}
+	reading := SensorData{SensorID: sensor.ID, Temperature: temperature, Transparency: 50, FishSpeciesName: "Tuna", FishSpeciesCount: 1, CreatedAt: time.Now()}
+	if err := CopySensorData(db, []SensorData{reading}); err != nil {
+		t.Fatal(err)
+	}
+	return tenant, sensor
+}
+
+func TestTenantIsolation(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	acme, _ := testTenant(t, db, 10)
+	globex, _ := testTenant(t, db, 30)
+	empty, err := CreateTenant(ctx, db, Actor{Subject: "test", Method: "none"}, fmt.Sprintf("test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tenant Tenant
+		want   float64
+	}{
+		{name: "acme", tenant: acme, want: 10},
+		{name: "globex", tenant: globex, want: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := NewDAO(db).NewSensorQuery(tt.tenant.ID)
+
+			average, _, err := query.FetchCodeNameAverageTemperature(ctx, "reef1", time.Time{}, nil)
+			if err != nil || average == nil || *average != tt.want {
+				t.Errorf("sensor average = %v, %v, want %v", average, err, tt.want)
+			}
+			average, _, err = query.FetchAverageTemperature(ctx, "reef")
+			if err != nil || average == nil || *average != tt.want {
+				t.Errorf("group average = %v, %v, want %v", average, err, tt.want)
+			}
+		})
+	}
+
+	query := NewDAO(db).NewSensorQuery(empty.ID)
+	if _, _, err := query.FetchCodeNameAverageTemperature(ctx, "reef1", time.Time{}, nil); !errors.Is(err, ErrSensorNotFound) {
+		t.Errorf("sensor of another tenant = %v, want %v", err, ErrSensorNotFound)
+	}
+	if _, err := query.FetchGroup(ctx, "reef"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("group of another tenant = %v, want %v", err, ErrGroupNotFound)
+	}
+}
+
+func TestSensorTenantIsItsGroups(t *testing.T) {
+	db := testDB(t)
+	acme, sensor := testTenant(t, db, 10)
+	globex, _ := testTenant(t, db, 30)
+
+	_, err := db.Exec(`
+		INSERT INTO sensors (tenant_id, group_id, codename, index, x, y, z, data_rate)
+		VALUES ($1, $2, 'intruder', 99, 0, 0, 0, 60);
+	`, globex.ID, sensor.GroupID)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23503" {
+		t.Errorf("sensor of tenant %d in a group of tenant %d: %v, want a foreign key violation", globex.ID, acme.ID, err)
+	}
+}
@@ -0,0 +1,486 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Events delivered to the webhooks
+const (
+	EventSensorCreated = "sensor.created"
+	EventSensorUpdated = "sensor.updated"
+	EventSensorDeleted = "sensor.deleted"
+	EventAlertPending  = "alert.pending"
+	EventAlertFiring   = "alert.firing"
+	EventAlertResolved = "alert.resolved"
+)
+
+// Events lists every event a webhook may subscribe to
+var Events = []string{
+	EventSensorCreated, EventSensorUpdated, EventSensorDeleted,
+	EventAlertPending, EventAlertFiring, EventAlertResolved,
+}
+
+// Delivery states. A delivery is pending until its receiver accepts it, and dead
+// once its attempts are exhausted, a dead letter then keeps its payload
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Webhook receives the events of its tenant, those of Events or every event when
+// it is empty, signed with Secret
+type Webhook struct {
+	ID        int
+	TenantID  int
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// webhookSnapshot is what the audit log keeps of a webhook, never its secret
+type webhookSnapshot struct {
+	ID     int      `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (w Webhook) snapshot() webhookSnapshot {
+	return webhookSnapshot{ID: w.ID, URL: w.URL, Events: w.Events}
+}
+
+// Delivery is an event on its way to a webhook, and its record once delivered
+// or dead. URL and Secret are those of the webhook
+type Delivery struct {
+	ID            int64
+	WebhookID     int
+	TenantID      int
+	URL           string
+	Secret        string
+	EventID       string
+	EventType     string
+	Payload       json.RawMessage
+	State         string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastStatus    *int
+	LastError     string
+	CreatedAt     time.Time
+	DeliveredAt   *time.Time
+}
+
+// DeadLetter keeps an event whose delivery was given up, so it can be replayed
+type DeadLetter struct {
+	ID         int64
+	DeliveryID int64
+	WebhookID  int
+	EventID    string
+	EventType  string
+	Payload    json.RawMessage
+	Attempts   int
+	LastStatus *int
+	LastError  string
+	DeadAt     time.Time
+}
+
+// sensorEvent is the data of the sensor events, Previous is the sensor before
+// an update
+type sensorEvent struct {
+	Sensor   sensorSnapshot  `json:"sensor"`
+	Previous *sensorSnapshot `json:"previous,omitempty"`
+}
+
+// alertEvent is the data of the alert events
+type alertEvent struct {
+	ID         int64      `json:"id"`
+	RuleID     *int       `json:"ruleId"`
+	Rule       string     `json:"rule"`
+	Severity   string     `json:"severity"`
+	Group      string     `json:"group,omitempty"`
+	Sensor     string     `json:"sensor,omitempty"`
+	State      string     `json:"state"`
+	Value      *float64   `json:"value"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FiredAt    *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// enqueueAlert enqueues the event of alert entering its state
+func enqueueAlert(ctx context.Context, tx *sql.Tx, alert Alert) error {
+	return enqueueEvent(ctx, tx, alert.TenantID, "alert."+alert.State, alertEvent{
+		ID:         alert.ID,
+		RuleID:     alert.RuleID,
+		Rule:       alert.RuleName,
+		Severity:   alert.Severity,
+		Group:      alert.Group,
+		Sensor:     alert.CodeName,
+		State:      alert.State,
+		Value:      alert.Value,
+		StartedAt:  alert.StartedAt,
+		FiredAt:    alert.FiredAt,
+		ResolvedAt: alert.ResolvedAt,
+	})
+}
+
+// enqueueEvent enqueues a delivery of the event of eventType with data to every
+// webhook of tenantID subscribed to it. It runs within the transaction of the
+// change so an event is delivered if and only if its change is committed
+func enqueueEvent(ctx context.Context, tx *sql.Tx, tenantID int, eventType string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	// Every webhook gets the same payload, receivers tell events apart by their id
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, tenant_id, event_id, event_type, payload)
+		SELECT w.id, w.tenant_id, $2::text, $3::text,
+			jsonb_build_object('id', $2::text, 'type', $3::text, 'tenant', t.name, 'createdAt', NOW(), 'data', $4::jsonb)
+		FROM webhooks w
+		JOIN tenants t ON t.id = w.tenant_id
+		WHERE w.tenant_id = $1 AND (cardinality(w.events) = 0 OR $3::text = ANY(w.events));
+	`, tenantID, hex.EncodeToString(id), eventType, string(dataJSON))
+	return err
+}
+
+// CreateWebhook stores webhook, filling its ID and CreatedAt
+func CreateWebhook(ctx context.Context, db *sql.DB, actor Actor, webhook *Webhook) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhooks (tenant_id, url, secret, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;
+	`, webhook.TenantID, webhook.URL, webhook.Secret, pq.Array(webhook.Events)).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &webhook.TenantID, actor, ActionWebhookCreate, "webhook", strconv.Itoa(webhook.ID), nil, webhook.snapshot()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const webhookColumns = `SELECT id, tenant_id, url, secret, events, created_at FROM webhooks`
+
+func scanWebhook(row scanner) (Webhook, error) {
+	var webhook Webhook
+	err := row.Scan(&webhook.ID, &webhook.TenantID, &webhook.URL, &webhook.Secret, pq.Array(&webhook.Events), &webhook.CreatedAt)
+	return webhook, err
+}
+
+// FetchWebhook returns the webhook of tenantID with id
+func FetchWebhook(ctx context.Context, db *sql.DB, tenantID, id int) (webhook Webhook, err error) {
+	ctx, end := start(ctx, "webhook")
+	defer end(&err)
+
+	webhook, err = scanWebhook(db.QueryRowContext(ctx, webhookColumns+" WHERE tenant_id = $1 AND id = $2", tenantID, id))
+	if err == sql.ErrNoRows {
+		return webhook, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+// ListWebhooks returns the webhooks of tenantID ordered by id
+func ListWebhooks(ctx context.Context, db *sql.DB, tenantID int) (webhooks []Webhook, err error) {
+	ctx, end := start(ctx, "webhooks")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, webhookColumns+" WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deletes the webhook of tenantID with id along with its deliveries
+// and dead letters
+func DeleteWebhook(ctx context.Context, db *sql.DB, actor Actor, tenantID, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanWebhook(tx.QueryRowContext(ctx, webhookColumns+" WHERE tenant_id = $1 AND id = $2 FOR UPDATE", tenantID, id))
+	if err == sql.ErrNoRows {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	if err := audit(ctx, tx, &tenantID, actor, ActionWebhookDelete, "webhook", strconv.Itoa(id), before.snapshot(), nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const deliveryColumns = `d.id, d.webhook_id, d.tenant_id, w.url, w.secret, d.event_id, d.event_type, d.payload, d.state,
+	d.attempts, d.next_attempt_at, d.last_status, d.last_error, d.created_at, d.delivered_at`
+
+func scanDelivery(row scanner) (Delivery, error) {
+	var (
+		delivery    Delivery
+		payload     []byte
+		lastStatus  sql.NullInt64
+		deliveredAt sql.NullTime
+	)
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.TenantID, &delivery.URL, &delivery.Secret, &delivery.EventID,
+		&delivery.EventType, &payload, &delivery.State, &delivery.Attempts, &delivery.NextAttemptAt, &lastStatus,
+		&delivery.LastError, &delivery.CreatedAt, &deliveredAt)
+	delivery.Payload = payload
+	delivery.LastStatus = nullInt(lastStatus)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return delivery, err
+}
+
+// ClaimDeliveries returns up to limit pending deliveries that are due, oldest
+// first, and postpones them by lease so no other dispatcher claims them while
+// they are attempted. A dispatcher stopping midway leaves them due after lease
+func ClaimDeliveries(ctx context.Context, db *sql.DB, limit int, lease time.Duration) (deliveries []Delivery, err error) {
+	ctx, end := start(ctx, "claim_deliveries")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries d SET next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE state = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+deliveryColumns+`;
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// DeliverySucceeded records the attempt of the delivery with id its receiver
+// accepted with status
+func DeliverySucceeded(ctx context.Context, db *sql.DB, id int64, status int) (err error) {
+	ctx, end := start(ctx, "delivery_succeeded")
+	defer end(&err)
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET state = 'delivered', attempts = attempts + 1, last_status = $2, last_error = '', delivered_at = NOW()
+		WHERE id = $1;
+	`, id, status)
+	return err
+}
+
+// DeliveryFailed records a failed attempt of the delivery with id, status being
+// nil when no response came, and schedules the next one after wait
+func DeliveryFailed(ctx context.Context, db *sql.DB, id int64, status *int, reason string, wait time.Duration) (err error) {
+	ctx, end := start(ctx, "delivery_failed")
+	defer end(&err)
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET attempts = attempts + 1, last_status = $2, last_error = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+		WHERE id = $1;
+	`, id, nullable(status), reason, wait.Seconds())
+	return err
+}
+
+// DeliveryDied records the last failed attempt of the delivery with id and moves
+// its event to the dead letters, in a single statement
+func DeliveryDied(ctx context.Context, db *sql.DB, id int64, status *int, reason string) (err error) {
+	ctx, end := start(ctx, "delivery_died")
+	defer end(&err)
+
+	_, err = db.ExecContext(ctx, `
+		WITH dead AS (
+			UPDATE webhook_deliveries
+			SET state = 'dead', attempts = attempts + 1, last_status = $2, last_error = $3
+			WHERE id = $1
+			RETURNING id, webhook_id, tenant_id, event_id, event_type, payload, attempts, last_status, last_error
+		)
+		INSERT INTO webhook_dead_letters (delivery_id, webhook_id, tenant_id, event_id, event_type, payload, attempts, last_status, last_error)
+		SELECT * FROM dead;
+	`, id, nullable(status), reason)
+	return err
+}
+
+// DeliveryFilter selects the deliveries or dead letters of a webhook of a tenant,
+// zero fields select everything
+type DeliveryFilter struct {
+	TenantID  int
+	WebhookID int
+	State     string
+	// BeforeID pages through the deliveries, newest first
+	BeforeID int64
+	Limit    int
+}
+
+// ListDeliveries returns the deliveries matching filter, newest first
+func ListDeliveries(ctx context.Context, db *sql.DB, filter DeliveryFilter) (deliveries []Delivery, err error) {
+	ctx, end := start(ctx, "deliveries")
+	defer end(&err)
+
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.tenant_id = $1 AND d.webhook_id = $2`
+	args := []interface{}{filter.TenantID, filter.WebhookID}
+	if filter.State != "" {
+		args = append(args, filter.State)
+		query += fmt.Sprintf(" AND d.state = $%d", len(args))
+	}
+	if filter.BeforeID > 0 {
+		args = append(args, filter.BeforeID)
+		query += fmt.Sprintf(" AND d.id < $%d", len(args))
+	}
+	query += fmt.Sprintf(" ORDER BY d.id DESC LIMIT %d", filter.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+const deadLetterColumns = `SELECT id, delivery_id, webhook_id, event_id, event_type, payload, attempts, last_status, last_error, dead_at
+	FROM webhook_dead_letters`
+
+func scanDeadLetter(row scanner) (DeadLetter, error) {
+	var (
+		letter     DeadLetter
+		payload    []byte
+		lastStatus sql.NullInt64
+	)
+	err := row.Scan(&letter.ID, &letter.DeliveryID, &letter.WebhookID, &letter.EventID, &letter.EventType, &payload,
+		&letter.Attempts, &lastStatus, &letter.LastError, &letter.DeadAt)
+	letter.Payload = payload
+	letter.LastStatus = nullInt(lastStatus)
+	return letter, err
+}
+
+// ListDeadLetters returns the dead letters matching filter, newest first. The
+// state of filter is ignored
+func ListDeadLetters(ctx context.Context, db *sql.DB, filter DeliveryFilter) (letters []DeadLetter, err error) {
+	ctx, end := start(ctx, "dead_letters")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, deadLetterColumns+`
+		WHERE tenant_id = $1 AND webhook_id = $2 AND ($3::bigint = 0 OR id < $3)
+		ORDER BY id DESC LIMIT $4;
+	`, filter.TenantID, filter.WebhookID, filter.BeforeID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, rows.Err()
+}
+
+// ReplayDeadLetter enqueues a new delivery of the dead letter with id of the
+// webhook of tenantID with webhookID and returns it. The letter is kept, the
+// event keeps its id so receivers can tell a replay from a new event
+func ReplayDeadLetter(ctx context.Context, db *sql.DB, actor Actor, tenantID, webhookID int, id int64) (delivery Delivery, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return delivery, err
+	}
+	defer tx.Rollback()
+
+	letter, err := scanDeadLetter(tx.QueryRowContext(ctx, deadLetterColumns+" WHERE tenant_id = $1 AND webhook_id = $2 AND id = $3",
+		tenantID, webhookID, id))
+	if err == sql.ErrNoRows {
+		return delivery, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return delivery, err
+	}
+
+	delivery, err = scanDelivery(tx.QueryRowContext(ctx, `
+		WITH d AS (
+			INSERT INTO webhook_deliveries (webhook_id, tenant_id, event_id, event_type, payload)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING *
+		)
+		SELECT `+deliveryColumns+`
+		FROM d
+		JOIN webhooks w ON w.id = d.webhook_id;
+	`, webhookID, tenantID, letter.EventID, letter.EventType, string(letter.Payload)))
+	if err != nil {
+		return delivery, err
+	}
+
+	after := map[string]interface{}{"deadLetter": letter.ID, "delivery": delivery.ID, "event": letter.EventID}
+	if err := audit(ctx, tx, &tenantID, actor, ActionWebhookReplay, "webhook", strconv.Itoa(webhookID), nil, after); err != nil {
+		return delivery, err
+	}
+
+	return delivery, tx.Commit()
+}
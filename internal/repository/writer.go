@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/retry"
+)
+
+// ErrWriterClosed is returned when writing to a closed BatchWriter
+var ErrWriterClosed = errors.New("batch writer closed")
+
+// WriterConfig tunes a BatchWriter
+type WriterConfig struct {
+	// BatchSize is the number of readings that triggers a flush
+	BatchSize int
+	// FlushInterval is the longest a reading waits in the buffer
+	FlushInterval time.Duration
+	// MaxBuffered bounds the readings queued on top of the current batch, Write
+	// blocks once it is reached
+	MaxBuffered int
+	// Backoff paces the retries of a batch failing with a transient error, the
+	// batch is dropped once the attempts are exhausted or the context of the
+	// writer is done
+	Backoff retry.Backoff
+	// OnDrop is called with the error and the readings of a batch that could not
+	// be written, it logs them when unset. An error returned stops the writer,
+	// Write, Flush and Close then return it and discard the readings left
+	OnDrop func(err error, dropped []SensorData) error
+	// OnFlush, when set, is called with the number of readings of every batch written
+	OnFlush func(written int)
+}
+
+// DefaultWriterConfig returns the settings used by the simulator
+func DefaultWriterConfig() WriterConfig {
+	return WriterConfig{
+		BatchSize:     1000,
+		FlushInterval: time.Second,
+		MaxBuffered:   10000,
+		Backoff:       retry.DefaultBackoff(),
+	}
+}
+
+// BatchWriter buffers readings and loads them with COPY once BatchSize readings
+// are waiting or FlushInterval elapsed, whichever comes first
+type BatchWriter struct {
+	db  *sql.DB
+	cfg WriterConfig
+
+	mu     sync.RWMutex
+	closed bool
+
+	in      chan SensorData
+	flushes chan chan error
+	done    chan struct{}
+	// err is the error of the last flush, nil when it succeeded, written by run
+	// before done is closed
+	err error
+	// failed is closed once OnDrop returned failure and the writer stopped
+	failed  chan struct{}
+	failure error
+}
+
+// NewBatchWriter starts a writer, Close must be called to flush the last readings.
+// ctx bounds the retries, once it is done a failing batch is dropped after a
+// single attempt
+func NewBatchWriter(ctx context.Context, db *sql.DB, cfg WriterConfig) *BatchWriter {
+	defaults := DefaultWriterConfig()
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaults.BatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaults.FlushInterval
+	}
+	if cfg.MaxBuffered < 0 {
+		cfg.MaxBuffered = 0
+	}
+	if cfg.OnDrop == nil {
+		cfg.OnDrop = func(err error, dropped []SensorData) error {
+			slog.Error("dropped readings", "readings", len(dropped), "err", err)
+			return nil
+		}
+	}
+
+	w := &BatchWriter{
+		db:      db,
+		cfg:     cfg,
+		in:      make(chan SensorData, cfg.MaxBuffered),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+		failed:  make(chan struct{}),
+	}
+	go w.run(ctx)
+
+	return w
+}
+
+// Write queues a reading, blocking while the buffer is full
+func (w *BatchWriter) Write(ctx context.Context, data SensorData) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	select {
+	case <-w.failed:
+		return w.failure
+	default:
+	}
+
+	select {
+	case w.in <- data:
+		return nil
+	case <-w.failed:
+		return w.failure
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush writes every reading queued so far and returns the error of the last
+// batch that could not be written, if any
+func (w *BatchWriter) Flush(ctx context.Context) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	reply := make(chan error, 1)
+	select {
+	case w.flushes <- reply:
+	case <-w.failed:
+		return w.failure
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes the queued readings, stops the writer and returns the error of
+// that last flush, or the one OnDrop stopped the writer with. The batches dropped
+// before are only reported to OnDrop
+func (w *BatchWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.in)
+	w.mu.Unlock()
+
+	<-w.done
+	if w.failure != nil {
+		return w.failure
+	}
+	return w.err
+}
+
+func (w *BatchWriter) run(ctx context.Context) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SensorData, 0, w.cfg.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 || w.failure != nil {
+			return w.failure
+		}
+		w.err = w.copy(ctx, batch)
+		batch = batch[:0]
+		if w.failure != nil {
+			return w.failure
+		}
+		return w.err
+	}
+	// discard drops the readings written once the writer stopped until it is closed
+	discard := func() {
+		for range w.in {
+		}
+	}
+
+	for {
+		if w.failure != nil {
+			discard()
+			return
+		}
+
+		select {
+		case data, ok := <-w.in:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= w.cfg.BatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case reply := <-w.flushes:
+			// Take everything queued before Flush was called
+			var err error
+			for drained := false; !drained; {
+				select {
+				case data := <-w.in:
+					batch = append(batch, data)
+					if len(batch) >= w.cfg.BatchSize {
+						if flushErr := flush(); flushErr != nil {
+							err = flushErr
+						}
+					}
+				default:
+					drained = true
+				}
+			}
+			if flushErr := flush(); flushErr != nil {
+				err = flushErr
+			}
+			reply <- err
+		}
+	}
+}
+
+// copy loads a batch, retrying transient failures with exponential backoff until
+// ctx is done, and drops it when the failure is permanent or every attempt failed
+func (w *BatchWriter) copy(ctx context.Context, batch []SensorData) error {
+	started := time.Now()
+	err := retry.Do(ctx, w.cfg.Backoff, IsTransient, func() error {
+		return CopySensorData(w.db, batch)
+	})
+	if err == nil {
+		metrics.ObserveWrite(len(batch), time.Since(started))
+		if w.cfg.OnFlush != nil {
+			w.cfg.OnFlush(len(batch))
+		}
+		return nil
+	}
+
+	dropped := make([]SensorData, len(batch))
+	copy(dropped, batch)
+	metrics.ObserveDrop(len(dropped))
+	if stop := w.cfg.OnDrop(err, dropped); stop != nil {
+		w.failure = stop
+		close(w.failed)
+	}
+
+	return err
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/retry"
+)
+
+// unreachable opens a database no connection can be made to
+func unreachable(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBatchWriterStopsOnDrop(t *testing.T) {
+	stop := errors.New("stop")
+	drops := 0
+	w := NewBatchWriter(context.Background(), unreachable(t), WriterConfig{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		Backoff:       retry.Backoff{MaxAttempts: 1},
+		OnDrop: func(err error, dropped []SensorData) error {
+			drops++
+			return stop
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := w.Write(ctx, SensorData{SensorID: 1}); err != nil {
+		t.Fatalf("first Write() = %v", err)
+	}
+	if err := w.Flush(ctx); !errors.Is(err, stop) {
+		t.Fatalf("Flush() = %v, want %v", err, stop)
+	}
+	if err := w.Write(ctx, SensorData{SensorID: 1}); !errors.Is(err, stop) {
+		t.Fatalf("Write() after the drop = %v, want %v", err, stop)
+	}
+	if err := w.Close(); !errors.Is(err, stop) {
+		t.Fatalf("Close() = %v, want %v", err, stop)
+	}
+	if drops != 1 {
+		t.Fatalf("%d batches dropped, want 1", drops)
+	}
+}
+
+func TestBatchWriterRetriesUntilDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var dropped []SensorData
+	// Without a limit on the attempts only the context of the writer ends the retries
+	w := NewBatchWriter(ctx, unreachable(t), WriterConfig{
+		BatchSize: 1,
+		Backoff:   retry.Backoff{Initial: time.Hour, Max: time.Hour},
+		OnDrop: func(err error, batch []SensorData) error {
+			dropped = append(dropped, batch...)
+			return nil
+		},
+	})
+
+	if err := w.Write(context.Background(), SensorData{SensorID: 1}); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatal("Close() = nil, want the error of the batch")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close() kept retrying once the context was done")
+	}
+	if len(dropped) != 1 {
+		t.Fatalf("%d readings dropped, want 1", len(dropped))
+	}
+}
@@ -0,0 +1,68 @@
+// Package retry retries operations failing with transient errors
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff describes an exponential backoff
+type Backoff struct {
+	// Initial is the wait before the first retry
+	Initial time.Duration
+	// Max caps the wait between two attempts
+	Max time.Duration
+	// Multiplier grows the wait after every attempt, 2 when unset
+	Multiplier float64
+	// MaxAttempts stops retrying after that many attempts, 0 retries until ctx is done
+	MaxAttempts int
+}
+
+// DefaultBackoff returns the backoff used for database operations
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:     100 * time.Millisecond,
+		Max:         10 * time.Second,
+		Multiplier:  2,
+		MaxAttempts: 8,
+	}
+}
+
+// Delay returns the wait before the given retry, the first retry being 1
+func (b Backoff) Delay(retry int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial)
+	for i := 1; i < retry; i++ {
+		delay *= multiplier
+		if b.Max > 0 && delay >= float64(b.Max) {
+			return b.Max
+		}
+	}
+	return time.Duration(delay)
+}
+
+// Do calls fn until it succeeds, returns an error retryable rejects, the attempts
+// are exhausted or ctx is done. It returns the last error of fn
+func Do(ctx context.Context, b Backoff, retryable func(error) bool, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+		if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(b.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("transient")
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		retry   int
+		want    time.Duration
+	}{
+		{name: "first retry", backoff: Backoff{Initial: time.Second, Multiplier: 3}, retry: 1, want: time.Second},
+		{name: "grows", backoff: Backoff{Initial: time.Second, Multiplier: 3}, retry: 3, want: 9 * time.Second},
+		{name: "capped", backoff: Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 3}, retry: 3, want: 5 * time.Second},
+		{name: "unset multiplier doubles", backoff: Backoff{Initial: time.Second}, retry: 4, want: 8 * time.Second},
+		{name: "multiplier of one doubles", backoff: Backoff{Initial: time.Second, Multiplier: 1}, retry: 2, want: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.backoff.Delay(tt.retry); got != tt.want {
+				t.Errorf("Delay(%d) = %v, want %v", tt.retry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	backoff := Backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3}
+	errPermanent := errors.New("permanent")
+
+	tests := []struct {
+		name     string
+		errs     []error
+		want     error
+		attempts int
+	}{
+		{name: "succeeds", errs: []error{nil}, attempts: 1},
+		{name: "retries transient", errs: []error{errTransient, errTransient, nil}, attempts: 3},
+		{name: "stops on permanent", errs: []error{errTransient, errPermanent}, want: errPermanent, attempts: 2},
+		{name: "exhausts attempts", errs: []error{errTransient, errTransient, errTransient, nil}, want: errTransient, attempts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Do(context.Background(), backoff, retryable, func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			})
+
+			if err != tt.want {
+				t.Errorf("Do() = %v, want %v", err, tt.want)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := Do(ctx, Backoff{Initial: time.Hour}, retryable, func() error {
+		attempts++
+		cancel()
+		return errTransient
+	})
+
+	if err != errTransient || attempts != 1 {
+		t.Errorf("Do() = %v after %d attempts, want %v after 1", err, attempts, errTransient)
+	}
+}
+
+func retryable(err error) bool {
+	return err == errTransient
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/stream"
+	"github.com/sensors/internal/tracing"
+)
+
+// Metrics the live aggregates are computed over
+const (
+	MetricTemperature  = "temperature"
+	MetricTransparency = "transparency"
+)
+
+const (
+	// DefaultAggregateWindow is the window of an aggregate that does not set one
+	DefaultAggregateWindow = 5 * time.Minute
+	maxAggregateWindow     = time.Hour
+	// maxAggregates bounds the aggregates a session computes at once
+	maxAggregates = 100
+	// aggregateInterval is how often the aggregates are recomputed, an update is
+	// sent when one changed
+	aggregateInterval = time.Second
+)
+
+// Region is a box of sensor positions, bounds included
+type Region struct {
+	XMin float64 `json:"xMin"`
+	XMax float64 `json:"xMax"`
+	YMin float64 `json:"yMin"`
+	YMax float64 `json:"yMax"`
+	ZMin float64 `json:"zMin"`
+	ZMax float64 `json:"zMax"`
+}
+
+// AggregateQuery describes an aggregate of Metric over the readings of the last
+// Window of the sensor called Sensor, of the group called Group or of the sensors
+// in Region, of every group when none is set
+type AggregateQuery struct {
+	Metric    string
+	Aggregate string
+	Window    time.Duration
+	Group     string
+	Sensor    string
+	Region    *Region
+}
+
+// AggregateUpdate is the value of the aggregate subscribed as ID at At, Value is
+// nil when there was no reading in its window
+type AggregateUpdate struct {
+	ID       string    `json:"id"`
+	Value    *float64  `json:"value"`
+	Readings int       `json:"readings"`
+	At       time.Time `json:"at"`
+}
+
+// AggregateSession computes rolling aggregates of the live readings, it ends when
+// the context it was opened with is done
+type AggregateSession interface {
+	// Subscribe starts computing query as id, its first update follows shortly
+	Subscribe(ctx context.Context, id string, query AggregateQuery) error
+	// Unsubscribe stops computing the aggregate subscribed as id
+	Unsubscribe(id string) error
+	// Updates returns the updates of every aggregate, it is closed when the
+	// session ends
+	Updates() <-chan AggregateUpdate
+	// Err tells why the session ended once Updates is closed, see ReadingStream.Err
+	Err() error
+}
+
+func (s *streamService) OpenAggregates(ctx context.Context) (session AggregateSession, err error) {
+	spanCtx, span := tracer.Start(ctx, "StreamService.OpenAggregates")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(spanCtx)
+	if err != nil {
+		return
+	}
+
+	a := &aggregateSession{
+		dao:          s.dao,
+		hub:          s.hub,
+		tenant:       tenant,
+		subscription: s.hub.Subscribe(ctx, stream.Filter{TenantID: tenant.ID}, 0),
+		updates:      make(chan AggregateUpdate),
+		aggregates:   make(map[string]*liveAggregate),
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// aggregateSession follows every reading of the tenant and feeds them to the
+// windows of the aggregates they are selected by. It does not read the
+// aggregated_statistics of the aggregator: those are per group averages stored
+// once per interval, while a session computes the minimum, maximum or average of
+// any sensor, group or region every second
+type aggregateSession struct {
+	dao          repository.DAO
+	hub          *stream.Hub
+	tenant       repository.Tenant
+	subscription *stream.Subscription
+	updates      chan AggregateUpdate
+
+	mu         sync.Mutex
+	aggregates map[string]*liveAggregate
+}
+
+type liveAggregate struct {
+	query  AggregateQuery
+	filter stream.Filter
+	window *stream.Window
+	// Readings are held in pending until the window is seeded from the database,
+	// which accounts for those up to seededThrough
+	seeded        bool
+	seededThrough int64
+	pending       []repository.Reading
+	// sent is the last update sent, nil until the first one
+	sent *AggregateUpdate
+}
+
+func (a *aggregateSession) Subscribe(ctx context.Context, id string, query AggregateQuery) (err error) {
+	ctx, span := tracer.Start(ctx, "StreamService.SubscribeAggregate")
+	defer func() { tracing.End(span, err) }()
+
+	if id == "" || len(id) > 64 {
+		return InvalidArgument("id must be 1 to 64 characters")
+	}
+	if query.Aggregate == "" {
+		query.Aggregate = stream.Avg
+	}
+	if err = checkAggregate(query.Metric, query.Aggregate); err != nil {
+		return
+	}
+	if query.Window == 0 {
+		query.Window = DefaultAggregateWindow
+	}
+	if err = checkWindow(query.Window); err != nil {
+		return
+	}
+	if query.Region != nil && (query.Group != "" || query.Sensor != "") {
+		return InvalidArgument("a region cannot be combined with a group or a sensor")
+	}
+	if err = authorizeSelector(ctx, a.dao, a.tenant, auth.Read, query.Group, query.Sensor); err != nil {
+		return
+	}
+
+	live := &liveAggregate{
+		query:  query,
+		filter: stream.Filter{TenantID: a.tenant.ID, Group: query.Group, CodeName: query.Sensor},
+		window: stream.NewWindow(query.Window),
+	}
+	if r := query.Region; r != nil {
+		live.filter.Region = &repository.Region{XMin: r.XMin, XMax: r.XMax, YMin: r.YMin, YMax: r.YMax, ZMin: r.ZMin, ZMax: r.ZMax}
+	}
+
+	a.mu.Lock()
+	if _, ok := a.aggregates[id]; ok {
+		a.mu.Unlock()
+		return Conflict("aggregate %q is already subscribed", id)
+	}
+	if len(a.aggregates) >= maxAggregates {
+		a.mu.Unlock()
+		return InvalidArgument("at most %d aggregates can be subscribed at once", maxAggregates)
+	}
+	// Registered before the window is seeded, so no reading falls in between
+	a.aggregates[id] = live
+	a.mu.Unlock()
+
+	buckets, lastID, err := a.hub.Buckets(ctx, live.filter, query.Metric, time.Now().Add(-query.Window), live.window.Width())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		delete(a.aggregates, id)
+		return Unavailable(err, "the readings cannot be read")
+	}
+	for _, bucket := range buckets {
+		live.window.Merge(bucket)
+	}
+	for _, reading := range live.pending {
+		if reading.ID > lastID {
+			live.window.AddReading(reading, live.query.Metric)
+		}
+	}
+	live.seeded, live.seededThrough, live.pending = true, lastID, nil
+	return nil
+}
+
+func (a *aggregateSession) Unsubscribe(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.aggregates[id]; !ok {
+		return NotFound("aggregate %q is not subscribed", id)
+	}
+	delete(a.aggregates, id)
+	return nil
+}
+
+func (a *aggregateSession) Updates() <-chan AggregateUpdate {
+	return a.updates
+}
+
+func (a *aggregateSession) Err() error {
+	return a.subscription.Err()
+}
+
+func (a *aggregateSession) run(ctx context.Context) {
+	defer close(a.updates)
+
+	ticker := time.NewTicker(aggregateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case reading, ok := <-a.subscription.Readings():
+			if !ok {
+				return
+			}
+			a.add(reading)
+
+		case now := <-ticker.C:
+			for _, update := range a.evaluate(now) {
+				select {
+				case a.updates <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *aggregateSession) add(reading repository.Reading) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, live := range a.aggregates {
+		switch {
+		case !live.filter.Match(reading):
+		case !live.seeded:
+			live.pending = append(live.pending, reading)
+		case reading.ID > live.seededThrough:
+			live.window.AddReading(reading, live.query.Metric)
+		}
+	}
+}
+
+// evaluate returns the updates of the aggregates that changed since their last update
+func (a *aggregateSession) evaluate(now time.Time) []AggregateUpdate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var updates []AggregateUpdate
+	for id, live := range a.aggregates {
+		if !live.seeded {
+			continue
+		}
+		value, count := live.window.Evaluate(now, live.query.Aggregate)
+		if value != nil {
+			rounded := math.Round(*value*100) / 100
+			value = &rounded
+		}
+		if sent := live.sent; sent != nil && sent.Readings == count && equalValues(sent.Value, value) {
+			continue
+		}
+		update := AggregateUpdate{ID: id, Value: value, Readings: count, At: now}
+		live.sent = &update
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+// checkAggregate checks aggregate of metric is one the live aggregates compute
+func checkAggregate(metric, aggregate string) error {
+	if metric != MetricTemperature && metric != MetricTransparency {
+		return InvalidArgument("metric must be %s or %s, got %q", MetricTemperature, MetricTransparency, metric)
+	}
+	if aggregate != stream.Avg && aggregate != stream.Min && aggregate != stream.Max {
+		return InvalidArgument("aggregate must be %s, %s or %s, got %q", stream.Avg, stream.Min, stream.Max, aggregate)
+	}
+	return nil
+}
+
+// checkWindow checks window spans whole minutes, within the bounds of the live aggregates
+func checkWindow(window time.Duration) error {
+	if window < time.Minute || window > maxAggregateWindow || window%time.Minute != 0 {
+		return InvalidArgument("window must be whole minutes from 1m to %s, got %s", maxAggregateWindow, window)
+	}
+	return nil
+}
+
+func equalValues(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensors/internal/alert"
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/stream"
+	"github.com/sensors/internal/tracing"
+)
+
+// Severities of the alert rules
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// maxAlertFor bounds how long a condition may have to hold before its alert fires
+const maxAlertFor = 24 * time.Hour
+
+// Bounds of the number of alerts returned at once
+const (
+	DefaultAlertLimit = 100
+	maxAlertLimit     = 1000
+)
+
+// Duration is a duration written as in Go in JSON, "5m" or "90s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	s := time.Duration(d).String()
+	// "5m0s" reads better as "5m", "1h0m0s" as "1h"
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return json.Marshal(s)
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// AlertRule raises an alert when Aggregate of Metric over the last Window of the
+// sensor called Sensor, else of the group called Group, else of every group
+// compares to Threshold with Operator for at least For
+type AlertRule struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Metric    string   `json:"metric"`
+	Aggregate string   `json:"aggregate"`
+	Window    Duration `json:"window"`
+	Group     string   `json:"group,omitempty"`
+	Sensor    string   `json:"sensor,omitempty"`
+	Operator  string   `json:"operator"`
+	Threshold float64  `json:"threshold"`
+	For       Duration `json:"for"`
+	Severity  string   `json:"severity"`
+	// Enabled is true unless set otherwise
+	Enabled   *bool     `json:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func newAlertRule(rule repository.AlertRule) AlertRule {
+	enabled := rule.Enabled
+	return AlertRule{
+		ID:        rule.ID,
+		Name:      rule.Name,
+		Metric:    rule.Metric,
+		Aggregate: rule.Aggregate,
+		Window:    Duration(rule.Window),
+		Group:     rule.Group,
+		Sensor:    rule.CodeName,
+		Operator:  rule.Operator,
+		Threshold: rule.Threshold,
+		For:       Duration(rule.For),
+		Severity:  rule.Severity,
+		Enabled:   &enabled,
+		CreatedAt: rule.CreatedAt,
+		UpdatedAt: rule.UpdatedAt,
+	}
+}
+
+// Alert is an occurrence of the condition of a rule, Value being the one that
+// started or fired it. RuleID is null once the rule is deleted
+type Alert struct {
+	ID         int64      `json:"id"`
+	RuleID     *int       `json:"ruleId"`
+	Rule       string     `json:"rule"`
+	Severity   string     `json:"severity"`
+	Group      string     `json:"group,omitempty"`
+	Sensor     string     `json:"sensor,omitempty"`
+	State      string     `json:"state"`
+	Value      *float64   `json:"value"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FiredAt    *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+func newAlert(found repository.Alert) Alert {
+	return Alert{
+		ID:         found.ID,
+		RuleID:     found.RuleID,
+		Rule:       found.RuleName,
+		Severity:   found.Severity,
+		Group:      found.Group,
+		Sensor:     found.CodeName,
+		State:      found.State,
+		Value:      found.Value,
+		StartedAt:  found.StartedAt,
+		FiredAt:    found.FiredAt,
+		ResolvedAt: found.ResolvedAt,
+	}
+}
+
+// AlertFilter selects alerts, zero fields select everything. Alerts are returned
+// newest first, Before pages through them by id
+type AlertFilter struct {
+	RuleID   int
+	State    string
+	Open     bool
+	Severity string
+	From     *time.Time
+	Till     *time.Time
+	Before   int64
+	Limit    int
+}
+
+// AlertService manages the alert rules of the tenant a request acts on and reads
+// their alerts. Managing a rule needs write on its group, reading it or its
+// alerts read, the rules spanning every group need the wildcard scopes
+type AlertService interface {
+	CreateRule(ctx context.Context, rule AlertRule) (AlertRule, error)
+	ListRules(ctx context.Context) ([]AlertRule, error)
+	GetRule(ctx context.Context, id int) (AlertRule, error)
+	ReplaceRule(ctx context.Context, id int, rule AlertRule) (AlertRule, error)
+	DeleteRule(ctx context.Context, id int) error
+	ListAlerts(ctx context.Context, filter AlertFilter) ([]Alert, error)
+}
+
+type alertService struct {
+	db      *sql.DB
+	dao     repository.DAO
+	tenants *tenantResolver
+}
+
+func NewAlertService(db *sql.DB) AlertService {
+	dao := repository.NewDAO(db)
+	return &alertService{db: db, dao: dao, tenants: newTenantResolver(dao.NewTenantQuery())}
+}
+
+// authorizeRule checks the principal of ctx may apply action to the group rule
+// reads, every group for a rule spanning them
+func authorizeRule(ctx context.Context, action auth.Action, rule repository.AlertRule) error {
+	group := rule.ScopeGroup()
+	if group == "" {
+		group = auth.AllGroups
+	}
+	return authorize(ctx, action, group)
+}
+
+// stored validates rule, fills its defaults and returns it as stored for tenant.
+// The principal of ctx must be allowed to write to the group it reads
+func (a *alertService) stored(ctx context.Context, tenant repository.Tenant, rule AlertRule) (repository.AlertRule, error) {
+	stored := repository.AlertRule{
+		TenantID:  tenant.ID,
+		Name:      rule.Name,
+		Metric:    rule.Metric,
+		Aggregate: rule.Aggregate,
+		Window:    time.Duration(rule.Window),
+		Group:     rule.Group,
+		CodeName:  rule.Sensor,
+		Operator:  rule.Operator,
+		Threshold: rule.Threshold,
+		For:       time.Duration(rule.For),
+		Severity:  rule.Severity,
+		Enabled:   rule.Enabled == nil || *rule.Enabled,
+	}
+	if stored.Aggregate == "" {
+		stored.Aggregate = stream.Avg
+	}
+	if stored.Window == 0 {
+		stored.Window = DefaultAggregateWindow
+	}
+	if stored.Severity == "" {
+		stored.Severity = SeverityWarning
+	}
+
+	if err := authorizeSelector(ctx, a.dao, tenant, auth.Write, stored.Group, stored.CodeName); err != nil {
+		return stored, err
+	}
+	if !namePattern.MatchString(stored.Name) {
+		return stored, InvalidArgument("name must be 1 to 64 letters, digits, '_' or '-'")
+	}
+	if err := checkAggregate(stored.Metric, stored.Aggregate); err != nil {
+		return stored, err
+	}
+	if err := checkWindow(stored.Window); err != nil {
+		return stored, err
+	}
+	switch stored.Operator {
+	case alert.Above, alert.AboveOrEqual, alert.Below, alert.BelowOrEqual:
+	default:
+		return stored, InvalidArgument("operator must be %s, %s, %s or %s, got %q", alert.Above, alert.AboveOrEqual, alert.Below, alert.BelowOrEqual, stored.Operator)
+	}
+	if stored.For < 0 || stored.For > maxAlertFor || stored.For%time.Second != 0 {
+		return stored, InvalidArgument("for must be whole seconds from 0s to %s, got %s", maxAlertFor, stored.For)
+	}
+	switch stored.Severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return stored, InvalidArgument("severity must be %s, %s or %s, got %q", SeverityInfo, SeverityWarning, SeverityCritical, stored.Severity)
+	}
+
+	return stored, nil
+}
+
+// fetch returns the rule of tenant with id, once the principal of ctx is allowed
+// to apply action to it
+func (a *alertService) fetch(ctx context.Context, tenant repository.Tenant, action auth.Action, id int) (repository.AlertRule, error) {
+	rule, err := repository.FetchAlertRule(ctx, a.db, tenant.ID, id)
+	if err != nil {
+		return rule, classify(err, strconv.Itoa(id))
+	}
+	return rule, authorizeRule(ctx, action, rule)
+}
+
+func (a *alertService) CreateRule(ctx context.Context, rule AlertRule) (created AlertRule, err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.CreateRule")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	stored, err := a.stored(ctx, tenant, rule)
+	if err != nil {
+		return
+	}
+
+	if err = repository.CreateAlertRule(ctx, a.db, actorOf(ctx), &stored); err != nil {
+		err = classify(err, stored.Name)
+		return
+	}
+	return newAlertRule(stored), nil
+}
+
+func (a *alertService) ListRules(ctx context.Context) (rules []AlertRule, err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.ListRules")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	stored, err := repository.ListAlertRules(ctx, a.db, &tenant.ID)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	// The rules of the groups the principal cannot read are left out
+	rules = make([]AlertRule, 0, len(stored))
+	for _, rule := range stored {
+		if authorizeRule(ctx, auth.Read, rule) == nil {
+			rules = append(rules, newAlertRule(rule))
+		}
+	}
+	return rules, nil
+}
+
+func (a *alertService) GetRule(ctx context.Context, id int) (rule AlertRule, err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.GetRule")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	stored, err := a.fetch(ctx, tenant, auth.Read, id)
+	if err != nil {
+		return
+	}
+	return newAlertRule(stored), nil
+}
+
+func (a *alertService) ReplaceRule(ctx context.Context, id int, rule AlertRule) (replaced AlertRule, err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.ReplaceRule")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	// Moving a rule writes to the group it leaves as well
+	if _, err = a.fetch(ctx, tenant, auth.Write, id); err != nil {
+		return
+	}
+	stored, err := a.stored(ctx, tenant, rule)
+	if err != nil {
+		return
+	}
+
+	stored.ID = id
+	if err = repository.ReplaceAlertRule(ctx, a.db, actorOf(ctx), &stored); err != nil {
+		err = classify(err, stored.Name)
+		return
+	}
+	return newAlertRule(stored), nil
+}
+
+func (a *alertService) DeleteRule(ctx context.Context, id int) (err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.DeleteRule")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if _, err = a.fetch(ctx, tenant, auth.Write, id); err != nil {
+		return
+	}
+
+	return classify(repository.DeleteAlertRule(ctx, a.db, actorOf(ctx), tenant.ID, id), strconv.Itoa(id))
+}
+
+func (a *alertService) ListAlerts(ctx context.Context, filter AlertFilter) (alerts []Alert, err error) {
+	ctx, span := tracer.Start(ctx, "AlertService.ListAlerts")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = DefaultAlertLimit
+	}
+	if filter.Limit < 0 || filter.Limit > maxAlertLimit {
+		return nil, InvalidArgument("limit must be between 1 and %d, got %d", maxAlertLimit, filter.Limit)
+	}
+	switch filter.State {
+	case "", repository.AlertPending, repository.AlertFiring, repository.AlertResolved:
+	default:
+		return nil, InvalidArgument("state must be %s, %s or %s, got %q", repository.AlertPending, repository.AlertFiring, repository.AlertResolved, filter.State)
+	}
+	if filter.From != nil && filter.Till != nil && filter.Till.Before(*filter.From) {
+		return nil, InvalidArgument("till must not be before from")
+	}
+
+	stored := repository.AlertFilter{
+		TenantID: tenant.ID,
+		RuleID:   filter.RuleID,
+		State:    filter.State,
+		Open:     filter.Open,
+		Severity: filter.Severity,
+		From:     filter.From,
+		Till:     filter.Till,
+		BeforeID: filter.Before,
+		Limit:    filter.Limit,
+	}
+	// A principal reads the alerts of the groups it may read, those of the rules
+	// spanning every group need read:*
+	if principal := auth.FromContext(ctx); principal != nil {
+		if groups, all := principal.Groups(auth.Read); !all {
+			stored.Groups = groups
+		}
+	}
+
+	found, err := repository.ListAlerts(ctx, a.db, stored)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	alerts = make([]Alert, 0, len(found))
+	for _, entry := range found {
+		alerts = append(alerts, newAlert(entry))
+	}
+	return alerts, nil
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+)
+
+// Bounds of the anomaly threshold of a group, in standard deviations
+const (
+	minAnomalyThreshold = 1
+	maxAnomalyThreshold = 10
+)
+
+// Bounds of the number of anomalies returned at once
+const (
+	DefaultAnomalyLimit = 100
+	maxAnomalyLimit     = 1000
+)
+
+// Anomaly describes a reading whose metric deviated from the baseline of its
+// sensor: the value expected by method and the deviation in standard deviations,
+// negative below
+type Anomaly struct {
+	ID        int64     `json:"id"`
+	Reading   int64     `json:"reading"`
+	Metric    string    `json:"metric"`
+	Method    string    `json:"method"`
+	Value     float64   `json:"value"`
+	Expected  float64   `json:"expected"`
+	Score     float64   `json:"score"`
+	Threshold float64   `json:"threshold"`
+	Group     string    `json:"group"`
+	ReadAt    time.Time `json:"readAt"`
+}
+
+// AnomalyFilter selects the anomalies of a sensor, zero fields select
+// everything. They are returned newest first, Before pages through them by id
+type AnomalyFilter struct {
+	Metric string
+	From   *time.Time
+	Till   *time.Time
+	Before int64
+	Limit  int
+}
+
+// AnomalySettings tunes the anomaly detection of a group. A lower Threshold
+// flags smaller deviations, null leaves it to the detector default
+type AnomalySettings struct {
+	Group     string   `json:"group"`
+	Threshold *float64 `json:"threshold"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+// AnomalyService serves the anomalies of the sensors and the anomaly settings of
+// the groups of the tenant a request acts on
+type AnomalyService interface {
+	ListAnomalies(ctx context.Context, codeName string, filter AnomalyFilter) ([]Anomaly, error)
+	GetSettings(ctx context.Context, groupName string) (AnomalySettings, error)
+	UpdateSettings(ctx context.Context, groupName string, settings AnomalySettings) (AnomalySettings, error)
+}
+
+type anomalyService struct {
+	db      *sql.DB
+	dao     repository.DAO
+	tenants *tenantResolver
+}
+
+func NewAnomalyService(db *sql.DB) AnomalyService {
+	dao := repository.NewDAO(db)
+	return &anomalyService{db: db, dao: dao, tenants: newTenantResolver(dao.NewTenantQuery())}
+}
+
+func newAnomalySettings(settings repository.AnomalySettings) AnomalySettings {
+	enabled := settings.Enabled
+	return AnomalySettings{Group: settings.Group, Threshold: settings.Threshold, Enabled: &enabled}
+}
+
+func (a *anomalyService) ListAnomalies(ctx context.Context, codeName string, filter AnomalyFilter) (anomalies []Anomaly, err error) {
+	ctx, span := tracer.Start(ctx, "AnomalyService.ListAnomalies")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if _, _, err = authorizeSensor(ctx, a.dao, tenant, auth.Read, codeName); err != nil {
+		return
+	}
+	if filter.Metric != "" && filter.Metric != MetricTemperature && filter.Metric != MetricTransparency {
+		return nil, InvalidArgument("metric must be %s or %s, got %q", MetricTemperature, MetricTransparency, filter.Metric)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = DefaultAnomalyLimit
+	}
+	if filter.Limit < 0 || filter.Limit > maxAnomalyLimit {
+		return nil, InvalidArgument("limit must be between 1 and %d, got %d", maxAnomalyLimit, filter.Limit)
+	}
+	if filter.From != nil && filter.Till != nil && filter.Till.Before(*filter.From) {
+		return nil, InvalidArgument("till must not be before from")
+	}
+
+	found, err := repository.ListAnomalies(ctx, a.db, repository.AnomalyFilter{
+		TenantID: tenant.ID,
+		CodeName: codeName,
+		Metric:   filter.Metric,
+		From:     filter.From,
+		Till:     filter.Till,
+		BeforeID: filter.Before,
+		Limit:    filter.Limit,
+	})
+	if err != nil {
+		err = classify(err, codeName)
+		return
+	}
+
+	anomalies = make([]Anomaly, 0, len(found))
+	for _, anomaly := range found {
+		anomalies = append(anomalies, Anomaly{
+			ID:        anomaly.ID,
+			Reading:   anomaly.ReadingID,
+			Metric:    anomaly.Metric,
+			Method:    anomaly.Method,
+			Value:     anomaly.Value,
+			Expected:  anomaly.Expected,
+			Score:     anomaly.Score,
+			Threshold: anomaly.Threshold,
+			Group:     anomaly.Group,
+			ReadAt:    anomaly.ReadAt,
+		})
+	}
+	return anomalies, nil
+}
+
+func (a *anomalyService) GetSettings(ctx context.Context, groupName string) (settings AnomalySettings, err error) {
+	ctx, span := tracer.Start(ctx, "AnomalyService.GetSettings")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorize(ctx, auth.Read, groupName); err != nil {
+		return
+	}
+
+	stored, err := repository.FetchAnomalySettings(ctx, a.db, tenant.ID, groupName)
+	if err != nil {
+		err = classify(err, groupName)
+		return
+	}
+	return newAnomalySettings(stored), nil
+}
+
+func (a *anomalyService) UpdateSettings(ctx context.Context, groupName string, settings AnomalySettings) (updated AnomalySettings, err error) {
+	ctx, span := tracer.Start(ctx, "AnomalyService.UpdateSettings")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := a.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorize(ctx, auth.Write, groupName); err != nil {
+		return
+	}
+	if t := settings.Threshold; t != nil && (*t < minAnomalyThreshold || *t > maxAnomalyThreshold) {
+		return updated, InvalidArgument("threshold must be between %d and %d standard deviations, got %g", minAnomalyThreshold, maxAnomalyThreshold, *t)
+	}
+
+	stored := repository.AnomalySettings{
+		TenantID:  tenant.ID,
+		Group:     groupName,
+		Threshold: settings.Threshold,
+		Enabled:   settings.Enabled == nil || *settings.Enabled,
+	}
+	if err = repository.UpdateAnomalySettings(ctx, a.db, actorOf(ctx), stored); err != nil {
+		err = classify(err, groupName)
+		return
+	}
+	return newAnomalySettings(stored), nil
+}
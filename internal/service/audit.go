@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tenant"
+	"github.com/sensors/internal/tracing"
+)
+
+// Bounds of the number of audit entries returned at once
+const (
+	DefaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// actorOf returns who the changes made on behalf of ctx are recorded for
+func actorOf(ctx context.Context) repository.Actor {
+	principal := auth.FromContext(ctx)
+	if principal == nil {
+		principal = auth.System
+	}
+	return repository.Actor{
+		Subject:     principal.Subject,
+		PrincipalID: principal.ID,
+		Method:      principal.Method,
+		RequestID:   logging.RequestID(ctx),
+	}
+}
+
+// AuditEntry describes a recorded change, Before and After are null when the
+// entity did not exist
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Tenant     string          `json:"tenant,omitempty"`
+	Actor      string          `json:"actor"`
+	AuthMethod string          `json:"authMethod"`
+	RequestID  string          `json:"requestId,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entityType"`
+	EntityID   string          `json:"entityId"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// AuditFilter selects audit entries, zero fields select everything. Entries are
+// returned newest first, Before pages through them by id
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   string
+	From       *time.Time
+	Till       *time.Time
+	Before     int64
+	Limit      int
+}
+
+// AuditService reads the audit log, every method needs the admin scope. A tenant
+// admin sees the entries of its tenant, a platform admin those of every tenant
+// unless the request chooses one
+type AuditService interface {
+	ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+type auditService struct {
+	db      *sql.DB
+	tenants *tenantResolver
+}
+
+func NewAuditService(db *sql.DB) AuditService {
+	return &auditService{db: db, tenants: newTenantResolver(repository.NewDAO(db).NewTenantQuery())}
+}
+
+func (a *auditService) ListAudit(ctx context.Context, filter AuditFilter) (entries []AuditEntry, err error) {
+	ctx, span := tracer.Start(ctx, "AuditService.ListAudit")
+	defer func() { tracing.End(span, err) }()
+
+	principal := auth.FromContext(ctx)
+	if principal == nil || !principal.IsAdmin() {
+		return nil, Forbidden("reading the audit log needs the %s scope", auth.ScopeAdmin)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = DefaultAuditLimit
+	}
+	if filter.Limit < 0 || filter.Limit > maxAuditLimit {
+		return nil, InvalidArgument("limit must be between 1 and %d, got %d", maxAuditLimit, filter.Limit)
+	}
+	if filter.From != nil && filter.Till != nil && filter.Till.Before(*filter.From) {
+		return nil, InvalidArgument("till must not be before from")
+	}
+
+	stored := repository.AuditFilter{
+		Actor:      filter.Actor,
+		Action:     filter.Action,
+		EntityType: filter.EntityType,
+		EntityID:   filter.EntityID,
+		From:       filter.From,
+		Till:       filter.Till,
+		BeforeID:   filter.Before,
+		Limit:      filter.Limit,
+	}
+	// Platform admins read the whole log unless they pick a tenant
+	if principal.Tenant != "" || tenant.Name(ctx) != "" {
+		t, err := a.tenants.resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stored.TenantID = &t.ID
+	}
+
+	found, err := repository.ListAuditEntries(ctx, a.db, stored)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	entries = make([]AuditEntry, 0, len(found))
+	for _, entry := range found {
+		entries = append(entries, AuditEntry{
+			ID:         entry.ID,
+			Tenant:     entry.Tenant,
+			Actor:      entry.Actor.Subject,
+			AuthMethod: entry.Actor.Method,
+			RequestID:  entry.Actor.RequestID,
+			Action:     entry.Action,
+			EntityType: entry.EntityType,
+			EntityID:   entry.EntityID,
+			Before:     entry.Before,
+			After:      entry.After,
+			CreatedAt:  entry.CreatedAt,
+		})
+	}
+	return entries, nil
+}
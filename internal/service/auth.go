@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+)
+
+// authorize checks the principal of ctx may apply action to group, a context
+// without principal is denied everything
+func authorize(ctx context.Context, action auth.Action, group string) error {
+	principal := auth.FromContext(ctx)
+	if principal == nil {
+		return Forbidden("no authenticated caller")
+	}
+	if principal.Can(action, group) {
+		return nil
+	}
+	if group == auth.AllGroups {
+		return Forbidden("%s on every group needs the %s:* scope", action, action)
+	}
+	return Forbidden("%s on group %q needs the %s:%s scope", action, group, action, group)
+}
+
+// authorizeSensor checks the principal of ctx may apply action to the group of
+// the sensor of tenant called codeName and returns the sensor. A missing sensor is only
+// reported to callers allowed on every group, others cannot probe for sensors
+func authorizeSensor(ctx context.Context, dao repository.DAO, tenant repository.Tenant, action auth.Action, codeName string) (repository.Sensor, string, error) {
+	sensor, groupName, err := dao.NewSensorQuery(tenant.ID).FetchSensor(ctx, codeName)
+	if errors.Is(err, repository.ErrSensorNotFound) {
+		if err := authorize(ctx, action, auth.AllGroups); err != nil {
+			return sensor, "", err
+		}
+	}
+	if err != nil {
+		return sensor, "", classify(err, codeName)
+	}
+	return sensor, groupName, authorize(ctx, action, groupName)
+}
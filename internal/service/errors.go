@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sensors/internal/repository"
+)
+
+// Kinds of domain errors, match them with errors.Is
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrUnavailable     = errors.New("unavailable")
+	ErrForbidden       = errors.New("forbidden")
+	ErrConflict        = errors.New("conflict")
+)
+
+// Error is a domain error of a Kind, with a detail meant for the client and the
+// cause, meant for the logs
+type Error struct {
+	Kind   error
+	Detail string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Kind, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Detail)
+}
+
+// Unwrap lets errors.Is match both the kind and the cause
+func (e *Error) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+// NotFound reports a missing entity
+func NotFound(format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Detail: fmt.Sprintf(format, args...)}
+}
+
+// InvalidArgument reports an argument the request cannot be served with
+func InvalidArgument(format string, args ...any) error {
+	return &Error{Kind: ErrInvalidArgument, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Forbidden reports a caller lacking the scope an action needs
+func Forbidden(format string, args ...any) error {
+	return &Error{Kind: ErrForbidden, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Conflict reports an entity clashing with one that already exists
+func Conflict(format string, args ...any) error {
+	return &Error{Kind: ErrConflict, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Unavailable reports a dependency that failed, err being its error
+func Unavailable(err error, format string, args ...any) error {
+	return &Error{Kind: ErrUnavailable, Detail: fmt.Sprintf(format, args...), Err: err}
+}
+
+// classify turns the repository errors the client can act upon into domain
+// errors, name being the group or sensor the query was about. Other errors are
+// returned as is and end up as internal errors
+func classify(err error, name string) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, repository.ErrGroupNotFound):
+		return NotFound("group %q does not exist", name)
+	case errors.Is(err, repository.ErrSensorNotFound):
+		return NotFound("sensor %q does not exist", name)
+	case errors.Is(err, repository.ErrSensorExists):
+		return Conflict("sensor %q already exists", name)
+	case errors.Is(err, repository.ErrAPIKeyNotFound):
+		return NotFound("API key %s does not exist", name)
+	case errors.Is(err, repository.ErrTenantNotFound):
+		return NotFound("tenant %q does not exist", name)
+	case errors.Is(err, repository.ErrGroupExists):
+		return Conflict("group %q already exists", name)
+	case errors.Is(err, repository.ErrTenantExists):
+		return Conflict("tenant %q already exists", name)
+	case errors.Is(err, repository.ErrAlertRuleNotFound):
+		return NotFound("alert rule %s does not exist", name)
+	case errors.Is(err, repository.ErrAlertRuleExists):
+		return Conflict("alert rule %q already exists", name)
+	case errors.Is(err, repository.ErrWebhookNotFound):
+		return NotFound("webhook %s does not exist", name)
+	case errors.Is(err, repository.ErrDeadLetterNotFound):
+		return NotFound("dead letter %s does not exist", name)
+	case repository.IsTransient(err), errors.Is(err, context.DeadlineExceeded):
+		return Unavailable(err, "the database is unavailable")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+	"github.com/sensors/internal/watchdog"
+)
+
+// Bounds of the window the health of the sensors is reported over
+const (
+	DefaultHealthWindow = 24 * time.Hour
+	maxHealthWindow     = 7 * 24 * time.Hour
+)
+
+// maxGaps bounds the gaps listed per sensor, the newest are kept
+const maxGaps = 100
+
+// SensorHealth is the health of a sensor over the window of a report. Interval
+// is the median number of seconds between its latest readings, Uptime the
+// percentage of the window it reported at its data rate since its first reading
+type SensorHealth struct {
+	Sensor   string     `json:"sensor"`
+	Group    string     `json:"group"`
+	DataRate int        `json:"dataRate"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen"`
+	Interval *float64   `json:"interval"`
+	Uptime   *float64   `json:"uptime"`
+	Gaps     []Gap      `json:"gaps"`
+	GapCount int        `json:"gapCount"`
+}
+
+// Gap is a time a sensor did not report for longer than its data rate allows,
+// Missing being the number of readings it missed. Till is absent while the gap
+// is open
+type Gap struct {
+	From    time.Time  `json:"from"`
+	Till    *time.Time `json:"till,omitempty"`
+	Missing int        `json:"missing"`
+}
+
+// HealthFilter selects the sensors of a health report, zero fields select
+// everything
+type HealthFilter struct {
+	Window time.Duration
+	Group  string
+	Status string
+}
+
+// HealthReport is the health of the sensors over the window since Since
+type HealthReport struct {
+	Window  Duration       `json:"window"`
+	Since   time.Time      `json:"since"`
+	Sensors []SensorHealth `json:"sensors"`
+}
+
+// SensorHealthService reports the health of the sensors of the tenant a request
+// acts on, those of the groups the principal may read
+type SensorHealthService interface {
+	Report(ctx context.Context, filter HealthFilter) (HealthReport, error)
+}
+
+type sensorHealthService struct {
+	db      *sql.DB
+	tenants *tenantResolver
+}
+
+func NewSensorHealthService(db *sql.DB) SensorHealthService {
+	return &sensorHealthService{db: db, tenants: newTenantResolver(repository.NewDAO(db).NewTenantQuery())}
+}
+
+func (h *sensorHealthService) Report(ctx context.Context, filter HealthFilter) (report HealthReport, err error) {
+	ctx, span := tracer.Start(ctx, "SensorHealthService.Report")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := h.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if filter.Window == 0 {
+		filter.Window = DefaultHealthWindow
+	}
+	if filter.Window < time.Minute || filter.Window > maxHealthWindow {
+		return report, InvalidArgument("window must be between 1m and %s, got %s", maxHealthWindow, filter.Window)
+	}
+	if filter.Status != "" && !slices.Contains(watchdog.Statuses, filter.Status) {
+		return report, InvalidArgument("status must be one of %s, got %q", strings.Join(watchdog.Statuses, ", "), filter.Status)
+	}
+
+	stored := repository.ActivityFilter{TenantID: &tenant.ID, Group: filter.Group}
+	if filter.Group != "" {
+		if err = authorize(ctx, auth.Read, filter.Group); err != nil {
+			return
+		}
+	} else if principal := auth.FromContext(ctx); principal != nil {
+		// A principal reads the health of the sensors of the groups it may read
+		if groups, all := principal.Groups(auth.Read); !all {
+			stored.Groups = groups
+		}
+	}
+
+	// The readings are stored in UTC
+	now := time.Now().UTC()
+	since := now.Add(-filter.Window)
+	activities, err := repository.ListSensorActivity(ctx, h.db, stored)
+	if err != nil {
+		err = classify(err, filter.Group)
+		return
+	}
+	gaps, err := repository.ListGaps(ctx, h.db, stored, since, watchdog.GapAfter)
+	if err != nil {
+		err = classify(err, filter.Group)
+		return
+	}
+	gapsOf := make(map[string][]repository.Gap)
+	for _, gap := range gaps {
+		gapsOf[gap.CodeName] = append(gapsOf[gap.CodeName], gap)
+	}
+
+	report = HealthReport{Window: Duration(filter.Window), Since: since, Sensors: []SensorHealth{}}
+	for _, activity := range activities {
+		health := newSensorHealth(activity, gapsOf[activity.CodeName], since, now)
+		if filter.Status == "" || health.Status == filter.Status {
+			report.Sensors = append(report.Sensors, health)
+		}
+	}
+	return report, nil
+}
+
+// newSensorHealth returns the health of the sensor of activity over the window
+// from since to now, gaps being those closed within it
+func newSensorHealth(activity repository.SensorActivity, gaps []repository.Gap, since, now time.Time) SensorHealth {
+	health := SensorHealth{
+		Sensor:   activity.CodeName,
+		Group:    activity.Group,
+		DataRate: activity.DataRate,
+		Status:   watchdog.Status(activity, now),
+		LastSeen: activity.LastSeen,
+		Gaps:     []Gap{},
+	}
+	if activity.Interval != nil {
+		interval := math.Round(*activity.Interval*100) / 100
+		health.Interval = &interval
+	}
+	if activity.LastSeen == nil {
+		return health
+	}
+
+	// A gap counts as down time but for the data rate the sensor would have
+	// waited anyway, unless it started before the window
+	rate := watchdog.Rate(activity)
+	expected := time.Duration(rate * float64(time.Second))
+	var down time.Duration
+	for _, gap := range gaps {
+		till := gap.Till
+		took := till.Sub(gap.From)
+		down += took
+		if gap.From.After(since) {
+			down -= expected
+		}
+		health.Gaps = append(health.Gaps, Gap{From: gap.From, Till: &till, Missing: max(int(math.Round(took.Seconds()/rate))-1, 1)})
+	}
+	if now.Sub(*activity.LastSeen).Seconds() > watchdog.GapAfter*rate {
+		from := *activity.LastSeen
+		if from.Before(since) {
+			from = since
+		} else {
+			down -= expected
+		}
+		down += now.Sub(from)
+		health.Gaps = append(health.Gaps, Gap{From: from, Missing: int(now.Sub(from).Seconds() / rate)})
+	}
+
+	// The window of a sensor starts at its first reading
+	started := since
+	if activity.FirstSeen != nil && activity.FirstSeen.After(since) {
+		started = *activity.FirstSeen
+	}
+	uptime := 100.0
+	if window := now.Sub(started); window > 0 {
+		uptime = math.Round(math.Max(0, 100*(1-down.Seconds()/window.Seconds()))*100) / 100
+	}
+	health.Uptime = &uptime
+
+	health.GapCount = len(health.Gaps)
+	if len(health.Gaps) > maxGaps {
+		health.Gaps = health.Gaps[len(health.Gaps)-maxGaps:]
+	}
+	return health
+}
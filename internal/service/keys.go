@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+)
+
+// APIKey describes an API key, the key itself is only known when it is issued
+type APIKey struct {
+	ID        int        `json:"id"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// KeyService manages the API keys of the tenant a request acts on, every method
+// needs the admin scope
+type KeyService interface {
+	IssueKey(ctx context.Context, name string, scopes []string) (key string, apiKey APIKey, err error)
+	ListKeys(ctx context.Context) ([]APIKey, error)
+	RevokeKey(ctx context.Context, id int) error
+}
+
+type keyService struct {
+	db      *sql.DB
+	tenants *tenantResolver
+}
+
+func NewKeyService(db *sql.DB) KeyService {
+	return &keyService{db: db, tenants: newTenantResolver(repository.NewDAO(db).NewTenantQuery())}
+}
+
+func newAPIKey(key repository.APIKey) APIKey {
+	return APIKey{
+		ID:        key.ID,
+		Tenant:    key.Tenant,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+// authorizeAdmin checks the principal of ctx holds the admin scope
+func authorizeAdmin(ctx context.Context) error {
+	principal := auth.FromContext(ctx)
+	if principal == nil || !principal.IsAdmin() {
+		return Forbidden("managing API keys needs the %s scope", auth.ScopeAdmin)
+	}
+	return nil
+}
+
+func (k *keyService) IssueKey(ctx context.Context, name string, scopes []string) (key string, apiKey APIKey, err error) {
+	ctx, span := tracer.Start(ctx, "KeyService.IssueKey")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := k.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorizeAdmin(ctx); err != nil {
+		return
+	}
+	if name == "" {
+		return key, apiKey, InvalidArgument("name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return key, apiKey, InvalidArgument("scopes must not be empty")
+	}
+	for _, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			return key, apiKey, InvalidArgument("invalid scope %q, want admin, read:<group> or write:<group>", scope)
+		}
+	}
+
+	key, stored, err := auth.IssueKey(ctx, k.db, actorOf(ctx), &tenant.ID, name, scopes)
+	if err != nil {
+		err = classify(err, name)
+		return
+	}
+
+	return key, newAPIKey(stored), nil
+}
+
+func (k *keyService) ListKeys(ctx context.Context) (keys []APIKey, err error) {
+	ctx, span := tracer.Start(ctx, "KeyService.ListKeys")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := k.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorizeAdmin(ctx); err != nil {
+		return
+	}
+
+	stored, err := repository.ListAPIKeys(ctx, k.db, &tenant.ID)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	keys = make([]APIKey, 0, len(stored))
+	for _, key := range stored {
+		keys = append(keys, newAPIKey(key))
+	}
+	return keys, nil
+}
+
+func (k *keyService) RevokeKey(ctx context.Context, id int) (err error) {
+	ctx, span := tracer.Start(ctx, "KeyService.RevokeKey")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := k.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorizeAdmin(ctx); err != nil {
+		return
+	}
+
+	return classify(repository.RevokeAPIKey(ctx, k.db, actorOf(ctx), &tenant.ID, id), fmt.Sprint(id))
+}
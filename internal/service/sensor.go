@@ -2,129 +2,321 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/logging"
+	"github.com/sensors/internal/metrics"
 	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("service")
+
+// Coverage describes the readings a result was computed from
+type Coverage = repository.Coverage
+
+// Statistic is a value computed from readings, Value is nil when there was no
+// reading to compute it from, which a real zero can then be told apart from
+type Statistic struct {
+	Value    *float64 `json:"value"`
+	Coverage Coverage `json:"coverage"`
+}
+
+// SpeciesCounts counts the fish seen per species
+type SpeciesCounts struct {
+	Species  map[string]int `json:"species"`
+	Coverage Coverage       `json:"coverage"`
+}
+
 type SensorService interface {
-	GetGroupTransparencyAverage(ctx context.Context, groupName string) (float64, error)
-	GetGroupTemperatureAverage(ctx context.Context, groupName string) (float64, error)
-	GetGroupSpecies(ctx context.Context, groupName string) (map[string]int, error)
-	GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (map[string]int, error)
-	GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (float64, error)
-	GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (float64, error)
-	GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from, till time.Time) (float64, error)
+	GetGroupTransparencyAverage(ctx context.Context, groupName string) (Statistic, error)
+	GetGroupTemperatureAverage(ctx context.Context, groupName string) (Statistic, error)
+	GetGroupSpecies(ctx context.Context, groupName string) (SpeciesCounts, error)
+	GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (SpeciesCounts, error)
+	GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (Statistic, error)
+	GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (Statistic, error)
+	GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from time.Time, till *time.Time) (Statistic, error)
+	CreateGroup(ctx context.Context, name string) (Group, error)
+	CreateSensor(ctx context.Context, groupName string, sensor Sensor) (Sensor, error)
+	UpdateSensor(ctx context.Context, codeName string, patch SensorPatch) (Sensor, error)
+	DeleteSensor(ctx context.Context, codeName string) error
 }
 
 type sensorService struct {
-	dao repository.DAO
+	dao         repository.DAO
+	redisClient *redis.Client
+	tenants     *tenantResolver
 }
 
-func NewSensorService(dao repository.DAO) SensorService {
-	return &sensorService{dao: dao}
+func NewSensorService(dao repository.DAO, redisClient *redis.Client) SensorService {
+	return &sensorService{dao: dao, redisClient: redisClient, tenants: newTenantResolver(dao.NewTenantQuery())}
 }
 
-func (s *sensorService) GetGroupTransparencyAverage(ctx context.Context, groupName string) (averageTransparency float64, err error) {
+func (s *sensorService) GetGroupTransparencyAverage(ctx context.Context, groupName string) (averageTransparency Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetGroupTransparencyAverage")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = authorize(ctx, auth.Read, groupName); err != nil {
+		return
+	}
 
 	// Check Redis cache first
-	cacheKey := "transparency:" + groupName
-	redisClient := repository.NewClient()
-	val, err := redisClient.Get(redisClient.Context(), cacheKey).Result()
-	if err == nil {
-		averageTransparency, _ = strconv.ParseFloat(val, 64)
+	cacheKey := tenantKey(tenant, "transparency:"+groupName)
+	if s.lookup(ctx, "group_transparency", cacheKey, &averageTransparency) {
 		return
 	}
 
-	averageTransparency, err = s.dao.NewSensorQuery().FetchAverageTransparency(groupName)
+	averageTransparency.Value, averageTransparency.Coverage, err = s.dao.NewSensorQuery(tenant.ID).FetchAverageTransparency(ctx, groupName)
 	if err != nil {
+		err = classify(err, groupName)
 		return
 	}
 
-	redisClient.Set(redisClient.Context(), cacheKey, averageTransparency, 10*time.Second)
+	s.cache(ctx, cacheKey, averageTransparency)
 
 	return
 }
 
-func (s *sensorService) GetGroupTemperatureAverage(ctx context.Context, groupName string) (averageTemperature float64, err error) {
+func (s *sensorService) GetGroupTemperatureAverage(ctx context.Context, groupName string) (averageTemperature Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetGroupTemperatureAverage")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = authorize(ctx, auth.Read, groupName); err != nil {
+		return
+	}
 
 	// Check Redis cache first
-	cacheKey := "temperature:" + groupName
-	redisClient := repository.NewClient()
-	val, err := redisClient.Get(redisClient.Context(), cacheKey).Result()
-	if err == nil {
-		averageTemperature, _ = strconv.ParseFloat(val, 64)
+	cacheKey := tenantKey(tenant, "temperature:group:"+groupName)
+	if s.lookup(ctx, "group_temperature", cacheKey, &averageTemperature) {
 		return
 	}
 
-	averageTemperature, err = s.dao.NewSensorQuery().FetchAverageTemperature(groupName)
+	averageTemperature.Value, averageTemperature.Coverage, err = s.dao.NewSensorQuery(tenant.ID).FetchAverageTemperature(ctx, groupName)
 	if err != nil {
+		err = classify(err, groupName)
 		return
 	}
 
-	redisClient.Set(redisClient.Context(), cacheKey, averageTemperature, 10*time.Second)
+	s.cache(ctx, cacheKey, averageTemperature)
 
 	return
 }
 
-func (s *sensorService) GetGroupSpecies(ctx context.Context, groupName string) (speciesList map[string]int, err error) {
+func (s *sensorService) GetGroupSpecies(ctx context.Context, groupName string) (speciesList SpeciesCounts, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetGroupSpecies")
+	defer func() { tracing.End(span, err) }()
 
-	speciesList, err = s.dao.NewSensorQuery().FetchSpeciesList(groupName)
+	tenant, err := s.tenants.resolve(ctx)
 	if err != nil {
 		return
 	}
 
+	if err = authorize(ctx, auth.Read, groupName); err != nil {
+		return
+	}
+
+	speciesList.Species, speciesList.Coverage, err = s.dao.NewSensorQuery(tenant.ID).FetchSpeciesList(ctx, groupName)
+	if err != nil {
+		err = classify(err, groupName)
+		return
+	}
+
 	return
 }
 
-func (s *sensorService) GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList map[string]int, err error) {
+func (s *sensorService) GetTopNGroupSpecies(ctx context.Context, groupName string, n int, from, till *time.Time) (speciesList SpeciesCounts, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetTopNGroupSpecies")
+	defer func() { tracing.End(span, err) }()
 
-	speciesList, err = s.dao.NewSensorQuery().FetchTopNSpeciesList(groupName, n, from, till)
+	tenant, err := s.tenants.resolve(ctx)
 	if err != nil {
 		return
 	}
 
+	if err = authorize(ctx, auth.Read, groupName); err != nil {
+		return
+	}
+
+	if n <= 0 {
+		return speciesList, InvalidArgument("n must be positive, got %d", n)
+	}
+	if from != nil && till != nil && from.After(*till) {
+		return speciesList, InvalidArgument("'from' must not be after 'till'")
+	}
+
+	speciesList.Species, speciesList.Coverage, err = s.dao.NewSensorQuery(tenant.ID).FetchTopNSpeciesList(ctx, groupName, n, from, till)
+	if err != nil {
+		err = classify(err, groupName)
+		return
+	}
+
 	return
 }
 
-func (s *sensorService) GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature float64, err error) {
+func (s *sensorService) GetRegionMinTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (minTemperature Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetRegionMinTemperature")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	// A region spans groups
+	if err = authorize(ctx, auth.Read, auth.AllGroups); err != nil {
+		return
+	}
+
+	if err = validateRegion(xMin, xMax, yMin, yMax, zMin, zMax); err != nil {
+		return
+	}
 
-	minTemperature, err = s.dao.NewSensorQuery().GetRegionMinTemperature(xMin, xMax, yMin, yMax, zMin, zMax)
+	minTemperature.Value, minTemperature.Coverage, err = s.dao.NewSensorQuery(tenant.ID).GetRegionMinTemperature(ctx, xMin, xMax, yMin, yMax, zMin, zMax)
 	if err != nil {
+		err = classify(err, "")
 		return
 	}
 
 	return
 }
 
-func (s *sensorService) GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature float64, err error) {
+func (s *sensorService) GetRegionMaxTemperature(ctx context.Context, xMin, xMax, yMin, yMax, zMin, zMax float64) (maxTemperature Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetRegionMaxTemperature")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	// A region spans groups
+	if err = authorize(ctx, auth.Read, auth.AllGroups); err != nil {
+		return
+	}
+
+	if err = validateRegion(xMin, xMax, yMin, yMax, zMin, zMax); err != nil {
+		return
+	}
 
-	maxTemperature, err = s.dao.NewSensorQuery().GetRegionMaxTemperature(xMin, xMax, yMin, yMax, zMin, zMax)
+	maxTemperature.Value, maxTemperature.Coverage, err = s.dao.NewSensorQuery(tenant.ID).GetRegionMaxTemperature(ctx, xMin, xMax, yMin, yMax, zMin, zMax)
 	if err != nil {
+		err = classify(err, "")
 		return
 	}
 
 	return
 }
 
-func (s *sensorService) GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from, till time.Time) (averageTemperature float64, err error) {
+// GetCodeNameTemperatureAverage averages the temperatures of a sensor since from,
+// until till or now when it is nil
+func (s *sensorService) GetCodeNameTemperatureAverage(ctx context.Context, codeName string, from time.Time, till *time.Time) (averageTemperature Statistic, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.GetCodeNameTemperatureAverage")
+	defer func() { tracing.End(span, err) }()
 
-	// Check Redis cache first
-	cacheKey := "temperature:" + codeName
-	redisClient := repository.NewClient()
-	val, err := redisClient.Get(redisClient.Context(), cacheKey).Result()
-	if err == nil {
-		averageTemperature, _ = strconv.ParseFloat(val, 64)
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
 		return
 	}
 
-	averageTemperature, err = s.dao.NewSensorQuery().FetchCodeNameAverageTemperature(codeName, from, till)
+	if till != nil && from.After(*till) {
+		return averageTemperature, InvalidArgument("'from' must not be after 'till'")
+	}
+	if _, _, err = authorizeSensor(ctx, s.dao, tenant, auth.Read, codeName); err != nil {
+		return
+	}
+
+	// Check Redis cache first, the range is part of the key. An open ended range
+	// is keyed as such, not by the current time, so it is cached like the others
+	end := "open"
+	if till != nil {
+		end = strconv.FormatInt(till.Unix(), 10)
+	}
+	cacheKey := tenantKey(tenant, fmt.Sprintf("temperature:sensor:%s:%d:%s", codeName, from.Unix(), end))
+	if s.lookup(ctx, "sensor_temperature", cacheKey, &averageTemperature) {
+		return
+	}
+
+	averageTemperature.Value, averageTemperature.Coverage, err = s.dao.NewSensorQuery(tenant.ID).FetchCodeNameAverageTemperature(ctx, codeName, from, till)
 	if err != nil {
+		err = classify(err, codeName)
 		return
 	}
 
-	redisClient.Set(redisClient.Context(), cacheKey, averageTemperature, 10*time.Second)
+	s.cache(ctx, cacheKey, averageTemperature)
 
 	return
 }
+
+// validateRegion checks the bounds of a region are not inverted
+func validateRegion(xMin, xMax, yMin, yMax, zMin, zMax float64) error {
+	switch {
+	case xMin > xMax:
+		return InvalidArgument("xMin must not be greater than xMax")
+	case yMin > yMax:
+		return InvalidArgument("yMin must not be greater than yMax")
+	case zMin > zMax:
+		return InvalidArgument("zMin must not be greater than zMax")
+	}
+	return nil
+}
+
+// lookup decodes the JSON cached under key into v and reports whether it was
+// found. A failure other than a miss is logged and handled as a miss
+func (s *sensorService) lookup(ctx context.Context, cache, key string, v interface{}) bool {
+	ctx, span := tracer.Start(ctx, "cache.get", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("cache", cache), attribute.String("cache.key", key)))
+	defer span.End()
+
+	val, err := s.redisClient.Get(ctx, key).Bytes()
+	if err == nil {
+		err = json.Unmarshal(val, v)
+	}
+	switch {
+	case err == nil:
+		metrics.ObserveCache(cache, metrics.CacheHit)
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return true
+	case err == redis.Nil:
+		metrics.ObserveCache(cache, metrics.CacheMiss)
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+	default:
+		metrics.ObserveCache(cache, metrics.CacheError)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logging.FromContext(ctx).Warn("cache lookup failed, falling back to the database", "cache", cache, "err", err)
+	}
+	return false
+}
+
+// cache stores v as JSON under key for 10 seconds, a failure only costs a cache miss
+func (s *sensorService) cache(ctx context.Context, key string, v interface{}) {
+	ctx, span := tracer.Start(ctx, "cache.set", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("cache.key", key)))
+
+	val, err := json.Marshal(v)
+	if err == nil {
+		err = s.redisClient.Set(ctx, key, val, 10*time.Second).Err()
+	}
+	tracing.End(span, err)
+	if err != nil {
+		logging.FromContext(ctx).Warn("cache store failed", "key", key, "err", err)
+	}
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/stream"
+	"github.com/sensors/internal/tracing"
+)
+
+// ErrSlowClient ends the stream of a client that fell behind the readings
+var ErrSlowClient = stream.ErrSlowSubscriber
+
+// Reading is a reading as it is written, ID orders the readings and resumes a stream
+type Reading struct {
+	ID           int64     `json:"id"`
+	Group        string    `json:"group"`
+	CodeName     string    `json:"codeName"`
+	Temperature  float64   `json:"temperature"`
+	Transparency int       `json:"transparency"`
+	Species      string    `json:"species"`
+	SpeciesCount int       `json:"speciesCount"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// ReadingStream delivers readings until the context it was opened with is done
+type ReadingStream interface {
+	// Readings returns the readings in ID order, it is closed when the stream ends
+	Readings() <-chan Reading
+	// Err tells why the stream ended once Readings is closed, nil when its
+	// context is done or the server is stopping, ErrSlowClient when the client
+	// fell behind, which then resumes the stream from its last reading
+	Err() error
+}
+
+// StreamService streams the readings of the tenant a request acts on, and
+// aggregates of them
+type StreamService interface {
+	// StreamReadings streams the readings of the sensor called codeName, else of
+	// the group called groupName, else of every group. A positive lastID replays
+	// the readings written after the one with that ID first
+	StreamReadings(ctx context.Context, groupName, codeName string, lastID int64) (ReadingStream, error)
+	// OpenAggregates opens a session computing rolling aggregates of the readings
+	OpenAggregates(ctx context.Context) (AggregateSession, error)
+}
+
+type streamService struct {
+	dao     repository.DAO
+	hub     *stream.Hub
+	tenants *tenantResolver
+}
+
+func NewStreamService(dao repository.DAO, hub *stream.Hub) StreamService {
+	return &streamService{dao: dao, hub: hub, tenants: newTenantResolver(dao.NewTenantQuery())}
+}
+
+func (s *streamService) StreamReadings(ctx context.Context, groupName, codeName string, lastID int64) (readings ReadingStream, err error) {
+	// The span covers opening the stream, not the stream itself
+	spanCtx, span := tracer.Start(ctx, "StreamService.StreamReadings")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(spanCtx)
+	if err != nil {
+		return
+	}
+	if lastID < 0 {
+		return nil, InvalidArgument("last event ID must not be negative, got %d", lastID)
+	}
+
+	if err = authorizeSelector(spanCtx, s.dao, tenant, auth.Read, groupName, codeName); err != nil {
+		return
+	}
+
+	subscription := s.hub.Subscribe(ctx, stream.Filter{TenantID: tenant.ID, Group: groupName, CodeName: codeName}, lastID)
+	return newReadingStream(ctx, subscription), nil
+}
+
+// authorizeSelector checks the principal of ctx may apply action to the sensor
+// called codeName, else the group called groupName, else every group of tenant.
+// The sensor and group must exist, and the sensor be in the group when both are set
+func authorizeSelector(ctx context.Context, dao repository.DAO, tenant repository.Tenant, action auth.Action, groupName, codeName string) error {
+	switch {
+	case codeName != "":
+		_, sensorGroup, err := authorizeSensor(ctx, dao, tenant, action, codeName)
+		if err != nil {
+			return err
+		}
+		if groupName != "" && groupName != sensorGroup {
+			return InvalidArgument("sensor %q is not in group %q", codeName, groupName)
+		}
+	case groupName != "":
+		if err := authorize(ctx, action, groupName); err != nil {
+			return err
+		}
+		if _, err := dao.NewSensorQuery(tenant.ID).FetchGroup(ctx, groupName); err != nil {
+			return classify(err, groupName)
+		}
+	default:
+		return authorize(ctx, action, auth.AllGroups)
+	}
+	return nil
+}
+
+type readingStream struct {
+	subscription *stream.Subscription
+	readings     chan Reading
+}
+
+func newReadingStream(ctx context.Context, subscription *stream.Subscription) *readingStream {
+	r := &readingStream{subscription: subscription, readings: make(chan Reading)}
+	go func() {
+		defer close(r.readings)
+		for reading := range subscription.Readings() {
+			select {
+			case r.readings <- Reading{
+				ID:           reading.ID,
+				Group:        reading.Group,
+				CodeName:     reading.CodeName,
+				Temperature:  reading.Temperature,
+				Transparency: reading.Transparency,
+				Species:      reading.FishSpeciesName,
+				SpeciesCount: reading.FishSpeciesCount,
+				CreatedAt:    reading.CreatedAt,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *readingStream) Readings() <-chan Reading {
+	return r.readings
+}
+
+func (r *readingStream) Err() error {
+	return r.subscription.Err()
+}
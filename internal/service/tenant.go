@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tenant"
+	"github.com/sensors/internal/tracing"
+)
+
+// tenantResolver finds the tenant a request acts on. Tenants are never renamed
+// nor deleted, so they are kept in memory once looked up
+type tenantResolver struct {
+	query   repository.TenantQuery
+	tenants sync.Map
+}
+
+func newTenantResolver(query repository.TenantQuery) *tenantResolver {
+	return &tenantResolver{query: query}
+}
+
+// resolve returns the tenant ctx acts on: the one chosen explicitly, else the one
+// of its principal, else the default tenant. A principal of another tenant is
+// denied before the tenant is looked up, so it cannot probe for tenants
+func (r *tenantResolver) resolve(ctx context.Context) (repository.Tenant, error) {
+	principal := auth.FromContext(ctx)
+	if principal == nil {
+		return repository.Tenant{}, Forbidden("no authenticated caller")
+	}
+
+	name := tenant.Name(ctx)
+	if name == "" {
+		name = principal.Tenant
+	}
+	if name == "" {
+		name = repository.DefaultTenant
+	}
+	if !principal.CanAccessTenant(name) {
+		return repository.Tenant{}, Forbidden("a principal of tenant %q cannot act on tenant %q", principal.Tenant, name)
+	}
+
+	if cached, ok := r.tenants.Load(name); ok {
+		return cached.(repository.Tenant), nil
+	}
+	found, err := r.query.FetchTenant(ctx, name)
+	if err != nil {
+		return found, classify(err, name)
+	}
+	r.tenants.Store(name, found)
+	return found, nil
+}
+
+// tenantKey scopes the cache key to t, the tenants share the cache but not its entries
+func tenantKey(t repository.Tenant, key string) string {
+	return fmt.Sprintf("tenant:%d:%s", t.ID, key)
+}
+
+// TenantInfo describes a tenant
+type TenantInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TenantService manages the tenants, every method needs a platform principal
+// with the admin scope
+type TenantService interface {
+	CreateTenant(ctx context.Context, name string) (TenantInfo, error)
+	ListTenants(ctx context.Context) ([]TenantInfo, error)
+}
+
+type tenantService struct {
+	db *sql.DB
+}
+
+func NewTenantService(db *sql.DB) TenantService {
+	return &tenantService{db: db}
+}
+
+// authorizePlatformAdmin checks the principal of ctx is an admin of no tenant in particular
+func authorizePlatformAdmin(ctx context.Context) error {
+	principal := auth.FromContext(ctx)
+	if principal == nil || principal.Tenant != "" || !principal.IsAdmin() {
+		return Forbidden("managing tenants needs a platform key with the %s scope", auth.ScopeAdmin)
+	}
+	return nil
+}
+
+func (t *tenantService) CreateTenant(ctx context.Context, name string) (created TenantInfo, err error) {
+	ctx, span := tracer.Start(ctx, "TenantService.CreateTenant")
+	defer func() { tracing.End(span, err) }()
+
+	if err = authorizePlatformAdmin(ctx); err != nil {
+		return
+	}
+	if !namePattern.MatchString(name) {
+		return created, InvalidArgument("name must be 1 to 64 letters, digits, '_' or '-'")
+	}
+
+	stored, err := repository.CreateTenant(ctx, t.db, actorOf(ctx), name)
+	if err != nil {
+		err = classify(err, name)
+		return
+	}
+
+	return TenantInfo{Name: stored.Name, CreatedAt: stored.CreatedAt}, nil
+}
+
+func (t *tenantService) ListTenants(ctx context.Context) (tenants []TenantInfo, err error) {
+	ctx, span := tracer.Start(ctx, "TenantService.ListTenants")
+	defer func() { tracing.End(span, err) }()
+
+	if err = authorizePlatformAdmin(ctx); err != nil {
+		return
+	}
+
+	stored, err := repository.ListTenants(ctx, t.db)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	tenants = make([]TenantInfo, 0, len(stored))
+	for _, tenant := range stored {
+		tenants = append(tenants, TenantInfo{Name: tenant.Name, CreatedAt: tenant.CreatedAt})
+	}
+	return tenants, nil
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tenant"
+)
+
+// fakeDAO serves the species of the group reef of every tenant from memory
+type fakeDAO struct {
+	repository.DAO
+	tenants map[string]repository.Tenant
+	species map[int]map[string]int
+	// lookups counts the tenants looked up
+	lookups int
+}
+
+func (d *fakeDAO) NewTenantQuery() repository.TenantQuery {
+	return d
+}
+
+func (d *fakeDAO) FetchTenant(_ context.Context, name string) (repository.Tenant, error) {
+	d.lookups++
+	found, ok := d.tenants[name]
+	if !ok {
+		return found, repository.ErrTenantNotFound
+	}
+	return found, nil
+}
+
+func (d *fakeDAO) NewSensorQuery(tenantID int) repository.SensorQuery {
+	return &fakeSensorQuery{tenantID: tenantID, dao: d}
+}
+
+type fakeSensorQuery struct {
+	repository.SensorQuery
+	tenantID int
+	dao      *fakeDAO
+}
+
+func (q *fakeSensorQuery) FetchTopNSpeciesList(_ context.Context, groupName string, _ int, _, _ *time.Time) (map[string]int, repository.Coverage, error) {
+	species, ok := q.dao.species[q.tenantID]
+	if !ok || groupName != "reef" {
+		return nil, repository.Coverage{}, repository.ErrGroupNotFound
+	}
+	return species, repository.Coverage{}, nil
+}
+
+func TestTenantIsolation(t *testing.T) {
+	dao := &fakeDAO{
+		tenants: map[string]repository.Tenant{
+			repository.DefaultTenant: {ID: 1, Name: repository.DefaultTenant},
+			"acme":                   {ID: 2, Name: "acme"},
+			"globex":                 {ID: 3, Name: "globex"},
+		},
+		species: map[int]map[string]int{
+			2: {"Tuna": 3},
+			3: {"Cod": 5},
+		},
+	}
+	acme := &auth.Principal{ID: "key:1", Tenant: "acme", Scopes: []string{"read:*"}}
+	platform := &auth.Principal{ID: "key:2", Scopes: []string{"read:*"}}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		path      string
+		want      map[string]int
+		wantErr   error
+		lookups   int
+	}{
+		{name: "own tenant", principal: acme, want: map[string]int{"Tuna": 3}, lookups: 1},
+		{name: "own tenant named", principal: acme, path: "acme", want: map[string]int{"Tuna": 3}, lookups: 1},
+		{name: "other tenant", principal: acme, path: "globex", wantErr: ErrForbidden},
+		{name: "other tenant that does not exist", principal: acme, path: "initech", wantErr: ErrForbidden},
+		{name: "platform on a tenant", principal: platform, path: "globex", want: map[string]int{"Cod": 5}, lookups: 1},
+		{name: "platform on the default tenant", principal: platform, wantErr: ErrNotFound, lookups: 1},
+		{name: "platform on a missing tenant", principal: platform, path: "initech", wantErr: ErrNotFound, lookups: 1},
+		{name: "anonymous", wantErr: ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = auth.WithPrincipal(ctx, tt.principal)
+			}
+			if tt.path != "" {
+				ctx = tenant.WithName(ctx, tt.path)
+			}
+			// A new service so the tenants are looked up again
+			sensors := NewSensorService(dao, nil)
+			dao.lookups = 0
+
+			got, err := sensors.GetTopNGroupSpecies(ctx, "reef", 3, nil, nil)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("GetTopNGroupSpecies() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got.Species, tt.want) {
+				t.Errorf("species = %v, want %v", got.Species, tt.want)
+			}
+			if dao.lookups != tt.lookups {
+				t.Errorf("tenants looked up %d times, want %d", dao.lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestTenantKey(t *testing.T) {
+	acme := repository.Tenant{ID: 2, Name: "acme"}
+	globex := repository.Tenant{ID: 3, Name: "globex"}
+	if tenantKey(acme, "species:reef") == tenantKey(globex, "species:reef") {
+		t.Error("two tenants share a cache entry")
+	}
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+)
+
+// Group is a sensor group of a tenant
+type Group struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+}
+
+// Sensor is a sensor of the topology
+type Sensor struct {
+	CodeName string  `json:"codeName"`
+	Group    string  `json:"group"`
+	Index    int     `json:"index"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Z        float64 `json:"z"`
+	DataRate int     `json:"dataRate"`
+}
+
+// SensorPatch holds the fields of a sensor to change, nil fields are left as is
+type SensorPatch struct {
+	Group    *string  `json:"group"`
+	X        *float64 `json:"x"`
+	Y        *float64 `json:"y"`
+	Z        *float64 `json:"z"`
+	DataRate *int     `json:"dataRate"`
+}
+
+// Group names and codenames end up in URL paths
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func newSensor(sensor repository.Sensor, groupName string) Sensor {
+	return Sensor{
+		CodeName: sensor.Codename,
+		Group:    groupName,
+		Index:    sensor.Index,
+		X:        sensor.X,
+		Y:        sensor.Y,
+		Z:        sensor.Z,
+		DataRate: sensor.DataRate,
+	}
+}
+
+func (s *sensorService) CreateGroup(ctx context.Context, name string) (group Group, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.CreateGroup")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	if err = authorize(ctx, auth.Write, name); err != nil {
+		return
+	}
+	if !namePattern.MatchString(name) {
+		return group, InvalidArgument("name must be 1 to 64 letters, digits, '_' or '-'")
+	}
+
+	if _, err = s.dao.NewSensorCommand(tenant.ID).CreateGroup(ctx, actorOf(ctx), name); err != nil {
+		err = classify(err, name)
+		return
+	}
+
+	return Group{Name: name, Tenant: tenant.Name}, nil
+}
+
+func (s *sensorService) CreateSensor(ctx context.Context, groupName string, sensor Sensor) (created Sensor, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.CreateSensor")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = authorize(ctx, auth.Write, groupName); err != nil {
+		return
+	}
+	if sensor.CodeName != "" && !namePattern.MatchString(sensor.CodeName) {
+		return created, InvalidArgument("codeName must be 1 to 64 letters, digits, '_' or '-'")
+	}
+	if sensor.Index < 0 {
+		return created, InvalidArgument("index must not be negative, got %d", sensor.Index)
+	}
+	if sensor.DataRate <= 0 {
+		return created, InvalidArgument("dataRate must be positive, got %d", sensor.DataRate)
+	}
+
+	stored := repository.Sensor{
+		Codename: sensor.CodeName,
+		Index:    sensor.Index,
+		X:        sensor.X,
+		Y:        sensor.Y,
+		Z:        sensor.Z,
+		DataRate: sensor.DataRate,
+	}
+	if err = s.dao.NewSensorCommand(tenant.ID).CreateSensor(ctx, actorOf(ctx), groupName, &stored); err != nil {
+		name := groupName
+		if errors.Is(err, repository.ErrSensorExists) {
+			name = stored.Codename
+		}
+		err = classify(err, name)
+		return
+	}
+
+	return newSensor(stored, groupName), nil
+}
+
+func (s *sensorService) UpdateSensor(ctx context.Context, codeName string, patch SensorPatch) (updated Sensor, err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.UpdateSensor")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+	_, groupName, err := authorizeSensor(ctx, s.dao, tenant, auth.Write, codeName)
+	if err != nil {
+		return
+	}
+	// Moving a sensor writes to the group it joins as well
+	if patch.Group != nil && *patch.Group != groupName {
+		if err = authorize(ctx, auth.Write, *patch.Group); err != nil {
+			return
+		}
+		groupName = *patch.Group
+	}
+	if patch.DataRate != nil && *patch.DataRate <= 0 {
+		return updated, InvalidArgument("dataRate must be positive, got %d", *patch.DataRate)
+	}
+
+	sensor, err := s.dao.NewSensorCommand(tenant.ID).UpdateSensor(ctx, actorOf(ctx), codeName, repository.SensorUpdate{
+		GroupName: patch.Group,
+		X:         patch.X,
+		Y:         patch.Y,
+		Z:         patch.Z,
+		DataRate:  patch.DataRate,
+	})
+	if err != nil {
+		name := codeName
+		if errors.Is(err, repository.ErrGroupNotFound) {
+			name = groupName
+		}
+		err = classify(err, name)
+		return
+	}
+
+	return newSensor(sensor, groupName), nil
+}
+
+func (s *sensorService) DeleteSensor(ctx context.Context, codeName string) (err error) {
+	ctx, span := tracer.Start(ctx, "SensorService.DeleteSensor")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := s.tenants.resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, _, err = authorizeSensor(ctx, s.dao, tenant, auth.Write, codeName); err != nil {
+		return
+	}
+
+	return classify(s.dao.NewSensorCommand(tenant.ID).DeleteSensor(ctx, actorOf(ctx), codeName), codeName)
+}
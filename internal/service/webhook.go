@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sensors/internal/auth"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/tracing"
+)
+
+// secretPrefix starts every webhook secret so it can be told apart from an API key
+const secretPrefix = "whsec_"
+
+// Bounds of the number of deliveries or dead letters returned at once
+const (
+	DefaultDeliveryLimit = 100
+	maxDeliveryLimit     = 1000
+)
+
+// Webhook describes a webhook, its secret is only known when it is created. An
+// empty Events subscribes to every event
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Delivery describes an event sent or to be sent to a webhook, NextAttemptAt is
+// only set while it is pending
+type Delivery struct {
+	ID            int64           `json:"id"`
+	Event         string          `json:"event"`
+	EventID       string          `json:"eventId"`
+	State         string          `json:"state"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+	LastStatus    *int            `json:"lastStatus,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	DeliveredAt   *time.Time      `json:"deliveredAt,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// DeadLetter describes an event whose delivery was given up
+type DeadLetter struct {
+	ID         int64           `json:"id"`
+	Delivery   int64           `json:"delivery"`
+	Event      string          `json:"event"`
+	EventID    string          `json:"eventId"`
+	Attempts   int             `json:"attempts"`
+	LastStatus *int            `json:"lastStatus,omitempty"`
+	LastError  string          `json:"lastError"`
+	DeadAt     time.Time       `json:"deadAt"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// DeliveryFilter selects the deliveries or dead letters of a webhook, zero fields
+// select everything. They are returned newest first, Before pages through them by id
+type DeliveryFilter struct {
+	State  string
+	Before int64
+	Limit  int
+}
+
+// WebhookService manages the webhooks of the tenant a request acts on, every
+// method needs the admin scope
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, url string, events []string) (secret string, webhook Webhook, err error)
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, id int) error
+	ListDeliveries(ctx context.Context, id int, filter DeliveryFilter) ([]Delivery, error)
+	ListDeadLetters(ctx context.Context, id int, filter DeliveryFilter) ([]DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, id int, letter int64) (Delivery, error)
+}
+
+type webhookService struct {
+	db      *sql.DB
+	tenants *tenantResolver
+}
+
+func NewWebhookService(db *sql.DB) WebhookService {
+	return &webhookService{db: db, tenants: newTenantResolver(repository.NewDAO(db).NewTenantQuery())}
+}
+
+func newWebhook(webhook repository.Webhook) Webhook {
+	return Webhook{ID: webhook.ID, URL: webhook.URL, Events: webhook.Events, CreatedAt: webhook.CreatedAt}
+}
+
+func newDelivery(delivery repository.Delivery) Delivery {
+	d := Delivery{
+		ID:          delivery.ID,
+		Event:       delivery.EventType,
+		EventID:     delivery.EventID,
+		State:       delivery.State,
+		Attempts:    delivery.Attempts,
+		LastStatus:  delivery.LastStatus,
+		LastError:   delivery.LastError,
+		CreatedAt:   delivery.CreatedAt,
+		DeliveredAt: delivery.DeliveredAt,
+		Payload:     delivery.Payload,
+	}
+	if delivery.State == repository.DeliveryPending {
+		d.NextAttemptAt = &delivery.NextAttemptAt
+	}
+	return d
+}
+
+// authorize resolves the tenant of ctx and checks its principal holds the admin scope
+func (w *webhookService) authorize(ctx context.Context) (repository.Tenant, error) {
+	tenant, err := w.tenants.resolve(ctx)
+	if err != nil {
+		return tenant, err
+	}
+	principal := auth.FromContext(ctx)
+	if principal == nil || !principal.IsAdmin() {
+		return tenant, Forbidden("managing webhooks needs the %s scope", auth.ScopeAdmin)
+	}
+	return tenant, nil
+}
+
+func (w *webhookService) CreateWebhook(ctx context.Context, target string, events []string) (secret string, webhook Webhook, err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.CreateWebhook")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := w.authorize(ctx)
+	if err != nil {
+		return
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return secret, webhook, InvalidArgument("url must be an absolute http or https URL, got %q", target)
+	}
+	if events == nil {
+		events = []string{}
+	}
+	for _, event := range events {
+		if !knownEvent(event) {
+			return secret, webhook, InvalidArgument("unknown event %q, want one of %v", event, repository.Events)
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	secret = secretPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	stored := repository.Webhook{TenantID: tenant.ID, URL: target, Secret: secret, Events: events}
+	if err = repository.CreateWebhook(ctx, w.db, actorOf(ctx), &stored); err != nil {
+		return "", webhook, classify(err, target)
+	}
+	return secret, newWebhook(stored), nil
+}
+
+func knownEvent(event string) bool {
+	for _, known := range repository.Events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhookService) ListWebhooks(ctx context.Context) (webhooks []Webhook, err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.ListWebhooks")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := w.authorize(ctx)
+	if err != nil {
+		return
+	}
+
+	stored, err := repository.ListWebhooks(ctx, w.db, tenant.ID)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	webhooks = make([]Webhook, 0, len(stored))
+	for _, webhook := range stored {
+		webhooks = append(webhooks, newWebhook(webhook))
+	}
+	return webhooks, nil
+}
+
+func (w *webhookService) DeleteWebhook(ctx context.Context, id int) (err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.DeleteWebhook")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := w.authorize(ctx)
+	if err != nil {
+		return
+	}
+
+	return classify(repository.DeleteWebhook(ctx, w.db, actorOf(ctx), tenant.ID, id), fmt.Sprint(id))
+}
+
+// stored checks filter and the webhook with id exist, and returns the repository
+// filter selecting its deliveries
+func (w *webhookService) stored(ctx context.Context, id int, filter DeliveryFilter) (repository.DeliveryFilter, error) {
+	tenant, err := w.authorize(ctx)
+	if err != nil {
+		return repository.DeliveryFilter{}, err
+	}
+	if filter.Limit == 0 {
+		filter.Limit = DefaultDeliveryLimit
+	}
+	if filter.Limit < 0 || filter.Limit > maxDeliveryLimit {
+		return repository.DeliveryFilter{}, InvalidArgument("limit must be between 1 and %d, got %d", maxDeliveryLimit, filter.Limit)
+	}
+	switch filter.State {
+	case "", repository.DeliveryPending, repository.DeliveryDelivered, repository.DeliveryDead:
+	default:
+		return repository.DeliveryFilter{}, InvalidArgument("invalid state %q, want pending, delivered or dead", filter.State)
+	}
+	if _, err := repository.FetchWebhook(ctx, w.db, tenant.ID, id); err != nil {
+		return repository.DeliveryFilter{}, classify(err, fmt.Sprint(id))
+	}
+
+	return repository.DeliveryFilter{
+		TenantID:  tenant.ID,
+		WebhookID: id,
+		State:     filter.State,
+		BeforeID:  filter.Before,
+		Limit:     filter.Limit,
+	}, nil
+}
+
+func (w *webhookService) ListDeliveries(ctx context.Context, id int, filter DeliveryFilter) (deliveries []Delivery, err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.ListDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	stored, err := w.stored(ctx, id, filter)
+	if err != nil {
+		return
+	}
+
+	found, err := repository.ListDeliveries(ctx, w.db, stored)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	deliveries = make([]Delivery, 0, len(found))
+	for _, delivery := range found {
+		deliveries = append(deliveries, newDelivery(delivery))
+	}
+	return deliveries, nil
+}
+
+func (w *webhookService) ListDeadLetters(ctx context.Context, id int, filter DeliveryFilter) (letters []DeadLetter, err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.ListDeadLetters")
+	defer func() { tracing.End(span, err) }()
+
+	filter.State = ""
+	stored, err := w.stored(ctx, id, filter)
+	if err != nil {
+		return
+	}
+
+	found, err := repository.ListDeadLetters(ctx, w.db, stored)
+	if err != nil {
+		err = classify(err, "")
+		return
+	}
+
+	letters = make([]DeadLetter, 0, len(found))
+	for _, letter := range found {
+		letters = append(letters, DeadLetter{
+			ID:         letter.ID,
+			Delivery:   letter.DeliveryID,
+			Event:      letter.EventType,
+			EventID:    letter.EventID,
+			Attempts:   letter.Attempts,
+			LastStatus: letter.LastStatus,
+			LastError:  letter.LastError,
+			DeadAt:     letter.DeadAt,
+			Payload:    letter.Payload,
+		})
+	}
+	return letters, nil
+}
+
+func (w *webhookService) ReplayDeadLetter(ctx context.Context, id int, letter int64) (delivery Delivery, err error) {
+	ctx, span := tracer.Start(ctx, "WebhookService.ReplayDeadLetter")
+	defer func() { tracing.End(span, err) }()
+
+	tenant, err := w.authorize(ctx)
+	if err != nil {
+		return
+	}
+
+	replayed, err := repository.ReplayDeadLetter(ctx, w.db, actorOf(ctx), tenant.ID, id, letter)
+	if err != nil {
+		err = classify(err, fmt.Sprint(letter))
+		return
+	}
+	return newDelivery(replayed), nil
+}
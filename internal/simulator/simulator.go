@@ -0,0 +1,256 @@
+package simulator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sensors/internal/generator"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/retry"
+)
+
+// pollInterval bounds how long the simulator waits before looking for new sensors
+const pollInterval = 10 * time.Second
+
+// Config holds everything needed to build a simulator
+type Config struct {
+	Generator generator.Config
+	Topology  generator.Topology
+	// Seed makes the run reproducible on a simulated clock starting at SimulationStart,
+	// the run stops once the clock reaches SimulationEnd
+	Seed            int64
+	SimulationStart time.Time
+	SimulationEnd   time.Time
+	Writer          repository.WriterConfig
+}
+
+// Simulator provisions the sensor topology and keeps writing readings for every
+// sensor at its data rate
+type Simulator struct {
+	db       *sql.DB
+	cfg      Config
+	clock    generator.Clock
+	gen      *generator.Generator
+	injector *generator.FaultInjector
+	writer   *repository.BatchWriter
+}
+
+// New builds the generator and starts the batch writer, redisClient is ignored for
+// seeded runs as its state would leak between runs. A seeded run needs a database
+// without readings, the sensors and readings of a previous run would change the
+// dataset. ctx bounds the retries of the writer. Close must be called to flush
+// the last readings
+func New(ctx context.Context, db *sql.DB, redisClient *redis.Client, cfg Config) (*Simulator, error) {
+	var clock generator.Clock = generator.SystemClock{}
+	if cfg.Seed != 0 {
+		if err := fresh(db); err != nil {
+			return nil, err
+		}
+		clock = generator.NewSimulatedClock(cfg.SimulationStart)
+		redisClient = nil
+	}
+
+	gen, err := generator.New(cfg.Generator, generator.NewRand(cfg.Seed), redisClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every written batch proves the generator is alive to the health checks
+	writerCfg := cfg.Writer
+	onFlush := writerCfg.OnFlush
+	writerCfg.OnFlush = func(written int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := repository.Heartbeat(ctx, db, repository.HeartbeatGenerator); err != nil {
+			slog.Warn("generator heartbeat", "err", err)
+		}
+		if onFlush != nil {
+			onFlush(written)
+		}
+	}
+
+	return &Simulator{
+		db:     db,
+		cfg:    cfg,
+		clock:  clock,
+		gen:    gen,
+		writer: repository.NewBatchWriter(ctx, db, writerCfg),
+	}, nil
+}
+
+// Close flushes the readings still buffered
+func (s *Simulator) Close() error {
+	return s.writer.Close()
+}
+
+// Kickoff creates the tables, groups and sensors that do not exist yet and writes
+// a first reading for every new sensor. Transient database errors are retried
+func (s *Simulator) Kickoff(ctx context.Context) error {
+	if err := s.retry(ctx, func() error { return repository.CreateTables(s.db) }); err != nil {
+		return err
+	}
+
+	var (
+		sensors []repository.Sensor
+		created map[int]bool
+	)
+	err := s.retry(ctx, func() (err error) {
+		sensors, created, err = generator.Provision(s.db, s.gen, s.cfg.Topology)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sensor := range sensors {
+		if created[sensor.ID] {
+			if err := s.writer.Write(ctx, s.gen.Generate(sensor, s.clock.Now())); err != nil {
+				return err
+			}
+			metrics.ObserveGenerated(1)
+		}
+	}
+	if err := s.writer.Flush(ctx); err != nil {
+		return err
+	}
+
+	var groupNames map[int]generator.GroupName
+	err = s.retry(ctx, func() (err error) {
+		groupNames, err = generator.LoadGroupNames(ctx, s.db)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.injector, err = generator.NewFaultInjector(s.gen, s.gen.Rand(), s.cfg.Generator.Faults, groupNames)
+	return err
+}
+
+// Run writes a reading for every sensor each time its data rate elapses, until ctx
+// is done or a seeded run reaches its end. Sensors added while running are picked
+// up within pollInterval. Transient database errors are retried and any other
+// error is returned
+func (s *Simulator) Run(ctx context.Context) error {
+	if s.injector == nil {
+		if err := s.Kickoff(ctx); err != nil {
+			return err
+		}
+	}
+
+	due := make(map[int]time.Time)
+
+	for {
+		var sensors []repository.Sensor
+		err := s.retry(ctx, func() (err error) {
+			sensors, err = repository.ListSensors(ctx, s.db)
+			return err
+		})
+		if err != nil {
+			return stopped(ctx, err)
+		}
+		if err := s.refreshGroups(ctx, sensors); err != nil {
+			return stopped(ctx, err)
+		}
+
+		now := s.clock.Now()
+		if s.cfg.Seed != 0 && !now.Before(s.cfg.SimulationEnd) {
+			slog.Info("simulation ended", "at", now)
+			return nil
+		}
+		wake := now.Add(pollInterval)
+
+		for _, sensor := range sensors {
+			next, ok := due[sensor.ID]
+			if !ok || !next.After(now) {
+				readings := s.injector.Generate(sensor, now)
+				metrics.ObserveGenerated(len(readings))
+				for _, data := range readings {
+					if err := s.writer.Write(ctx, data); err != nil {
+						return stopped(ctx, err)
+					}
+				}
+
+				// Keep the cadence, unless the simulator fell behind by a whole period
+				next = next.Add(sensorPeriod(sensor))
+				if !next.After(now) {
+					next = now.Add(sensorPeriod(sensor))
+				}
+				due[sensor.ID] = next
+			}
+
+			if next.Before(wake) {
+				wake = next
+			}
+		}
+
+		if err := s.clock.Sleep(ctx, wake.Sub(now)); err != nil {
+			return nil
+		}
+	}
+}
+
+// refreshGroups reloads the group names the faults select sensors by once one of
+// sensors is in a group created since they were loaded
+func (s *Simulator) refreshGroups(ctx context.Context, sensors []repository.Sensor) error {
+	for _, sensor := range sensors {
+		if s.injector.HasGroup(sensor.GroupID) {
+			continue
+		}
+		var groupNames map[int]generator.GroupName
+		err := s.retry(ctx, func() (err error) {
+			groupNames, err = generator.LoadGroupNames(ctx, s.db)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.injector.SetGroupNames(groupNames)
+		return nil
+	}
+	return nil
+}
+
+// fresh returns an error when db holds readings, transient errors are retried
+func fresh(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var found bool
+	err := retry.Do(ctx, retry.DefaultBackoff(), repository.IsTransient, func() (err error) {
+		found, err = repository.HasReadings(ctx, db)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		return errors.New("a seeded run needs a database without readings to be reproducible")
+	}
+	return nil
+}
+
+func (s *Simulator) retry(ctx context.Context, fn func() error) error {
+	return retry.Do(ctx, retry.DefaultBackoff(), repository.IsTransient, fn)
+}
+
+// stopped hides the errors caused by ctx being done, as stopping is not a failure
+func stopped(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// sensorPeriod returns the time between two readings of sensor
+func sensorPeriod(sensor repository.Sensor) time.Duration {
+	if sensor.DataRate <= 0 {
+		return pollInterval
+	}
+	return time.Duration(sensor.DataRate) * time.Second
+}
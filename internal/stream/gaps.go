@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+const (
+	// lateCommitWindow is how long the ids skipped by the readings delivered are
+	// looked for, a transaction committing later than that goes unnoticed
+	lateCommitWindow = time.Minute
+	// maxGaps bounds the ranges of skipped ids looked for, the oldest go first
+	maxGaps = 256
+)
+
+// gap is a range of reading ids, bounds included, skipped when a larger id was
+// delivered. They are usually readings whose transaction had not committed yet
+type gap struct {
+	from, to int64
+	seen     time.Time
+}
+
+// gaps are the ranges of ids skipped by the readings delivered so far, oldest first
+type gaps []gap
+
+// skip records the ids between last, the largest id delivered, and id as skipped
+func (g *gaps) skip(last, id int64, now time.Time) {
+	if id <= last+1 {
+		return
+	}
+	*g = append(*g, gap{from: last + 1, to: id - 1, seen: now})
+	if len(*g) > maxGaps {
+		*g = (*g)[len(*g)-maxGaps:]
+	}
+}
+
+// found removes id from the gaps, it was delivered
+func (g *gaps) found(id int64) {
+	for i, r := range *g {
+		if id < r.from || id > r.to {
+			continue
+		}
+		var split []gap
+		if id > r.from {
+			split = append(split, gap{from: r.from, to: id - 1, seen: r.seen})
+		}
+		if id < r.to {
+			split = append(split, gap{from: id + 1, to: r.to, seen: r.seen})
+		}
+		*g = append((*g)[:i], append(split, (*g)[i+1:]...)...)
+		return
+	}
+}
+
+// expire drops the gaps seen before
+func (g *gaps) expire(before time.Time) {
+	i := 0
+	for i < len(*g) && (*g)[i].seen.Before(before) {
+		i++
+	}
+	*g = (*g)[i:]
+}
+
+// floor returns the smallest id that may still be delivered after last, the
+// largest id delivered
+func (g gaps) floor(last int64) int64 {
+	floor := last + 1
+	for _, r := range g {
+		if r.from < floor {
+			floor = r.from
+		}
+	}
+	return floor
+}
+
+// ranges returns the id ranges of the gaps
+func (g gaps) ranges() []repository.IDRange {
+	ranges := make([]repository.IDRange, len(g))
+	for i, r := range g {
+		ranges[i] = repository.IDRange{From: r.from, To: r.to}
+	}
+	return ranges
+}
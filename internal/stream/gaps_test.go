@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+func TestGaps(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var g gaps
+	g.skip(10, 11, now)
+	if len(g) != 0 {
+		t.Fatalf("consecutive ids left gaps %v", g)
+	}
+
+	g.skip(11, 15, now)
+	g.skip(15, 18, now.Add(time.Minute))
+	if got, want := g.ranges(), []repository.IDRange{{From: 12, To: 14}, {From: 16, To: 17}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges() = %v, want %v", got, want)
+	}
+	if got := g.floor(18); got != 12 {
+		t.Errorf("floor(18) = %d, want 12", got)
+	}
+
+	g.found(13)
+	g.found(16)
+	g.found(99)
+	if got, want := g.ranges(), []repository.IDRange{{From: 12, To: 12}, {From: 14, To: 14}, {From: 17, To: 17}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges() after found = %v, want %v", got, want)
+	}
+
+	g.expire(now.Add(time.Second))
+	if got, want := g.ranges(), []repository.IDRange{{From: 17, To: 17}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges() after expire = %v, want %v", got, want)
+	}
+
+	g.found(17)
+	if len(g) != 0 || g.floor(18) != 19 {
+		t.Errorf("gaps = %v, floor(18) = %d, want none and 19", g, g.floor(18))
+	}
+}
+
+func TestGapsBounded(t *testing.T) {
+	var g gaps
+	now := time.Now()
+	// Skips 1, 3, 5... one more time than kept
+	for id := int64(2); id <= 2*(maxGaps+1); id += 2 {
+		g.skip(id-2, id, now)
+	}
+	if len(g) != maxGaps {
+		t.Fatalf("len = %d, want %d", len(g), maxGaps)
+	}
+	if got, want := g[0].from, int64(3); got != want {
+		t.Errorf("oldest gap from = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,378 @@
+// Package stream fans the readings written to sensor_data out to the live
+// subscribers of an API replica. Writers notify the readings channel of Postgres,
+// so every replica sees every reading whoever wrote it
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+)
+
+// ErrSlowSubscriber ends a subscription that fell too far behind, its client
+// resumes from the last reading it got
+var ErrSlowSubscriber = errors.New("subscriber too slow")
+
+const (
+	// pageSize is the number of readings fetched at once
+	pageSize = 1000
+	// bufferSize is the number of live readings a subscriber may lag behind
+	bufferSize = 1024
+	// pollInterval bounds the delay of a reading whose notification was lost,
+	// while the listener reconnects for instance
+	pollInterval = 30 * time.Second
+)
+
+// Filter selects the readings of a tenant, of one of its groups, sensors or
+// regions when set
+type Filter struct {
+	TenantID int
+	// AllTenants selects the readings of every tenant instead, for the workers
+	// learning from all of them
+	AllTenants bool
+	Group      string
+	CodeName   string
+	Region     *repository.Region
+}
+
+// Match reports whether reading is selected by f
+func (f Filter) Match(reading repository.Reading) bool {
+	return (f.AllTenants || reading.TenantID == f.TenantID) &&
+		(f.Group == "" || reading.Group == f.Group) &&
+		(f.CodeName == "" || reading.CodeName == f.CodeName) &&
+		(f.Region == nil || f.Region.Contains(reading.X, reading.Y, reading.Z))
+}
+
+func (f Filter) readings(afterID int64) repository.ReadingFilter {
+	tenantID := f.TenantID
+	if f.AllTenants {
+		tenantID = 0
+	}
+	return repository.ReadingFilter{
+		TenantID: tenantID,
+		Group:    f.Group,
+		CodeName: f.CodeName,
+		Region:   f.Region,
+		AfterID:  afterID,
+		Limit:    pageSize,
+	}
+}
+
+// Hub fetches the readings Postgres notifies and hands them to the subscriptions
+// they match. Readings are delivered in id order, but for those committed after
+// a larger id was delivered: the skipped ids are looked for on every catch up,
+// for lateCommitWindow
+type Hub struct {
+	db  *sql.DB
+	url string
+
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+	lastID        int64
+	gaps          gaps
+	started       bool
+}
+
+// NewHub creates a hub reading db and listening on a connection to url, Run
+// must be called for subscriptions to get readings
+func NewHub(db *sql.DB, url string) *Hub {
+	return &Hub{db: db, url: url, subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Run delivers the readings written from now on until ctx is done, it then ends
+// every subscription. When it fails the subscriptions are kept, a new Run
+// delivers them the readings written meanwhile
+func (h *Hub) Run(ctx context.Context) error {
+	defer func() {
+		if ctx.Err() != nil {
+			h.closeAll()
+		}
+	}()
+
+	// The listener reconnects on its own, a nil notification follows every reconnection
+	listener := pq.NewListener(h.url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("readings listener", "event", event, "err", err)
+		}
+	})
+	defer listener.Close()
+
+	// Listen blocks until the database is reachable
+	listening := make(chan error, 1)
+	go func() {
+		listening <- listener.Listen(repository.ReadingsChannel)
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-listening:
+			if err != nil {
+				return err
+			}
+			h.catchUp(ctx)
+		case <-listener.Notify:
+			h.catchUp(ctx)
+		case <-ticker.C:
+			h.catchUp(ctx)
+		}
+	}
+}
+
+// catchUp delivers the readings written since the last one delivered, then those
+// committed late. The first call only records where the stream starts
+func (h *Hub) catchUp(ctx context.Context) {
+	if !h.started {
+		lastID, err := repository.LastReadingID(ctx, h.db)
+		if err != nil {
+			slog.Warn("stream start", "err", err)
+			return
+		}
+		h.setLastID(lastID)
+		h.started = true
+		return
+	}
+
+	for {
+		readings, err := repository.ReadingsAfter(ctx, h.db, repository.ReadingFilter{AfterID: h.last(), Limit: pageSize})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("stream readings", "err", err)
+			}
+			return
+		}
+		for _, reading := range readings {
+			h.dispatch(reading)
+		}
+		if len(readings) < pageSize {
+			break
+		}
+	}
+
+	h.catchUpLate(ctx)
+}
+
+// catchUpLate delivers the readings committed with an id that was skipped
+func (h *Hub) catchUpLate(ctx context.Context) {
+	h.mu.Lock()
+	h.gaps.expire(time.Now().Add(-lateCommitWindow))
+	ranges := h.gaps.ranges()
+	h.mu.Unlock()
+	if len(ranges) == 0 {
+		return
+	}
+
+	afterID := ranges[0].From - 1
+	for {
+		readings, err := repository.ReadingsAfter(ctx, h.db, repository.ReadingFilter{AfterID: afterID, IDs: ranges, Limit: pageSize})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("stream late readings", "err", err)
+			}
+			return
+		}
+		for _, reading := range readings {
+			h.dispatch(reading)
+			afterID = reading.ID
+		}
+		if len(readings) < pageSize {
+			return
+		}
+	}
+}
+
+func (h *Hub) dispatch(reading repository.Reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if reading.ID > h.lastID {
+		h.gaps.skip(h.lastID, reading.ID, time.Now())
+		h.lastID = reading.ID
+	} else {
+		h.gaps.found(reading.ID)
+	}
+	for subscription := range h.subscriptions {
+		if !subscription.filter.Match(reading) {
+			continue
+		}
+		select {
+		case subscription.live <- reading:
+		default:
+			metrics.ObserveSlowDisconnect()
+			h.remove(subscription, ErrSlowSubscriber)
+		}
+	}
+}
+
+// last returns the id of the last reading delivered
+func (h *Hub) last() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+func (h *Hub) setLastID(id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID = id
+}
+
+// Subscribe returns the readings matching filter as they are written until ctx
+// is done. A positive afterID first replays the readings written after it, so a
+// client resumes where it left off
+func (h *Hub) Subscribe(ctx context.Context, filter Filter, afterID int64) *Subscription {
+	subscription := &Subscription{
+		filter:   filter,
+		live:     make(chan repository.Reading, bufferSize),
+		readings: make(chan repository.Reading),
+	}
+
+	h.mu.Lock()
+	h.subscriptions[subscription] = struct{}{}
+	liveFrom := h.gaps.floor(h.lastID)
+	h.mu.Unlock()
+	metrics.ObserveSubscribers(1)
+
+	go func() {
+		defer close(subscription.readings)
+		defer h.unsubscribe(subscription)
+		subscription.pump(ctx, h.db, afterID, liveFrom)
+	}()
+
+	return subscription
+}
+
+func (h *Hub) unsubscribe(subscription *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(subscription, nil)
+}
+
+// remove ends subscription with err, h.mu must be held
+func (h *Hub) remove(subscription *Subscription, err error) {
+	if _, ok := h.subscriptions[subscription]; !ok {
+		return
+	}
+	delete(h.subscriptions, subscription)
+	subscription.fail(err)
+	close(subscription.live)
+	metrics.ObserveSubscribers(-1)
+}
+
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscription := range h.subscriptions {
+		h.remove(subscription, nil)
+	}
+}
+
+// Subscription is a stream of readings, it ends when the context it was created
+// with is done, when the hub stops or when the subscriber falls behind
+type Subscription struct {
+	filter Filter
+	// live is fed by the hub and closed when it removes the subscription
+	live     chan repository.Reading
+	readings chan repository.Reading
+
+	mu  sync.Mutex
+	err error
+}
+
+// Readings returns the readings in id order, but for those committed late, see
+// Hub. It is closed when the subscription ends
+func (s *Subscription) Readings() <-chan repository.Reading {
+	return s.readings
+}
+
+// Err tells why the subscription ended once Readings is closed, nil when its
+// context is done or the hub stopped
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail records the first error ending s
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// pump replays the readings written after afterID then forwards the live ones,
+// skipping those already replayed. liveFrom is the smallest id the hub could
+// still deliver when s was registered
+func (s *Subscription) pump(ctx context.Context, db *sql.DB, afterID, liveFrom int64) {
+	send := func(reading repository.Reading) bool {
+		select {
+		case s.readings <- reading:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// The subscription is registered before the replay, so a reading is either
+	// replayed, or live, or both. Only the readings from liveFrom can be both
+	replayed := make(map[int64]bool)
+	for after := afterID; afterID > 0; {
+		readings, err := repository.ReadingsAfter(ctx, db, s.filter.readings(after))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("stream replay", "err", err)
+				s.fail(err)
+			}
+			return
+		}
+		for _, reading := range readings {
+			if reading.ID >= liveFrom {
+				replayed[reading.ID] = true
+			}
+			if !send(reading) {
+				return
+			}
+			after = reading.ID
+		}
+		if len(readings) < pageSize {
+			break
+		}
+	}
+
+	for {
+		select {
+		case reading, ok := <-s.live:
+			if !ok {
+				return
+			}
+			if replayed[reading.ID] {
+				delete(replayed, reading.ID)
+				continue
+			}
+			if !send(reading) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Buckets summarizes column over the readings matching filter written since
+// since, by width long buckets, lastID being the largest reading id summarized
+func (h *Hub) Buckets(ctx context.Context, filter Filter, column string, since time.Time, width time.Duration) ([]repository.ReadingBucket, int64, error) {
+	return repository.ReadingBuckets(ctx, h.db, filter.readings(0), column, since, width)
+}
@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"math"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// Aggregates a Window computes
+const (
+	Avg = "avg"
+	Min = "min"
+	Max = "max"
+)
+
+// windowBuckets is the number of buckets a window is split in, values leave the
+// window a bucket at a time so its span is accurate to 1/windowBuckets
+const windowBuckets = 60
+
+// Window is a rolling summary of the values of the last span, kept by bucket so
+// that it costs the same whatever the number of readings
+type Window struct {
+	span    time.Duration
+	width   time.Duration
+	buckets map[int64]*repository.ReadingBucket
+}
+
+// NewWindow creates an empty window over the last span
+func NewWindow(span time.Duration) *Window {
+	width := span / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &Window{span: span, width: width, buckets: make(map[int64]*repository.ReadingBucket)}
+}
+
+// Width is the span of a bucket
+func (w *Window) Width() time.Duration {
+	return w.width
+}
+
+// Merge adds bucket, whose index counts Width since the Unix epoch, to w
+func (w *Window) Merge(bucket repository.ReadingBucket) {
+	existing, ok := w.buckets[bucket.Index]
+	if !ok {
+		b := bucket
+		w.buckets[bucket.Index] = &b
+		return
+	}
+	existing.Count += bucket.Count
+	existing.Sum += bucket.Sum
+	existing.Min = math.Min(existing.Min, bucket.Min)
+	existing.Max = math.Max(existing.Max, bucket.Max)
+}
+
+// Add adds value read at t to w, a value that is not a finite number is left out
+// so a corrupt reading does not spoil the aggregates of the whole span
+func (w *Window) Add(t time.Time, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	w.Merge(repository.ReadingBucket{Index: w.index(t), Count: 1, Sum: value, Min: value, Max: value})
+}
+
+// AddReading adds the value of column, temperature or transparency, of reading to w
+func (w *Window) AddReading(reading repository.Reading, column string) {
+	value := reading.Temperature
+	if column == "transparency" {
+		value = float64(reading.Transparency)
+	}
+	w.Add(reading.CreatedAt, value)
+}
+
+func (w *Window) index(t time.Time) int64 {
+	return t.UnixNano() / int64(w.width)
+}
+
+// Evaluate drops the buckets that left the window at now and returns aggregate
+// of the values left along with their number, nil when there is none
+func (w *Window) Evaluate(now time.Time, aggregate string) (*float64, int) {
+	oldest := w.index(now.Add(-w.span))
+
+	var (
+		count int
+		sum   float64
+		min   = math.Inf(1)
+		max   = math.Inf(-1)
+	)
+	for index, bucket := range w.buckets {
+		if index < oldest {
+			delete(w.buckets, index)
+			continue
+		}
+		count += bucket.Count
+		sum += bucket.Sum
+		min = math.Min(min, bucket.Min)
+		max = math.Max(max, bucket.Max)
+	}
+	if count == 0 {
+		return nil, 0
+	}
+
+	var value float64
+	switch aggregate {
+	case Min:
+		value = min
+	case Max:
+		value = max
+	default:
+		value = sum / float64(count)
+	}
+	return &value, count
+}
@@ -0,0 +1,198 @@
+// Package supervisor runs long lived workers and restarts them when they fail
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/retry"
+)
+
+// Worker runs until ctx is done, returning nil, or until it fails
+type Worker func(ctx context.Context) error
+
+// State is the lifecycle state of a worker
+type State string
+
+const (
+	StateRunning State = "running"
+	// StateRestarting means the worker failed and waits for its backoff to elapse
+	StateRestarting State = "restarting"
+	// StateStopped means the worker returned, because it was done or ctx was
+	StateStopped State = "stopped"
+)
+
+// failingRestarts is the number of backoff maxima a worker may keep failing for
+// before it is reported as failed rather than restarting
+const failingRestarts = 10
+
+// Status describes a worker
+type Status struct {
+	Name        string     `json:"name"`
+	State       State      `json:"state"`
+	Restarts    int        `json:"restarts"`
+	StartedAt   time.Time  `json:"startedAt"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	// FailingSince is the first of the failures the worker was not running long
+	// enough in between to reset its backoff
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+}
+
+// Supervisor restarts failed workers with an exponential backoff, the backoff
+// starts over once a worker ran longer than the maximum delay
+type Supervisor struct {
+	backoff retry.Backoff
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	statuses map[string]*Status
+}
+
+func New(backoff retry.Backoff) *Supervisor {
+	return &Supervisor{
+		backoff:  backoff,
+		statuses: make(map[string]*Status),
+	}
+}
+
+// DefaultBackoff returns the restart backoff used by the commands
+func DefaultBackoff() retry.Backoff {
+	return retry.Backoff{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+	}
+}
+
+// Go runs worker under name until ctx is done
+func (s *Supervisor) Go(ctx context.Context, name string, worker Worker) {
+	s.mu.Lock()
+	s.statuses[name] = &Status{Name: name, State: StateRunning}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		failures := 0
+		var failingSince time.Time
+		for {
+			started := time.Now()
+			s.update(name, func(status *Status) {
+				status.State = StateRunning
+				status.StartedAt = started
+			})
+
+			err := s.run(ctx, worker)
+			if ctx.Err() != nil || err == nil {
+				s.update(name, func(status *Status) { status.State = StateStopped })
+				return
+			}
+
+			now := time.Now()
+			if now.Sub(started) > s.backoff.Max {
+				failures = 0
+			}
+			if failures == 0 {
+				failingSince = now
+			}
+			failures++
+			delay := s.backoff.Delay(failures)
+
+			slog.Error("worker failed", "worker", name, "restart_in", delay, "err", err)
+			since := failingSince
+			s.update(name, func(status *Status) {
+				status.State = StateRestarting
+				status.Restarts++
+				status.LastError = err.Error()
+				status.LastErrorAt = &now
+				status.FailingSince = &since
+			})
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				s.update(name, func(status *Status) { status.State = StateStopped })
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// run calls worker, turning a panic into an error so it gets restarted as well
+func (s *Supervisor) run(ctx context.Context, worker Worker) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return worker(ctx)
+}
+
+// Wait blocks until every worker stopped
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Statuses returns the status of every worker sorted by name
+func (s *Supervisor) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// Healthy reports whether no worker failed for good, that is kept failing for
+// ten times the maximum backoff. A worker restarting after a short outage of a
+// dependency is healthy, and so is a worker that stopped
+func (s *Supervisor) Healthy() bool {
+	limit := failingRestarts * s.backoff.Max
+	for _, status := range s.Statuses() {
+		if s.failing(status) && time.Since(*status.FailingSince) > limit {
+			return false
+		}
+	}
+	return true
+}
+
+// failing reports whether status is part of a streak of failures, a worker that
+// runs again for longer than the maximum backoff ended it
+func (s *Supervisor) failing(status Status) bool {
+	switch {
+	case status.FailingSince == nil, status.State == StateStopped:
+		return false
+	case status.State == StateRunning:
+		return time.Since(status.StartedAt) <= s.backoff.Max
+	default:
+		return true
+	}
+}
+
+// Restarting reports whether a worker failed and waits to be restarted
+func (s *Supervisor) Restarting() bool {
+	for _, status := range s.Statuses() {
+		if status.State == StateRestarting {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Supervisor) update(name string, fn func(status *Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.statuses[name])
+}
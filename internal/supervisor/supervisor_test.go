@@ -0,0 +1,139 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/retry"
+)
+
+// waitFor polls the statuses of s until done accepts them
+func waitFor(t *testing.T, s *Supervisor, done func(statuses []Status) bool) []Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := s.Statuses()
+		if done(statuses) {
+			return statuses
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("statuses are still %+v", statuses)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRestartsAfterFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(retry.Backoff{Initial: time.Millisecond, Max: time.Second})
+	runs := 0
+	s.Go(ctx, "worker", func(ctx context.Context) error {
+		runs++
+		if runs == 1 {
+			return errors.New("connection refused")
+		}
+		<-ctx.Done()
+		return nil
+	})
+
+	statuses := waitFor(t, s, func(statuses []Status) bool {
+		return statuses[0].State == StateRunning && statuses[0].Restarts == 1
+	})
+	if statuses[0].LastError != "connection refused" || statuses[0].FailingSince == nil {
+		t.Errorf("status = %+v, want the failure recorded", statuses[0])
+	}
+	if !s.Healthy() {
+		t.Error("Healthy() = false after one failure")
+	}
+	if s.Restarting() {
+		t.Error("Restarting() = true once the worker runs again")
+	}
+
+	cancel()
+	s.Wait()
+	if statuses := s.Statuses(); statuses[0].State != StateStopped {
+		t.Errorf("state = %s after cancel, want %s", statuses[0].State, StateStopped)
+	}
+}
+
+func TestRestartsAfterPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(retry.Backoff{Initial: time.Millisecond, Max: time.Second})
+	runs := 0
+	s.Go(ctx, "worker", func(ctx context.Context) error {
+		runs++
+		if runs == 1 {
+			panic("nil map")
+		}
+		<-ctx.Done()
+		return nil
+	})
+
+	statuses := waitFor(t, s, func(statuses []Status) bool {
+		return statuses[0].State == StateRunning && statuses[0].Restarts == 1
+	})
+	if statuses[0].LastError != "panic: nil map" {
+		t.Errorf("LastError = %q, want the panic", statuses[0].LastError)
+	}
+}
+
+func TestCleanStopIsHealthy(t *testing.T) {
+	s := New(retry.Backoff{Initial: time.Millisecond, Max: time.Second})
+	s.Go(context.Background(), "seed", func(ctx context.Context) error { return nil })
+	s.Wait()
+
+	if statuses := s.Statuses(); statuses[0].State != StateStopped {
+		t.Errorf("state = %s, want %s", statuses[0].State, StateStopped)
+	}
+	if !s.Healthy() || s.Restarting() {
+		t.Errorf("Healthy() = %v, Restarting() = %v, want healthy and not restarting", s.Healthy(), s.Restarting())
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	backoff := retry.Backoff{Initial: time.Second, Max: time.Minute}
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+
+	tests := []struct {
+		name       string
+		status     Status
+		healthy    bool
+		restarting bool
+	}{
+		{name: "running", status: Status{State: StateRunning, StartedAt: now}, healthy: true},
+		{name: "stopped", status: Status{State: StateStopped, FailingSince: ago(time.Hour)}, healthy: true},
+		{name: "restarting briefly", status: Status{State: StateRestarting, FailingSince: ago(time.Minute)},
+			healthy: true, restarting: true},
+		{name: "failing for good", status: Status{State: StateRestarting, FailingSince: ago(11 * time.Minute)},
+			restarting: true},
+		{name: "running between failures", status: Status{State: StateRunning, StartedAt: *ago(time.Second),
+			FailingSince: ago(11 * time.Minute)}},
+		{name: "recovered", status: Status{State: StateRunning, StartedAt: *ago(2 * time.Minute),
+			FailingSince: ago(time.Hour)}, healthy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(backoff)
+			status := tt.status
+			s.statuses["worker"] = &status
+
+			if got := s.Healthy(); got != tt.healthy {
+				t.Errorf("Healthy() = %v, want %v", got, tt.healthy)
+			}
+			if got := s.Restarting(); got != tt.restarting {
+				t.Errorf("Restarting() = %v, want %v", got, tt.restarting)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Package tenant carries the tenant a request acts on
+package tenant
+
+import "context"
+
+type nameKey struct{}
+
+// WithName returns a copy of ctx acting on the tenant called name
+func WithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameKey{}, name)
+}
+
+// Name returns the tenant ctx acts on, empty when it was not chosen explicitly
+func Name(ctx context.Context) string {
+	name, _ := ctx.Value(nameKey{}).(string)
+	return name
+}
@@ -0,0 +1,201 @@
+// Package watchdog judges the health of every sensor from when it reported
+// against its data rate, and raises alerts for the sensors that went stale or
+// sample at an implausible rate
+package watchdog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+)
+
+// Health statuses of a sensor
+const (
+	// StatusOK is a sensor reporting at its data rate
+	StatusOK = "ok"
+	// StatusStale is a sensor that did not report for StaleAfter data rates
+	StatusStale = "stale"
+	// StatusIrregular is a sensor whose latest readings are more than
+	// IrregularFactor times closer or further apart than its data rate
+	StatusIrregular = "irregular"
+	// StatusSilent is a sensor that never reported
+	StatusSilent = "silent"
+)
+
+// Statuses lists every health status
+var Statuses = []string{StatusOK, StatusStale, StatusIrregular, StatusSilent}
+
+// Tolerances of the health statuses, in data rates
+const (
+	StaleAfter      = 3
+	IrregularFactor = 2
+	// GapAfter is the time between two readings that counts as a gap, a missed
+	// reading leaves twice the data rate
+	GapAfter = 1.5
+)
+
+// Names of the alerts raised for the sensors that are not healthy
+const (
+	AlertStale     = "sensor-stale"
+	AlertIrregular = "sensor-irregular"
+)
+
+const severity = "warning"
+
+// Status returns the health status at now of the sensor of activity
+func Status(activity repository.SensorActivity, now time.Time) string {
+	if activity.LastSeen == nil {
+		return StatusSilent
+	}
+	rate := Rate(activity)
+	if now.Sub(*activity.LastSeen).Seconds() > StaleAfter*rate {
+		return StatusStale
+	}
+	if interval := activity.Interval; interval != nil && (*interval*IrregularFactor < rate || *interval > rate*IrregularFactor) {
+		return StatusIrregular
+	}
+	return StatusOK
+}
+
+// Rate returns the number of seconds between two readings of the sensor of
+// activity, at least one
+func Rate(activity repository.SensorActivity) float64 {
+	return math.Max(float64(activity.DataRate), 1)
+}
+
+// Watchdog checks the health of every sensor and keeps an alert open for each
+// of those that are stale or irregular. A single watchdog must run against a
+// database, the alerts of several would interleave
+type Watchdog struct {
+	db       *sql.DB
+	interval time.Duration
+}
+
+// New creates a watchdog checking the sensors of db once per interval
+func New(db *sql.DB, interval time.Duration) *Watchdog {
+	return &Watchdog{db: db, interval: interval}
+}
+
+// Run checks the sensors until ctx is done, a failed check is retried after an
+// interval
+func (w *Watchdog) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.check(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			slog.Warn("sensor watchdog", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check raises an alert for the sensors turning stale or irregular and resolves
+// those of the sensors that recovered, changed status or were deleted
+func (w *Watchdog) check(ctx context.Context, now time.Time) error {
+	activities, err := repository.ListSensorActivity(ctx, w.db, repository.ActivityFilter{})
+	if err != nil {
+		return err
+	}
+	open, err := repository.OpenSensorAlerts(ctx, w.db)
+	if err != nil {
+		return err
+	}
+
+	// Keyed by sensor id, a sensor re-created under the same code name does not
+	// take over the alerts of the deleted one
+	alerts := make(map[int]repository.Alert, len(open))
+	var orphans []repository.Alert
+	for _, alert := range open {
+		if alert.SensorID == nil {
+			orphans = append(orphans, alert)
+			continue
+		}
+		alerts[*alert.SensorID] = alert
+	}
+
+	counts := make(map[string]int, len(Statuses))
+	for _, status := range Statuses {
+		counts[status] = 0
+	}
+	for _, activity := range activities {
+		status := Status(activity, now)
+		counts[status]++
+
+		alert, ok := alerts[activity.SensorID]
+		delete(alerts, activity.SensorID)
+
+		var (
+			name  string
+			value float64
+		)
+		switch status {
+		case StatusStale:
+			name, value = AlertStale, now.Sub(*activity.LastSeen).Seconds()
+		case StatusIrregular:
+			name, value = AlertIrregular, *activity.Interval
+		}
+		if ok && alert.RuleName == name {
+			continue
+		}
+
+		if ok {
+			if err := w.resolve(ctx, alert); err != nil {
+				return err
+			}
+		}
+		if name != "" {
+			raised, err := repository.RaiseSensorAlert(ctx, w.db, activity, name, severity, math.Round(value))
+			if err != nil {
+				return err
+			}
+			observe(raised)
+		}
+	}
+
+	// The sensors deleted since their alert was raised
+	for _, alert := range alerts {
+		orphans = append(orphans, alert)
+	}
+	for _, alert := range orphans {
+		if err := w.resolve(ctx, alert); err != nil {
+			return err
+		}
+	}
+
+	metrics.ObserveSensorStatuses(counts)
+	return nil
+}
+
+// resolve resolves alert unless it was meanwhile
+func (w *Watchdog) resolve(ctx context.Context, alert repository.Alert) error {
+	resolved, err := repository.ResolveAlert(ctx, w.db, alert.ID)
+	if errors.Is(err, repository.ErrAlertNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	observe(resolved)
+	return nil
+}
+
+func observe(alert repository.Alert) {
+	metrics.ObserveAlert(alert.Severity, alert.State)
+	attrs := []any{"rule", alert.RuleName, "tenant", alert.TenantID, "sensor", alert.CodeName, "severity", alert.Severity, "state", alert.State}
+	if alert.Value != nil {
+		attrs = append(attrs, "value", *alert.Value)
+	}
+	slog.Info("alert", attrs...)
+}
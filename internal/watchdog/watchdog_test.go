@@ -0,0 +1,62 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+func TestStatus(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	ago := func(seconds float64) *time.Time {
+		at := now.Add(-time.Duration(seconds * float64(time.Second)))
+		return &at
+	}
+	interval := func(seconds float64) *float64 { return &seconds }
+
+	tests := []struct {
+		name     string
+		activity repository.SensorActivity
+		want     string
+	}{
+		{name: "never reported", activity: repository.SensorActivity{DataRate: 10}, want: StatusSilent},
+		{name: "reporting", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(5), Interval: interval(10)}, want: StatusOK},
+		{name: "single reading", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(5)}, want: StatusOK},
+		{name: "late within tolerance", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(30), Interval: interval(10)}, want: StatusOK},
+		{name: "stale", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(31), Interval: interval(10)}, want: StatusStale},
+		{name: "stale before irregular", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(31), Interval: interval(1)}, want: StatusStale},
+		{name: "fast within tolerance", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(1), Interval: interval(5)}, want: StatusOK},
+		{name: "too fast", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(1), Interval: interval(4.9)}, want: StatusIrregular},
+		{name: "slow within tolerance", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(1), Interval: interval(20)}, want: StatusOK},
+		{name: "too slow", activity: repository.SensorActivity{DataRate: 10, LastSeen: ago(1), Interval: interval(20.1)}, want: StatusIrregular},
+		{name: "no data rate reporting", activity: repository.SensorActivity{LastSeen: ago(2), Interval: interval(1)}, want: StatusOK},
+		{name: "no data rate stale", activity: repository.SensorActivity{LastSeen: ago(4), Interval: interval(1)}, want: StatusStale},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Status(tt.activity, now); got != tt.want {
+				t.Fatalf("Status() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		dataRate int
+		want     float64
+	}{
+		{dataRate: 10, want: 10},
+		{dataRate: 1, want: 1},
+		{dataRate: 0, want: 1},
+		{dataRate: -5, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := Rate(repository.SensorActivity{DataRate: tt.dataRate}); got != tt.want {
+			t.Errorf("Rate(%d) = %v, want %v", tt.dataRate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package webhook delivers the events enqueued by the repository to the webhooks
+// of their tenant, signed with the secret of each webhook
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sensors/internal/metrics"
+	"github.com/sensors/internal/repository"
+	"github.com/sensors/internal/retry"
+)
+
+// batchSize is the number of deliveries claimed and attempted at once
+const batchSize = 32
+
+// DefaultBackoff returns the waits between the attempts of a delivery, about 4
+// hours pass before it is given up
+func DefaultBackoff() retry.Backoff {
+	return retry.Backoff{
+		Initial:     30 * time.Second,
+		Max:         2 * time.Hour,
+		Multiplier:  2,
+		MaxAttempts: 10,
+	}
+}
+
+// Dispatcher attempts the due deliveries and records their outcome. Several
+// dispatchers may run against a database, a delivery is claimed by one of them
+type Dispatcher struct {
+	db       *sql.DB
+	outcomes outcomes
+	client   *http.Client
+	interval time.Duration
+	timeout  time.Duration
+	backoff  retry.Backoff
+}
+
+// New creates a dispatcher looking for due deliveries once per interval, waiting
+// up to timeout for a receiver and retrying the failed deliveries with backoff
+func New(db *sql.DB, interval, timeout time.Duration, backoff retry.Backoff) *Dispatcher {
+	return &Dispatcher{
+		db:       db,
+		outcomes: stored{db},
+		// Receivers redirecting would get the signature without being the webhook
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		interval: interval,
+		timeout:  timeout,
+		backoff:  backoff,
+	}
+}
+
+// Run delivers the due deliveries until ctx is done. A full batch is followed by
+// the next one right away, the deliveries are otherwise looked for once per interval
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		claimed, err := d.dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("webhook deliveries", "err", err)
+		}
+		if claimed == batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch claims a batch of due deliveries and attempts them concurrently, it
+// returns the number claimed
+func (d *Dispatcher) dispatch(ctx context.Context) (int, error) {
+	// The lease outlasts the attempts so another dispatcher does not repeat them
+	deliveries, err := repository.ClaimDeliveries(ctx, d.db, batchSize, 2*d.timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery repository.Delivery) {
+			defer wg.Done()
+			if err := d.attempt(ctx, delivery); err != nil && ctx.Err() == nil {
+				slog.Warn("webhook delivery", "delivery", delivery.ID, "webhook", delivery.WebhookID, "err", err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// attempt sends delivery and records the outcome: delivered on a 2xx response,
+// retried later on any other, dead once its attempts are exhausted
+func (d *Dispatcher) attempt(ctx context.Context, delivery repository.Delivery) error {
+	status, err := d.send(ctx, delivery)
+	if ctx.Err() != nil {
+		// Stopping is not the fault of the receiver, the lease makes it due again
+		return nil
+	}
+	if err == nil {
+		metrics.ObserveDelivery(metrics.DeliveryDelivered)
+		return d.outcomes.succeeded(ctx, delivery.ID, *status)
+	}
+
+	attempts := delivery.Attempts + 1
+	if d.backoff.MaxAttempts > 0 && attempts >= d.backoff.MaxAttempts {
+		metrics.ObserveDelivery(metrics.DeliveryDead)
+		slog.Warn("webhook delivery dead", "delivery", delivery.ID, "webhook", delivery.WebhookID, "event", delivery.EventType,
+			"attempts", attempts, "err", err)
+		return d.outcomes.died(ctx, delivery.ID, status, err.Error())
+	}
+	metrics.ObserveDelivery(metrics.DeliveryFailed)
+	return d.outcomes.failed(ctx, delivery.ID, status, err.Error(), d.backoff.Delay(attempts))
+}
+
+// outcomes records how the attempts of deliveries went
+type outcomes interface {
+	succeeded(ctx context.Context, id int64, status int) error
+	failed(ctx context.Context, id int64, status *int, reason string, wait time.Duration) error
+	died(ctx context.Context, id int64, status *int, reason string) error
+}
+
+// stored records the outcomes in the database
+type stored struct {
+	db *sql.DB
+}
+
+func (s stored) succeeded(ctx context.Context, id int64, status int) error {
+	return repository.DeliverySucceeded(ctx, s.db, id, status)
+}
+
+func (s stored) failed(ctx context.Context, id int64, status *int, reason string, wait time.Duration) error {
+	return repository.DeliveryFailed(ctx, s.db, id, status, reason, wait)
+}
+
+func (s stored) died(ctx context.Context, id int64, status *int, reason string) error {
+	return repository.DeliveryDied(ctx, s.db, id, status, reason)
+}
+
+// send posts the payload of delivery to its webhook and returns the status of the
+// response, nil when none came, and an error unless it is a 2xx
+func (d *Dispatcher) send(ctx context.Context, delivery repository.Delivery) (*int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "sensors-webhook/1")
+	request.Header.Set(HeaderEvent, delivery.EventType)
+	request.Header.Set(HeaderDelivery, delivery.EventID)
+	request.Header.Set(HeaderSignature, Sign(delivery.Secret, time.Now(), delivery.Payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	// Draining a bounded part of the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	status := response.StatusCode
+	if status < 200 || status > 299 {
+		return &status, fmt.Errorf("receiver replied %s", response.Status)
+	}
+	return &status, nil
+}
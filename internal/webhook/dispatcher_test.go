@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sensors/internal/repository"
+)
+
+// outcome is an outcome recorded by recorder
+type outcome struct {
+	state  string
+	status *int
+	wait   time.Duration
+}
+
+// recorder records the outcomes of the attempts in memory
+type recorder struct {
+	outcomes map[int64]outcome
+}
+
+func (r *recorder) succeeded(_ context.Context, id int64, status int) error {
+	r.outcomes[id] = outcome{state: repository.DeliveryDelivered, status: &status}
+	return nil
+}
+
+func (r *recorder) failed(_ context.Context, id int64, status *int, _ string, wait time.Duration) error {
+	r.outcomes[id] = outcome{state: repository.DeliveryPending, status: status, wait: wait}
+	return nil
+}
+
+func (r *recorder) died(_ context.Context, id int64, status *int, _ string) error {
+	r.outcomes[id] = outcome{state: repository.DeliveryDead, status: status}
+	return nil
+}
+
+func TestDispatcherAttempt(t *testing.T) {
+	backoff := DefaultBackoff()
+
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		want     outcome
+	}{
+		{name: "delivered", status: http.StatusOK, want: outcome{state: repository.DeliveryDelivered}},
+		{name: "accepted", status: http.StatusAccepted, attempts: 3, want: outcome{state: repository.DeliveryDelivered}},
+		{name: "first failure", status: http.StatusInternalServerError,
+			want: outcome{state: repository.DeliveryPending, wait: backoff.Initial}},
+		{name: "backs off", status: http.StatusServiceUnavailable, attempts: 3,
+			want: outcome{state: repository.DeliveryPending, wait: backoff.Delay(4)}},
+		{name: "redirect is a failure", status: http.StatusFound,
+			want: outcome{state: repository.DeliveryPending, wait: backoff.Initial}},
+		{name: "last attempt", status: http.StatusInternalServerError, attempts: backoff.MaxAttempts - 1,
+			want: outcome{state: repository.DeliveryDead}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := `{"type":"sensor.reading"}`
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if !Verify("secret", r.Header.Get(HeaderSignature), body, time.Minute, time.Now()) {
+					t.Errorf("receiver got an invalid signature %q", r.Header.Get(HeaderSignature))
+				}
+				if got := r.Header.Get(HeaderEvent); got != "sensor.reading" {
+					t.Errorf("receiver got event %q, want sensor.reading", got)
+				}
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer receiver.Close()
+
+			dispatcher := New(nil, time.Second, time.Second, backoff)
+			recorded := &recorder{outcomes: map[int64]outcome{}}
+			dispatcher.outcomes = recorded
+
+			delivery := repository.Delivery{
+				ID:        1,
+				URL:       receiver.URL,
+				Secret:    "secret",
+				EventID:   "event",
+				EventType: "sensor.reading",
+				Payload:   []byte(payload),
+				Attempts:  tt.attempts,
+			}
+			if err := dispatcher.attempt(context.Background(), delivery); err != nil {
+				t.Fatalf("attempt: %v", err)
+			}
+
+			got, ok := recorded.outcomes[delivery.ID]
+			if !ok {
+				t.Fatal("attempt recorded no outcome")
+			}
+			if got.state != tt.want.state || got.wait != tt.want.wait {
+				t.Errorf("attempt recorded %s after %s, want %s after %s", got.state, got.wait, tt.want.state, tt.want.wait)
+			}
+			if got.status == nil || *got.status != tt.status {
+				t.Errorf("attempt recorded status %v, want %d", got.status, tt.status)
+			}
+		})
+	}
+}
+
+func TestDispatcherAttemptUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	dispatcher := New(nil, time.Second, time.Second, DefaultBackoff())
+	recorded := &recorder{outcomes: map[int64]outcome{}}
+	dispatcher.outcomes = recorded
+
+	delivery := repository.Delivery{ID: 1, URL: url, Secret: "secret", EventType: "sensor.reading", Payload: []byte(`{}`)}
+	if err := dispatcher.attempt(context.Background(), delivery); err != nil {
+		t.Fatalf("attempt: %v", err)
+	}
+	got := recorded.outcomes[delivery.ID]
+	if got.state != repository.DeliveryPending || got.status != nil {
+		t.Errorf("attempt recorded %s with status %v, want a retry without status", got.state, got.status)
+	}
+}
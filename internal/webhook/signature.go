@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of the webhook requests
+const (
+	HeaderSignature = "X-Sensors-Signature"
+	HeaderEvent     = "X-Sensors-Event"
+	HeaderDelivery  = "X-Sensors-Delivery"
+)
+
+// Sign returns the signature header of body sent at t with secret: the Unix time
+// and the hex HMAC-SHA256 of "<time>.<body>", as in t=1700000000,v1=5d41...
+// Signing the time lets receivers reject replayed requests
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, mac(secret, timestamp, body))
+}
+
+// Verify reports whether header is a signature of body with secret made less
+// than tolerance before now
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return false
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(mac(secret, timestamp, body)))
+}
+
+func mac(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
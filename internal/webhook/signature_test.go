@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	signed := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"alert.firing"}`)
+	header := Sign("secret", signed, body)
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		now    time.Time
+		want   bool
+	}{
+		{name: "round trip", secret: "secret", header: header, body: body, now: signed, want: true},
+		{name: "within tolerance", secret: "secret", header: header, body: body, now: signed.Add(4 * time.Minute), want: true},
+		{name: "tampered body", secret: "secret", header: header, body: []byte(`{"type":"alert.resolved"}`), now: signed},
+		{name: "other secret", secret: "other", header: header, body: body, now: signed},
+		{name: "expired", secret: "secret", header: header, body: body, now: signed.Add(6 * time.Minute)},
+		{name: "from the future", secret: "secret", header: header, body: body, now: signed.Add(-6 * time.Minute)},
+		{name: "tampered timestamp", secret: "secret", header: Sign("secret", signed, body)[len("t=1700000000"):] + ",t=1700000100",
+			body: body, now: signed.Add(100 * time.Second)},
+		{name: "no signature", secret: "secret", header: "t=1700000000", body: body, now: signed},
+		{name: "malformed", secret: "secret", header: "garbage", body: body, now: signed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.secret, tt.header, tt.body, 5*time.Minute, tt.now); got != tt.want {
+				t.Errorf("Verify(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}